@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// aggregateLengths implements flag.Value for -also-insert-aggregate: either
+// "/N" for both address families or "v4/N,v6/M" for each separately. A zero
+// length disables the family.
+type aggregateLengths struct {
+	v4, v6 int
+}
+
+func (a *aggregateLengths) String() string {
+	if a.v4 == 0 && a.v6 == 0 {
+		return ""
+	}
+	return fmt.Sprintf("v4/%d,v6/%d", a.v4, a.v6)
+}
+
+func (a *aggregateLengths) Set(value string) error {
+	if strings.HasPrefix(value, "/") {
+		n, err := parseAggregateLength(value, 32)
+		if err != nil {
+			return err
+		}
+		a.v4, a.v6 = n, n
+		return nil
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		family, length, ok := strings.Cut(strings.TrimSpace(part), "/")
+		if !ok {
+			return fmt.Errorf("expected /N or v4/N,v6/M, got %q", value)
+		}
+		var err error
+		switch family {
+		case "v4":
+			a.v4, err = parseAggregateLength("/"+length, 32)
+		case "v6":
+			a.v6, err = parseAggregateLength("/"+length, 128)
+		default:
+			return fmt.Errorf("unknown address family %q", family)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseAggregateLength(s string, maxLen int) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "/"))
+	if err != nil || n < 1 || n > maxLen {
+		return 0, fmt.Errorf("invalid prefix length %q", s)
+	}
+	return n, nil
+}
+
+// enabled reports whether any family has an aggregate length.
+func (a *aggregateLengths) enabled() bool {
+	return a.v4 > 0 || a.v6 > 0
+}
+
+// aggregateSummary collects the specifics seen under one covering
+// aggregate.
+type aggregateSummary struct {
+	network *net.IPNet
+	asns    map[mmdbtype.Uint32]bool
+	orgs    map[mmdbtype.String]bool
+}
+
+// aggregator synthesizes a record for the covering /N of every inserted
+// prefix. Aggregates are inserted after all rows and only fill address space
+// that has no data, so a more specific prefix always wins on lookup.
+type aggregator struct {
+	lengths    aggregateLengths
+	aggregates map[string]*aggregateSummary
+}
+
+func newAggregator(lengths aggregateLengths) *aggregator {
+	return &aggregator{lengths: lengths, aggregates: map[string]*aggregateSummary{}}
+}
+
+// add records an inserted prefix and its record under its aggregate.
+func (a *aggregator) add(network *net.IPNet, record mmdbtype.Map) {
+	ones, bits := network.Mask.Size()
+	length := a.lengths.v6
+	if bits == 32 {
+		length = a.lengths.v4
+	}
+	if length == 0 || ones <= length {
+		return
+	}
+
+	mask := net.CIDRMask(length, bits)
+	covering := &net.IPNet{IP: network.IP.Mask(mask), Mask: mask}
+	key := covering.String()
+
+	summary, ok := a.aggregates[key]
+	if !ok {
+		summary = &aggregateSummary{
+			network: covering,
+			asns:    map[mmdbtype.Uint32]bool{},
+			orgs:    map[mmdbtype.String]bool{},
+		}
+		a.aggregates[key] = summary
+	}
+	if asn, ok := record["autonomous_system_number"].(mmdbtype.Uint32); ok {
+		summary.asns[asn] = true
+	}
+	if org, ok := record["autonomous_system_organization"].(mmdbtype.String); ok {
+		summary.orgs[org] = true
+	}
+}
+
+// insert writes the aggregates into the tree and returns how many of them
+// filled at least some empty address space. The summary record is marked
+// with is_aggregate and carries the ASN and organization when all
+// specifics under it agree on them.
+func (a *aggregator) insert(writer *mmdbwriter.Tree) (int, error) {
+	keys := make([]string, 0, len(a.aggregates))
+	for key := range a.aggregates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	synthesized := 0
+	for _, key := range keys {
+		summary := a.aggregates[key]
+
+		record := mmdbtype.Map{"is_aggregate": mmdbtype.Bool(true)}
+		if len(summary.asns) == 1 {
+			for asn := range summary.asns {
+				record["autonomous_system_number"] = asn
+			}
+		}
+		if len(summary.orgs) == 1 {
+			for org := range summary.orgs {
+				record["autonomous_system_organization"] = org
+			}
+		}
+
+		filled := false
+		err := writer.InsertFunc(summary.network, func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+			if existing != nil {
+				return existing, nil
+			}
+			filled = true
+			return record, nil
+		})
+		if err != nil {
+			// Aggregates overlapping reserved space are skipped like
+			// any other problematic network.
+			logger.Warn("skipping aggregate", "network", summary.network, "error", err)
+			continue
+		}
+		if filled {
+			synthesized++
+		}
+	}
+	return synthesized, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+func TestAggregateLengthsSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    aggregateLengths
+		wantErr bool
+	}{
+		{value: "/16", want: aggregateLengths{16, 16}},
+		{value: "v4/16,v6/32", want: aggregateLengths{16, 32}},
+		{value: "v6/48", want: aggregateLengths{0, 48}},
+		{value: "/33", wantErr: true},
+		{value: "/0", wantErr: true},
+		{value: "v4/33", wantErr: true},
+		{value: "v6/129", wantErr: true},
+		{value: "16", wantErr: true},
+		{value: "v5/16", wantErr: true},
+	}
+	for _, tt := range tests {
+		var got aggregateLengths
+		err := got.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q): got error %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("Set(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestAlsoInsertAggregate(t *testing.T) {
+	input := "network,asn,org\n" +
+		"8.8.8.0/24,15169,Google\n" +
+		"8.8.4.0/24,15169,Google\n" +
+		"9.9.9.0/24,19281,Quad9\n" +
+		"9.9.10.0/24,64500,Other\n" +
+		"2001:4860:4860::/48,15169,Google\n"
+	db, stats := buildTestDB(t, testConfig(t, "-also-insert-aggregate", "v4/16,v6/32"), input)
+	if stats.aggregates != 3 {
+		t.Errorf("synthesized %d aggregates, want 3", stats.aggregates)
+	}
+
+	tests := []struct {
+		ip   string
+		want mmdbtype.Map
+	}{
+		{"8.8.8.8", mmdbtype.Map{
+			"autonomous_system_number":       mmdbtype.Uint32(15169),
+			"autonomous_system_organization": mmdbtype.String("Google"),
+		}},
+		{"8.8.1.1", mmdbtype.Map{
+			"autonomous_system_number":       mmdbtype.Uint32(15169),
+			"autonomous_system_organization": mmdbtype.String("Google"),
+			"is_aggregate":                   mmdbtype.Bool(true),
+		}},
+		// The specifics under 9.9.0.0/16 disagree, so only the flag is set.
+		{"9.9.1.1", mmdbtype.Map{"is_aggregate": mmdbtype.Bool(true)}},
+		{"2001:4860:1::1", mmdbtype.Map{
+			"autonomous_system_number":       mmdbtype.Uint32(15169),
+			"autonomous_system_organization": mmdbtype.String("Google"),
+			"is_aggregate":                   mmdbtype.Bool(true),
+		}},
+		{"8.9.0.1", nil},
+	}
+	for _, tt := range tests {
+		_, got, err := lookupRecord(db, parseTestIP(t, tt.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == nil) != (tt.want == nil) || (got != nil && !got.Equal(tt.want)) {
+			t.Errorf("%s: got %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
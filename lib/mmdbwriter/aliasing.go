@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ipv4Space is the whole IPv4 address space.
+var ipv4Space = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+
+// checkAliasing rebuilds the database with DisableIPv4Aliasing and confirms
+// that every IPv4 network resolves to the same record in both builds, so
+// toggling the aliasing options cannot change what IPv4 lookups observe.
+func checkAliasing(built *maxminddb.Reader) error {
+	opts := treeOptionsFrom(built.Metadata)
+	opts.DisableIPv4Aliasing = true
+	unaliasedTree, _, err := copyDatabase(built, nil, opts)
+	if err != nil {
+		return fmt.Errorf("failed to build unaliased database: %w", err)
+	}
+	var buf bytes.Buffer
+	if _, err := unaliasedTree.WriteTo(&buf); err != nil {
+		return fmt.Errorf("failed to serialize unaliased database: %w", err)
+	}
+	unaliased, err := maxminddb.FromBytes(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to read back unaliased database: %w", err)
+	}
+
+	compared := 0
+	divergent := 0
+	// Networks from either side are looked up in the other so a record
+	// missing from one build is caught as well.
+	for _, pair := range [][2]*maxminddb.Reader{{built, unaliased}, {unaliased, built}} {
+		err := walkDatabase(pair[0], ipv4Space, func(network *net.IPNet, _ mmdbtype.DataType) error {
+			compared++
+			_, a, err := lookupRecord(built, network.IP)
+			if err != nil {
+				return fmt.Errorf("failed to look up %s in aliased database: %w", network, err)
+			}
+			_, b, err := lookupRecord(unaliased, network.IP)
+			if err != nil {
+				return fmt.Errorf("failed to look up %s in unaliased database: %w", network, err)
+			}
+			if recordsEqual(a, b) {
+				return nil
+			}
+			divergent++
+			if divergent <= maxReportedDiscrepancies {
+				logger.Error("aliasing divergence", "network", network, "aliased", a, "unaliased", b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info("aliasing comparison", "compared", compared, "divergent", divergent)
+	if divergent > 0 {
+		return fmt.Errorf("aliasing comparison found %d divergent IPv4 networks", divergent)
+	}
+	return nil
+}
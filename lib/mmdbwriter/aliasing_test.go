@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckAliasing(t *testing.T) {
+	source, err := os.ReadFile("testdata/bgp-tools.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{nil, {"-disable-ipv4-aliasing"}} {
+		db, _ := buildTestDB(t, testConfig(t, args...), string(source))
+		if err := checkAliasing(db); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Kinds of anomalies -anomalies reports.
+const (
+	anomalyReserved    = "reserved"
+	anomalyUnallocated = "unallocated"
+	anomalyGrowth      = "prefix-growth"
+)
+
+// anomaly is a finding of -anomalies: an announced prefix of reserved or
+// undelegated space, or an origin ASN with far more networks than in the
+// base database, which has no prefix.
+type anomaly struct {
+	kind   string
+	prefix netip.Prefix
+	asn    uint32
+	detail string
+}
+
+// anomalyReport collects the anomalies of a build.
+type anomalyReport struct {
+	delegations rirDelegations
+	found       []anomaly
+}
+
+// add records an anomaly and warns about it.
+func (r *anomalyReport) add(a anomaly) {
+	r.found = append(r.found, a)
+	attrs := []any{"kind", a.kind, "asn", a.asn, "detail", a.detail}
+	if a.prefix.IsValid() {
+		attrs = append(attrs, "network", a.prefix)
+	}
+	logger.Warn("anomaly", attrs...)
+}
+
+// checkPrefix reports a prefix announced by asn that lies in special-purpose
+// space, or, with -rir-stats, outside the space the RIRs allocated or
+// assigned. Prefixes containing such space, like a default route, are not
+// reported.
+func (r *anomalyReport) checkPrefix(prefix netip.Prefix, asn uint32) {
+	for _, b := range bogonNetworks {
+		bogon := netip.MustParsePrefix(b.network)
+		if bogon.Bits() <= prefix.Bits() && bogon.Contains(prefix.Addr()) {
+			r.add(anomaly{kind: anomalyReserved, prefix: prefix, asn: asn, detail: "announces " + b.kind + " space " + b.network})
+			return
+		}
+	}
+	if len(r.delegations) == 0 {
+		return
+	}
+	switch all, some := r.delegations.covers(prefix); {
+	case !some:
+		r.add(anomaly{kind: anomalyUnallocated, prefix: prefix, asn: asn, detail: "not allocated or assigned by any RIR"})
+	case !all:
+		r.add(anomaly{kind: anomalyUnallocated, prefix: prefix, asn: asn, detail: "partly not allocated or assigned by any RIR"})
+	}
+}
+
+// covers reports whether the delegations cover all of prefix, and whether
+// they cover any of it.
+func (d rirDelegations) covers(prefix netip.Prefix) (all, some bool) {
+	first, last := prefix.Masked().Addr(), prefixLast(prefix)
+	// Only the delegation before the first one starting after first can
+	// start before it.
+	start := sort.Search(len(d), func(i int) bool {
+		return first.Less(d[i].first)
+	})
+	// next is the first address not known to be covered.
+	next := first
+	all = true
+	for i := max(start-1, 0); i < len(d) && !last.Less(d[i].first); i++ {
+		if d[i].first.BitLen() != first.BitLen() || d[i].last.Less(next) {
+			continue
+		}
+		some = true
+		if next.Less(d[i].first) {
+			all = false
+		}
+		if !d[i].last.Less(last) {
+			return all, true
+		}
+		next = d[i].last.Next()
+	}
+	return false, some
+}
+
+// checkAnomalies completes the anomalies of a build with the growth of its
+// origin ASNs against -compare-base, when given, and writes the report.
+func checkAnomalies(cfg *config, built *maxminddb.Reader, report *anomalyReport) error {
+	if cfg.compareBase != "" {
+		base, err := maxminddb.Open(cfg.compareBase)
+		if err != nil {
+			return fmt.Errorf("failed to open base database: %w", err)
+		}
+		defer base.Close()
+		if err := report.checkGrowth(base, built, cfg.anomalyGrowth, cfg.anomalyMinPrefixes); err != nil {
+			return err
+		}
+	}
+	return report.write(cfg.anomalies)
+}
+
+// checkGrowth reports the origin ASNs with at least minPrefixes networks in
+// built and more than growth times their networks in base. Both are counted
+// as networks of the database, so prefixes split by more specifics of
+// other ASNs count as their parts in either.
+func (r *anomalyReport) checkGrowth(base, built *maxminddb.Reader, growth float64, minPrefixes int) error {
+	count := func(db *maxminddb.Reader) (map[uint32]int, error) {
+		counts := map[uint32]int{}
+		err := walkDatabase(db, nil, func(_ *net.IPNet, record mmdbtype.DataType) error {
+			if asn := recordASN(record); asn != nil {
+				counts[*asn]++
+			}
+			return nil
+		})
+		return counts, err
+	}
+	before, err := count(base)
+	if err != nil {
+		return fmt.Errorf("failed to read base database: %w", err)
+	}
+	after, err := count(built)
+	if err != nil {
+		return err
+	}
+	asns := make([]uint32, 0, len(after))
+	for asn := range after {
+		asns = append(asns, asn)
+	}
+	slices.Sort(asns)
+	for _, asn := range asns {
+		n := after[asn]
+		if n >= minPrefixes && float64(n) > growth*float64(before[asn]) {
+			r.add(anomaly{kind: anomalyGrowth, asn: asn,
+				detail: fmt.Sprintf("%d networks, %d in the base database", n, before[asn])})
+		}
+	}
+	return nil
+}
+
+// write replaces the report file with the anomalies as CSV, one per line:
+// kind, network (empty for an ASN), asn and detail.
+func (r *anomalyReport) write(path string) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"kind", "network", "asn", "detail"})
+	for _, a := range r.found {
+		network := ""
+		if a.prefix.IsValid() {
+			network = a.prefix.String()
+		}
+		w.Write([]string{a.kind, network, strconv.FormatUint(uint64(a.asn), 10), a.detail})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write anomalies report: %w", err)
+	}
+	logger.Info("anomalies report written", "file", path, "anomalies", len(r.found))
+	return nil
+}
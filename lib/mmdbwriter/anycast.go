@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// anycastSources implements flag.Value for the repeatable -anycast flag.
+type anycastSources []string
+
+func (s *anycastSources) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *anycastSources) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// loadAnycastPrefixes reads prefix lists, one prefix per line with # for
+// comments, such as the anycatch-v4-prefixes.txt and
+// anycatch-v6-prefixes.txt lists of bgp.tools. Sources may be files or
+// URLs.
+func loadAnycastPrefixes(ctx context.Context, sources []string, userAgent string, retries int) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, source := range sources {
+		path := source
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			dir, err := os.MkdirTemp("", "mmdbwriter-anycast-")
+			if err != nil {
+				return nil, err
+			}
+			defer os.RemoveAll(dir)
+			path = filepath.Join(dir, "prefixes.txt")
+			if _, err := fetchFile(ctx, source, path, userAgent, retries); err != nil {
+				return nil, fmt.Errorf("failed to fetch anycast prefixes from %s: %w", source, err)
+			}
+		}
+
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open anycast prefixes: %w", err)
+		}
+		scanner := bufio.NewScanner(fh)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text, _, _ := strings.Cut(scanner.Text(), "#")
+			text = strings.TrimSpace(text)
+			if text == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(text)
+			if err != nil {
+				logger.Warn("skipping invalid anycast prefix", "source", source, "line", line, "prefix", text, "error", err)
+				continue
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+		err = scanner.Err()
+		fh.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read anycast prefixes from %s: %w", source, err)
+		}
+	}
+	return prefixes, nil
+}
+
+// anycastEnricher is the anycast stage of the enrichment pipeline.
+type anycastEnricher []netip.Prefix
+
+func (e anycastEnricher) enrichNetworks(writer *mmdbwriter.Tree, cfg *config, stats *buildStats) error {
+	var err error
+	stats.anycastPrefixes, err = tagAnycastNetworks(writer, cfg, e)
+	return err
+}
+
+// tagAnycastNetworks sets is_anycast on every record within an anycast
+// prefix and returns how many prefixes matched a record. Unlike bogon and
+// IXP tagging no records are created: space without data stays empty.
+func tagAnycastNetworks(writer *mmdbwriter.Tree, cfg *config, prefixes []netip.Prefix) (int, error) {
+	policy := networkPolicy(cfg)
+	matched := 0
+	for _, prefix := range prefixes {
+		if excludesFamily(cfg, prefix) {
+			continue
+		}
+		if err := policy.Check(prefix); err != nil {
+			logger.Warn("skipping unsupported anycast prefix", "network", prefix, "error", err)
+			continue
+		}
+		found := false
+		err := writer.InsertFunc(prefixNetwork(prefix), func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+			record, ok := existing.(mmdbtype.Map)
+			if !ok {
+				return existing, nil
+			}
+			found = true
+			tagged := record.Copy().(mmdbtype.Map)
+			tagged["is_anycast"] = mmdbtype.Bool(true)
+			return tagged, nil
+		})
+		if err != nil {
+			return matched, fmt.Errorf("failed to tag anycast prefix %s: %w", prefix, err)
+		}
+		if found {
+			matched++
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// arrowBatchRows is the number of rows per record batch.
+const arrowBatchRows = 1 << 16
+
+// arrowContentType is the media type of the Arrow IPC stream format.
+const arrowContentType = "application/vnd.apache.arrow.stream"
+
+// arrowWriter writes networks in the Arrow IPC stream format, with the
+// columns of -output-format parquet so that both can be queried alike: the
+// schema, then a record batch every arrowBatchRows rows, then the
+// end-of-stream marker.
+type arrowWriter struct {
+	w  *ipc.Writer
+	nb *networkBuilder
+}
+
+func newArrowWriter(w io.Writer, metadata map[string]string) *arrowWriter {
+	schema := networkSchema(metadata)
+	return &arrowWriter{w: ipc.NewWriter(w, ipc.WithSchema(schema)), nb: newNetworkBuilder(schema)}
+}
+
+func (a *arrowWriter) row(network *net.IPNet, record mmdbtype.Map) error {
+	a.nb.add(network, record)
+	if a.nb.rows == arrowBatchRows {
+		return a.flush()
+	}
+	return nil
+}
+
+// flush writes the pending rows as a record batch.
+func (a *arrowWriter) flush() error {
+	if a.nb.rows == 0 {
+		return nil
+	}
+	rec := a.nb.newRecord()
+	defer rec.Release()
+	return a.w.Write(rec)
+}
+
+// close writes the last batch and the end-of-stream marker, and the schema
+// when there were no rows.
+func (a *arrowWriter) close() error {
+	defer a.nb.release()
+	if err := a.flush(); err != nil {
+		return err
+	}
+	return a.w.Close()
+}
+
+// exportArrowStream writes every network of db as an Arrow stream, with the
+// database type and build time as schema metadata.
+func exportArrowStream(db *maxminddb.Reader, w io.Writer) (int, error) {
+	a := newArrowWriter(w, map[string]string{
+		"database_type": db.Metadata.DatabaseType,
+		"build_epoch":   strconv.FormatUint(uint64(db.Metadata.BuildEpoch), 10),
+	})
+	exported := 0
+	err := walkDatabase(db, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+		m, _ := record.(mmdbtype.Map)
+		if err := a.row(network, m); err != nil {
+			return err
+		}
+		exported++
+		return nil
+	})
+	if err != nil {
+		a.nb.release()
+		return exported, err
+	}
+	if err := a.close(); err != nil {
+		return exported, fmt.Errorf("failed to write Arrow stream: %w", err)
+	}
+	return exported, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// exportTestRow is a network written by the Arrow and Parquet writers and
+// the non-null columns it must read back as.
+type exportTestRow struct {
+	network string
+	record  mmdbtype.Map
+	want    map[string]any
+}
+
+// exportTestRows cover every column type, nulls, empty and repeated lists
+// and values of the wrong type.
+var exportTestRows = []exportTestRow{
+	{
+		network: "1.1.1.0/24",
+		record: mmdbtype.Map{
+			"autonomous_system_number":       mmdbtype.Uint32(13335),
+			"autonomous_system_organization": mmdbtype.String("Cloudflare, Inc."),
+			"rpki_status":                    mmdbtype.String("valid"),
+			"announced":                      mmdbtype.Bool(true),
+			"upstreams":                      mmdbtype.Slice{mmdbtype.Uint32(174), mmdbtype.Uint32(3356)},
+			"first_seen":                     mmdbtype.Uint64(1700000000),
+		},
+		want: map[string]any{
+			"prefix":        "1.1.1.0/24",
+			"ip_version":    int32(4),
+			"network_start": addr16("::ffff:1.1.1.0"),
+			"network_end":   addr16("::ffff:1.1.1.255"),
+			"ipv4_start":    int64(0x01010100),
+			"ipv4_end":      int64(0x010101ff),
+			"asn":           int64(13335),
+			"org":           "Cloudflare, Inc.",
+			"rpki_status":   "valid",
+			"announced":     true,
+			"upstreams":     []int64{174, 3356},
+			"first_seen":    int64(1700000000),
+		},
+	},
+	{
+		network: "2606:4700::/32",
+		record: mmdbtype.Map{
+			"autonomous_system_number":       mmdbtype.Uint32(13335),
+			"autonomous_system_organization": mmdbtype.String("Cloudflare, Inc."),
+			"is_anycast":                     mmdbtype.Bool(true),
+			"upstreams":                      mmdbtype.Slice{},
+		},
+		want: map[string]any{
+			"prefix":        "2606:4700::/32",
+			"ip_version":    int32(6),
+			"network_start": addr16("2606:4700::"),
+			"network_end":   addr16("2606:4700:ffff:ffff:ffff:ffff:ffff:ffff"),
+			"asn":           int64(13335),
+			"org":           "Cloudflare, Inc.",
+			"is_anycast":    true,
+			"upstreams":     []int64{},
+		},
+	},
+	{
+		network: "10.0.0.0/8",
+		record: mmdbtype.Map{
+			"is_bogon":   mmdbtype.Bool(true),
+			"bogon_type": mmdbtype.String("private"),
+			"country":    mmdbtype.Uint32(5),
+		},
+		want: map[string]any{
+			"prefix":        "10.0.0.0/8",
+			"ip_version":    int32(4),
+			"network_start": addr16("::ffff:10.0.0.0"),
+			"network_end":   addr16("::ffff:10.255.255.255"),
+			"ipv4_start":    int64(0x0a000000),
+			"ipv4_end":      int64(0x0affffff),
+			"is_bogon":      true,
+			"bogon_type":    "private",
+		},
+	},
+	{
+		network: "8.8.8.0/24",
+		record: mmdbtype.Map{
+			"autonomous_system_numbers":      mmdbtype.Slice{mmdbtype.Uint32(15169), mmdbtype.Uint32(36040)},
+			"autonomous_system_organization": mmdbtype.String(`Gøøgle "LLC"`),
+			"is_bogon":                       mmdbtype.Bool(false),
+		},
+		want: map[string]any{
+			"prefix":                    "8.8.8.0/24",
+			"ip_version":                int32(4),
+			"network_start":             addr16("::ffff:8.8.8.0"),
+			"network_end":               addr16("::ffff:8.8.8.255"),
+			"ipv4_start":                int64(0x08080800),
+			"ipv4_end":                  int64(0x080808ff),
+			"autonomous_system_numbers": []int64{15169, 36040},
+			"org":                       `Gøøgle "LLC"`,
+			"is_bogon":                  false,
+		},
+	},
+	{
+		network: "2001:db8::/128",
+		record:  mmdbtype.Map{},
+		want: map[string]any{
+			"prefix":        "2001:db8::/128",
+			"ip_version":    int32(6),
+			"network_start": addr16("2001:db8::"),
+			"network_end":   addr16("2001:db8::"),
+		},
+	},
+}
+
+func addr16(s string) []byte {
+	a := netip.MustParseAddr(s).As16()
+	return a[:]
+}
+
+// exportTestNetwork returns the network of a row as the writers take it.
+func exportTestNetwork(t testing.TB, network string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// arrowValue returns the value of a column at row i with the Go type the
+// writers take, nil for null.
+func arrowValue(t testing.TB, col arrow.Array, i int) any {
+	t.Helper()
+	if col.IsNull(i) {
+		return nil
+	}
+	switch col := col.(type) {
+	case *array.String:
+		return col.Value(i)
+	case *array.Int32:
+		return col.Value(i)
+	case *array.Int64:
+		return col.Value(i)
+	case *array.Boolean:
+		return col.Value(i)
+	case *array.FixedSizeBinary:
+		return bytes.Clone(col.Value(i))
+	case *array.List:
+		start, end := col.ValueOffsets(i)
+		values := col.ListValues().(*array.Int64)
+		elems := []int64{}
+		for j := start; j < end; j++ {
+			elems = append(elems, values.Value(int(j)))
+		}
+		return elems
+	}
+	t.Fatalf("unexpected column type %s", col.DataType())
+	return nil
+}
+
+// checkExportRecord compares row i of rec, as read by a reference reader,
+// with want: every column not in it must be null.
+func checkExportRecord(t testing.TB, rec arrow.Record, i int, want map[string]any) {
+	t.Helper()
+	for c, field := range rec.Schema().Fields() {
+		got := arrowValue(t, rec.Column(c), i)
+		if !reflect.DeepEqual(got, want[field.Name]) {
+			t.Errorf("%v: column %s: got %#v, want %#v", want["prefix"], field.Name, got, want[field.Name])
+		}
+	}
+}
+
+// readArrowTest decodes an Arrow stream with the reader of the Arrow
+// project and returns its schema and record batches.
+func readArrowTest(t testing.TB, data []byte) (*arrow.Schema, []arrow.Record) {
+	t.Helper()
+	r, err := ipc.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release()
+	var recs []arrow.Record
+	for r.Next() {
+		rec := r.Record()
+		rec.Retain()
+		t.Cleanup(rec.Release)
+		recs = append(recs, rec)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return r.Schema(), recs
+}
+
+func TestArrowRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	a := newArrowWriter(&buf, map[string]string{"database_type": "BGP-Tools-ASN", "build_epoch": "1700000000"})
+	for _, row := range exportTestRows {
+		if err := a.row(exportTestNetwork(t, row.network), row.record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	schema, recs := readArrowTest(t, buf.Bytes())
+	for _, kv := range [][2]string{{"database_type", "BGP-Tools-ASN"}, {"build_epoch", "1700000000"}} {
+		if got, ok := schema.Metadata().GetValue(kv[0]); !ok || got != kv[1] {
+			t.Errorf("got metadata %s %q, want %q", kv[0], got, kv[1])
+		}
+	}
+	wantTypes := map[string]arrow.DataType{
+		"prefix":                    arrow.BinaryTypes.String,
+		"ip_version":                arrow.PrimitiveTypes.Int32,
+		"network_start":             &arrow.FixedSizeBinaryType{ByteWidth: 16},
+		"ipv4_start":                arrow.PrimitiveTypes.Int64,
+		"asn":                       arrow.PrimitiveTypes.Int64,
+		"autonomous_system_numbers": arrow.ListOfNonNullable(arrow.PrimitiveTypes.Int64),
+		"is_bogon":                  arrow.FixedWidthTypes.Boolean,
+	}
+	for name, want := range wantTypes {
+		fields, ok := schema.FieldsByName(name)
+		if !ok {
+			t.Errorf("no column %s", name)
+		} else if !arrow.TypeEqual(fields[0].Type, want) {
+			t.Errorf("column %s: got type %s, want %s", name, fields[0].Type, want)
+		}
+	}
+
+	if len(recs) != 1 || recs[0].NumRows() != int64(len(exportTestRows)) {
+		t.Fatalf("got %d batches, want one of %d rows", len(recs), len(exportTestRows))
+	}
+	for i, row := range exportTestRows {
+		checkExportRecord(t, recs[0], i, row.want)
+	}
+}
+
+// arrowTestPrefix returns the i-th /32 of 11.0.0.0/8.
+func arrowTestPrefix(i int) string {
+	return fmt.Sprintf("11.%d.%d.%d/32", i>>16, i>>8&0xff, i&0xff)
+}
+
+func TestArrowBatches(t *testing.T) {
+	var buf bytes.Buffer
+	a := newArrowWriter(&buf, nil)
+	rows := arrowBatchRows + 3
+	for i := range rows {
+		network := exportTestNetwork(t, arrowTestPrefix(i))
+		if err := a.row(network, mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, recs := readArrowTest(t, buf.Bytes())
+	if len(recs) != 2 || recs[0].NumRows() != arrowBatchRows || recs[1].NumRows() != 3 {
+		t.Fatalf("got %d batches, want %d and 3 rows", len(recs), arrowBatchRows)
+	}
+	last := recs[1]
+	if got := arrowValue(t, last.Column(0), 2); got != arrowTestPrefix(rows-1) {
+		t.Errorf("got last prefix %v", got)
+	}
+	if got := arrowValue(t, last.Column(6), 2); got != int64(rows-1) {
+		t.Errorf("got last asn %v, want %d", got, rows-1)
+	}
+}
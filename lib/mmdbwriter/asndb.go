@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// Output formats of the asn-db command.
+const (
+	asnDBJSON   = "json"
+	asnDBSQLite = "sqlite"
+)
+
+// asnDBEntry is what the ASN database holds for one AS number.
+type asnDBEntry struct {
+	ASN          uint32 `json:"-"`
+	Name         string `json:"name,omitempty"`
+	Country      string `json:"country,omitempty"`
+	RIR          string `json:"rir,omitempty"`
+	IPv4Prefixes int    `json:"ipv4_prefixes"`
+	IPv6Prefixes int    `json:"ipv6_prefixes"`
+
+	// Upstreams are the providers of the ASN in -as-rel, in ASN order.
+	Upstreams []uint32 `json:"upstreams,omitempty"`
+}
+
+// runASNDB implements `asn-db [flags] <out> <input>...`: it builds the
+// companion dataset keyed by AS number from the same prefix inputs as the
+// MMDB, with the name of each ASN from -asn-names (else the first org of
+// its rows), its country and RIR from -rir-stats, its upstreams from
+// -as-rel, and the number of distinct IPv4 and IPv6 prefixes it originates.
+func runASNDB(args []string) error {
+	fs := flag.NewFlagSet("asn-db", flag.ExitOnError)
+	format := fs.String("format", "",
+		"output format: json or sqlite (default sqlite for .db, .sqlite and .sqlite3 files, else json)")
+	inputFormat := fs.String("input-format", "",
+		"input format: csv, table, jsonl, mrt, iptoasn or ipinfo (default from the file extension, else csv)")
+	asnNamesFile := fs.String("asn-names", "",
+		"bgp.tools asns.csv `file` naming the ASNs; these are included even without prefixes")
+	var rirStats rirStatsFiles
+	fs.Var(&rirStats, "rir-stats",
+		"RIR delegated-extended stats `file` adding country and rir; repeat for each RIR")
+	asRel := fs.String("as-rel", "",
+		"CAIDA as-rel or \"asn,upstream\" list `file-or-url` adding the upstreams of each ASN")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s asn-db [flags] <out.json|out.db> <input>...\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("asn-db needs an output file and at least one input")
+	}
+	outFile, inputs := fs.Arg(0), fs.Args()[1:]
+
+	if *format == "" {
+		*format = asnDBJSON
+		if ext := filepath.Ext(outFile); ext == ".db" || ext == ".sqlite" || ext == ".sqlite3" {
+			*format = asnDBSQLite
+		}
+	}
+	if *format != asnDBJSON && *format != asnDBSQLite {
+		return fmt.Errorf("unknown -format %q (want %s or %s)", *format, asnDBJSON, asnDBSQLite)
+	}
+	if *format == asnDBSQLite && !sqliteSupported {
+		return errNoSQLite
+	}
+	if *format == asnDBSQLite && outFile == stdioPath {
+		return errors.New("the sqlite format cannot be written to stdout")
+	}
+
+	entries := map[uint32]*asnDBEntry{}
+	entry := func(asn uint32) *asnDBEntry {
+		e := entries[asn]
+		if e == nil {
+			e = &asnDBEntry{ASN: asn}
+			entries[asn] = e
+		}
+		return e
+	}
+
+	// The same prefix of an ASN is counted once, however many inputs or
+	// rows carry it.
+	seen := map[asnPrefix]bool{}
+	for _, input := range inputs {
+		inFormat := *inputFormat
+		if inFormat == "" {
+			inFormat = formatFromExtension(input)
+		}
+		if inFormat == "" {
+			inFormat = formatCSV
+		}
+		switch inFormat {
+		case formatCSV, formatTable, formatJSONL, formatMRT, formatIPtoASN, formatIPinfo:
+		default:
+			return fmt.Errorf("unknown -input-format %q (want csv, table, jsonl, mrt, iptoasn or ipinfo)", inFormat)
+		}
+		rows, err := countASNPrefixes(input, inFormat, entry, seen)
+		if err != nil {
+			return err
+		}
+		logger.Info("processed input", "file", input, "format", inFormat, "rows", rows)
+	}
+
+	if *asnNamesFile != "" {
+		names, err := loadASNNames(*asnNamesFile)
+		if err != nil {
+			return err
+		}
+		for asn, name := range names {
+			entry(asn).Name = name
+		}
+		logger.Info("loaded ASN names", "count", len(names), "file", *asnNamesFile)
+	}
+
+	if len(rirStats) > 0 {
+		blocks, err := loadRIRASNs(rirStats)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if block, ok := blocks.lookup(e.ASN); ok {
+				e.Country, e.RIR = block.country, block.rir
+			}
+		}
+		logger.Info("loaded RIR ASN delegations", "count", len(blocks), "files", len(rirStats))
+	}
+
+	if *asRel != "" {
+		rels, relations, err := loadASRelationships(context.Background(), *asRel, defaultUserAgent, 0)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			for _, upstream := range rels.upstreams[e.ASN] {
+				e.Upstreams = append(e.Upstreams, uint32(upstream.(mmdbtype.Uint32)))
+			}
+		}
+		logger.Info("loaded AS relationships", "relations", relations, "source", *asRel)
+	}
+
+	sorted := make([]*asnDBEntry, 0, len(entries))
+	for _, asn := range slices.Sorted(maps.Keys(entries)) {
+		sorted = append(sorted, entries[asn])
+	}
+
+	var err error
+	if *format == asnDBSQLite {
+		err = writeASNDatabaseSQLite(sorted, outFile)
+	} else {
+		err = writeASNDatabaseJSON(sorted, outFile, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info("ASN database written", "file", outFile, "format", *format, "asns", len(sorted))
+	return nil
+}
+
+// asnPrefix is a prefix originated by an ASN, counted once however many
+// inputs or rows carry it.
+type asnPrefix struct {
+	prefix netip.Prefix
+	asn    uint32
+}
+
+// countASNPrefixes adds the prefixes of one input to the entries of their
+// origin ASNs, taking the name of an ASN from the org column of its first
+// row that has one. Rows that the build would skip are skipped silently;
+// the build reports them. It returns the number of rows read.
+func countASNPrefixes(input, format string, entry func(uint32) *asnDBEntry, seen map[asnPrefix]bool) (int, error) {
+	fh := os.Stdin
+	if input != stdioPath {
+		var err error
+		fh, err = os.Open(input)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open input: %w", err)
+		}
+		defer fh.Close()
+	}
+	dr, err := decompressInput(fh)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", input, err)
+	}
+	defer dr.Close()
+	r, header, err := newRowReader(&config{format: format}, dr)
+	if err != nil {
+		return 0, err
+	}
+	networkIndex, asnIndex, orgIndex, _ := inputColumns(columnMap{}, header)
+
+	rows := 0
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", input, err)
+		}
+		rows++
+		if len(row) <= max(networkIndex, asnIndex) {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(row[networkIndex]))
+		if err != nil {
+			continue
+		}
+		asn, err := strconv.ParseUint(strings.TrimSpace(row[asnIndex]), 10, 32)
+		if err != nil || asn == 0 {
+			continue
+		}
+
+		e := entry(uint32(asn))
+		// Only the CSV format has an org column, the third unless the
+		// header names it.
+		if e.Name == "" && format == formatCSV {
+			e.Name = columnValue(row, orgIndex)
+		}
+		key := asnPrefix{prefix.Masked(), uint32(asn)}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if prefix.Addr().Unmap().Is4() {
+			e.IPv4Prefixes++
+		} else {
+			e.IPv6Prefixes++
+		}
+	}
+}
+
+// writeASNDatabaseJSON writes the entries as one JSON object keyed by AS
+// number, in numeric order, next to the build time:
+//
+//	{"build_epoch": 1700000000, "asns": {"13335": {"name": "Cloudflare", ...}}}
+func writeASNDatabaseJSON(entries []*asnDBEntry, path string, buildTime time.Time) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "{\n  \"build_epoch\": %d,\n  \"asns\": {", buildTime.Unix())
+	for i, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "\n    \"%d\": %s", e.ASN, data)
+	}
+	b.WriteString("\n  }\n}\n")
+
+	if path == stdioPath {
+		_, err := os.Stdout.Write(b.Bytes())
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	if err := writeFileAtomic(path, b.Bytes()); err != nil {
+		return fmt.Errorf("failed to write ASN database: %w", err)
+	}
+	return nil
+}
+
+// readASNDatabase reads an ASN database written by asn-db, JSON or SQLite,
+// and returns its entries by AS number.
+func readASNDatabase(path string) (map[uint32]*asnDBEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ASN database: %w", err)
+	}
+	if bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		return readASNDatabaseSQLite(path)
+	}
+	var file struct {
+		ASNs map[string]*asnDBEntry `json:"asns"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid ASN database %s: %w", path, err)
+	}
+	entries := make(map[uint32]*asnDBEntry, len(file.ASNs))
+	for key, e := range file.ASNs {
+		asn, err := strconv.ParseUint(key, 10, 32)
+		if err != nil || e == nil {
+			return nil, fmt.Errorf("invalid ASN database %s: ASN %q", path, key)
+		}
+		e.ASN = uint32(asn)
+		entries[e.ASN] = e
+	}
+	return entries, nil
+}
+
+// linkMetadata returns the metadata of the build, with its provenance and
+// -link added: the file name and SHA-256 of the ASN database, so a reader
+// of the MMDB can find the companion artifact of the same build and check
+// it is the one.
+func linkMetadata(cfg *config) (map[string]string, error) {
+	extra := provenanceMetadata(cfg)
+	if cfg.link == "" {
+		return extra, nil
+	}
+	sum, err := fileSHA256(cfg.link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -link ASN database: %w", err)
+	}
+	extra["asn_database"] = filepath.Base(cfg.link)
+	extra["asn_database_sha256"] = hex.EncodeToString(sum)
+	return extra, nil
+}
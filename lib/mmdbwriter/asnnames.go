@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// loadASNNames reads the bgp.tools asns.csv (asn,name,class,cc) and returns
+// the name of each ASN. ASNs may be written with or without the AS prefix.
+func loadASNNames(path string) (map[uint32]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ASN names file: %w", err)
+	}
+	defer fh.Close()
+
+	r := csv.NewReader(fh)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ASN names header: %w", err)
+	}
+	asnIndex, nameIndex := mmdbbuild.HeaderIndex(header, "asn"), mmdbbuild.HeaderIndex(header, "name")
+	if asnIndex < 0 || nameIndex < 0 {
+		return nil, fmt.Errorf("ASN names file %s needs asn and name columns", path)
+	}
+
+	names := map[uint32]string{}
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ASN names: %w", err)
+		}
+
+		asnStr := strings.TrimPrefix(strings.ToUpper(columnValue(row, asnIndex)), "AS")
+		asn, err := strconv.ParseUint(asnStr, 10, 32)
+		if err != nil {
+			line, _ := r.FieldPos(asnIndex)
+			logger.Warn("skipping invalid ASN", "file", path, "line", line, "asn", columnValue(row, asnIndex))
+			continue
+		}
+		if name := columnValue(row, nameIndex); name != "" {
+			names[uint32(asn)] = name
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// asRelationships holds the upstreams (providers) and peers of each ASN,
+// ready to be stored as sorted uint32 arrays.
+type asRelationships struct {
+	upstreams map[uint32]mmdbtype.Slice
+	peers     map[uint32]mmdbtype.Slice
+
+	// peersToo stores the peers as well, for -as-rel-peers.
+	peersToo bool
+}
+
+// loadASRelationships reads AS relationships from a file or URL, gzip or
+// bzip2 compressed or not. Two line formats are accepted:
+//
+//	provider|customer|-1[|source]   CAIDA as-rel, provider to customer
+//	peer|peer|0[|source]            CAIDA as-rel, peer to peer
+//	asn,upstream                    one upstream of asn per line
+//
+// Lines starting with # are comments. It returns the relationships and the
+// number of relationship lines read.
+func loadASRelationships(ctx context.Context, source, userAgent string, retries int) (*asRelationships, int, error) {
+	path := source
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		dir, err := os.MkdirTemp("", "mmdbwriter-asrel-")
+		if err != nil {
+			return nil, 0, err
+		}
+		defer os.RemoveAll(dir)
+		path = filepath.Join(dir, "as-rel.txt")
+		if _, err := fetchFile(ctx, source, path, userAgent, retries); err != nil {
+			return nil, 0, fmt.Errorf("failed to fetch AS relationships from %s: %w", source, err)
+		}
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open AS relationships: %w", err)
+	}
+	defer fh.Close()
+	r, err := decompressInput(fh)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read AS relationships from %s: %w", source, err)
+	}
+	defer r.Close()
+
+	upstreams := map[uint32][]uint32{}
+	peers := map[uint32][]uint32{}
+	scanner := bufio.NewScanner(r)
+	line, relations := 0, 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var fields []string
+		rel := "-1"
+		if strings.Contains(text, "|") {
+			fields = strings.Split(text, "|")
+			if len(fields) < 3 {
+				logger.Warn("skipping invalid AS relationship", "source", source, "line", line, "text", text)
+				continue
+			}
+			rel = fields[2]
+		} else {
+			fields = strings.Split(text, ",")
+			if len(fields) != 2 {
+				logger.Warn("skipping invalid AS relationship", "source", source, "line", line, "text", text)
+				continue
+			}
+			// An upstream list names the customer first.
+			fields[0], fields[1] = fields[1], fields[0]
+		}
+
+		a, errA := parseRelASN(fields[0])
+		b, errB := parseRelASN(fields[1])
+		if errA != nil || errB != nil || (rel != "-1" && rel != "0") {
+			logger.Warn("skipping invalid AS relationship", "source", source, "line", line, "text", text)
+			continue
+		}
+		relations++
+		if rel == "-1" {
+			upstreams[b] = append(upstreams[b], a)
+		} else {
+			peers[a] = append(peers[a], b)
+			peers[b] = append(peers[b], a)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read AS relationships from %s: %w", source, err)
+	}
+
+	return &asRelationships{upstreams: asnSlices(upstreams), peers: asnSlices(peers)}, relations, nil
+}
+
+func parseRelASN(s string) (uint32, error) {
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "AS")
+	asn, err := strconv.ParseUint(s, 10, 32)
+	return uint32(asn), err
+}
+
+// asnSlices sorts and deduplicates the ASN lists and converts them to the
+// arrays stored in the records.
+func asnSlices(lists map[uint32][]uint32) map[uint32]mmdbtype.Slice {
+	out := make(map[uint32]mmdbtype.Slice, len(lists))
+	for asn, list := range lists {
+		slices.Sort(list)
+		list = slices.Compact(list)
+		s := make(mmdbtype.Slice, len(list))
+		for i, v := range list {
+			s[i] = mmdbtype.Uint32(v)
+		}
+		out[asn] = s
+	}
+	return out
+}
+
+// enrich adds the upstreams of the origin ASN, and its peers with
+// -as-rel-peers. AS_SET origins get neither.
+func (r *asRelationships) enrich(_ netip.Prefix, record *mmdbbuild.Record, stats *buildStats) {
+	if record.ASN == 0 {
+		return
+	}
+	if upstreams, ok := r.upstreams[record.ASN]; ok {
+		record.Fields["upstreams"] = upstreams
+		stats.asRelMatched++
+	}
+	if peers, ok := r.peers[record.ASN]; ok && r.peersToo {
+		record.Fields["peers"] = peers
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// benchInput is the input of the benchmarks; a sample is generated when
+// it is empty.
+var benchInput = flag.String("bench-input", "", "CSV `file` the benchmarks read instead of the generated sample")
+
+// benchSampleRows is the size of the generated sample.
+const benchSampleRows = 200000
+
+// benchSeed pins the generated sample, so that runs on different commits
+// measure the same input.
+const benchSeed = 20240101
+
+// benchChunks is the number of disjoint sub-trees BenchmarkChunked splits
+// the input into.
+const benchChunks = 16
+
+// benchConfig returns the config of a build of the benchmark input given
+// args as its flags.
+func benchConfig(b *testing.B, args ...string) *config {
+	b.Helper()
+	cfg := testConfig(b, args...)
+	cfg.csvFile = *benchInput
+	if cfg.csvFile == "" {
+		cfg.csvFile = filepath.Join(b.TempDir(), "sample.csv")
+		if err := writeBenchSample(cfg.csvFile, benchSampleRows); err != nil {
+			b.Fatalf("failed to write benchmark sample: %v", err)
+		}
+	}
+	return cfg
+}
+
+// BenchmarkParse reads and checks the rows of the input without
+// enrichment data or a tree.
+func BenchmarkParse(b *testing.B) {
+	cfg := benchConfig(b)
+	b.ReportAllocs()
+	var rows int
+	for b.Loop() {
+		var err error
+		if rows, err = parseBenchInput(cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(rows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// BenchmarkParseInsert reads the input into a new tree.
+func BenchmarkParseInsert(b *testing.B) {
+	cfg := benchConfig(b)
+	b.ReportAllocs()
+	var rows int
+	for b.Loop() {
+		writer, err := mmdbwriter.New(treeOptions(cfg))
+		if err != nil {
+			b.Fatal(err)
+		}
+		stats, err := processCSVFile(context.Background(), writer, cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rows = stats.rows
+	}
+	b.ReportMetric(float64(rows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// BenchmarkSerialize writes the tree of the input to nowhere.
+func BenchmarkSerialize(b *testing.B) {
+	cfg := benchConfig(b)
+	writer, err := mmdbwriter.New(treeOptions(cfg))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := processCSVFile(context.Background(), writer, cfg); err != nil {
+		b.Fatal(err)
+	}
+	size, err := writer.WriteTo(io.Discard)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(size)
+	for b.Loop() {
+		if _, err := writer.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFanOut serializes the built input at every record size, the jobs
+// of -size-report, on one goroutine and on -write-workers goroutines.
+func BenchmarkFanOut(b *testing.B) {
+	cfg := benchConfig(b)
+	writer, err := mmdbwriter.New(treeOptions(cfg))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := processCSVFile(context.Background(), writer, cfg); err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := writer.WriteTo(&buf); err != nil {
+		b.Fatal(err)
+	}
+	built, err := maxminddb.FromBytes(buf.Bytes())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	jobs := make([]outputJob, len(recordSizes))
+	for i, size := range recordSizes {
+		jobs[i] = outputJob{
+			name: fmt.Sprintf("record size %d", size),
+			run: func() error {
+				opts := treeOptionsFrom(built.Metadata)
+				opts.RecordSize = size
+				tree, _, err := copyDatabase(built, nil, opts)
+				if err != nil {
+					return err
+				}
+				_, err = tree.WriteTo(io.Discard)
+				return err
+			},
+		}
+	}
+	for _, bm := range []struct {
+		name    string
+		workers int
+	}{{"serial", 1}, {"parallel", cfg.writeWorkers}} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if err := runOutputJobs(jobs, bm.workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkChunked measures the alternative of building and serializing
+// disjoint sub-trees, one per group of first bytes, on -write-workers
+// goroutines. It is an upper bound: mmdbwriter numbers the nodes and
+// deduplicates the data of a whole tree as it writes it, so the sub-trees
+// cannot be joined into one database without inserting every network
+// again. Only separate files, as -shard-max-size writes, could be built
+// this way.
+func BenchmarkChunked(b *testing.B) {
+	cfg := benchConfig(b)
+	chunks, err := splitBenchInput(cfg.csvFile, b.TempDir(), benchChunks)
+	if err != nil {
+		b.Fatalf("failed to split benchmark input: %v", err)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		jobs := make([]outputJob, len(chunks))
+		for i, chunk := range chunks {
+			chunkCfg := *cfg
+			chunkCfg.csvFile = chunk
+			jobs[i] = outputJob{
+				name: chunk,
+				run: func() error {
+					tree, err := mmdbwriter.New(treeOptions(&chunkCfg))
+					if err != nil {
+						return err
+					}
+					if _, err := processCSVFile(context.Background(), tree, &chunkCfg); err != nil {
+						return err
+					}
+					_, err = tree.WriteTo(io.Discard)
+					return err
+				},
+			}
+		}
+		if err := runOutputJobs(jobs, cfg.writeWorkers); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// parseBenchInput reads the rows of the input through the row builder of
+// the build and drops them, returning how many there were.
+func parseBenchInput(cfg *config) (int, error) {
+	fh, err := os.Open(cfg.csvFile)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	dr, err := decompressInput(bufio.NewReaderSize(fh, cfg.readBuffer<<10))
+	if err != nil {
+		return 0, err
+	}
+	defer dr.Close()
+	r, header, err := newRowReader(cfg, dr)
+	if err != nil {
+		return 0, err
+	}
+	builder, err := newRowBuilder(cfg, header, nil, nil, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	stats := &buildStats{}
+	builder.initStats(stats)
+	rows := 0
+	_, err = buildRows(r, nil, builder, stats, cfg.workers, func(*builtRow) error {
+		rows++
+		return nil
+	})
+	return rows, err
+}
+
+// splitBenchInput splits a CSV input into n files in dir by the first
+// byte of each IPv4 network and the second of each IPv6 one, so that the
+// files cover disjoint address space.
+// Rows without a valid network go to the first file, where the build
+// rejects them as it would have anyway.
+func splitBenchInput(path, dir string, n int) ([]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	dr, err := decompressInput(fh)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	r := csv.NewReader(dr)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, n)
+	files := make([]*os.File, n)
+	writers := make([]*csv.Writer, n)
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i := range n {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("chunk-%02d.csv", i))
+		if files[i], err = os.Create(paths[i]); err != nil {
+			return nil, err
+		}
+		writers[i] = csv.NewWriter(files[i])
+		if err := writers[i].Write(header); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk := 0
+		if prefix, err := netip.ParsePrefix(columnValue(row, 0)); err == nil {
+			// Global unicast IPv6 space mostly shares its first byte.
+			b := prefix.Addr().AsSlice()
+			if len(b) == 16 {
+				b = b[1:]
+			}
+			chunk = int(b[0]) % n
+		}
+		if err := writers[chunk].Write(row); err != nil {
+			return nil, err
+		}
+	}
+	for i, w := range writers {
+		if w.Flush(); w.Error() != nil {
+			return nil, w.Error()
+		}
+		if err := files[i].Close(); err != nil {
+			return nil, err
+		}
+		files[i] = nil
+	}
+	return paths, nil
+}
+
+// writeBenchSample writes rows of network,asn,org in random order: IPv4
+// prefixes from /16 to /24 and IPv6 ones from /32 to /48, all outside the
+// reserved ranges, with the nesting and repeated organizations of a real
+// table.
+func writeBenchSample(path string, rows int) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	r := rand.New(rand.NewPCG(benchSeed, benchSeed))
+	w := bufio.NewWriter(fh)
+	fmt.Fprintln(w, "network,asn,org")
+	for range rows {
+		asn := 1 + r.IntN(400000)
+		org := fmt.Sprintf("\"Example Network %d, Inc.\"", asn%5000)
+		if r.IntN(5) == 0 {
+			bits := 32 + 4*r.IntN(5)
+			sub := r.IntN(1<<16) &^ (1<<(48-bits) - 1)
+			fmt.Fprintf(w, "2a%02x:%x:%x::/%d,%d,%s\n", r.IntN(16), r.IntN(1<<16), sub, bits, asn, org)
+			continue
+		}
+		first := 11 + r.IntN(89) // 11.0.0.0 to 99.255.255.255
+		bits := 16 + r.IntN(9)
+		addr := r.Uint32() & ^uint32(0xff000000) &^ (1<<(32-bits) - 1)
+		fmt.Fprintf(w, "%d.%d.%d.%d/%d,%d,%s\n", first, addr>>16&0xff, addr>>8&0xff, addr&0xff, bits, asn, org)
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// BMP message types (RFC 7854) and per-peer header flags read by the bmp
+// command.
+const (
+	bmpVersion         = 3
+	bmpRouteMonitoring = 0
+	bmpPeerDown        = 2
+	bmpTermination     = 5
+
+	bmpCommonHeaderLen  = 6
+	bmpPerPeerHeaderLen = 42
+	// bmpMaxMessage bounds the length a router can announce, so a broken
+	// stream cannot make the collector allocate without limit.
+	bmpMaxMessage = 1 << 20
+
+	bmpFlagIPv6       = 0x80
+	bmpFlagPostPolicy = 0x40
+	bmpFlagAS2        = 0x20
+)
+
+// bmpPeer identifies a monitored BGP session: the router reporting it, and
+// the peer as the per-peer header gives it. Pre-policy and post-policy
+// routes of one peer are kept apart.
+type bmpPeer struct {
+	router        string
+	distinguisher uint64
+	addr          netip.Addr
+	postPolicy    bool
+}
+
+// bmpState is the routing table the collector maintains: the origin each
+// peer has for each prefix.
+type bmpState struct {
+	mu     sync.Mutex
+	routes map[bmpPeer]map[netip.Prefix]string
+	// dirty is set when the routes changed since the last snapshot.
+	dirty bool
+}
+
+func (s *bmpState) update(peer bmpPeer, u bgpUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	routes := s.routes[peer]
+	for _, prefix := range u.withdrawn {
+		if _, ok := routes[prefix]; ok {
+			delete(routes, prefix)
+			s.dirty = true
+		}
+	}
+	if !u.hasOrigin || len(u.announced) == 0 {
+		return
+	}
+	if routes == nil {
+		routes = map[netip.Prefix]string{}
+		s.routes[peer] = routes
+	}
+	for _, prefix := range u.announced {
+		routes[prefix] = u.origin
+	}
+	s.dirty = true
+}
+
+// dropPeers forgets the routes of the peers match selects, after a Peer
+// Down message or when the session of their router ends.
+func (s *bmpState) dropPeers(match func(bmpPeer) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peer := range s.routes {
+		if match(peer) {
+			delete(s.routes, peer)
+			s.dirty = true
+		}
+	}
+}
+
+// bmpRoute is a prefix of a snapshot with the origin most peers see.
+type bmpRoute struct {
+	prefix netip.Prefix
+	origin string
+}
+
+// table returns the routes of a snapshot, less specific prefixes first, and
+// the number of peers, or nil when nothing changed since the last one. The
+// origin of a prefix is the one most peers have, the lowest ASN on a tie
+// and single ASNs before AS_SETs, as for the RIB entries of -format mrt.
+func (s *bmpState) table() ([]bmpRoute, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil, len(s.routes)
+	}
+	s.dirty = false
+
+	votes := map[netip.Prefix]map[string]int{}
+	for _, routes := range s.routes {
+		for prefix, origin := range routes {
+			if votes[prefix] == nil {
+				votes[prefix] = map[string]int{}
+			}
+			votes[prefix][origin]++
+		}
+	}
+	table := make([]bmpRoute, 0, len(votes))
+	for prefix, origins := range votes {
+		var best string
+		for origin, n := range origins {
+			if best == "" || n > origins[best] || (n == origins[best] && originLess(origin, best)) {
+				best = origin
+			}
+		}
+		table = append(table, bmpRoute{prefix, best})
+	}
+	// A later insert replaces the data of the networks it covers, so
+	// covering prefixes go first.
+	slices.SortFunc(table, func(a, b bmpRoute) int {
+		if c := cmp.Compare(a.prefix.Bits(), b.prefix.Bits()); c != 0 {
+			return c
+		}
+		return a.prefix.Addr().Compare(b.prefix.Addr())
+	})
+	return table, len(s.routes)
+}
+
+// runBMP implements `bmp [flags] <out.mmdb>`: an experimental collector
+// that accepts BMP sessions from routers, keeps the prefix to origin table
+// of their peers and writes it to the output every -interval, as a
+// self-hosted near-real-time alternative to the daily dump.
+func runBMP(args []string) error {
+	fs := flag.NewFlagSet("bmp", flag.ExitOnError)
+	listen := fs.String("listen", ":11019", "`address` to accept BMP sessions from routers on")
+	interval := fs.Duration("interval", time.Minute, "time between snapshots written to the output")
+	asnNames := fs.String("asn-names", "", "bgp.tools asns.csv `file` naming the origin ASNs")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bmp [flags] <out.mmdb>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("bmp needs an output file")
+	}
+	if *interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+	outFile := fs.Arg(0)
+
+	var names map[uint32]string
+	if *asnNames != "" {
+		var err error
+		if names, err = loadASNNames(*asnNames); err != nil {
+			return err
+		}
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen for BMP: %w", err)
+	}
+	defer ln.Close()
+	logger.Info("accepting BMP sessions", "address", ln.Addr().String(), "output", outFile, "interval", *interval)
+
+	state := &bmpState{routes: map[bmpPeer]map[netip.Prefix]string{}}
+	go func() {
+		for range time.Tick(*interval) {
+			if err := writeBMPSnapshot(state, names, outFile); err != nil {
+				logger.Error("snapshot failed", "error", err)
+			}
+		}
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept BMP session: %w", err)
+		}
+		go serveBMP(conn, state)
+	}
+}
+
+// writeBMPSnapshot writes the table of state to outFile, replacing it
+// atomically, unless it is unchanged since the last snapshot or empty.
+func writeBMPSnapshot(state *bmpState, names map[uint32]string, outFile string) (err error) {
+	table, peers := state.table()
+	if table == nil {
+		return nil
+	}
+	defer func() {
+		// Retry at the next interval even if nothing changes until then.
+		if err != nil {
+			state.mu.Lock()
+			state.dirty = true
+			state.mu.Unlock()
+		}
+	}()
+	// With every router gone, e.g. while they reconnect after a restart of
+	// the collector, an empty database would only hide the last good one.
+	if len(table) == 0 {
+		logger.Warn("no routes, keeping previous output", "output", outFile)
+		return nil
+	}
+	start := time.Now()
+	b, err := mmdbbuild.New()
+	if err != nil {
+		return err
+	}
+	skipped := 0
+	for _, route := range table {
+		asn, set, err := parseOrigin(route.origin)
+		if err != nil {
+			skipped++
+			continue
+		}
+		var record mmdbbuild.Record
+		if set != nil {
+			record.ASNs = set
+		} else {
+			record.ASN, record.Organization = uint32(asn), names[uint32(asn)]
+		}
+		if err := b.AddPrefix(route.prefix, record); err != nil {
+			if errors.Is(err, mmdbbuild.ErrUnsupportedNetwork) {
+				skipped++
+				continue
+			}
+			return err
+		}
+	}
+	size := func() int64 {
+		n, _ := b.WriteTo(io.Discard)
+		return n
+	}
+	if err := writeOutput(context.Background(), outFile, b, size); err != nil {
+		return err
+	}
+	logger.Info("snapshot written", "output", outFile, "peers", peers, "prefixes", len(table)-skipped,
+		"skipped", skipped, "seconds", time.Since(start).Seconds())
+	return nil
+}
+
+// serveBMP reads the messages of one router until its session ends, and
+// then drops the routes of its peers, which are no longer monitored.
+func serveBMP(conn net.Conn, state *bmpState) {
+	router := conn.RemoteAddr().String()
+	defer conn.Close()
+	defer state.dropPeers(func(peer bmpPeer) bool { return peer.router == router })
+	logger.Info("BMP session opened", "router", router)
+
+	r := bufio.NewReader(conn)
+	header := make([]byte, bmpCommonHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Warn("BMP session failed", "router", router, "error", err)
+			}
+			logger.Info("BMP session closed", "router", router)
+			return
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		if header[0] != bmpVersion || length < bmpCommonHeaderLen || length > bmpMaxMessage {
+			logger.Warn("closing BMP session with invalid message header", "router", router,
+				"version", header[0], "length", length)
+			return
+		}
+		body := make([]byte, length-bmpCommonHeaderLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			logger.Warn("BMP session failed", "router", router, "error", err)
+			return
+		}
+		switch header[5] {
+		case bmpTermination:
+			logger.Info("BMP session terminated by router", "router", router)
+			return
+		case bmpRouteMonitoring, bmpPeerDown:
+			if err := handleBMPMessage(router, header[5], body, state); err != nil {
+				logger.Warn("skipping invalid BMP message", "router", router, "type", header[5], "error", err)
+			}
+		}
+		// Initiation, Peer Up, Statistics Report and Route Mirroring
+		// messages carry nothing the table needs.
+	}
+}
+
+// handleBMPMessage applies a Route Monitoring or Peer Down message to the
+// table.
+func handleBMPMessage(router string, typ byte, body []byte, state *bmpState) error {
+	if len(body) < bmpPerPeerHeaderLen {
+		return errMRTShort
+	}
+	// peer type, flags, distinguisher, address, AS, BGP ID, timestamp
+	flags := body[1]
+	peer := bmpPeer{
+		router:        router,
+		distinguisher: binary.BigEndian.Uint64(body[2:]),
+		postPolicy:    flags&bmpFlagPostPolicy != 0,
+	}
+	if flags&bmpFlagIPv6 != 0 {
+		peer.addr = netip.AddrFrom16([16]byte(body[10:26]))
+	} else {
+		peer.addr = netip.AddrFrom4([4]byte(body[22:26]))
+	}
+	if typ == bmpPeerDown {
+		state.dropPeers(func(p bmpPeer) bool {
+			return p.router == peer.router && p.distinguisher == peer.distinguisher && p.addr == peer.addr
+		})
+		return nil
+	}
+
+	msg := body[bmpPerPeerHeaderLen:]
+	// marker, length, type
+	if len(msg) < 19 {
+		return errMRTShort
+	}
+	if msg[18] != bgpMessageUpdate {
+		return nil
+	}
+	asSize := 4
+	if flags&bmpFlagAS2 != 0 {
+		asSize = 2
+	}
+	// Whether the session negotiated ADD-PATH is only known from the OPEN
+	// messages of Peer Up, which are not decoded; such sessions are not
+	// supported.
+	u, err := parseBGPUpdate(msg[19:], asSize, false)
+	if err != nil {
+		return err
+	}
+	state.update(peer, u)
+	return nil
+}
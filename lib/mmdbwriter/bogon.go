@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/inserter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// asnRange is an inclusive range of ASNs sharing an IANA designation.
+type asnRange struct {
+	first, last uint32
+	label       string
+}
+
+// bogonASNs lists the ASN ranges IANA has not made available for public
+// allocation. ASN 0 is left out as it has its own handling.
+var bogonASNs = []asnRange{
+	{23456, 23456, "AS_TRANS"},
+	{64496, 64511, "Documentation ASN"},
+	{64512, 65534, "Private ASN"},
+	{65535, 65535, "Reserved ASN"},
+	{65536, 65551, "Documentation ASN"},
+	{65552, 131071, "Reserved ASN"},
+	{4200000000, 4294967294, "Private ASN"},
+	{4294967295, 4294967295, "Reserved ASN"},
+}
+
+// bogonLabel returns the descriptive label for asn when it falls in a
+// bogon range.
+func bogonLabel(asn uint32) (string, bool) {
+	for _, r := range bogonASNs {
+		if asn >= r.first && asn <= r.last {
+			return r.label, true
+		}
+	}
+	return "", false
+}
+
+// bogonNetwork is a special-purpose range with the bogon_type it is tagged
+// with.
+type bogonNetwork struct {
+	network string
+	kind    string
+}
+
+// bogonNetworks are the ranges mmdbwriter reserves by default, from the
+// IANA special-purpose registries. ::ffff:0:0/96, 64:ff9b::/96 and
+// 2002::/16 are aliases of the IPv4 tree and pick up its tags.
+var bogonNetworks = []bogonNetwork{
+	{"0.0.0.0/8", "this-network"},
+	{"10.0.0.0/8", "private"},
+	{"100.64.0.0/10", "shared"},
+	{"127.0.0.0/8", "loopback"},
+	{"169.254.0.0/16", "link-local"},
+	{"172.16.0.0/12", "private"},
+	{"192.0.0.0/29", "ietf-protocol"},
+	{"192.0.2.0/24", "documentation"},
+	{"192.88.99.0/24", "6to4-relay"},
+	{"192.168.0.0/16", "private"},
+	{"198.18.0.0/15", "benchmarking"},
+	{"198.51.100.0/24", "documentation"},
+	{"203.0.113.0/24", "documentation"},
+	{"224.0.0.0/4", "multicast"},
+	{"240.0.0.0/4", "reserved"},
+	{"100::/64", "discard"},
+	// 2001::/23 except Teredo at 2001::/32, which is routable.
+	{"2001:1::/32", "ietf-protocol"},
+	{"2001:2::/31", "ietf-protocol"},
+	{"2001:4::/30", "ietf-protocol"},
+	{"2001:8::/29", "ietf-protocol"},
+	{"2001:10::/28", "ietf-protocol"},
+	{"2001:20::/27", "ietf-protocol"},
+	{"2001:40::/26", "ietf-protocol"},
+	{"2001:80::/25", "ietf-protocol"},
+	{"2001:100::/24", "ietf-protocol"},
+	{"2001:db8::/32", "documentation"},
+	{"fc00::/7", "unique-local"},
+	{"fe80::/10", "link-local"},
+	{"ff00::/8", "multicast"},
+}
+
+// tagBogonNetworks stores is_bogon and bogon_type for every bogon network.
+// Rows already inserted inside a bogon network keep their data and gain
+// the two fields; the rest of the range gets a record of its own. Bogon
+// networks of a family the build leaves out are skipped.
+func tagBogonNetworks(writer *mmdbwriter.Tree, cfg *config) error {
+	for _, b := range bogonNetworks {
+		prefix := netip.MustParsePrefix(b.network)
+		if excludesFamily(cfg, prefix) {
+			continue
+		}
+		tag := mmdbbuild.Record{IsBogon: true, Fields: map[string]mmdbtype.DataType{"bogon_type": mmdbtype.String(b.kind)}}
+		if err := writer.InsertFunc(prefixNetwork(prefix), inserter.TopLevelMergeWith(tag.Map())); err != nil {
+			return fmt.Errorf("failed to tag bogon network %s: %w", b.network, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// cancelOnSignal returns a context that the first SIGINT or SIGTERM
+// cancels, with the signal as its cause. The build then stops at the next
+// read or write, removes its temporary files and exits through the usual
+// error path; a second signal kills the process at once.
+func cancelOnSignal() context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		logger.Warn("signal received, cancelling; send it again to exit immediately", "signal", sig.String())
+		cancel(fmt.Errorf("interrupted by %s", sig))
+	}()
+	return ctx
+}
+
+// contextReader fails reads once ctx is done. A read blocked on an idle
+// pipe returns with the next data; nothing is written while reading, so
+// there is nothing to clean up before that.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	return r.r.Read(p)
+}
+
+// contextWriter fails writes once ctx is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if w.ctx.Err() != nil {
+		return 0, context.Cause(w.ctx)
+	}
+	return w.w.Write(p)
+}
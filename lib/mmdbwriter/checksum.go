@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Signature methods accepted by -sign-method. age only encrypts, so it has
+// no place here; minisign covers the same "small modern key" use.
+const (
+	signMinisign = "minisign"
+	signGPG      = "gpg"
+	signEd25519  = "ed25519"
+)
+
+// checksumSuffix is appended to the output file name for the sidecar.
+const checksumSuffix = ".sha256"
+
+// signatureSuffixes are appended to the sidecar name for its signature.
+var signatureSuffixes = map[string]string{
+	signMinisign: ".minisig",
+	signGPG:      ".asc",
+	signEd25519:  ".sig",
+}
+
+// validateChecksum checks -checksum, -sign-key and -sign-method. The
+// sidecar describes one output file, and the signature covers the sidecar.
+func validateChecksum(cfg *config) error {
+	if _, ok := signatureSuffixes[cfg.signMethod]; !ok {
+		return fmt.Errorf("unknown -sign-method %q (want %s, %s or %s)", cfg.signMethod, signMinisign, signGPG, signEd25519)
+	}
+	if cfg.signKey == "" {
+		return nil
+	}
+	switch {
+	case !cfg.checksum:
+		return errors.New("-sign-key signs the .sha256 sidecar and cannot be used with -checksum=false")
+	case cfg.outputFile == stdioPath:
+		return errors.New("-sign-key cannot be used when writing to stdout")
+	case cfg.shardMaxSize > 0:
+		return errors.New("-sign-key cannot be used with -shard-max-size")
+	}
+	if cfg.signMethod == signEd25519 {
+		if _, err := readEd25519PrivateKey(cfg.signKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputSidecars returns the files written next to the output: the
+// checksum and its signature, and the manifest, when enabled.
+func outputSidecars(cfg *config) []string {
+	var sidecars []string
+	if cfg.checksum {
+		sidecars = append(sidecars, cfg.outputFile+checksumSuffix)
+		if cfg.signKey != "" {
+			sidecars = append(sidecars, cfg.outputFile+checksumSuffix+signatureSuffixes[cfg.signMethod])
+		}
+	}
+	if cfg.manifest {
+		sidecars = append(sidecars, cfg.outputFile+manifestSuffix)
+	}
+	return sidecars
+}
+
+// writeOutputChecksum writes the .sha256 sidecar of the output file in the
+// format of sha256sum, then signs it with -sign-key. Both are replaced
+// atomically so that readers never see a checksum of another build.
+func writeOutputChecksum(cfg *config) error {
+	if !cfg.checksum {
+		return nil
+	}
+	sum, err := fileSHA256(cfg.outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to checksum output: %w", err)
+	}
+	sidecar := cfg.outputFile + checksumSuffix
+	line := hex.EncodeToString(sum) + "  " + filepath.Base(cfg.outputFile) + "\n"
+	if err := writeFileAtomic(sidecar, []byte(line)); err != nil {
+		return fmt.Errorf("failed to write checksum file: %w", err)
+	}
+	logger.Info("checksum written", "file", sidecar, "sha256", hex.EncodeToString(sum))
+
+	if cfg.signKey == "" {
+		return nil
+	}
+	signature := sidecar + signatureSuffixes[cfg.signMethod]
+	if err := signFile(cfg.signMethod, cfg.signKey, sidecar, signature); err != nil {
+		return fmt.Errorf("failed to sign %s with %s: %w", sidecar, cfg.signMethod, err)
+	}
+	logger.Info("signature written", "file", signature, "method", cfg.signMethod)
+	return nil
+}
+
+func fileSHA256(path string) ([]byte, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path.
+func writeFileAtomic(path string, data []byte) error {
+	fh, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(fh.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), path)
+}
+
+// signFile writes a detached signature of path to signature. minisign and
+// gpg are run as commands with the terminal attached, so a key passphrase
+// can be entered; key is a minisign secret key file or a gpg key ID. An
+// ed25519 key is a PKCS#8 PEM file, e.g. from
+// `openssl genpkey -algorithm ed25519`, and the signature is base64.
+func signFile(method, key, path, signature string) error {
+	tmp := signature + ".tmp"
+	defer os.Remove(tmp)
+
+	switch method {
+	case signEd25519:
+		priv, err := readEd25519PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)) + "\n"
+		if err := os.WriteFile(tmp, []byte(sig), 0644); err != nil {
+			return err
+		}
+	case signMinisign:
+		if err := runSigner("minisign", "-S", "-s", key, "-m", path, "-x", tmp); err != nil {
+			return err
+		}
+	case signGPG:
+		if err := runSigner("gpg", "--batch", "--yes", "--local-user", key, "--armor", "--detach-sign",
+			"--output", tmp, path); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, signature)
+}
+
+func runSigner(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func readEd25519PrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEMFile(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ed25519 key %s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key %s is a %T, not an ed25519 key", path, key)
+	}
+	return priv, nil
+}
+
+func readEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEMFile(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ed25519 public key %s: %w", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key %s is a %T, not an ed25519 key", path, key)
+	}
+	return pub, nil
+}
+
+func readPEMFile(path, blockType string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("key %s is not a PEM %s", path, blockType)
+	}
+	return block, nil
+}
+
+// runVerifySignature implements `verify-signature [flags] <db.mmdb>`: it
+// checks the signature of the .sha256 sidecar of the database, then that
+// the database matches the checksum in it.
+func runVerifySignature(args []string) error {
+	fs := flag.NewFlagSet("verify-signature", flag.ExitOnError)
+	method := fs.String("method", "",
+		"signature method: minisign, gpg or ed25519 (default from the signature file next to the sidecar)")
+	key := fs.String("key", "",
+		"public key `file`: a minisign public key, an ed25519 PEM public key or a gpg keyring (default: the gpg keyring of the user)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify-signature [flags] <db.mmdb>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("verify-signature needs a database")
+	}
+	dbFile := fs.Arg(0)
+	sidecar := dbFile + checksumSuffix
+
+	if *method == "" {
+		for _, m := range []string{signMinisign, signGPG, signEd25519} {
+			if _, err := os.Stat(sidecar + signatureSuffixes[m]); err == nil {
+				*method = m
+				break
+			}
+		}
+		if *method == "" {
+			return fmt.Errorf("no signature found for %s", sidecar)
+		}
+	}
+	suffix, ok := signatureSuffixes[*method]
+	if !ok {
+		return fmt.Errorf("unknown -method %q (want %s, %s or %s)", *method, signMinisign, signGPG, signEd25519)
+	}
+	if *key == "" && *method != signGPG {
+		return fmt.Errorf("-key is required for %s signatures", *method)
+	}
+	signature := sidecar + suffix
+
+	if err := verifySignature(*method, *key, sidecar, signature); err != nil {
+		return fmt.Errorf("bad signature %s: %w", signature, err)
+	}
+
+	data, err := os.ReadFile(sidecar)
+	if err != nil {
+		return fmt.Errorf("failed to read checksum file: %w", err)
+	}
+	want, _, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	sum, err := fileSHA256(dbFile)
+	if err != nil {
+		return fmt.Errorf("failed to checksum database: %w", err)
+	}
+	if got := hex.EncodeToString(sum); !strings.EqualFold(got, want) {
+		return fmt.Errorf("checksum mismatch for %s: %s has %s, file is %s", dbFile, sidecar, want, got)
+	}
+
+	fmt.Printf("OK: %s matches %s, signed (%s) %s\n", dbFile, sidecar, *method, signature)
+	return nil
+}
+
+// verifySignature checks a detached signature of path made by signFile.
+func verifySignature(method, key, path, signature string) error {
+	switch method {
+	case signEd25519:
+		pub, err := readEd25519PublicKey(key)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		encoded, err := os.ReadFile(signature)
+		if err != nil {
+			return err
+		}
+		sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+		if err != nil {
+			return fmt.Errorf("invalid signature encoding: %w", err)
+		}
+		if !ed25519.Verify(pub, data, sig) {
+			return errors.New("signature does not match")
+		}
+		return nil
+	case signMinisign:
+		return runVerifier("minisign", "-V", "-p", key, "-m", path, "-x", signature)
+	case signGPG:
+		if key == "" {
+			return runVerifier("gpg", "--batch", "--verify", signature, path)
+		}
+		// gpgv looks up relative keyring names in its home directory.
+		keyring, err := filepath.Abs(key)
+		if err != nil {
+			return err
+		}
+		return runVerifier("gpgv", "--keyring", keyring, signature, path)
+	}
+	return nil
+}
+
+func runVerifier(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil && len(bytes.TrimSpace(out)) > 0 {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
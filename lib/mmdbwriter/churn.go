@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// churnReport summarizes how a freshly built database differs from the
+// previous (base) build.
+type churnReport struct {
+	baseNetworks int
+	added        int
+	removed      int
+	changed      int
+}
+
+// compareWithBase walks both databases. A base network is removed when the
+// new build has no data anywhere in it, changed when any part of it now
+// resolves to a different record, and a new network is added when the base
+// had no data for it.
+func compareWithBase(base, current *maxminddb.Reader) (churnReport, error) {
+	var report churnReport
+
+	err := walkDatabase(base, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+		report.baseNetworks++
+
+		covering, currentRecord, err := lookupRecord(current, network.IP)
+		if err != nil {
+			return err
+		}
+		baseLen, _ := network.Mask.Size()
+		currentLen, _ := covering.Mask.Size()
+		if currentLen <= baseLen {
+			// A single record of the new build covers the whole network.
+			switch {
+			case currentRecord == nil:
+				report.removed++
+			case !recordsEqual(record, currentRecord):
+				report.changed++
+			}
+			return nil
+		}
+
+		// The new build split the network; inspect every part of it.
+		found, differs := false, false
+		err = walkDatabase(current, network, func(_ *net.IPNet, currentRecord mmdbtype.DataType) error {
+			found = true
+			if !recordsEqual(record, currentRecord) {
+				differs = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		switch {
+		case !found:
+			report.removed++
+		case differs:
+			report.changed++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to walk base database: %w", err)
+	}
+
+	err = walkDatabase(current, nil, func(network *net.IPNet, _ mmdbtype.DataType) error {
+		_, baseRecord, err := lookupRecord(base, network.IP)
+		if err != nil {
+			return err
+		}
+		if baseRecord == nil {
+			report.added++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to walk new database: %w", err)
+	}
+
+	return report, nil
+}
+
+// churnPercent is the share of base networks that were changed or removed.
+func (r churnReport) churnPercent() float64 {
+	if r.baseNetworks == 0 {
+		return 0
+	}
+	return float64(r.changed+r.removed) * 100 / float64(r.baseNetworks)
+}
+
+// dominant names the category with the most networks.
+func (r churnReport) dominant() string {
+	switch {
+	case r.added == 0 && r.removed == 0 && r.changed == 0:
+		return "none"
+	case r.removed >= r.changed && r.removed >= r.added:
+		return "removed"
+	case r.changed >= r.added:
+		return "changed"
+	default:
+		return "added"
+	}
+}
+
+func (r churnReport) print() {
+	logger.Info("churn versus base",
+		"base_networks", r.baseNetworks, "added", r.added, "removed", r.removed, "changed", r.changed,
+		"churn_percent", fmt.Sprintf("%.2f", r.churnPercent()), "dominated_by", r.dominant())
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompareWithBase(t *testing.T) {
+	const base = "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,15169\n9.9.9.0/24,19281\n"
+	tests := []struct {
+		name         string
+		current      string
+		want         churnReport
+		wantPercent  float64
+		wantDominant string
+	}{
+		{
+			name:         "unchanged",
+			current:      base,
+			want:         churnReport{baseNetworks: 3},
+			wantDominant: "none",
+		},
+		{
+			name:         "changed origin",
+			current:      "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,64500\n9.9.9.0/24,19281\n",
+			want:         churnReport{baseNetworks: 3, changed: 1},
+			wantPercent:  100.0 / 3,
+			wantDominant: "changed",
+		},
+		{
+			name:         "removed and added",
+			current:      "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,15169\n5.5.5.0/24,64500\n6.6.6.0/24,64501\n",
+			want:         churnReport{baseNetworks: 3, removed: 1, added: 2},
+			wantPercent:  100.0 / 3,
+			wantDominant: "added",
+		},
+		{
+			name:         "split network",
+			current:      "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,15169\n9.9.9.0/24,19281\n9.9.9.128/25,42\n",
+			want:         churnReport{baseNetworks: 3, changed: 1},
+			wantPercent:  100.0 / 3,
+			wantDominant: "changed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseDB, _ := buildTestDB(t, testConfig(t), base)
+			currentDB, _ := buildTestDB(t, testConfig(t), tt.current)
+			got, err := compareWithBase(baseDB, currentDB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if p := got.churnPercent(); p != tt.wantPercent {
+				t.Errorf("got churn %.2f%%, want %.2f%%", p, tt.wantPercent)
+			}
+			if d := got.dominant(); d != tt.wantDominant {
+				t.Errorf("got dominant %q, want %q", d, tt.wantDominant)
+			}
+		})
+	}
+}
+
+// -max-churn-percent refuses a build that changed too much of the base and
+// leaves the previous output, the base itself here, in place.
+func TestMaxChurnPercent(t *testing.T) {
+	const base = "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,15169\n9.9.9.0/24,19281\n"
+	tests := []struct {
+		name    string
+		current string
+		wantErr string
+	}{
+		{"within limit", "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,64500\n9.9.9.0/24,19281\n", ""},
+		{"over limit", "network,asn\n1.1.1.0/24,64500\n8.8.8.0/24,64501\n9.9.9.0/24,19281\n", "exceeds -max-churn-percent 50.00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "asn.mmdb")
+			cfg := testConfig(t)
+			cfg.csvFile = writeTestFile(t, "base.csv", base)
+			cfg.outputFile = output
+			if err := build(context.Background(), cfg, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			previous, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg = testConfig(t, "-compare-base", output, "-max-churn-percent", "50")
+			cfg.csvFile = writeTestFile(t, "current.csv", tt.current)
+			cfg.outputFile = output
+			err = build(context.Background(), cfg, io.Discard)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := bytes.Equal(got, previous); kept != (tt.wantErr != "") {
+				t.Errorf("previous output kept: %v", kept)
+			}
+			// Nor is a temporary file left behind.
+			if tmp, _ := filepath.Glob(filepath.Join(filepath.Dir(output), ".*")); len(tmp) > 0 {
+				t.Errorf("got temporary files %v", tmp)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// prefixNode is a prefix of -collapse-prefixes in the forest of the rows
+// ordered by containment. winner is the row whose record the prefix ends up
+// with; row is the row of the prefix itself, nil for merged prefixes.
+type prefixNode struct {
+	prefix   netip.Prefix
+	seq      int
+	row      *builtRow
+	winner   *builtRow
+	file     string
+	children []*prefixNode
+}
+
+// collapsedRow is a row to insert after collapsing, with the input it was
+// read from for -rejects.
+type collapsedRow struct {
+	row  *builtRow
+	file string
+}
+
+// prefixCollapser buffers the rows of a build and collapses them before
+// they are inserted: prefixes whose record is already given by a covering
+// prefix are dropped, and sibling prefixes with identical records are
+// merged into their parent prefix, e.g. two /25s of one ASN into a /24.
+// The lookup result of every address is the same as inserting the rows one
+// by one with -merge-strategy replace.
+type prefixCollapser struct {
+	v6   bool
+	rows []*prefixNode
+}
+
+// newPrefixCollapser returns a collapser for a tree of the given IP
+// version, where 0 is the IPv6 default of mmdbwriter.
+func newPrefixCollapser(ipVersion int) *prefixCollapser {
+	return &prefixCollapser{v6: ipVersion != 4}
+}
+
+// treePrefix returns the prefix a network has in the search tree. An IPv6
+// tree stores IPv4 networks at ::a.b.c.d, so that they nest under IPv6
+// networks covering that space.
+func treePrefix(p netip.Prefix, v6 bool) netip.Prefix {
+	addr, ones := p.Addr(), p.Bits()
+	if v6 && addr.Is4() {
+		b := addr.As16()
+		b[10], b[11] = 0, 0 // ::a.b.c.d, not ::ffff:a.b.c.d
+		addr = netip.AddrFrom16(b)
+		ones += 96
+	}
+	return netip.PrefixFrom(addr, ones)
+}
+
+// untreePrefix is the inverse of treePrefix: prefixes within ::/96 of an
+// IPv6 tree are IPv4 networks.
+func untreePrefix(p netip.Prefix, v6 bool) netip.Prefix {
+	addr, bits := p.Addr(), p.Bits()
+	if v6 && bits >= 96 {
+		if b := addr.As16(); [12]byte(b[:12]) == [12]byte{} {
+			return netip.PrefixFrom(netip.AddrFrom4([4]byte(b[12:])), bits-96)
+		}
+	}
+	return p
+}
+
+func (c *prefixCollapser) add(row *builtRow, file string) {
+	c.rows = append(c.rows, &prefixNode{
+		prefix: treePrefix(row.prefix, c.v6),
+		seq:    len(c.rows),
+		row:    row,
+		winner: row,
+		file:   file,
+	})
+}
+
+// collapse returns the rows to insert, in order, and how many rows were
+// collapsed away.
+func (c *prefixCollapser) collapse() ([]collapsedRow, int) {
+	// A later row with the same prefix replaces the earlier one entirely.
+	last := make(map[netip.Prefix]*prefixNode, len(c.rows))
+	for _, n := range c.rows {
+		last[n.prefix] = n
+	}
+	nodes := make([]*prefixNode, 0, len(last))
+	for _, n := range last {
+		nodes = append(nodes, n)
+	}
+	slices.SortFunc(nodes, func(a, b *prefixNode) int {
+		if cmp := a.prefix.Addr().Compare(b.prefix.Addr()); cmp != 0 {
+			return cmp
+		}
+		return a.prefix.Bits() - b.prefix.Bits()
+	})
+
+	// CIDR prefixes either nest or are disjoint, so sorted by address and
+	// length the enclosing prefixes of a node are on the stack.
+	var roots, stack []*prefixNode
+	for _, n := range nodes {
+		for len(stack) > 0 && !stack[len(stack)-1].prefix.Contains(n.prefix.Addr()) {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			roots = append(roots, n)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, n)
+		}
+		stack = append(stack, n)
+	}
+
+	for _, root := range roots {
+		resolveWinners(root, nil)
+	}
+	roots = normalizeGroup(nil, roots)
+
+	var out []collapsedRow
+	var emit func(nodes []*prefixNode)
+	emit = func(nodes []*prefixNode) {
+		slices.SortFunc(nodes, func(a, b *prefixNode) int {
+			return a.prefix.Addr().Compare(b.prefix.Addr())
+		})
+		for _, n := range nodes {
+			out = append(out, c.outputRow(n))
+			emit(n.children)
+		}
+	}
+	emit(roots)
+	return out, len(c.rows) - len(out)
+}
+
+// resolveWinners gives every node the row that wins its address space: of
+// all rows containing an address, the last one inserted.
+func resolveWinners(n *prefixNode, inherited *prefixNode) {
+	if inherited != nil && inherited.seq > n.seq {
+		n.winner, n.seq, n.file = inherited.winner, inherited.seq, inherited.file
+	}
+	for _, child := range n.children {
+		resolveWinners(child, n)
+	}
+}
+
+func sameRecord(a, b *prefixNode) bool {
+	return a.winner == b.winner || a.winner.record.Equal(b.winner.record)
+}
+
+// normalizeGroup collapses the children of parent (the roots when parent
+// is nil), bottom-up: children with the record of their parent are dropped
+// in favor of their own children, and siblings with identical records are
+// merged. When a merge yields the parent prefix itself, the parent takes
+// over the record and the group is checked again.
+func normalizeGroup(parent *prefixNode, children []*prefixNode) []*prefixNode {
+	for _, child := range children {
+		child.children = normalizeGroup(child, child.children)
+	}
+
+	queue := children
+	for {
+		byPrefix := make(map[netip.Prefix]*prefixNode, len(queue))
+		absorbed := false
+		for len(queue) > 0 {
+			n := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+
+			if parent != nil && sameRecord(n, parent) {
+				queue = append(queue, n.children...)
+				continue
+			}
+			if n.prefix.Bits() > 0 {
+				super := netip.PrefixFrom(n.prefix.Addr(), n.prefix.Bits()-1).Masked()
+				sibling := siblingPrefix(n.prefix)
+				if s, ok := byPrefix[sibling]; ok && sameRecord(s, n) {
+					delete(byPrefix, sibling)
+					merged := append(s.children, n.children...)
+					if parent != nil && super == parent.prefix {
+						parent.winner, parent.file = n.winner, n.file
+						absorbed = true
+						queue = append(queue, merged...)
+						continue
+					}
+					queue = append(queue, &prefixNode{prefix: super, winner: n.winner, file: n.file, children: merged})
+					continue
+				}
+			}
+			byPrefix[n.prefix] = n
+		}
+
+		group := make([]*prefixNode, 0, len(byPrefix))
+		for _, n := range byPrefix {
+			group = append(group, n)
+		}
+		if !absorbed {
+			return group
+		}
+		queue = group
+	}
+}
+
+// siblingPrefix returns the other half of the parent prefix of p.
+func siblingPrefix(p netip.Prefix) netip.Prefix {
+	b := p.Addr().AsSlice()
+	bit := p.Bits() - 1
+	b[bit/8] ^= 0x80 >> (bit % 8)
+	addr, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(addr, p.Bits())
+}
+
+// outputRow returns the row to insert for a node: the winning row with the
+// network of the node. Unchanged prefixes keep the network as written in
+// the input; merged ones within ::/96 of an IPv6 tree are written as IPv4.
+func (c *prefixCollapser) outputRow(n *prefixNode) collapsedRow {
+	out := *n.winner
+	if n.row != nil {
+		out.network, out.prefix = n.row.network, n.row.prefix
+		return collapsedRow{&out, n.file}
+	}
+
+	out.prefix = untreePrefix(n.prefix, c.v6)
+	out.network = out.prefix.String()
+	return collapsedRow{&out, n.file}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// Column types accepted by -column-type.
+const (
+	// columnTypeJSON parses the column as a JSON object and merges its
+	// keys into the record.
+	columnTypeJSON = "json"
+)
+
+// columnTypes maps 1-based column numbers to column types. It implements
+// flag.Value for the repeatable -column-type N=type flag.
+type columnTypes map[int]string
+
+// columns returns the mapped column numbers in ascending order.
+func (c columnTypes) columns() []int {
+	cols := make([]int, 0, len(c))
+	for col := range c {
+		cols = append(cols, col)
+	}
+	sort.Ints(cols)
+	return cols
+}
+
+func (c columnTypes) String() string {
+	parts := make([]string, 0, len(c))
+	for _, col := range c.columns() {
+		parts = append(parts, fmt.Sprintf("%d=%s", col, c[col]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (c columnTypes) Set(value string) error {
+	colStr, typ, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected N=type, got %q", value)
+	}
+	col, err := strconv.Atoi(strings.TrimSpace(colStr))
+	if err != nil || col < 1 {
+		return fmt.Errorf("invalid column number %q", colStr)
+	}
+
+	typ = strings.TrimSpace(typ)
+	switch typ {
+	case columnTypeJSON:
+	default:
+		return fmt.Errorf("unknown column type %q", typ)
+	}
+	c[col] = typ
+	return nil
+}
+
+// columnMap implements flag.Value for -columns, e.g.
+// "network=1,asn=3,org=5": the 1-based positions of the network, ASN and
+// organization columns. Zero leaves a column to header detection.
+type columnMap struct {
+	network, asn, org int
+}
+
+func (m *columnMap) String() string {
+	var parts []string
+	for _, c := range []struct {
+		name string
+		col  int
+	}{{"network", m.network}, {"asn", m.asn}, {"org", m.org}} {
+		if c.col > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", c.name, c.col))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *columnMap) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		name, colStr, ok := strings.Cut(strings.TrimSpace(part), "=")
+		col, err := strconv.Atoi(strings.TrimSpace(colStr))
+		if !ok || err != nil || col < 1 {
+			return fmt.Errorf("expected network=N, asn=N or org=N with a 1-based column, got %q", part)
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "network":
+			m.network = col
+		case "asn":
+			m.asn = col
+		case "org":
+			m.org = col
+		default:
+			return fmt.Errorf("unknown column %q, want network, asn or org", name)
+		}
+	}
+	return nil
+}
+
+// inputColumns returns the 0-based positions of the network, ASN and
+// organization columns with mmdbbuild.CSVColumns.Find, which AddCSV of the
+// library shares: those of m, else the first header column named like
+// one, else the first, second and third column. named reports whether the
+// organization column was mapped or named rather than assumed.
+func inputColumns(m columnMap, header []string) (network, asn, org int, named bool) {
+	return mmdbbuild.CSVColumns{Network: m.network, ASN: m.asn, Org: m.org}.Find(header)
+}
+
+// jsonColumnFields decodes a JSON object column into mmdbtype values. Null
+// members are dropped.
+func jsonColumnFields(value string) (mmdbtype.Map, error) {
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, errors.New("expected a JSON object")
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("unexpected data after JSON object")
+	}
+
+	v, err := jsonToMMDBType(obj)
+	if err != nil {
+		return nil, err
+	}
+	return v.(mmdbtype.Map), nil
+}
+
+// jsonToMMDBType infers an mmdbtype for a decoded JSON value. Integers
+// become the smallest unsigned type that holds them (or Int32 when
+// negative) and other numbers become Float64.
+func jsonToMMDBType(v any) (mmdbtype.DataType, error) {
+	switch v := v.(type) {
+	case string:
+		return mmdbtype.String(v), nil
+	case bool:
+		return mmdbtype.Bool(v), nil
+	case json.Number:
+		return jsonNumberToMMDBType(v)
+	case map[string]any:
+		m := make(mmdbtype.Map, len(v))
+		for key, item := range v {
+			if item == nil {
+				continue
+			}
+			mv, err := jsonToMMDBType(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			m[mmdbtype.String(key)] = mv
+		}
+		return m, nil
+	case []any:
+		s := make(mmdbtype.Slice, 0, len(v))
+		for _, item := range v {
+			if item == nil {
+				continue
+			}
+			sv, err := jsonToMMDBType(item)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, sv)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported JSON value %T", v)
+}
+
+func jsonNumberToMMDBType(n json.Number) (mmdbtype.DataType, error) {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			if u <= math.MaxUint32 {
+				return mmdbtype.Uint32(u), nil
+			}
+			return mmdbtype.Uint64(u), nil
+		}
+		if i, err := strconv.ParseInt(s, 10, 32); err == nil {
+			return mmdbtype.Int32(i), nil
+		}
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, err
+	}
+	return mmdbtype.Float64(f), nil
+}
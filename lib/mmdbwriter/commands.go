@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// subcommand is a command run as `mmdbwriter <name> ...` instead of a build.
+type subcommand struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+// subcommands are dispatched on the first argument. A build is the default
+// and is also available as `build`, alongside help and completion, which
+// main handles itself because they need the build flags.
+var subcommands = []subcommand{
+	{"extract", "<in.mmdb> <prefix> <out.mmdb>", runExtract},
+	{"export", "[flags] <db.mmdb> [out]", runExport},
+	{"verify", "[flags] <db.mmdb> [source.csv]", runVerify},
+	{"validate-input", "[flags] <input.csv|input.jsonl>", runValidateInput},
+	{"verify-signature", "[flags] <db.mmdb>", runVerifySignature},
+	{"reproduce", "[flags] <manifest.json>", runReproduce},
+	{"publish", "[flags] <db.mmdb> <dir>", runPublish},
+	{"update", "<base.mmdb> <delta.csv> <out.mmdb>", runUpdate},
+	{"diff", "[flags] <old.mmdb> <new.mmdb>", runDiff},
+	{"info", "[flags] <db.mmdb>", runInfo},
+	{"lookup", "[flags] <db.mmdb|publish-dir> <ip|->...", runLookup},
+	{"prefixes", "[flags] <db.mmdb>", runPrefixes},
+	{"stats", "[flags] <db.mmdb>", runStats},
+	{"serve", "[flags] <db.mmdb|source.csv>", runServe},
+	{"healthcheck", "[flags]", runHealthcheck},
+	{"asn-db", "[flags] <out.json|out.db> <input>...", runASNDB},
+	{"bmp", "[flags] <out.mmdb>", runBMP},
+	{"gen-fixture", "<out.mmdb> <out.expected.json>", runGenFixture},
+}
+
+// Shells `completion` writes a script for.
+const (
+	shellBash = "bash"
+	shellZsh  = "zsh"
+	shellFish = "fish"
+)
+
+// programName is the name the tool was run as, without the .exe of a
+// Windows build, for usage lines and completion scripts.
+func programName() string {
+	return strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+}
+
+func findSubcommand(name string) *subcommand {
+	for i := range subcommands {
+		if subcommands[i].name == name {
+			return &subcommands[i]
+		}
+	}
+	return nil
+}
+
+// printUsage writes the usage lines of the build and every subcommand.
+func printUsage(w io.Writer) {
+	name := os.Args[0]
+	fmt.Fprintf(w, "Usage: %s [build] [flags] <csv-file> [output-file]\n", name)
+	for _, c := range subcommands {
+		fmt.Fprintf(w, "       %s %s %s\n", name, c.name, c.usage)
+	}
+	fmt.Fprintf(w, "       %s help [command]\n", name)
+	fmt.Fprintf(w, "       %s completion bash|zsh|fish\n", name)
+	fmt.Fprintf(w, "Example: %s asn-blocks.csv asn.mmdb\n", name)
+	fmt.Fprintf(w, "Use - as the csv-file or output-file for stdin or stdout.\n")
+}
+
+// runHelp implements `help [command]`: the usage of the build, or that of
+// a subcommand with its flags.
+func runHelp(args []string) error {
+	if len(args) == 0 || args[0] == "build" {
+		flag.CommandLine.SetOutput(os.Stdout)
+		flag.Usage()
+		return nil
+	}
+	c := findSubcommand(args[0])
+	if c == nil {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if !strings.HasPrefix(c.usage, "[flags]") {
+		fmt.Printf("Usage: %s %s %s\n", os.Args[0], c.name, c.usage)
+		return nil
+	}
+	// The flags of a subcommand are only defined when it runs; -h prints
+	// them and exits.
+	return c.run([]string{"-h"})
+}
+
+// runCompletion implements `completion <shell>`: it writes a script that
+// completes the subcommands, the build flags and file names.
+func runCompletion(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s completion bash|zsh|fish", os.Args[0])
+	}
+	name := programName()
+	commands := []string{"build", "help", "completion"}
+	for _, c := range subcommands {
+		commands = append(commands, c.name)
+	}
+	var flags []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+
+	switch args[0] {
+	case shellBash, shellZsh:
+		words := make([]string, 0, len(flags))
+		for _, f := range flags {
+			words = append(words, "-"+f.Name)
+		}
+		fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+		if args[0] == shellZsh {
+			fmt.Fprint(w, "autoload -U +X bashcompinit && bashcompinit\n")
+		}
+		fmt.Fprintf(w, `%s() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	if [ "$COMP_CWORD" -eq 1 ] && [[ "$cur" != -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	elif [[ "$cur" == -* ]] && { [ "$COMP_CWORD" -eq 1 ] || [ "${COMP_WORDS[1]}" = build ] || [[ "${COMP_WORDS[1]}" == -* ]]; }; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	elif [ "${COMP_WORDS[1]}" = completion ]; then
+		COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+	elif [ "${COMP_WORDS[1]}" = help ]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	fi
+}
+complete -o default -F %s %s
+`, fn, strings.Join(commands, " "), strings.Join(words, " "), strings.Join(commands, " "), fn, name)
+	case shellFish:
+		all := strings.Join(commands, " ")
+		fmt.Fprintf(w, "complete -c %s -n '__fish_use_subcommand' -f -a '%s'\n", name, all)
+		fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from completion' -f -a 'bash zsh fish'\n", name)
+		fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from help' -f -a '%s'\n", name, all)
+		for _, f := range flags {
+			usage, _, _ := strings.Cut(f.Usage, "\n")
+			usage = strings.ReplaceAll(usage, "`", "")
+			fmt.Fprintf(w, "complete -c %s -n 'not __fish_seen_subcommand_from %s' -o %s -d %s\n",
+				name, strings.Join(commands[1:], " "), f.Name, fishQuote(usage))
+		}
+	default:
+		return fmt.Errorf("unknown shell %q (want %s, %s or %s)", args[0], shellBash, shellZsh, shellFish)
+	}
+	return nil
+}
+
+// fishQuote quotes s as a single-quoted fish string.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// inputSource is one input of a build with its format and priority.
+type inputSource struct {
+	file     string
+	format   string
+	priority int
+}
+
+// buildFile is the part of a -config file that is not a flag: the inputs
+// and the output, which are positional arguments on the command line.
+type buildFile struct {
+	Inputs []struct {
+		File     string `yaml:"file"`
+		Format   string `yaml:"format"`
+		Priority int    `yaml:"priority"`
+	} `yaml:"inputs"`
+	Output string `yaml:"output"`
+}
+
+// buildFileKeys are the keys of a -config file that are not flag names.
+var buildFileKeys = []string{"inputs", "output"}
+
+// loadConfigFile applies a YAML -config file. Every top-level key other
+// than inputs and output names a flag without its dash; flags given on the
+// command line take precedence over the file. Lists set a repeatable flag
+// once per item and maps set it once per key=value pair, in key order.
+// The inputs and output fill in cfg unless positional arguments were given.
+func loadConfigFile(cfg *config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var file buildFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if slices.Contains(buildFileKeys, name) {
+			continue
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+		if flagSet(name) {
+			continue
+		}
+		values, err := flagValues(settings[name])
+		if err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, name, err)
+		}
+		for _, value := range values {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("config file %s: %s: %w", path, name, err)
+			}
+		}
+	}
+
+	if flag.NArg() == 0 {
+		for i, in := range file.Inputs {
+			if in.File == "" {
+				return fmt.Errorf("config file %s: input %d has no file", path, i+1)
+			}
+			if i == 0 {
+				cfg.csvFile, cfg.inputPriority = in.File, in.Priority
+				if in.Format != "" && !flagSet("format") {
+					if err := flag.Set("format", in.Format); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			cfg.extraInputs = append(cfg.extraInputs, inputSource{file: in.File, format: in.Format, priority: in.Priority})
+		}
+	}
+	if flag.NArg() < 2 && file.Output != "" {
+		cfg.outputFile = file.Output
+	}
+	return nil
+}
+
+// flagValues turns a YAML value into the strings to pass to flag.Set.
+func flagValues(value any) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, errors.New("missing value")
+	case []any:
+		var values []string
+		for _, item := range v {
+			if _, ok := item.(map[string]any); ok {
+				return nil, errors.New("list items must be plain values")
+			}
+			if _, ok := item.([]any); ok {
+				return nil, errors.New("list items must be plain values")
+			}
+			values = append(values, fmt.Sprint(item))
+		}
+		return values, nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		values := make([]string, 0, len(keys))
+		for _, key := range keys {
+			values = append(values, fmt.Sprintf("%s=%v", key, v[key]))
+		}
+		return values, nil
+	}
+	return []string{fmt.Sprint(value)}, nil
+}
+
+// resolveInputFormats fills in the format of the extra inputs from their
+// extension, falling back to the format of the first input. Only the first
+// input may be stdin.
+func resolveInputFormats(cfg *config) error {
+	for i := range cfg.extraInputs {
+		in := &cfg.extraInputs[i]
+		if in.file == stdioPath {
+			return errors.New("only the first input can be stdin")
+		}
+		if in.format == "" {
+			in.format = formatFromExtension(in.file)
+		}
+		if in.format == "" {
+			in.format = cfg.format
+		}
+		switch in.format {
+		case formatCSV, formatFixed, formatTable, formatJSONL, formatMRT, formatIPtoASN, formatIPinfo:
+		default:
+			return fmt.Errorf("unknown format %q of input %s", in.format, in.file)
+		}
+		if in.format == formatFixed && cfg.format != formatFixed {
+			if err := validateFixedFields(cfg.fixedFields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// Handling of ASCII control characters in string fields accepted by
+// -on-control-char, and of invalid UTF-8 by -on-invalid-utf8.
+const (
+	controlCharStrip   = "strip"
+	controlCharReplace = "replace"
+	controlCharWarn    = "warn"
+	controlCharReject  = "reject"
+	controlCharFail    = "fail"
+)
+
+func validateControlCharMode(flagName, mode string) error {
+	switch mode {
+	case controlCharStrip, controlCharReplace, controlCharWarn, controlCharReject, controlCharFail:
+		return nil
+	}
+	return fmt.Errorf("unknown -%s mode %q (want %s, %s, %s, %s or %s)", flagName,
+		mode, controlCharStrip, controlCharReplace, controlCharWarn, controlCharReject, controlCharFail)
+}
+
+func isControlChar(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// stringCheck is a problem string fields of a record can have: bad finds
+// it, and strip and replace remove it or put U+FFFD in its place.
+type stringCheck struct {
+	bad            func(string) bool
+	strip, replace func(string) string
+}
+
+// controlChars finds ASCII control characters.
+var controlChars = stringCheck{
+	bad: func(s string) bool { return strings.IndexFunc(s, isControlChar) >= 0 },
+	strip: func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if isControlChar(r) {
+				return -1
+			}
+			return r
+		}, s)
+	},
+	replace: func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if isControlChar(r) {
+				return utf8.RuneError
+			}
+			return r
+		}, s)
+	},
+}
+
+// invalidUTF8 finds byte sequences that are not UTF-8. A run of them counts
+// as one character.
+var invalidUTF8 = stringCheck{
+	bad:     func(s string) bool { return !utf8.ValidString(s) },
+	strip:   func(s string) string { return strings.ToValidUTF8(s, "") },
+	replace: func(s string) string { return strings.ToValidUTF8(s, string(utf8.RuneError)) },
+}
+
+// find returns the paths of the string fields of record that have the
+// problem, sorted. With the strip and replace modes the fields are fixed in
+// place.
+func (c stringCheck) find(record mmdbtype.Map, mode string) []string {
+	var clean func(string) string
+	switch mode {
+	case controlCharStrip:
+		clean = c.strip
+	case controlCharReplace:
+		clean = c.replace
+	}
+	var paths []string
+	for key, value := range record {
+		if cleaned, found := c.clean(value, string(key), clean, &paths); found && clean != nil {
+			record[key] = cleaned
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// clean walks value, appending the path of every string with the problem
+// to paths. It returns the value fixed by clean when it is set, and whether
+// the problem was found.
+func (c stringCheck) clean(value mmdbtype.DataType, path string, clean func(string) string, paths *[]string) (mmdbtype.DataType, bool) {
+	switch v := value.(type) {
+	case mmdbtype.String:
+		if !c.bad(string(v)) {
+			return v, false
+		}
+		*paths = append(*paths, path)
+		if clean != nil {
+			return mmdbtype.String(clean(string(v))), true
+		}
+		return v, true
+	case mmdbtype.Map:
+		found := false
+		for key, item := range v {
+			if cleaned, ok := c.clean(item, path+"."+string(key), clean, paths); ok {
+				found = true
+				if clean != nil {
+					v[key] = cleaned
+				}
+			}
+		}
+		return v, found
+	case mmdbtype.Slice:
+		found := false
+		for i, item := range v {
+			if cleaned, ok := c.clean(item, fmt.Sprintf("%s[%d]", path, i), clean, paths); ok {
+				found = true
+				if clean != nil {
+					v[i] = cleaned
+				}
+			}
+		}
+		return v, found
+	}
+	return value, false
+}
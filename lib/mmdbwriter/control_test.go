@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+func TestStringCheckFind(t *testing.T) {
+	record := func() mmdbtype.Map {
+		return mmdbtype.Map{
+			"autonomous_system_organization": mmdbtype.String("Exam\x01ple\x7f"),
+			"autonomous_system_number":       mmdbtype.Uint32(64500),
+			"names": mmdbtype.Map{
+				"en": mmdbtype.String("clean"),
+				"de": mmdbtype.String("tab\there"),
+			},
+			"tags": mmdbtype.Slice{mmdbtype.String("ok"), mmdbtype.String("bell\a")},
+		}
+	}
+	wantPaths := []string{"autonomous_system_organization", "names.de", "tags[1]"}
+
+	tests := []struct {
+		mode string
+		want mmdbtype.Map
+	}{
+		{controlCharStrip, mmdbtype.Map{
+			"autonomous_system_organization": mmdbtype.String("Example"),
+			"autonomous_system_number":       mmdbtype.Uint32(64500),
+			"names":                          mmdbtype.Map{"en": mmdbtype.String("clean"), "de": mmdbtype.String("tabhere")},
+			"tags":                           mmdbtype.Slice{mmdbtype.String("ok"), mmdbtype.String("bell")},
+		}},
+		{controlCharReplace, mmdbtype.Map{
+			"autonomous_system_organization": mmdbtype.String("Exam�ple�"),
+			"autonomous_system_number":       mmdbtype.Uint32(64500),
+			"names":                          mmdbtype.Map{"en": mmdbtype.String("clean"), "de": mmdbtype.String("tab�here")},
+			"tags":                           mmdbtype.Slice{mmdbtype.String("ok"), mmdbtype.String("bell�")},
+		}},
+		{controlCharWarn, record()},
+		{controlCharReject, record()},
+	}
+	for _, tt := range tests {
+		got := record()
+		paths := controlChars.find(got, tt.mode)
+		if !reflect.DeepEqual(paths, wantPaths) {
+			t.Errorf("%s: got paths %q, want %q", tt.mode, paths, wantPaths)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{controlCharStrip, "Example"},
+		{controlCharReplace, "Exam�ple"},
+		{controlCharWarn, "Exam\xff\xfeple"},
+	}
+	for _, tt := range tests {
+		record := mmdbtype.Map{"org": mmdbtype.String("Exam\xff\xfeple")}
+		if paths := invalidUTF8.find(record, tt.mode); !reflect.DeepEqual(paths, []string{"org"}) {
+			t.Errorf("%s: got paths %q", tt.mode, paths)
+		}
+		if got := record["org"]; got != mmdbtype.String(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+	if paths := invalidUTF8.find(mmdbtype.Map{"org": mmdbtype.String("Exämple")}, controlCharStrip); paths != nil {
+		t.Errorf("valid UTF-8 reported at %q", paths)
+	}
+}
+
+func TestValidateControlCharMode(t *testing.T) {
+	for _, mode := range []string{controlCharStrip, controlCharReplace, controlCharWarn, controlCharReject, controlCharFail} {
+		if err := validateControlCharMode("on-control-char", mode); err != nil {
+			t.Errorf("%s: %v", mode, err)
+		}
+	}
+	if err := validateControlCharMode("on-control-char", "ignore"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Coverage index layout: a 4-byte magic, a version byte, the IPv4 and IPv6
+// prefix lengths of the bitmaps, then one bitmap per family. Bit i of a
+// bitmap (most significant bit first) is set when the database has data
+// anywhere inside the i-th top-level prefix.
+const (
+	coverageMagic   = "BCOV"
+	coverageVersion = 1
+	coverageV4Bits  = 8
+	coverageV6Bits  = 16
+)
+
+// coverageBitmap is a bitmap over the top-level prefixes of one family.
+type coverageBitmap struct {
+	prefixBits int
+	bits       []byte
+}
+
+func newCoverageBitmap(prefixBits int) *coverageBitmap {
+	return &coverageBitmap{prefixBits: prefixBits, bits: make([]byte, (1<<prefixBits)/8)}
+}
+
+// mark sets the bits of all top-level prefixes that network overlaps.
+func (b *coverageBitmap) mark(network *net.IPNet) {
+	ones, _ := network.Mask.Size()
+
+	// The top-level prefix number is the leading prefixBits of the address.
+	ip := network.IP
+	first := 0
+	for i := 0; i < b.prefixBits; i++ {
+		if ip[i/8]&(0x80>>(i%8)) != 0 {
+			first |= 1 << (b.prefixBits - 1 - i)
+		}
+	}
+	count := 1
+	if ones < b.prefixBits {
+		count = 1 << (b.prefixBits - ones)
+	}
+	for n := first; n < first+count; n++ {
+		b.bits[n/8] |= 0x80 >> (n % 8)
+	}
+}
+
+// covered returns the number of top-level prefixes with data.
+func (b *coverageBitmap) covered() int {
+	n := 0
+	for _, c := range b.bits {
+		for ; c != 0; c &= c - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// writeCoverageIndex writes the coverage index of the built database to
+// path.
+func writeCoverageIndex(built *maxminddb.Reader, path string) error {
+	v4 := newCoverageBitmap(coverageV4Bits)
+	v6 := newCoverageBitmap(coverageV6Bits)
+	err := walkDatabase(built, nil, func(network *net.IPNet, _ mmdbtype.DataType) error {
+		if network.IP.To4() != nil && len(network.IP) == net.IPv4len {
+			v4.mark(network)
+		} else {
+			v6.mark(network)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data := append([]byte(coverageMagic), coverageVersion, coverageV4Bits, coverageV6Bits)
+	data = append(data, v4.bits...)
+	data = append(data, v6.bits...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write coverage index: %w", err)
+	}
+
+	logger.Info("coverage index written", "file", path, "bytes", len(data),
+		fmt.Sprintf("ipv4_/%d_covered", coverageV4Bits), v4.covered(),
+		fmt.Sprintf("ipv6_/%d_covered", coverageV6Bits), v6.covered())
+	return nil
+}
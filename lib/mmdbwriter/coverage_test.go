@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCoverageBitmapMark(t *testing.T) {
+	tests := []struct {
+		network string
+		want    []int
+	}{
+		{"1.1.1.0/24", []int{1}},
+		{"8.0.0.0/8", []int{8}},
+		{"8.0.0.0/7", []int{8, 9}},
+		{"0.0.0.0/6", []int{0, 1, 2, 3}},
+		{"255.255.255.255/32", []int{255}},
+	}
+	for _, tt := range tests {
+		b := newCoverageBitmap(coverageV4Bits)
+		_, network, _ := net.ParseCIDR(tt.network)
+		b.mark(network)
+		if got := b.covered(); got != len(tt.want) {
+			t.Errorf("%s: %d prefixes covered, want %d", tt.network, got, len(tt.want))
+		}
+		for _, n := range tt.want {
+			if b.bits[n/8]&(0x80>>(n%8)) == 0 {
+				t.Errorf("%s: bit %d not set", tt.network, n)
+			}
+		}
+	}
+}
+
+func TestWriteCoverageIndex(t *testing.T) {
+	source, err := os.ReadFile("testdata/bgp-tools.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := buildTestDB(t, testConfig(t), string(source))
+	path := filepath.Join(t.TempDir(), "asn.coverage")
+	if err := writeCoverageIndex(db, path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const header = len(coverageMagic) + 3
+	if want := header + 256/8 + 65536/8; len(data) != want {
+		t.Fatalf("got %d bytes, want %d", len(data), want)
+	}
+	if string(data[:4]) != coverageMagic || data[4] != coverageVersion || data[5] != coverageV4Bits || data[6] != coverageV6Bits {
+		t.Fatalf("got header % x", data[:header])
+	}
+	v4, v6 := data[header:header+32], data[header+32:]
+	isSet := func(bits []byte, n int) bool { return bits[n/8]&(0x80>>(n%8)) != 0 }
+	for _, n := range []int{1, 8, 9, 23, 45} {
+		if !isSet(v4, n) {
+			t.Errorf("IPv4 /8 %d is not covered", n)
+		}
+	}
+	// ::/0 covers the IPv4 space too, except the reserved networks.
+	for _, n := range []int{0, 10, 127} {
+		if isSet(v4, n) {
+			t.Errorf("IPv4 /8 %d is covered", n)
+		}
+	}
+	for _, n := range []int{0x2001, 0x2606, 0x2a00, 0x2a01, 0x2c0f} {
+		if !isSet(v6, n) {
+			t.Errorf("IPv6 /16 %04x is not covered", n)
+		}
+	}
+}
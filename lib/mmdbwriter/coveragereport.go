@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Formats of -coverage-format.
+const (
+	coverageText = "text"
+	coverageJSON = "json"
+)
+
+// coverageReport is the -coverage-report of a build: how much of the
+// unicast space of each family has an origin ASN, and the largest gaps.
+type coverageReport struct {
+	Families []coverageFamily `json:"families"`
+}
+
+// coverageFamily is the coverage of one address family. Address space is
+// counted in /24s for IPv4 and /48s for IPv6, fractions included. The
+// unicast space is 0.0.0.0/0 and 2000::/3 without the bogon networks.
+type coverageFamily struct {
+	Family      string        `json:"family"`
+	Unit        string        `json:"unit"`
+	Unicast     float64       `json:"unicast"`
+	Covered     float64       `json:"covered"`
+	Percent     float64       `json:"percent"`
+	Gaps        int           `json:"gaps"`
+	LargestGaps []coverageGap `json:"largest_gaps"`
+
+	// CoveredChange and PercentChange compare with -coverage-base.
+	CoveredChange *float64 `json:"covered_change,omitempty"`
+	PercentChange *float64 `json:"percent_change,omitempty"`
+}
+
+// coverageGap is a range of unicast space without an origin ASN.
+type coverageGap struct {
+	First    string   `json:"first"`
+	Last     string   `json:"last"`
+	Size     float64  `json:"size"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// addrRange is the addresses first to last.
+type addrRange struct {
+	first, last netip.Addr
+}
+
+// coverageFamilies are the families of the report with the prefix their
+// unicast space is in and the prefix length of their unit.
+var coverageFamilies = []struct {
+	name     string
+	root     netip.Prefix
+	unitBits int
+}{
+	{"ipv4", netip.MustParsePrefix("0.0.0.0/0"), 24},
+	{"ipv6", netip.MustParsePrefix("2000::/3"), 48},
+}
+
+func validateCoverageReport(cfg *config) error {
+	if cfg.coverageReport == "" {
+		return nil
+	}
+	if cfg.coverageFormat != coverageText && cfg.coverageFormat != coverageJSON {
+		return fmt.Errorf("invalid -coverage-format %q: must be %s or %s", cfg.coverageFormat, coverageText, coverageJSON)
+	}
+	if cfg.coverageReport == stdioPath && cfg.outputFile == stdioPath {
+		return errors.New("-coverage-report cannot be written to stdout along with the database")
+	}
+	if cfg.coverageGaps < 0 {
+		return errors.New("-coverage-gaps must not be negative")
+	}
+	return nil
+}
+
+// buildCoverageReport measures the coverage of built and compares it with
+// -coverage-base when given.
+func buildCoverageReport(cfg *config, built *maxminddb.Reader) (*coverageReport, error) {
+	report, err := measureCoverage(built, cfg.coverageGaps)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.coverageBase != "" {
+		base, err := readCoverageBase(cfg.coverageBase)
+		if err != nil {
+			return nil, err
+		}
+		report.compare(base)
+	}
+	for _, f := range report.Families {
+		attrs := []any{"family", f.Family, "percent", math.Round(f.Percent*100) / 100, "gaps", f.Gaps}
+		if f.PercentChange != nil {
+			attrs = append(attrs, "percent_change", math.Round(*f.PercentChange*100)/100)
+		}
+		logger.Info("coverage", attrs...)
+	}
+	return report, nil
+}
+
+// writeCoverageReport writes report to -coverage-report.
+func writeCoverageReport(cfg *config, report *coverageReport) error {
+	var buf bytes.Buffer
+	if cfg.coverageFormat == coverageJSON {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		report.writeText(&buf)
+	}
+	var err error
+	if cfg.coverageReport == stdioPath {
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = writeFileAtomic(cfg.coverageReport, buf.Bytes())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write coverage report: %w", err)
+	}
+	return nil
+}
+
+// measureCoverage walks the networks of db with an origin ASN, or an
+// AS_SET, and measures them against the unicast space. Records without
+// one, such as bogon tags or the dark space of -tag-unannounced, are gaps.
+func measureCoverage(db *maxminddb.Reader, gaps int) (*coverageReport, error) {
+	covered := make([][]addrRange, len(coverageFamilies))
+	err := walkDatabase(db, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+		m, _ := record.(mmdbtype.Map)
+		_, asn := m["autonomous_system_number"]
+		_, asSet := m["autonomous_system_numbers"]
+		if !asn && !asSet || m["announced"] == mmdbtype.Bool(false) {
+			return nil
+		}
+		addr, _ := netip.AddrFromSlice(network.IP)
+		ones, _ := network.Mask.Size()
+		prefix := netip.PrefixFrom(addr.Unmap(), ones)
+		r := addrRange{prefix.Masked().Addr(), prefixLast(prefix)}
+		i := 0
+		if !prefix.Addr().Is4() {
+			i = 1
+		}
+		// Networks come in address order, so adjacent ones are merged.
+		if n := len(covered[i]); n > 0 && covered[i][n-1].last.Next() == r.first {
+			covered[i][n-1].last = r.last
+		} else {
+			covered[i] = append(covered[i], r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &coverageReport{}
+	for i, fam := range coverageFamilies {
+		if fam.name == "ipv6" && db.Metadata.IPVersion == 4 {
+			continue
+		}
+		unicast := unicastRanges(fam.root)
+		uncovered := subtractRanges(unicast, covered[i])
+		f := coverageFamily{Family: fam.name, Unit: fmt.Sprintf("/%d", fam.unitBits), Gaps: len(uncovered)}
+		for _, r := range unicast {
+			f.Unicast += rangeSize(r, fam.unitBits)
+		}
+		sizes := make([]float64, len(uncovered))
+		gapTotal := 0.0
+		for j, r := range uncovered {
+			sizes[j] = rangeSize(r, fam.unitBits)
+			gapTotal += sizes[j]
+		}
+		f.Covered = f.Unicast - gapTotal
+		f.Percent = 100 * f.Covered / f.Unicast
+
+		order := make([]int, len(uncovered))
+		for j := range order {
+			order[j] = j
+		}
+		// Largest first, then in address order.
+		slices.SortStableFunc(order, func(a, b int) int {
+			switch {
+			case sizes[a] > sizes[b]:
+				return -1
+			case sizes[a] < sizes[b]:
+				return 1
+			}
+			return 0
+		})
+		f.LargestGaps = []coverageGap{}
+		for _, j := range order[:min(gaps, len(order))] {
+			r := uncovered[j]
+			gap := coverageGap{First: r.first.String(), Last: r.last.String(), Size: sizes[j]}
+			for _, p := range rangePrefixes(r.first, r.last) {
+				gap.Prefixes = append(gap.Prefixes, p.String())
+			}
+			f.LargestGaps = append(f.LargestGaps, gap)
+		}
+		report.Families = append(report.Families, f)
+	}
+	return report, nil
+}
+
+// unicastRanges returns the ranges of root outside the bogon networks, in
+// address order.
+func unicastRanges(root netip.Prefix) []addrRange {
+	var bogons []addrRange
+	for _, b := range bogonNetworks {
+		p := netip.MustParsePrefix(b.network)
+		if root.Overlaps(p) {
+			bogons = append(bogons, addrRange{p.Addr(), prefixLast(p)})
+		}
+	}
+	slices.SortFunc(bogons, func(a, b addrRange) int { return a.first.Compare(b.first) })
+	return subtractRanges([]addrRange{{root.Addr(), prefixLast(root)}}, bogons)
+}
+
+// subtractRanges returns the parts of the ranges a that are not in any of
+// the ranges b. Both are sorted and do not overlap.
+func subtractRanges(a, b []addrRange) []addrRange {
+	var out []addrRange
+	j := 0
+	for _, r := range a {
+		for j < len(b) && b[j].last.Less(r.first) {
+			j++
+		}
+		first, done := r.first, false
+		for k := j; k < len(b) && !r.last.Less(b[k].first); k++ {
+			if first.Less(b[k].first) {
+				out = append(out, addrRange{first, b[k].first.Prev()})
+			}
+			if !b[k].last.Less(r.last) {
+				done = true
+				break
+			}
+			if next := b[k].last.Next(); first.Less(next) {
+				first = next
+			}
+		}
+		if !done {
+			out = append(out, addrRange{first, r.last})
+		}
+	}
+	return out
+}
+
+// rangeSize returns the number of addresses of r in units of prefixes of
+// unitBits.
+func rangeSize(r addrRange, unitBits int) float64 {
+	first := new(big.Int).SetBytes(r.first.AsSlice())
+	last := new(big.Int).SetBytes(r.last.AsSlice())
+	n := new(big.Int).Sub(last, first)
+	n.Add(n, big.NewInt(1))
+	size, _ := new(big.Float).SetInt(n).Float64()
+	return size / math.Exp2(float64(r.first.BitLen()-unitBits))
+}
+
+// readCoverageBase reads the coverage of an earlier build from its
+// -manifest, or from a JSON -coverage-report.
+func readCoverageBase(path string) (*coverageReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read coverage base: %w", err)
+	}
+	var file struct {
+		Coverage *coverageReport  `json:"coverage"`
+		Families []coverageFamily `json:"families"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid coverage base %s: %w", path, err)
+	}
+	if file.Coverage != nil {
+		return file.Coverage, nil
+	}
+	if file.Families == nil {
+		return nil, fmt.Errorf("invalid coverage base %s: no coverage, build it with -coverage-report", path)
+	}
+	return &coverageReport{Families: file.Families}, nil
+}
+
+// compare sets the changes of the families against base.
+func (r *coverageReport) compare(base *coverageReport) {
+	for i := range r.Families {
+		f := &r.Families[i]
+		for _, b := range base.Families {
+			if b.Family == f.Family {
+				covered, percent := f.Covered-b.Covered, f.Percent-b.Percent
+				f.CoveredChange, f.PercentChange = &covered, &percent
+			}
+		}
+	}
+}
+
+func (r *coverageReport) writeText(w io.Writer) {
+	for i, f := range r.Families {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s: %.2f%% of unicast space covered (%s of %s %ss)\n", f.Family, f.Percent,
+			formatSlashes(math.Round(f.Covered*100)/100), formatSlashes(f.Unicast), f.Unit)
+		if f.PercentChange != nil {
+			fmt.Fprintf(w, "  change: %+.2f points (%+.2f %ss)\n", *f.PercentChange, *f.CoveredChange, f.Unit)
+		}
+		fmt.Fprintf(w, "  %d gaps", f.Gaps)
+		if len(f.LargestGaps) > 0 {
+			fmt.Fprintf(w, ", largest:")
+		}
+		fmt.Fprintln(w)
+		for _, g := range f.LargestGaps {
+			fmt.Fprintf(w, "    %s - %s  %s %ss  %s\n", g.First, g.Last, formatSlashes(g.Size), f.Unit, strings.Join(g.Prefixes, ", "))
+		}
+	}
+}
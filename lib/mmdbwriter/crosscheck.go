@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// maxReportedDiscrepancies caps how many differing prefixes are printed.
+const maxReportedDiscrepancies = 20
+
+// checkAgainstReference looks up the first address of every inserted network
+// in both the freshly built database and a known-good reference database.
+// Any difference in the resolved record, e.g. from a serialization or
+// aliasing change in a new mmdbwriter version, is reported and fails the
+// check.
+func checkAgainstReference(refFile string, built *maxminddb.Reader, inserted []*net.IPNet) error {
+	ref, err := maxminddb.Open(refFile)
+	if err != nil {
+		return fmt.Errorf("failed to open reference database: %w", err)
+	}
+	defer ref.Close()
+
+	discrepancies := 0
+	for _, network := range inserted {
+		_, builtRecord, err := lookupRecord(built, network.IP)
+		if err != nil {
+			return fmt.Errorf("failed to look up %s in new database: %w", network, err)
+		}
+		_, refRecord, err := lookupRecord(ref, network.IP)
+		if err != nil {
+			return fmt.Errorf("failed to look up %s in reference database: %w", network, err)
+		}
+		if recordsEqual(builtRecord, refRecord) {
+			continue
+		}
+
+		discrepancies++
+		if discrepancies <= maxReportedDiscrepancies {
+			logger.Error("crosscheck mismatch", "network", network, "built", builtRecord, "reference", refRecord)
+		}
+	}
+
+	logger.Info("crosscheck", "reference", refFile, "compared", len(inserted), "discrepancies", discrepancies)
+	if discrepancies > 0 {
+		return fmt.Errorf("crosscheck found %d discrepancies", discrepancies)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckAgainstReference(t *testing.T) {
+	const input = "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,15169\n"
+	var inserted []*net.IPNet
+	for _, network := range []string{"1.1.1.0/24", "8.8.8.0/24"} {
+		_, n, _ := net.ParseCIDR(network)
+		inserted = append(inserted, n)
+	}
+	built, _ := buildTestDB(t, testConfig(t), input)
+
+	tests := []struct {
+		name      string
+		reference string
+		wantErr   bool
+	}{
+		{"same records", input, false},
+		{"changed origin", "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,64500\n", true},
+		{"missing network", "network,asn\n1.1.1.0/24,13335\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := buildTestMMDB(t, testConfig(t), tt.reference)
+			refFile := writeTestFile(t, "reference.mmdb", string(data))
+			err := checkAgainstReference(refFile, built, inserted)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
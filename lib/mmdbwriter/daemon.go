@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// validateDaemon checks the -daemon flags. The reload flags only make
+// sense in daemon mode, and the output has to be a single file that can be
+// replaced.
+func validateDaemon(cfg *config) error {
+	if !cfg.daemon {
+		if cfg.reloadPIDFile != "" || cfg.reloadWebhook != "" {
+			return errors.New("-reload-pid-file and -reload-webhook require -daemon")
+		}
+		return nil
+	}
+	switch {
+	case cfg.interval <= 0:
+		return errors.New("-interval must be positive")
+	case cfg.csvFile == stdioPath || cfg.outputFile == stdioPath:
+		return errors.New("-daemon cannot read from stdin or write to stdout")
+	case cfg.shardMaxSize > 0:
+		return errors.New("-daemon cannot be combined with -shard-max-size")
+	}
+	return nil
+}
+
+// runDaemon builds the output every cfg.interval until ctx is cancelled.
+// A failed build keeps the previous output and is retried at the next
+// interval. With -fetch, a build is skipped when the source has not
+// changed and the last build succeeded.
+func runDaemon(ctx context.Context, cfg *config) {
+	logger.Info("daemon mode", "output", cfg.outputFile, "interval", cfg.interval)
+	pinnedBuildTime := flagSet("build-time")
+	built := false
+	for {
+		start := time.Now()
+		if !pinnedBuildTime {
+			cfg.buildTime = start
+		}
+
+		switch updated, err := fetchInput(ctx, cfg); {
+		case err != nil:
+			logger.Error("build failed", "error", err)
+			finishBuildMetrics(cfg, err)
+			notifyBuild(cfg, err)
+			built = false
+		case built && cfg.fetchURL != "" && !updated:
+			logger.Info("source unchanged, keeping output", "output", cfg.outputFile)
+		default:
+			if err := runBuild(ctx, cfg, os.Stdout); err != nil {
+				logger.Error("build failed", "error", err)
+				// The output may be older than the fetched source, so
+				// the next build runs even when the source is unchanged.
+				built = false
+				break
+			}
+			built = true
+			notifyReload(cfg, start)
+		}
+
+		if ctx.Err() == nil {
+			next := start.Add(cfg.interval)
+			logger.Info("next build", "at", next.Format(time.RFC3339))
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(next)):
+				continue
+			}
+		}
+		logger.Info("daemon stopped", "reason", context.Cause(ctx))
+		return
+	}
+}
+
+// notifyReload tells downstream consumers that a new output is in place.
+// Failures are reported but do not fail the build.
+func notifyReload(cfg *config, buildTime time.Time) {
+	if cfg.reloadPIDFile != "" {
+		if err := signalReload(cfg.reloadPIDFile); err != nil {
+			logger.Warn("reload signal failed", "error", err)
+		} else {
+			logger.Info("sent SIGHUP", "pid_file", cfg.reloadPIDFile)
+		}
+	}
+	if cfg.reloadWebhook != "" {
+		if err := callReloadWebhook(cfg, buildTime); err != nil {
+			logger.Warn("reload webhook failed", "error", err)
+		} else {
+			logger.Info("reload webhook notified", "url", cfg.reloadWebhook)
+		}
+	}
+}
+
+// signalReload sends SIGHUP to the process whose PID is in pidFile.
+func signalReload(pidFile string) error {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("invalid PID in %s", pidFile)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(syscall.SIGHUP)
+}
+
+// reloadNotification is the body POSTed to -reload-webhook.
+type reloadNotification struct {
+	Output    string `json:"output"`
+	BuildTime string `json:"build_time"`
+}
+
+func callReloadWebhook(cfg *config, buildTime time.Time) error {
+	body, err := json.Marshal(reloadNotification{
+		Output:    cfg.outputFile,
+		BuildTime: buildTime.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.reloadWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", cfg.userAgent)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDaemonRebuildsAfterFailure(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		fetches     int
+		vrpRequests int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/table.csv", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		switch fetches {
+		case 1:
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("network,asn\n1.2.3.0/24,64500\n"))
+		case 2:
+			w.Header().Set("ETag", `"v2"`)
+			w.Write([]byte("network,asn\n1.2.3.0/24,64501\n"))
+		default:
+			if r.Header.Get("If-None-Match") != `"v2"` {
+				t.Errorf("fetch %d: got If-None-Match %q, want \"v2\"", fetches, r.Header.Get("If-None-Match"))
+			}
+			w.WriteHeader(http.StatusNotModified)
+		}
+	})
+	// The second build, of v2, fails to load its VRPs.
+	mux.HandleFunc("/vrps.json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		vrpRequests++
+		if vrpRequests == 2 {
+			http.Error(w, "gone", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"roas":[{"asn":"AS64501","prefix":"1.2.3.0/24","maxLength":24}]}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := testConfig(t, "-daemon", "-interval", "10ms", "-fetch-retries", "0",
+		"-fetch", srv.URL+"/table.csv", "-rpki", srv.URL+"/vrps.json")
+	cfg.csvFile = filepath.Join(dir, "table.csv")
+	cfg.outputFile = filepath.Join(dir, "asn.mmdb")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runDaemon(ctx, cfg)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The third fetch is answered with 304: v2 still has to be built.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		n := fetches
+		mu.Unlock()
+		if n >= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("daemon made %d fetches, want 4", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	data, err := os.ReadFile(cfg.outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, data)
+	if _, record := lookupTest(t, db, "1.2.3.4"); record["autonomous_system_number"] != uint64(64501) {
+		t.Errorf("got %v after the 304, want the record of v2", record)
+	}
+}
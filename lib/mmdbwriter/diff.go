@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// aliasedIPv6 are the IPv6 ranges mmdbwriter maps onto the IPv4 subtree.
+// They are compared as IPv4, so the IPv6 sweep skips them.
+var aliasedIPv6 = []netip.Prefix{
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// diffEntry is one prefix that differs between two builds. Old is nil for
+// added prefixes and New for removed ones.
+type diffEntry struct {
+	Prefix string         `json:"prefix"`
+	Old    map[string]any `json:"old,omitempty"`
+	New    map[string]any `json:"new,omitempty"`
+	OldASN *uint32        `json:"old_asn,omitempty"`
+	NewASN *uint32        `json:"new_asn,omitempty"`
+}
+
+// diffReport lists the differences between an old and a new build.
+type diffReport struct {
+	Added      []diffEntry `json:"added"`
+	Removed    []diffEntry `json:"removed"`
+	Changed    []diffEntry `json:"changed"`
+	Reassigned int         `json:"asn_reassignments"`
+}
+
+// runDiff implements `diff [-json] old.mmdb new.mmdb`.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "write the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [flags] <old.mmdb> <new.mmdb>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("diff needs two databases")
+	}
+
+	oldDB, err := maxminddb.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open old database: %w", err)
+	}
+	defer oldDB.Close()
+	newDB, err := maxminddb.Open(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("failed to open new database: %w", err)
+	}
+	defer newDB.Close()
+
+	report, err := diffDatabases(oldDB, newDB)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	for _, e := range report.Added {
+		fmt.Printf("+ %s %v\n", e.Prefix, e.New)
+	}
+	for _, e := range report.Removed {
+		fmt.Printf("- %s %v\n", e.Prefix, e.Old)
+	}
+	for _, e := range report.Changed {
+		if e.OldASN != nil && e.NewASN != nil && *e.OldASN != *e.NewASN {
+			fmt.Printf("~ %s AS%d -> AS%d\n", e.Prefix, *e.OldASN, *e.NewASN)
+			continue
+		}
+		fmt.Printf("~ %s %v -> %v\n", e.Prefix, e.Old, e.New)
+	}
+	fmt.Printf("Diff: %d added, %d removed, %d changed (%d ASN reassignments)\n",
+		len(report.Added), len(report.Removed), len(report.Changed), report.Reassigned)
+	return nil
+}
+
+// diffDatabases sweeps the address space of both databases. At every
+// position the more specific of the two networks containing it is
+// compared, so each reported prefix has a single record on both sides.
+func diffDatabases(oldDB, newDB *maxminddb.Reader) (*diffReport, error) {
+	report := &diffReport{}
+	if err := diffRange(oldDB, newDB, netip.IPv4Unspecified(), report); err != nil {
+		return nil, err
+	}
+	if oldDB.Metadata.IPVersion == 6 || newDB.Metadata.IPVersion == 6 {
+		if err := diffRange(oldDB, newDB, netip.IPv6Unspecified(), report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func diffRange(oldDB, newDB *maxminddb.Reader, addr netip.Addr, report *diffReport) error {
+	for {
+		if addr.Is6() {
+			if skip, ok := aliasedPrefix(addr); ok {
+				next := prefixLast(skip).Next()
+				if !next.IsValid() {
+					return nil
+				}
+				addr = next
+				continue
+			}
+		}
+
+		oldNet, oldRecord, err := diffLookup(oldDB, addr)
+		if err != nil {
+			return err
+		}
+		newNet, newRecord, err := diffLookup(newDB, addr)
+		if err != nil {
+			return err
+		}
+		segment := oldNet
+		if newNet.Bits() > oldNet.Bits() {
+			segment = newNet
+		}
+		record(report, segment, oldRecord, newRecord)
+
+		next := prefixLast(segment).Next()
+		if !next.IsValid() || next.BitLen() != addr.BitLen() {
+			return nil
+		}
+		addr = next
+	}
+}
+
+// diffLookup returns the network containing addr and its record. A
+// database without the address family has one empty network.
+func diffLookup(db *maxminddb.Reader, addr netip.Addr) (netip.Prefix, mmdbtype.DataType, error) {
+	if addr.Is6() && db.Metadata.IPVersion == 4 {
+		return netip.PrefixFrom(netip.IPv6Unspecified(), 0), nil, nil
+	}
+	network, record, err := lookupRecord(db, net.IP(addr.AsSlice()))
+	if err != nil {
+		return netip.Prefix{}, nil, fmt.Errorf("failed to look up %s: %w", addr, err)
+	}
+	ones, _ := network.Mask.Size()
+	ip, _ := netip.AddrFromSlice(network.IP)
+	if addr.Is4() {
+		ip = ip.Unmap()
+	}
+	return netip.PrefixFrom(ip, ones), record, nil
+}
+
+func aliasedPrefix(addr netip.Addr) (netip.Prefix, bool) {
+	for _, p := range aliasedIPv6 {
+		if p.Contains(addr) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// record adds the comparison of one segment to the report.
+func record(report *diffReport, segment netip.Prefix, oldRecord, newRecord mmdbtype.DataType) {
+	if recordsEqual(oldRecord, newRecord) {
+		return
+	}
+	e := diffEntry{Prefix: segment.String()}
+	if oldRecord != nil {
+		e.Old, _ = mmdbToJSON(oldRecord).(map[string]any)
+		e.OldASN = recordASN(oldRecord)
+	}
+	if newRecord != nil {
+		e.New, _ = mmdbToJSON(newRecord).(map[string]any)
+		e.NewASN = recordASN(newRecord)
+	}
+	switch {
+	case oldRecord == nil:
+		report.Added = append(report.Added, e)
+	case newRecord == nil:
+		report.Removed = append(report.Removed, e)
+	default:
+		if e.OldASN != nil && e.NewASN != nil && *e.OldASN != *e.NewASN {
+			report.Reassigned++
+		}
+		report.Changed = append(report.Changed, e)
+	}
+}
+
+// recordASN returns the autonomous_system_number of a record, if any.
+func recordASN(record mmdbtype.DataType) *uint32 {
+	m, ok := record.(mmdbtype.Map)
+	if !ok {
+		return nil
+	}
+	asn, ok := m["autonomous_system_number"].(mmdbtype.Uint32)
+	if !ok {
+		return nil
+	}
+	v := uint32(asn)
+	return &v
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// The origin lookups of the Team Cymru IP-to-ASN DNS service: a TXT query
+// for the reversed IPv4 address under origin.<zone>, or the reversed
+// nibbles of an IPv6 address under origin6.<zone>, returns
+// "ASN | prefix | CC | registry | allocated". Requests and responses are
+// plain DNS messages over UDP, which a few lines of encoding cover without
+// a DNS library.
+
+// dnsMaxMessage is the largest UDP response a client without EDNS accepts;
+// an origin answer is far smaller.
+const dnsMaxMessage = 512
+
+// DNS header flags, types, classes and response codes used by the
+// responder.
+const (
+	dnsFlagQR = 1 << 15
+	dnsFlagAA = 1 << 10
+	dnsFlagTC = 1 << 9
+	dnsFlagRD = 1 << 8
+
+	dnsTypeTXT = 16
+	dnsTypeANY = 255
+	dnsClassIN = 1
+
+	dnsNoError  = 0
+	dnsFormErr  = 1
+	dnsServFail = 2
+	dnsNXDomain = 3
+	dnsNotImp   = 4
+	dnsRefused  = 5
+)
+
+// dnsQuestion is the single question of a query.
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+	class uint16
+	// wire is the encoded question, echoed in the response.
+	wire []byte
+}
+
+// dnsResponder answers origin queries under zone from the database of s.
+type dnsResponder struct {
+	s    *lookupServer
+	zone string
+	ttl  uint32
+}
+
+// serveDNS answers origin queries under zone on the UDP address addr.
+func serveDNS(addr, zone string, ttl time.Duration, s *lookupServer) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	d := &dnsResponder{s: s, zone: strings.ToLower(strings.Trim(zone, ".")), ttl: uint32(ttl / time.Second)}
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		resp := d.answer(buf[:n])
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, peer); err != nil {
+			log.Printf("DNS response to %s failed: %v", peer, err)
+		}
+	}
+}
+
+// answer returns the response to a query message, or nil for messages
+// that get none: responses and messages too short for a header.
+func (d *dnsResponder) answer(msg []byte) []byte {
+	if len(msg) < 12 {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(msg)
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&dnsFlagQR != 0 {
+		return nil
+	}
+	respFlags := dnsFlagQR | flags&dnsFlagRD
+	if opcode := flags >> 11 & 0xf; opcode != 0 {
+		return dnsMessage(id, respFlags|dnsNotImp, nil, nil)
+	}
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return dnsMessage(id, respFlags|dnsFormErr, nil, nil)
+	}
+	q, err := parseDNSQuestion(msg)
+	if err != nil {
+		return dnsMessage(id, respFlags|dnsFormErr, nil, nil)
+	}
+
+	labels, ok := d.zoneLabels(q.name)
+	if !ok || (q.class != dnsClassIN && q.class != dnsTypeANY) {
+		return dnsMessage(id, respFlags|dnsRefused, &q, nil)
+	}
+	respFlags |= dnsFlagAA
+	if len(labels) == 0 || (len(labels) == 1 && (labels[0] == "origin" || labels[0] == "origin6")) {
+		// The zone apex and origin/origin6 themselves exist but hold no TXT.
+		return dnsMessage(id, respFlags|dnsNoError, &q, nil)
+	}
+
+	d.s.lookups.Add(1)
+	ip := reversedIP(labels)
+	if ip == nil {
+		d.s.invalid.Add(1)
+		return dnsMessage(id, respFlags|dnsNXDomain, &q, nil)
+	}
+	network, record, err := d.s.lookup(ip)
+	if err != nil {
+		d.s.failed.Add(1)
+		return dnsMessage(id, respFlags|dnsServFail, &q, nil)
+	}
+	txt, ok := originTXT(network, record)
+	if !ok {
+		d.s.notFound.Add(1)
+		return dnsMessage(id, respFlags|dnsNXDomain, &q, nil)
+	}
+	if q.qtype != dnsTypeTXT && q.qtype != dnsTypeANY {
+		return dnsMessage(id, respFlags|dnsNoError, &q, nil)
+	}
+	return dnsMessage(id, respFlags|dnsNoError, &q, txtRecord(d.ttl, txt))
+}
+
+// zoneLabels returns the labels of name below the zone, or reports false
+// for names outside it.
+func (d *dnsResponder) zoneLabels(name string) ([]string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == d.zone {
+		return nil, true
+	}
+	rest, ok := strings.CutSuffix(name, "."+d.zone)
+	if !ok {
+		return nil, false
+	}
+	return strings.Split(rest, "."), true
+}
+
+// reversedIP parses the labels of a query name: four decimal octets under
+// origin, or 32 hex nibbles under origin6, least significant first.
+func reversedIP(labels []string) net.IP {
+	apex, labels := labels[len(labels)-1], labels[:len(labels)-1]
+	switch {
+	case apex == "origin" && len(labels) == 4:
+		ip := make(net.IP, 4)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[3-i] = byte(octet)
+		}
+		return ip
+	case apex == "origin6" && len(labels) == 32:
+		ip := make(net.IP, 16)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			ip[15-i/2] |= byte(nibble) << (4 * (i % 2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// originTXT returns the origin answer for a record: its ASN, the network
+// it was found in and, with -rir-stats, the country and registry. The
+// allocation date of the Team Cymru service is not known and left empty.
+// Addresses without an ASN have no answer.
+func originTXT(network *net.IPNet, record mmdbtype.DataType) (string, bool) {
+	m, ok := record.(mmdbtype.Map)
+	if !ok {
+		return "", false
+	}
+	asn, ok := m["autonomous_system_number"].(mmdbtype.Uint32)
+	if !ok {
+		return "", false
+	}
+	country, _ := m["country"].(mmdbtype.String)
+	rir, _ := m["rir"].(mmdbtype.String)
+	return fmt.Sprintf("%d | %s | %s | %s |", asn, network, country, rir), true
+}
+
+// parseDNSQuestion decodes the question that follows the header. Names in
+// questions are never compressed.
+func parseDNSQuestion(msg []byte) (dnsQuestion, error) {
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return dnsQuestion{}, errors.New("truncated name")
+		}
+		n := int(msg[off])
+		if n == 0 {
+			off++
+			break
+		}
+		if n > 63 || off+1+n > len(msg) {
+			return dnsQuestion{}, errors.New("invalid label")
+		}
+		labels = append(labels, string(msg[off+1:off+1+n]))
+		off += 1 + n
+	}
+	if off+4 > len(msg) {
+		return dnsQuestion{}, errors.New("truncated question")
+	}
+	return dnsQuestion{
+		name:  strings.Join(labels, "."),
+		qtype: binary.BigEndian.Uint16(msg[off:]),
+		class: binary.BigEndian.Uint16(msg[off+2:]),
+		wire:  msg[12 : off+4],
+	}, nil
+}
+
+// txtRecord encodes a TXT answer for the question name, split into
+// character strings of at most 255 bytes.
+func txtRecord(ttl uint32, txt string) []byte {
+	var rdata []byte
+	for len(txt) > 0 || rdata == nil {
+		chunk := txt[:min(len(txt), 255)]
+		txt = txt[len(chunk):]
+		rdata = append(append(rdata, byte(len(chunk))), chunk...)
+	}
+	// 0xc00c points to the question name right after the header.
+	rr := []byte{0xc0, 0x0c}
+	rr = binary.BigEndian.AppendUint16(rr, dnsTypeTXT)
+	rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+// dnsMessage encodes a response with the question, if any, and at most one
+// answer. An answer that would exceed dnsMaxMessage is left out and the
+// response marked truncated.
+func dnsMessage(id, flags uint16, q *dnsQuestion, answer []byte) []byte {
+	var qd, an uint16
+	if q != nil {
+		qd = 1
+		if answer != nil {
+			an = 1
+		}
+	}
+	size := 12
+	if q != nil {
+		size += len(q.wire)
+	}
+	if size+len(answer) > dnsMaxMessage {
+		flags |= dnsFlagTC
+		answer, an = nil, 0
+	}
+
+	b := make([]byte, 0, size+len(answer))
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint16(b, qd)
+	b = binary.BigEndian.AppendUint16(b, an)
+	b = append(b, 0, 0, 0, 0) // no authority or additional records
+	if q != nil {
+		b = append(b, q.wire...)
+		b = append(b, answer...)
+	}
+	return b
+}
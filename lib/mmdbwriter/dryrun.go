@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// dataSectionSeparatorSize is the size of the zero bytes between the search
+// tree and the data section.
+const dataSectionSeparatorSize = 16
+
+// dryRunPointerSize is what a dry run counts for a value the data section
+// already holds, which the writer stores as a pointer of 2 to 5 bytes.
+const dryRunPointerSize = 4
+
+// validateDryRun rejects the options of a dry run that write files: the
+// rows it reads are not kept anywhere.
+func validateDryRun(cfg *config) error {
+	if !cfg.dryRun {
+		return nil
+	}
+	for _, f := range []struct{ flag, value string }{
+		{"-insert-log", cfg.insertLog},
+		{"-rejects", cfg.rejects},
+		{"-sqlite", cfg.sqlite},
+		{"-progress-file", cfg.progressFile},
+	} {
+		if f.value != "" {
+			return fmt.Errorf("-dry-run writes nothing and cannot be combined with %s", f.flag)
+		}
+	}
+	switch {
+	case cfg.daemon:
+		return errors.New("-dry-run cannot be combined with -daemon")
+	case cfg.minCoverage.enabled():
+		return errors.New("-min-coverage cannot be combined with -dry-run")
+	}
+	return nil
+}
+
+// sizeEstimate predicts the size of a database from the networks a dry run
+// would store, without building its tree.
+type sizeEstimate struct {
+	ipVersion int
+	records   map[netip.Prefix]mmdbtype.Map
+}
+
+func newSizeEstimate(ipVersion int) *sizeEstimate {
+	return &sizeEstimate{ipVersion: ipVersion, records: map[netip.Prefix]mmdbtype.Map{}}
+}
+
+// add stores record for prefix, replacing the record of an earlier row.
+func (e *sizeEstimate) add(prefix netip.Prefix, record mmdbtype.Map) {
+	e.records[prefix] = record
+}
+
+// treeKey is the path of a prefix in the search tree: IPv4 networks sit
+// under ::/96 in an IPv6 tree.
+type treeKey struct {
+	addr [16]byte
+	bits int
+}
+
+// nodes estimates the node count of the search tree: the number of
+// distinct nodes on the paths to the networks. Sorted, the nodes a path
+// shares with any earlier one are those it shares with the one before it.
+// The networks the writer adds on its own are counted by dryRun; siblings
+// it merges are not left out.
+func (e *sizeEstimate) nodes() int64 {
+	keys := make([]treeKey, 0, len(e.records))
+	for prefix := range e.records {
+		k := treeKey{bits: prefix.Bits()}
+		switch {
+		case prefix.Addr().Is6():
+			k.addr = prefix.Addr().As16()
+		case e.ipVersion == 4:
+			a := prefix.Addr().As4()
+			copy(k.addr[:], a[:])
+		default:
+			a := prefix.Addr().As4()
+			copy(k.addr[12:], a[:])
+			k.bits += 96
+		}
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b treeKey) int {
+		if c := bytes.Compare(a.addr[:], b.addr[:]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.bits, b.bits)
+	})
+
+	var nodes int64
+	for i, k := range keys {
+		shared := 0
+		if i > 0 {
+			prev := keys[i-1]
+			shared = min(k.bits, prev.bits, commonBits(k.addr, prev.addr)+1)
+		}
+		nodes += int64(k.bits - shared)
+	}
+	return nodes
+}
+
+// commonBits returns the length of the common prefix of a and b in bits.
+func commonBits(a, b [16]byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 128
+}
+
+// dataBytes estimates the size of the data section: every distinct record
+// serialized once, with the values repeated within and across records
+// counted as pointers as the writer stores them.
+func (e *sizeEstimate) dataBytes() (int64, error) {
+	seen := map[string]bool{}
+	var total int64
+	for _, record := range e.records {
+		key, size, err := encodeEstimate(record, seen)
+		if err != nil {
+			return 0, err
+		}
+		if !seen[key] {
+			seen[key] = true
+			total += size
+		}
+	}
+	return total, nil
+}
+
+// estimateEncoder serializes values as the data section writer does, but
+// only counts the bytes. buf holds the value without pointers, which tells
+// equal values apart, size what the writer would store for it, and seen
+// every value stored so far.
+type estimateEncoder struct {
+	buf  bytes.Buffer
+	size int64
+	seen map[string]bool
+}
+
+func (enc *estimateEncoder) Write(p []byte) (int, error) {
+	enc.size += int64(len(p))
+	return enc.buf.Write(p)
+}
+
+func (enc *estimateEncoder) WriteByte(c byte) error {
+	enc.size++
+	return enc.buf.WriteByte(c)
+}
+
+func (enc *estimateEncoder) WriteString(s string) (int, error) {
+	enc.size += int64(len(s))
+	return enc.buf.WriteString(s)
+}
+
+// WriteOrWritePointer counts value, or a pointer when an equal value was
+// counted before and the pointer is smaller.
+func (enc *estimateEncoder) WriteOrWritePointer(value mmdbtype.DataType) (int64, error) {
+	key, size, err := encodeEstimate(value, enc.seen)
+	if err != nil {
+		return 0, err
+	}
+	enc.buf.WriteString(key)
+	if enc.seen[key] {
+		size = min(size, dryRunPointerSize)
+	}
+	enc.seen[key] = true
+	enc.size += size
+	return size, nil
+}
+
+// encodeEstimate returns value serialized without pointers and the size
+// the writer would store it in, given the values in seen.
+func encodeEstimate(value mmdbtype.DataType, seen map[string]bool) (string, int64, error) {
+	enc := &estimateEncoder{seen: seen}
+	if _, err := value.WriteTo(enc); err != nil {
+		return "", 0, err
+	}
+	return enc.buf.String(), enc.size, nil
+}
+
+// dryRun implements -dry-run: the inputs are read, validated and merged as
+// in a build, without building the tree, and the output size is predicted
+// at every record size from the networks that would be stored. Nothing is
+// written; a record size given with -record-size that cannot hold the
+// database fails the run, as does -min-records.
+func dryRun(ctx context.Context, cfg *config) error {
+	if err := checkInputFiles(cfg); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	stats, err := processCSVFile(ctx, nil, cfg)
+	if err != nil {
+		return err
+	}
+	processed := time.Now()
+
+	baseNodes, metadataBytes, err := dryRunEmptyTree(cfg)
+	if err != nil {
+		return err
+	}
+	nodes := baseNodes + stats.estimate.nodes()
+	data, err := stats.estimate.dataBytes()
+	if err != nil {
+		return fmt.Errorf("failed to estimate the data section: %w", err)
+	}
+
+	// The records of the search tree address the nodes, the separator
+	// and the data section.
+	required := 0
+	for _, size := range recordSizes {
+		total := nodes*int64(size)/4 + dataSectionSeparatorSize + data + metadataBytes
+		viable := nodes+dataSectionSeparatorSize+data <= 1<<size
+		if viable && required == 0 {
+			required = size
+		}
+		logger.Info("predicted output", "record_size", size, "viable", viable, "bytes", total)
+	}
+
+	attrs := stats.summary(cfg)
+	attrs = append(attrs, "networks", len(stats.estimate.records), "nodes", nodes, "data_bytes", data,
+		"required_record_size", required,
+		"process_seconds", processed.Sub(start).Seconds(), "total_seconds", time.Since(start).Seconds())
+	logger.Info("dry run summary", attrs...)
+	if cfg.notifier != nil {
+		cfg.notifier.recordSummary(attrs)
+	}
+
+	if err := checkMinRecords(cfg, stats); err != nil {
+		return err
+	}
+	if !cfg.recordSizeAuto && cfg.recordSize < required {
+		return fmt.Errorf("the database needs -record-size %d, -record-size %d cannot address its ~%d nodes and ~%d data bytes",
+			required, cfg.recordSize, nodes, data)
+	}
+	return nil
+}
+
+// dryRunEmptyTree returns the node count of an empty tree with the options
+// of the build, the networks the writer stores or reserves on its own, and
+// the size of the metadata of the database.
+func dryRunEmptyTree(cfg *config) (nodes, metadataBytes int64, err error) {
+	writer, err := mmdbwriter.New(treeOptions(cfg))
+	if err != nil {
+		return 0, 0, err
+	}
+	metadata, err := linkMetadata(cfg)
+	if err != nil {
+		return 0, 0, err
+	}
+	var buf bytes.Buffer
+	if len(metadata) > 0 {
+		_, err = extraMetadata{db: writer, extra: metadata}.WriteTo(&buf)
+	} else {
+		_, err = writer.WriteTo(&buf)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to serialize database metadata: %w", err)
+	}
+	i := bytes.LastIndex(buf.Bytes(), metadataStartMarker)
+	if i < 0 {
+		return 0, 0, errors.New("failed to serialize database metadata: no metadata")
+	}
+	md, err := readMetadataMap(buf.Bytes()[i:])
+	if err != nil {
+		return 0, 0, err
+	}
+	count, _ := md["node_count"].(uint64)
+	return int64(count), int64(buf.Len() - i), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDryRun(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{nil, ""},
+		{[]string{"-first-seen", "seen.csv", "-coverage-index", "coverage.idx"}, ""},
+		{[]string{"-insert-log", "inserted.log"}, "cannot be combined with -insert-log"},
+		{[]string{"-rejects", "rejects.csv"}, "cannot be combined with -rejects"},
+		{[]string{"-sqlite", "asn.db"}, "cannot be combined with -sqlite"},
+		{[]string{"-progress-file", "progress.log"}, "cannot be combined with -progress-file"},
+		{[]string{"-min-coverage", "v4=50"}, "-min-coverage cannot be combined with -dry-run"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			err := validateDryRun(testConfig(t, append([]string{"-dry-run"}, tt.args...)...))
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDryRunWritesNothing(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, "-dry-run",
+		"-first-seen", filepath.Join(dir, "first-seen.csv"),
+		"-coverage-index", filepath.Join(dir, "coverage.idx"),
+		"-checksum", "-manifest")
+	cfg.csvFile = writeTestFile(t, "input.csv", "network,asn,org\n1.1.1.0/24,13335,Cloudflare\nnot-a-network,1,\n")
+	cfg.outputFile = filepath.Join(dir, "asn.mmdb")
+	if err := build(context.Background(), cfg, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("dry run wrote %v", entries)
+	}
+}
+
+// The prediction of a dry run is close to the size of the database the
+// build writes.
+func TestDryRunEstimate(t *testing.T) {
+	golden, err := os.ReadFile("testdata/bgp-tools.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var large strings.Builder
+	large.WriteString("network,asn,org\n")
+	for i := range 20000 {
+		fmt.Fprintf(&large, "%s,%d,Org %d\n", arrowTestPrefix(i), 64500+i%300, i%300)
+		if i%3 == 0 {
+			fmt.Fprintf(&large, "2001:db8:%x::/48,%d,Org %d\n", i, 64500+i%300, i%300)
+		}
+	}
+
+	tests := []struct {
+		name, input string
+		tolerance   float64
+	}{
+		{"golden corpus", string(golden), 0.25},
+		{"large", large.String(), 0.05},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.csvFile = writeTestFile(t, "input.csv", tt.input)
+			stats, err := processCSVFile(context.Background(), nil, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			baseNodes, metadataBytes, err := dryRunEmptyTree(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := stats.estimate.dataBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := baseNodes + stats.estimate.nodes()
+			predicted := nodes*int64(cfg.recordSize)/4 + dataSectionSeparatorSize + data + metadataBytes
+
+			built, _ := buildTestMMDB(t, testConfig(t), tt.input)
+			db := openTestDB(t, built)
+			if !within(float64(nodes), float64(db.Metadata.NodeCount), tt.tolerance) {
+				t.Errorf("predicted %d nodes, got %d", nodes, db.Metadata.NodeCount)
+			}
+			if !within(float64(predicted), float64(len(built)), tt.tolerance) {
+				t.Errorf("predicted %d bytes, got %d", predicted, len(built))
+			}
+		})
+	}
+}
+
+// within reports whether got is within the fraction tolerance of want.
+func within(got, want, tolerance float64) bool {
+	return got >= want*(1-tolerance) && got <= want*(1+tolerance)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// An enricher is a pipeline stage run on every built row. It adds its
+// fields to the record of prefix in place: the record belongs to the row
+// until the row is stored. Its Fields map is never nil.
+type enricher interface {
+	enrich(prefix netip.Prefix, record *mmdbbuild.Record, stats *buildStats)
+}
+
+// A networkEnricher is a pipeline stage run on the tree once every row is
+// stored, for sources that tag networks rather than rows, including space
+// no row covers.
+type networkEnricher interface {
+	enrichNetworks(writer *mmdbwriter.Tree, cfg *config, stats *buildStats) error
+}
+
+// enrichStage is a loaded stage of the pipeline. Row stages set row and
+// network stages network.
+type enrichStage struct {
+	name    string
+	row     enricher
+	network networkEnricher
+}
+
+// enricherDef registers a stage of the pipeline.
+type enricherDef struct {
+	name string
+
+	// network marks stages that load a networkEnricher.
+	network bool
+
+	// configured reports whether the flags give the stage its source; a
+	// configured stage runs unless -enrichers leaves it out. Stages
+	// without it only run when -enrichers names them.
+	configured func(cfg *config) bool
+
+	// load reads the source of the stage. The RIR delegations are passed
+	// in as they are loaded for other uses too.
+	load func(ctx context.Context, cfg *config, delegations rirDelegations) (enrichStage, error)
+}
+
+// enricherDefs are the registered stages in the order they run by
+// default, the built-in ones first.
+var enricherDefs []enricherDef
+
+// builtinEnrichers are the stages of the flags of a build. Row stages come
+// first as the network stages only see stored records.
+var builtinEnrichers = []enricherDef{
+	{
+		name:       "rpki",
+		configured: func(cfg *config) bool { return cfg.rpki != "" },
+		load: func(ctx context.Context, cfg *config, _ rirDelegations) (enrichStage, error) {
+			vrps, roas, err := loadVRPs(ctx, cfg.rpki, cfg.userAgent, cfg.fetchRetries)
+			if err != nil {
+				return enrichStage{}, err
+			}
+			logger.Info("loaded VRPs", "count", roas, "source", cfg.rpki)
+			return enrichStage{row: vrps}, nil
+		},
+	},
+	{
+		name:       "country",
+		configured: func(cfg *config) bool { return len(cfg.rirStats) > 0 },
+		load: func(_ context.Context, _ *config, delegations rirDelegations) (enrichStage, error) {
+			return enrichStage{row: delegations}, nil
+		},
+	},
+	{
+		name:       "upstreams",
+		configured: func(cfg *config) bool { return cfg.asRel != "" },
+		load: func(ctx context.Context, cfg *config, _ rirDelegations) (enrichStage, error) {
+			asRels, relations, err := loadASRelationships(ctx, cfg.asRel, cfg.userAgent, cfg.fetchRetries)
+			if err != nil {
+				return enrichStage{}, err
+			}
+			logger.Info("loaded AS relationships", "count", relations, "asns_with_upstreams", len(asRels.upstreams),
+				"source", cfg.asRel)
+			asRels.peersToo = cfg.asRelPeers
+			return enrichStage{row: asRels}, nil
+		},
+	},
+	{
+		name:       "ixp",
+		network:    true,
+		configured: func(cfg *config) bool { return cfg.peeringDB != "" },
+		load: func(ctx context.Context, cfg *config, _ rirDelegations) (enrichStage, error) {
+			prefixes, err := loadIXPPrefixes(ctx, cfg.peeringDB, cfg.userAgent, cfg.fetchRetries)
+			if err != nil {
+				return enrichStage{}, err
+			}
+			logger.Info("loaded IXP prefixes", "count", len(prefixes), "source", cfg.peeringDB)
+			return enrichStage{network: ixpEnricher(prefixes)}, nil
+		},
+	},
+	{
+		name:       "anycast",
+		network:    true,
+		configured: func(cfg *config) bool { return len(cfg.anycast) > 0 },
+		load: func(ctx context.Context, cfg *config, _ rirDelegations) (enrichStage, error) {
+			prefixes, err := loadAnycastPrefixes(ctx, cfg.anycast, cfg.userAgent, cfg.fetchRetries)
+			if err != nil {
+				return enrichStage{}, err
+			}
+			logger.Info("loaded anycast prefixes", "count", len(prefixes), "sources", len(cfg.anycast))
+			return enrichStage{network: anycastEnricher(prefixes)}, nil
+		},
+	},
+	{
+		name:       "geofeed",
+		network:    true,
+		configured: func(cfg *config) bool { return len(cfg.geofeeds) > 0 },
+		load: func(ctx context.Context, cfg *config, _ rirDelegations) (enrichStage, error) {
+			entries, err := loadGeofeeds(ctx, cfg.geofeeds, cfg.userAgent, cfg.fetchRetries)
+			if err != nil {
+				return enrichStage{}, err
+			}
+			logger.Info("loaded geofeeds", "count", len(entries), "sources", len(cfg.geofeeds))
+			return enrichStage{network: geofeedEnricher(entries)}, nil
+		},
+	},
+}
+
+// The built-in stages are registered while the package variables are
+// initialized, so that they come before those of any init function.
+var _ = func() bool {
+	for _, def := range builtinEnrichers {
+		registerEnricher(def)
+	}
+	return true
+}()
+
+// registerEnricher adds a stage to the pipeline, after those registered
+// before it. It is meant to be called from an init function.
+func registerEnricher(def enricherDef) {
+	if slices.ContainsFunc(enricherDefs, func(d enricherDef) bool { return d.name == def.name }) {
+		panic("enricher " + def.name + " registered twice")
+	}
+	enricherDefs = append(enricherDefs, def)
+}
+
+// enricherNames returns the names of the registered stages.
+func enricherNames() []string {
+	names := make([]string, len(enricherDefs))
+	for i, def := range enricherDefs {
+		names[i] = def.name
+	}
+	return names
+}
+
+// enricherList implements flag.Value for -enrichers, a comma-separated
+// list of the stages to run in that order; lists given more than once,
+// e.g. by a -config file, are joined. The names are checked against the
+// registered stages when the pipeline is set up.
+type enricherList []string
+
+func (l *enricherList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *enricherList) Set(value string) error {
+	// An empty list is set too: it turns every stage off.
+	if *l == nil {
+		*l = enricherList{}
+	}
+	for _, part := range strings.Split(value, ",") {
+		name := strings.ToLower(strings.TrimSpace(part))
+		if name == "" {
+			continue
+		}
+		if slices.Contains(*l, name) {
+			return fmt.Errorf("stage %q listed twice", name)
+		}
+		*l = append(*l, name)
+	}
+	return nil
+}
+
+// enrichPipeline is the loaded stages of a build, in the order they run.
+type enrichPipeline struct {
+	rows     []enrichStage
+	networks []enrichStage
+}
+
+// selectEnrichers returns the definitions of the stages the build runs,
+// in order: those of -enrichers, else every configured stage. Row stages
+// cannot follow network stages, which run after all rows.
+func selectEnrichers(cfg *config) ([]enricherDef, error) {
+	if cfg.enrichers == nil {
+		var defs []enricherDef
+		for _, def := range enricherDefs {
+			if def.configured != nil && def.configured(cfg) {
+				defs = append(defs, def)
+			}
+		}
+		return defs, nil
+	}
+
+	defs := make([]enricherDef, 0, len(cfg.enrichers))
+	for _, name := range cfg.enrichers {
+		i := slices.IndexFunc(enricherDefs, func(d enricherDef) bool { return d.name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("-enrichers: unknown stage %q (want %s)", name, strings.Join(enricherNames(), ", "))
+		}
+		def := enricherDefs[i]
+		if def.configured != nil && !def.configured(cfg) {
+			return nil, fmt.Errorf("-enrichers: stage %s has no source; set its flag too", name)
+		}
+		if !def.network && len(defs) > 0 && defs[len(defs)-1].network {
+			return nil, fmt.Errorf("-enrichers: row stage %s cannot run after network stage %s",
+				name, defs[len(defs)-1].name)
+		}
+		defs = append(defs, def)
+	}
+	for _, def := range enricherDefs {
+		if def.configured != nil && def.configured(cfg) && !slices.Contains(cfg.enrichers, def.name) {
+			logger.Info("skipping enrichment stage left out of -enrichers", "stage", def.name)
+		}
+	}
+	return defs, nil
+}
+
+// loadEnrichPipeline loads the sources of the stages the build runs.
+func loadEnrichPipeline(ctx context.Context, cfg *config, delegations rirDelegations) (*enrichPipeline, error) {
+	defs, err := selectEnrichers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	p := &enrichPipeline{}
+	for _, def := range defs {
+		stage, err := def.load(ctx, cfg, delegations)
+		if err != nil {
+			return nil, err
+		}
+		stage.name = def.name
+		if def.network {
+			p.networks = append(p.networks, stage)
+		} else {
+			p.rows = append(p.rows, stage)
+		}
+	}
+	return p, nil
+}
+
+// names returns the names of the stages in the order they run.
+func (p *enrichPipeline) names() []string {
+	var names []string
+	for _, stage := range slices.Concat(p.rows, p.networks) {
+		names = append(names, stage.name)
+	}
+	return names
+}
+
+// has reports whether the pipeline runs the named stage.
+func (p *enrichPipeline) has(name string) bool {
+	if p == nil {
+		return false
+	}
+	return slices.ContainsFunc(slices.Concat(p.rows, p.networks), func(s enrichStage) bool { return s.name == name })
+}
+
+// enrichRow runs the row stages on a built record, adding the time each
+// took to stats.
+func (p *enrichPipeline) enrichRow(prefix netip.Prefix, record *mmdbbuild.Record, stats *buildStats) {
+	for _, stage := range p.rows {
+		start := time.Now()
+		stage.row.enrich(prefix, record, stats)
+		stats.enrichTime[stage.name] += time.Since(start)
+	}
+}
+
+// enrichNetworks runs the network stages on the tree.
+func (p *enrichPipeline) enrichNetworks(writer *mmdbwriter.Tree, cfg *config, stats *buildStats) error {
+	for _, stage := range p.networks {
+		start := time.Now()
+		if err := stage.network.enrichNetworks(writer, cfg, stats); err != nil {
+			return err
+		}
+		stats.enrichTime[stage.name] += time.Since(start)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// tagEnricher is a row stage setting the field tag on every record.
+type tagEnricher string
+
+func (e tagEnricher) enrich(_ netip.Prefix, record *mmdbbuild.Record, _ *buildStats) {
+	record.Fields["tag"] = mmdbtype.String(e)
+}
+
+// registerTestEnricher registers a row stage named name for the test.
+func registerTestEnricher(t *testing.T, name string) {
+	t.Helper()
+	saved := slices.Clone(enricherDefs)
+	t.Cleanup(func() { enricherDefs = saved })
+	registerEnricher(enricherDef{
+		name: name,
+		load: func(context.Context, *config, rirDelegations) (enrichStage, error) {
+			return enrichStage{row: tagEnricher(name)}, nil
+		},
+	})
+}
+
+func TestRegisterEnricher(t *testing.T) {
+	want := []string{"rpki", "country", "upstreams", "ixp", "anycast", "geofeed"}
+	if got := enricherNames(); !slices.Equal(got, want) {
+		t.Fatalf("got built-in stages %v, want %v", got, want)
+	}
+
+	registerTestEnricher(t, "custom")
+	if got := enricherNames(); !slices.Equal(got, append(want, "custom")) {
+		t.Errorf("got stages %v after registering custom", got)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("registering a stage twice did not panic")
+			}
+		}()
+		registerEnricher(enricherDef{name: "rpki"})
+	}()
+
+	// A stage without a source flag only runs when -enrichers names it.
+	tests := []struct {
+		args []string
+		want any
+	}{
+		{nil, nil},
+		{[]string{"-enrichers", "custom"}, "custom"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			db, _ := buildTestDB(t, testConfig(t, tt.args...), "network,asn,org\n1.1.1.0/24,13335,Cloudflare\n")
+			if _, record := lookupTest(t, db, "1.1.1.1"); record["tag"] != tt.want {
+				t.Errorf("got tag %v, want %v", record["tag"], tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectEnrichers(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config
+		want    []string
+		wantErr string
+	}{
+		{"none configured", config{}, nil, ""},
+		{
+			"configured in default order",
+			config{geofeeds: []string{"feed.csv"}, rpki: "vrps.json", peeringDB: "ixp.json"},
+			[]string{"rpki", "ixp", "geofeed"}, "",
+		},
+		{
+			"-enrichers picks and orders",
+			config{rpki: "vrps.json", asRel: "rel.txt", enrichers: enricherList{"upstreams", "rpki"}},
+			[]string{"upstreams", "rpki"}, "",
+		},
+		{"-enrichers empty", config{rpki: "vrps.json", enrichers: enricherList{}}, []string{}, ""},
+		{"unknown stage", config{enrichers: enricherList{"whois"}}, nil, `unknown stage "whois"`},
+		{"no source", config{enrichers: enricherList{"rpki"}}, nil, "stage rpki has no source"},
+		{
+			"row after network",
+			config{rpki: "vrps.json", peeringDB: "ixp.json", enrichers: enricherList{"ixp", "rpki"}},
+			nil, "row stage rpki cannot run after network stage ixp",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defs, err := selectEnrichers(&tt.cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, def := range defs {
+				got = append(got, def.name)
+			}
+			if len(got) != len(tt.want) || !slices.Equal(got, tt.want) {
+				t.Errorf("got stages %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Output formats of the export command.
+const (
+	exportCSV   = "csv"
+	exportTSV   = "tsv"
+	exportJSONL = "jsonl"
+	exportArrow = "arrow"
+)
+
+// exportLeadingFields are written right after the network so that a CSV
+// export can be fed back to the build as network,asn,org.
+var exportLeadingFields = []string{"autonomous_system_number", "autonomous_system_organization"}
+
+// runExport implements `export [flags] <db.mmdb> [out]`: it writes every
+// network of the database with all of its record fields as CSV, TSV or
+// JSONL, or with the columns of the Parquet output as an Arrow stream, to
+// stdout unless an output file is given.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "",
+		"output format: csv, tsv, jsonl or arrow (default from the output file extension, else csv)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s export [flags] <db.mmdb> [out]\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return errors.New("export needs a database and at most one output file")
+	}
+	dbFile, outFile := fs.Arg(0), stdioPath
+	if fs.NArg() == 2 {
+		outFile = fs.Arg(1)
+	}
+
+	if *format == "" {
+		*format = exportCSV
+		switch {
+		case strings.HasSuffix(outFile, ".tsv"):
+			*format = exportTSV
+		case strings.HasSuffix(outFile, ".jsonl"):
+			*format = exportJSONL
+		case strings.HasSuffix(outFile, ".arrow") || strings.HasSuffix(outFile, ".arrows"):
+			*format = exportArrow
+		}
+	}
+	if *format != exportCSV && *format != exportTSV && *format != exportJSONL && *format != exportArrow {
+		return fmt.Errorf("unknown -format %q (want %s, %s, %s or %s)", *format, exportCSV, exportTSV, exportJSONL, exportArrow)
+	}
+
+	db, err := maxminddb.Open(dbFile)
+	if err != nil {
+		return fmt.Errorf("failed to open MMDB file: %w", err)
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if outFile != stdioPath {
+		out, err = os.Create(outFile)
+		if err != nil {
+			return fmt.Errorf("failed to create export file: %w", err)
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+
+	var exported int
+	switch *format {
+	case exportJSONL:
+		exported, err = exportJSONLines(db, w)
+	case exportArrow:
+		exported, err = exportArrowStream(db, w)
+	default:
+		comma := ','
+		if *format == exportTSV {
+			comma = '\t'
+		}
+		exported, err = exportTable(db, w, comma)
+	}
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	if outFile != stdioPath {
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("failed to write export: %w", err)
+		}
+		fmt.Printf("Exported %d networks to %s\n", exported, outFile)
+	}
+	return nil
+}
+
+// exportJSONLines writes one JSON object per network: the record fields
+// plus a network key.
+func exportJSONLines(db *maxminddb.Reader, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	exported := 0
+	err := walkDatabase(db, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+		if err := encodeJSONLine(enc, network, record); err != nil {
+			return err
+		}
+		exported++
+		return nil
+	})
+	return exported, err
+}
+
+func encodeJSONLine(enc *json.Encoder, network *net.IPNet, record mmdbtype.DataType) error {
+	fields, err := exportRecord(network, record)
+	if err != nil {
+		return err
+	}
+	line := make(map[string]any, len(fields)+1)
+	for key, value := range fields {
+		line[string(key)] = mmdbToJSON(value)
+	}
+	line["network"] = network.String()
+	if err := enc.Encode(line); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	return nil
+}
+
+// jsonlSink writes the networks of a built database as exportJSONLines
+// does, for -emit-normalized and -output-format jsonl. The file is written
+// next to its path and renamed over it.
+type jsonlSink struct {
+	path, tmp string
+	fh        *os.File
+	w         *bufio.Writer
+	enc       *json.Encoder
+}
+
+func newJSONLSink(t sinkTarget) (outputSink, error) {
+	outputDir := filepath.Dir(t.path)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	tmp := filepath.Join(outputDir, "."+filepath.Base(t.path)+".tmp")
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create normalized records file: %w", err)
+	}
+	w := bufio.NewWriterSize(fh, 1<<20)
+	return &jsonlSink{path: t.path, tmp: tmp, fh: fh, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (s *jsonlSink) add(network *net.IPNet, record mmdbtype.Map) error {
+	return encodeJSONLine(s.enc, network, record)
+}
+
+func (s *jsonlSink) close() error {
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write normalized records: %w", err)
+	}
+	if err := s.fh.Close(); err != nil {
+		return fmt.Errorf("failed to write normalized records: %w", err)
+	}
+	if err := os.Rename(s.tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace normalized records file: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonlSink) abort() {
+	s.fh.Close()
+	os.Remove(s.tmp)
+}
+
+// exportTable writes the networks as delimited rows with one column per
+// record field. The columns are the union of the fields of all records, so
+// the database is walked once to collect them and once to write the rows.
+func exportTable(db *maxminddb.Reader, w io.Writer, comma rune) (int, error) {
+	names := map[string]bool{}
+	err := walkDatabase(db, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+		fields, err := exportRecord(network, record)
+		if err != nil {
+			return err
+		}
+		for key := range fields {
+			names[string(key)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var columns []string
+	for _, name := range exportLeadingFields {
+		if names[name] {
+			columns = append(columns, name)
+			delete(names, name)
+		}
+	}
+	rest := make([]string, 0, len(names))
+	for name := range names {
+		rest = append(rest, name)
+	}
+	slices.Sort(rest)
+	columns = append(columns, rest...)
+
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	if err := cw.Write(append([]string{"network"}, columns...)); err != nil {
+		return 0, fmt.Errorf("failed to write export: %w", err)
+	}
+
+	exported := 0
+	row := make([]string, len(columns)+1)
+	err = walkDatabase(db, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+		fields, err := exportRecord(network, record)
+		if err != nil {
+			return err
+		}
+		row[0] = network.String()
+		for i, name := range columns {
+			row[i+1] = ""
+			if value, ok := fields[mmdbtype.String(name)]; ok {
+				if row[i+1], err = exportCell(value); err != nil {
+					return fmt.Errorf("failed to encode %s of %s: %w", name, network, err)
+				}
+			}
+		}
+		if err := cw.Write(row); err != nil {
+			return fmt.Errorf("failed to write export: %w", err)
+		}
+		exported++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	cw.Flush()
+	return exported, cw.Error()
+}
+
+// exportRecord returns the fields of a record. Every database this tool
+// writes stores maps; anything else cannot be laid out as fields.
+func exportRecord(network *net.IPNet, record mmdbtype.DataType) (mmdbtype.Map, error) {
+	fields, ok := record.(mmdbtype.Map)
+	if !ok {
+		return nil, fmt.Errorf("record of %s is a %T, not a map", network, record)
+	}
+	return fields, nil
+}
+
+// exportCell formats a field value for a CSV or TSV cell: strings as they
+// are, everything else in its JSON form, so that numbers and booleans stay
+// plain and maps and arrays can be read back with -column-type N=json.
+func exportCell(value mmdbtype.DataType) (string, error) {
+	if s, ok := value.(mmdbtype.String); ok {
+		return string(s), nil
+	}
+	data, err := json.Marshal(mmdbToJSON(value))
+	if err != nil {
+		return "", err
+	}
+	// Uint128 and bytes marshal as JSON strings; store their contents.
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		return s, nil
+	}
+	return string(data), nil
+}
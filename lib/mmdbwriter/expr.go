@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// The -set expression language is deliberately tiny: an expression is a
+// string literal ("...", with Go escapes), a column reference ($name by
+// header name, case-insensitive, or $N by 1-based position) or a call of
+// one of the builtins below. Everything evaluates to a string.
+var exprBuiltins = map[string]struct {
+	minArgs, maxArgs int
+	fn               func(args []string) string
+}{
+	"upper":  {1, 1, func(a []string) string { return strings.ToUpper(a[0]) }},
+	"lower":  {1, 1, func(a []string) string { return strings.ToLower(a[0]) }},
+	"trim":   {1, 1, func(a []string) string { return strings.TrimSpace(a[0]) }},
+	"concat": {1, -1, func(a []string) string { return strings.Join(a, "") }},
+}
+
+// exprNode is a parsed expression.
+type exprNode interface {
+	eval(vars exprVars) (string, error)
+}
+
+// exprVars resolves column references for the current row.
+type exprVars interface {
+	lookup(name string) (string, bool)
+}
+
+type exprLiteral string
+
+func (l exprLiteral) eval(exprVars) (string, error) { return string(l), nil }
+
+type exprColumn string
+
+func (c exprColumn) eval(vars exprVars) (string, error) {
+	v, ok := vars.lookup(string(c))
+	if !ok {
+		return "", fmt.Errorf("no column $%s", string(c))
+	}
+	return v, nil
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+func (c exprCall) eval(vars exprVars) (string, error) {
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return "", err
+		}
+		args[i] = v
+	}
+	return exprBuiltins[c.name].fn(args), nil
+}
+
+// parseExpr parses a complete expression.
+func parseExpr(src string) (exprNode, error) {
+	p := &exprParser{src: src}
+	node, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.src[p.pos:], p.pos)
+	}
+	return node, nil
+}
+
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) parse() (exprNode, error) {
+	p.skipSpace()
+	if p.pos == len(p.src) {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	switch c := p.src[p.pos]; {
+	case c == '"':
+		return p.parseString()
+	case c == '$':
+		p.pos++
+		name := p.ident()
+		if name == "" {
+			return nil, fmt.Errorf("expected a column name after $ at offset %d", p.pos)
+		}
+		return exprColumn(name), nil
+	default:
+		name := p.ident()
+		if name == "" {
+			return nil, fmt.Errorf("unexpected %q at offset %d", p.src[p.pos:], p.pos)
+		}
+		return p.parseCall(name)
+	}
+}
+
+func (p *exprParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.src) {
+		r := rune(p.src[p.pos])
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
+			break
+		}
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *exprParser) parseString() (exprNode, error) {
+	// Find the closing quote, skipping escaped characters.
+	end := p.pos + 1
+	for end < len(p.src) && p.src[end] != '"' {
+		if p.src[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.src) {
+		return nil, errors.New("unterminated string literal")
+	}
+
+	s, err := strconv.Unquote(p.src[p.pos : end+1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid string literal %s: %w", p.src[p.pos:end+1], err)
+	}
+	p.pos = end + 1
+	return exprLiteral(s), nil
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	builtin, ok := exprBuiltins[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+
+	p.skipSpace()
+	if p.pos == len(p.src) || p.src[p.pos] != '(' {
+		return nil, fmt.Errorf("expected ( after %s", name)
+	}
+	p.pos++
+
+	call := exprCall{name: name}
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == ')' {
+		p.pos++
+	} else {
+		for {
+			arg, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+
+			p.skipSpace()
+			if p.pos == len(p.src) {
+				return nil, fmt.Errorf("missing ) in call to %s", name)
+			}
+			if p.src[p.pos] == ')' {
+				p.pos++
+				break
+			}
+			if p.src[p.pos] != ',' {
+				return nil, fmt.Errorf("expected , or ) at offset %d", p.pos)
+			}
+			p.pos++
+		}
+	}
+
+	if len(call.args) < builtin.minArgs || (builtin.maxArgs >= 0 && len(call.args) > builtin.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments to %s: %d", name, len(call.args))
+	}
+	return call, nil
+}
+
+// setRule is one -set field=expression assignment.
+type setRule struct {
+	field string
+	expr  exprNode
+}
+
+// setRules implements flag.Value for the repeatable -set flag. Rules are
+// applied in order, so later rules can override earlier ones.
+type setRules []setRule
+
+func (s *setRules) String() string {
+	fields := make([]string, len(*s))
+	for i, rule := range *s {
+		fields[i] = rule.field
+	}
+	return strings.Join(fields, ",")
+}
+
+func (s *setRules) Set(value string) error {
+	field, src, ok := strings.Cut(value, "=")
+	field = strings.TrimSpace(field)
+	if !ok || field == "" {
+		return fmt.Errorf("expected field=expression, got %q", value)
+	}
+	expr, err := parseExpr(src)
+	if err != nil {
+		return fmt.Errorf("invalid expression for %s: %w", field, err)
+	}
+	*s = append(*s, setRule{field: field, expr: expr})
+	return nil
+}
+
+// rowVars resolves column references against the header of the input.
+type rowVars struct {
+	header []string
+	row    []string
+}
+
+func (v rowVars) lookup(name string) (string, bool) {
+	index := mmdbbuild.HeaderIndex(v.header, name)
+	if index < 0 {
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 1 || n > len(v.header) {
+			return "", false
+		}
+		index = n - 1
+	}
+	return columnValue(v.row, index), true
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestExpr(t *testing.T) {
+	vars := rowVars{
+		header: []string{"network", "asn", "Org", "cc"},
+		row:    []string{"1.2.3.0/24", "64500", " Example Networks ", "nl"},
+	}
+	tests := []struct {
+		src     string
+		want    string
+		wantErr bool
+	}{
+		{src: `"literal"`, want: "literal"},
+		{src: `"tab\there"`, want: "tab\there"},
+		{src: `"quote \" inside"`, want: `quote " inside`},
+		{src: `$cc`, want: "nl"},
+		{src: `$ORG`, want: "Example Networks"},
+		{src: `$2`, want: "64500"},
+		{src: `upper($cc)`, want: "NL"},
+		{src: `lower("ABC")`, want: "abc"},
+		{src: `trim("  padded ")`, want: "padded"},
+		{src: ` concat( "AS" , $asn ) `, want: "AS64500"},
+		{src: `concat(upper($cc), "-", trim(lower($org)))`, want: "NL-example networks"},
+		{src: `$missing`, wantErr: true},
+		{src: `$5`, wantErr: true},
+	}
+	for _, tt := range tests {
+		node, err := parseExpr(tt.src)
+		if err != nil {
+			t.Errorf("parseExpr(%s): %v", tt.src, err)
+			continue
+		}
+		got, err := node.eval(vars)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("eval(%s): got error %v, want error %t", tt.src, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("eval(%s) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`   `,
+		`"unterminated`,
+		`"bad \q escape"`,
+		`$`,
+		`nosuch($cc)`,
+		`upper`,
+		`upper($cc`,
+		`upper($cc $asn)`,
+		`upper()`,
+		`upper($cc, $asn)`,
+		`concat()`,
+		`$cc trailing`,
+		`#`,
+	} {
+		if _, err := parseExpr(src); err == nil {
+			t.Errorf("parseExpr(%q) succeeded", src)
+		}
+	}
+}
+
+func TestSetRules(t *testing.T) {
+	var rules setRules
+	for _, value := range []string{"country=upper($cc)", " label = concat($asn, \"!\")"} {
+		if err := rules.Set(value); err != nil {
+			t.Fatalf("Set(%q): %v", value, err)
+		}
+	}
+	if got := rules.String(); got != "country,label" {
+		t.Errorf("got %q, want country,label", got)
+	}
+	for _, value := range []string{"no-equals", "=upper($cc)", "field=upper("} {
+		if err := rules.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded", value)
+		}
+	}
+}
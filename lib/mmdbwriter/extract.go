@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// runExtract implements `extract in.mmdb prefix out.mmdb`: it copies every
+// network of the source database that lies within prefix into a new
+// database with the same metadata.
+func runExtract(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: %s extract <in.mmdb> <prefix> <out.mmdb>", os.Args[0])
+	}
+	inFile, prefix, outFile := args[0], args[1], args[2]
+
+	_, within, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix %s: %w", prefix, err)
+	}
+
+	db, err := maxminddb.Open(inFile)
+	if err != nil {
+		return fmt.Errorf("failed to open MMDB file: %w", err)
+	}
+	defer db.Close()
+
+	fmt.Printf("Extracting %s from %s\n", within, inFile)
+
+	sink, err := openOutputSink(outputFormatMMDB, sinkTarget{path: outFile, opts: treeOptionsFrom(db.Metadata)})
+	if err != nil {
+		return err
+	}
+	extracted, err := writeSink(context.Background(), sink, db, within)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Extracted %d networks into %s\n", extracted, outFile)
+	return nil
+}
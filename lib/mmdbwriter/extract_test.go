@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestExtract(t *testing.T) {
+	source, err := os.ReadFile("testdata/bgp-tools.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := buildTestMMDB(t, testConfig(t), string(source))
+	inFile := writeTestFile(t, "in.mmdb", string(data))
+	in := openTestDB(t, data)
+
+	tests := []struct {
+		prefix  string
+		inside  []string
+		outside []string
+	}{
+		{"8.8.0.0/16", []string{"8.8.8.8", "8.8.4.4", "8.8.1.1"}, []string{"1.1.1.1", "9.9.9.9"}},
+		{"45.3.0.0/16", []string{"45.3.3.1", "45.3.200.1"}, []string{"45.2.0.1"}},
+		{"9.9.9.0/24", []string{"9.9.9.9", "9.9.9.200"}, []string{"9.1.1.1"}},
+		{"2001:4860::/32", []string{"2001:4860:4860::8888", "2001:4860:1::1"}, []string{"2606:4700::1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			outFile := filepath.Join(t.TempDir(), "out.mmdb")
+			if err := runExtract([]string{inFile, tt.prefix, outFile}); err != nil {
+				t.Fatal(err)
+			}
+			out, err := maxminddb.Open(outFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+
+			if out.Metadata.DatabaseType != in.Metadata.DatabaseType || out.Metadata.IPVersion != in.Metadata.IPVersion {
+				t.Errorf("got metadata %+v, want that of the source", out.Metadata)
+			}
+			for _, ip := range tt.inside {
+				_, want, err := lookupRecord(in, net.ParseIP(ip))
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, got, err := lookupRecord(out, net.ParseIP(ip))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want == nil || !recordsEqual(got, want) {
+					t.Errorf("%s: got %v, want %v", ip, got, want)
+				}
+			}
+			for _, ip := range tt.outside {
+				if _, got, err := lookupRecord(out, net.ParseIP(ip)); err != nil || got != nil {
+					t.Errorf("%s: got %v (%v), want no record", ip, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractInvalidPrefix(t *testing.T) {
+	if err := runExtract([]string{"in.mmdb", "8.8.8.8", "out.mmdb"}); err == nil {
+		t.Error("extract with an address instead of a prefix succeeded")
+	}
+}
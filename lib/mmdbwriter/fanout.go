@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// outputJob serializes one output tree. Jobs must be independent of each
+// other; they only share read-only inputs such as the built database.
+type outputJob struct {
+	name string
+	run  func() error
+}
+
+// runOutputJobs runs jobs on at most workers goroutines and prints the
+// time each took in job order once all are done. Errors from all failed
+// jobs are returned together.
+func runOutputJobs(jobs []outputJob, workers int) error {
+	elapsed := make([]time.Duration, len(jobs))
+	errs := make([]error, len(jobs))
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				start := time.Now()
+				if err := jobs[i].run(); err != nil {
+					errs[i] = fmt.Errorf("%s: %w", jobs[i].name, err)
+				}
+				elapsed[i] = time.Since(start)
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for i, job := range jobs {
+		logger.Info("output serialized", "output", job.name, "duration", elapsed[i].Round(time.Microsecond))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunOutputJobs(t *testing.T) {
+	for _, workers := range []int{1, 2, 8} {
+		var ran atomic.Int32
+		var running, maxRunning atomic.Int32
+		jobs := make([]outputJob, 5)
+		for i := range jobs {
+			jobs[i] = outputJob{name: "job" + string(rune('a'+i)), run: func() error {
+				n := running.Add(1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				defer running.Add(-1)
+				ran.Add(1)
+				if i == 1 || i == 3 {
+					return errors.New("failed")
+				}
+				return nil
+			}}
+		}
+
+		err := runOutputJobs(jobs, workers)
+		if ran.Load() != int32(len(jobs)) {
+			t.Errorf("%d workers: ran %d of %d jobs", workers, ran.Load(), len(jobs))
+		}
+		if int(maxRunning.Load()) > workers {
+			t.Errorf("%d workers: %d jobs ran at once", workers, maxRunning.Load())
+		}
+		if err == nil || !strings.Contains(err.Error(), "jobb: failed") || !strings.Contains(err.Error(), "jobd: failed") {
+			t.Errorf("%d workers: got error %v, want the errors of jobb and jobd", workers, err)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mmdbwriter/pkg/bgptools"
+)
+
+// defaultUserAgent identifies the tool to bgp.tools, which rejects
+// requests without a descriptive User-Agent.
+const defaultUserAgent = "BGP.Tools-OpenDB/1.0.0 (https://github.com/Alice39s/BGP.Tools-OpenDB)"
+
+// fetchRetryDelay is the wait before the first retry; it doubles after
+// every failed attempt.
+const fetchRetryDelay = time.Second
+
+// fetchState is stored next to a downloaded file as <file>.fetch.json so
+// the next fetch can be a conditional GET. FetchedAt is when the file was
+// last downloaded, for the fetched_at metadata of the builds using it.
+type fetchState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	FetchedAt    string `json:"fetched_at,omitempty"`
+}
+
+// readFetchState returns the fetch state of path if it was fetched from
+// url.
+func readFetchState(url, path string) (fetchState, bool) {
+	var state fetchState
+	data, err := os.ReadFile(path + ".fetch.json")
+	if err != nil || json.Unmarshal(data, &state) != nil || state.URL != url {
+		return fetchState{}, false
+	}
+	return state, true
+}
+
+// errRetryable marks a failed attempt that is worth repeating.
+type errRetryable struct{ err error }
+
+func (e errRetryable) Error() string { return e.err.Error() }
+func (e errRetryable) Unwrap() error { return e.err }
+
+// fetchFile downloads url to path, retrying transient failures with
+// exponential backoff. When path was fetched from the same url before, the
+// request is conditional and an unchanged upstream file is not downloaded
+// again. It reports whether path was updated. Cancelling ctx stops the
+// download without a retry and keeps the partial file for the next run.
+// Requests go through a bgptools.Client, so they carry userAgent and retries
+// wait for the Retry-After of a 429 or 503 response.
+func fetchFile(ctx context.Context, url, path, userAgent string, retries int) (bool, error) {
+	statePath := path + ".fetch.json"
+	state, _ := readFetchState(url, path)
+	// Without the cached file a conditional request is of no use.
+	if _, err := os.Stat(path); err != nil {
+		state = fetchState{}
+	}
+
+	client, err := bgptools.New(bgptools.Options{UserAgent: userAgent})
+	if err != nil {
+		return false, err
+	}
+	delay := fetchRetryDelay
+	for attempt := 0; ; attempt++ {
+		updated, err := fetchOnce(ctx, client, url, path, &state)
+		if err == nil {
+			if !updated {
+				return false, nil
+			}
+			state.URL = url
+			state.FetchedAt = time.Now().UTC().Format(time.RFC3339)
+			data, err := json.MarshalIndent(state, "", "  ")
+			if err != nil {
+				return true, err
+			}
+			if err := os.WriteFile(statePath, append(data, '\n'), 0644); err != nil {
+				return true, fmt.Errorf("failed to write fetch state: %w", err)
+			}
+			return true, nil
+		}
+
+		if ctx.Err() != nil {
+			return false, context.Cause(ctx)
+		}
+		var retryable errRetryable
+		if !errors.As(err, &retryable) || attempt >= retries {
+			return false, err
+		}
+		logger.Warn("fetch failed, retrying", "url", url, "attempt", attempt+1, "attempts", retries+1,
+			"error", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return false, context.Cause(ctx)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// fetchPartial is stored next to an interrupted download as
+// <file>.part.json. It names the version of the upstream file the partial
+// data belongs to, so the rest can be requested with If-Range.
+type fetchPartial struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// fetchOnce makes a single request. A 304 response leaves path as it is.
+//
+// The response is written to <file>.part, which an interrupted transfer
+// leaves behind: the next attempt, in this run or a later one, asks for the
+// remaining bytes with a Range request and only starts over when the
+// upstream file has changed. A complete download that is gzip, bzip2 or
+// zstd compressed is decompressed into path.
+func fetchOnce(ctx context.Context, client *bgptools.Client, url, path string, state *fetchState) (bool, error) {
+	partPath, partStatePath := path+".part", path+".part.json"
+	var partial fetchPartial
+	var offset int64
+	if data, err := os.ReadFile(partStatePath); err == nil && json.Unmarshal(data, &partial) == nil && partial.URL == url {
+		if info, err := os.Stat(partPath); err == nil {
+			offset = info.Size()
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if partial.ETag != "" {
+			req.Header.Set("If-Range", partial.ETag)
+		} else {
+			req.Header.Set("If-Range", partial.LastModified)
+		}
+		logger.Info("resuming download", "url", url, "offset", offset)
+	} else {
+		if state.ETag != "" {
+			req.Header.Set("If-None-Match", state.ETag)
+		}
+		if state.LastModified != "" {
+			req.Header.Set("If-Modified-Since", state.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, errRetryable{err}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return false, nil
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			os.Remove(partPath)
+			return false, errRetryable{fmt.Errorf("unexpected Content-Range %q for offset %d", resp.Header.Get("Content-Range"), offset)}
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial data does not fit the upstream file any more.
+		os.Remove(partPath)
+		return false, errRetryable{fmt.Errorf("HTTP %s", resp.Status)}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return false, errRetryable{fmt.Errorf("HTTP %s", resp.Status)}
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("HTTP %s - %s", resp.Status, url)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if resp.StatusCode == http.StatusOK {
+		// A full response: the upstream file changed or Range is not
+		// supported.
+		if offset > 0 {
+			logger.Info("download cannot be resumed, starting over", "url", url)
+		}
+		offset = 0
+		flags |= os.O_TRUNC
+		partial = fetchPartial{URL: url, LastModified: resp.Header.Get("Last-Modified")}
+		// Weak ETags cannot be used with If-Range.
+		if etag := resp.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+			partial.ETag = etag
+		}
+		if partial.ETag != "" || partial.LastModified != "" {
+			data, err := json.Marshal(partial)
+			if err != nil {
+				return false, err
+			}
+			if err := os.WriteFile(partStatePath, append(data, '\n'), 0644); err != nil {
+				return false, fmt.Errorf("failed to write fetch state: %w", err)
+			}
+		} else {
+			os.Remove(partStatePath)
+		}
+	}
+
+	// Download next to the destination and rename, so an interrupted
+	// transfer never replaces a good cached file.
+	part, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return false, fmt.Errorf("failed to create download file: %w", err)
+	}
+	n, err := io.Copy(part, resp.Body)
+	if cerr := part.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, errRetryable{fmt.Errorf("download interrupted after %d bytes: %w", offset+n, err)}
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return false, errRetryable{fmt.Errorf("download truncated: got %d of %d bytes", offset+n, offset+resp.ContentLength)}
+	}
+
+	compression, err := storeDownload(partPath, path)
+	if err != nil {
+		return false, err
+	}
+	if compression != "" {
+		logger.Info("decompressed download", "url", url, "compression", compression)
+	}
+	os.Remove(partPath)
+	os.Remove(partStatePath)
+
+	state.ETag = resp.Header.Get("ETag")
+	state.LastModified = resp.Header.Get("Last-Modified")
+	return true, nil
+}
+
+// storeDownload moves a complete download to path, decompressing gzip,
+// bzip2 and zstd data on the way. It returns the compression that was
+// found.
+func storeDownload(partPath, path string) (string, error) {
+	src, err := os.Open(partPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(src, magic)
+	magic = magic[:n]
+
+	var compression string
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		compression = "gzip"
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		compression = "bzip2"
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		compression = "zstd"
+	default:
+		src.Close()
+		if err := os.Rename(partPath, path); err != nil {
+			return "", fmt.Errorf("failed to store download: %w", err)
+		}
+		return "", nil
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create download file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	var r io.ReadCloser
+	if r, err = decompressInput(src); err == nil {
+		_, err = io.Copy(tmp, r)
+		r.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Corrupt data is not fixed by resuming it.
+		os.Remove(partPath)
+		return "", errRetryable{fmt.Errorf("failed to decompress %s download: %w", compression, err)}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to store download: %w", err)
+	}
+	return compression, nil
+}
+
+// trimCompressionExt strips the extension of a compression storeDownload
+// undoes from a file name or URL.
+func trimCompressionExt(name string) string {
+	for _, ext := range []string{".gz", ".bz2", ".zst"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fetchServer serves content with an ETag and Last-Modified date,
+// supporting conditional and Range requests, and records the requests.
+type fetchServer struct {
+	mu       sync.Mutex
+	content  []byte
+	etag     string
+	requests []*http.Request
+}
+
+func (s *fetchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, etag := s.content, s.etag
+	s.requests = append(s.requests, r)
+	s.mu.Unlock()
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, "table.csv", time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), bytes.NewReader(content))
+}
+
+func (s *fetchServer) set(content, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content, s.etag = []byte(content), etag
+}
+
+func (s *fetchServer) last() *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+func TestFetchFileConditionalGET(t *testing.T) {
+	s := &fetchServer{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "table.csv")
+	ctx := context.Background()
+
+	steps := []struct {
+		name        string
+		content     string
+		etag        string
+		prepare     func()
+		wantUpdated bool
+		wantINM     string
+	}{
+		{name: "first download", content: "v1", etag: `"v1"`, wantUpdated: true},
+		{name: "unchanged", content: "v1", etag: `"v1"`, wantUpdated: false, wantINM: `"v1"`},
+		{name: "changed", content: "v2", etag: `"v2"`, wantUpdated: true, wantINM: `"v1"`},
+		{
+			name:        "missing cached file",
+			content:     "v2",
+			etag:        `"v2"`,
+			prepare:     func() { os.Remove(path) },
+			wantUpdated: true,
+		},
+		{
+			name:    "state of another URL",
+			content: "v2",
+			etag:    `"v2"`,
+			prepare: func() {
+				os.WriteFile(path+".fetch.json", []byte(`{"url":"https://example.com/other","etag":"\"v2\""}`), 0644)
+			},
+			wantUpdated: true,
+		},
+	}
+	for _, step := range steps {
+		if step.prepare != nil {
+			step.prepare()
+		}
+		s.set(step.content, step.etag)
+		updated, err := fetchFile(ctx, srv.URL, path, "test-agent", 0)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if updated != step.wantUpdated {
+			t.Errorf("%s: got updated %t, want %t", step.name, updated, step.wantUpdated)
+		}
+		req := s.last()
+		if got := req.Header.Get("If-None-Match"); got != step.wantINM {
+			t.Errorf("%s: got If-None-Match %q, want %q", step.name, got, step.wantINM)
+		}
+		if got := req.Header.Get("User-Agent"); got != "test-agent" {
+			t.Errorf("%s: got User-Agent %q", step.name, got)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != step.content {
+			t.Errorf("%s: got %q (%v), want %q", step.name, data, err, step.content)
+		}
+		if state, ok := readFetchState(srv.URL, path); !ok || state.ETag != step.etag || state.FetchedAt == "" {
+			t.Errorf("%s: got fetch state %+v", step.name, state)
+		}
+	}
+}
+
+func TestFetchFileErrors(t *testing.T) {
+	tests := []struct {
+		status       int
+		retries      int
+		wantRequests int
+	}{
+		{http.StatusNotFound, 2, 1},
+		{http.StatusForbidden, 2, 1},
+		{http.StatusServiceUnavailable, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			path := filepath.Join(t.TempDir(), "table.csv")
+			if _, err := fetchFile(context.Background(), srv.URL, path, "test-agent", tt.retries); err == nil {
+				t.Fatal("fetch succeeded")
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("got %d requests, want %d", requests, tt.wantRequests)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("the failed fetch created %s", path)
+			}
+		})
+	}
+}
+
+func TestFetchFileResume(t *testing.T) {
+	const content = "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,15169\n"
+	tests := []struct {
+		name        string
+		partial     string
+		partialETag string
+		serverETag  string
+		wantRange   string
+	}{
+		{
+			name:        "same version",
+			partial:     content[:20],
+			partialETag: `"v1"`,
+			serverETag:  `"v1"`,
+			wantRange:   "bytes=20-",
+		},
+		{
+			name:        "changed upstream starts over",
+			partial:     "stale data",
+			partialETag: `"v0"`,
+			serverETag:  `"v1"`,
+			wantRange:   "bytes=10-",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &fetchServer{}
+			s.set(content, tt.serverETag)
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+
+			path := filepath.Join(t.TempDir(), "table.csv")
+			if err := os.WriteFile(path+".part", []byte(tt.partial), 0644); err != nil {
+				t.Fatal(err)
+			}
+			state := `{"url":"` + srv.URL + `","etag":` + strconv.Quote(tt.partialETag) + `}`
+			if err := os.WriteFile(path+".part.json", []byte(state), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			updated, err := fetchFile(context.Background(), srv.URL, path, "test-agent", 0)
+			if err != nil || !updated {
+				t.Fatalf("got updated %t, error %v", updated, err)
+			}
+			req := s.last()
+			if got := req.Header.Get("Range"); got != tt.wantRange {
+				t.Errorf("got Range %q, want %q", got, tt.wantRange)
+			}
+			if got := req.Header.Get("If-Range"); got != tt.partialETag {
+				t.Errorf("got If-Range %q, want %q", got, tt.partialETag)
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != content {
+				t.Errorf("got %q (%v), want %q", data, err, content)
+			}
+			for _, leftover := range []string{path + ".part", path + ".part.json"} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("%s was left behind", leftover)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchFileInterrupted(t *testing.T) {
+	const content = "network,asn\n1.1.1.0/24,13335\n8.8.8.0/24,15169\n"
+	var mu sync.Mutex
+	cut := true
+	s := &fetchServer{}
+	s.set(content, `"v1"`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		cutThis := cut
+		cut = false
+		mu.Unlock()
+		if !cutThis {
+			s.ServeHTTP(w, r)
+			return
+		}
+		// Promise the whole file but drop the connection halfway.
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write([]byte(content[:15]))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "table.csv")
+
+	if _, err := fetchFile(context.Background(), srv.URL, path, "test-agent", 0); err == nil {
+		t.Fatal("the interrupted fetch succeeded")
+	}
+	if data, err := os.ReadFile(path + ".part"); err != nil || string(data) != content[:15] {
+		t.Fatalf("got partial download %q (%v), want %q", data, err, content[:15])
+	}
+	if _, err := fetchFile(context.Background(), srv.URL, path, "test-agent", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.last().Header.Get("Range"); got != "bytes=15-" {
+		t.Errorf("got Range %q, want bytes=15-", got)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != content {
+		t.Errorf("got %q (%v), want %q", data, err, content)
+	}
+}
+
+func TestFetchFileDecompresses(t *testing.T) {
+	t.Setenv("PATH", "")
+	for _, compression := range []string{"gzip", "bzip2", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			s := &fetchServer{}
+			s.set(string(compressTest(t, compression)), `"`+compression+`"`)
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+			path := filepath.Join(t.TempDir(), "table.csv")
+
+			if _, err := fetchFile(context.Background(), srv.URL+"/table.csv.z", path, "test-agent", 0); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != compressTestContent {
+				t.Errorf("got %q (%v), want %q", data, err, compressTestContent)
+			}
+		})
+	}
+}
+
+func TestTrimCompressionExt(t *testing.T) {
+	for name, want := range map[string]string{
+		"table.csv.gz":  "table.csv",
+		"table.csv.bz2": "table.csv",
+		"table.csv.zst": "table.csv",
+		"table.csv":     "table.csv",
+		"table.gz.csv":  "table.gz.csv",
+	} {
+		if got := trimCompressionExt(name); got != want {
+			t.Errorf("trimCompressionExt(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
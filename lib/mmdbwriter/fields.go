@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Optional columns recognized by their header name, in addition to the
+// positional network, asn and organization columns.
+const (
+	// rdnsColumn holds the canonical reverse-DNS suffix of the
+	// allocation, stored as reverse_dns.
+	rdnsColumn = "rdns"
+
+	// rpkiColumn holds the RPKI ROA validation state of the prefix,
+	// stored as rpki_status.
+	rpkiColumn = "rpki"
+
+	// expiresColumn holds the time after which the prefix is stale,
+	// stored as expires in Unix seconds.
+	expiresColumn = "expires"
+
+	// hitsColumn holds how many bgp.tools peers see the route, stored
+	// as route_visibility.
+	hitsColumn = "hits"
+
+	// visibilityColumn holds how many peers of an MRT dump see the
+	// route, stored as visibility.
+	visibilityColumn = "visibility"
+
+	// pathLengthColumn holds the length of the shortest AS path of the
+	// route, stored as path_length.
+	pathLengthColumn = "path_length"
+)
+
+// rpkiStatuses are the accepted values of the rpki column.
+var rpkiStatuses = []string{"valid", "invalid", "unknown", "notfound"}
+
+// parseTimestamp accepts Unix seconds or an RFC 3339 timestamp. Times
+// before the Unix epoch are rejected as they cannot be stored unsigned.
+func parseTimestamp(s string) (time.Time, error) {
+	var t time.Time
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		t = time.Unix(secs, 0)
+	} else if t, err = time.Parse(time.RFC3339, s); err != nil {
+		return time.Time{}, errors.New("want Unix seconds or an RFC 3339 timestamp")
+	}
+	if t.Unix() < 0 {
+		return time.Time{}, errors.New("timestamp is before the Unix epoch")
+	}
+	return t, nil
+}
+
+// columnValue returns the trimmed value at index, or "" when the row is too
+// short or the column is absent (index -1).
+func columnValue(row []string, index int) string {
+	if index < 0 || index >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[index])
+}
+
+// isDomainName does a basic syntax check of a DNS name: dot-separated labels
+// of 1 to 63 letters, digits or hyphens that do not start or end with a
+// hyphen, at most 253 characters, with an optional trailing dot.
+func isDomainName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
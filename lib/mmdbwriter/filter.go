@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/inserter"
+)
+
+// prefixList is a repeatable flag of comma-separated CIDRs.
+type prefixList []netip.Prefix
+
+func (l *prefixList) String() string {
+	parts := make([]string, len(*l))
+	for i, p := range *l {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *prefixList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		p, err := netip.ParsePrefix(strings.TrimSpace(part))
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q", part)
+		}
+		*l = append(*l, p.Masked())
+	}
+	return nil
+}
+
+// Actions of -max-prefix-action on rows more specific than -max-prefix-len.
+const (
+	maxPrefixDrop     = "drop"
+	maxPrefixTruncate = "truncate"
+)
+
+// maxPrefixLen implements flag.Value for -max-prefix-len, e.g.
+// "v4=24,v6=48". A length of 0 sets no limit for the family.
+type maxPrefixLen struct {
+	v4, v6 int
+}
+
+func (m *maxPrefixLen) String() string {
+	var parts []string
+	if m.v4 > 0 {
+		parts = append(parts, "v4="+strconv.Itoa(m.v4))
+	}
+	if m.v6 > 0 {
+		parts = append(parts, "v6="+strconv.Itoa(m.v6))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *maxPrefixLen) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		family, lenStr, ok := strings.Cut(strings.TrimSpace(part), "=")
+		bits, err := strconv.Atoi(strings.TrimSpace(lenStr))
+		if !ok || err != nil {
+			return fmt.Errorf("expected v4=N or v6=N, got %q", part)
+		}
+		switch strings.ToLower(strings.TrimSpace(family)) {
+		case "v4", "ipv4":
+			if bits < 1 || bits > 32 {
+				return fmt.Errorf("invalid IPv4 prefix length %d", bits)
+			}
+			m.v4 = bits
+		case "v6", "ipv6":
+			if bits < 1 || bits > 128 {
+				return fmt.Errorf("invalid IPv6 prefix length %d", bits)
+			}
+			m.v6 = bits
+		default:
+			return fmt.Errorf("unknown address family %q, want v4 or v6", family)
+		}
+	}
+	return nil
+}
+
+// limit returns the longest prefix length allowed for network, or 0 when
+// its family has no limit.
+func (m maxPrefixLen) limit(prefix netip.Prefix) int {
+	if prefix.Addr().Is4() {
+		return m.v4
+	}
+	return m.v6
+}
+
+func validateMaxPrefixAction(action string) error {
+	switch action {
+	case maxPrefixDrop, maxPrefixTruncate:
+		return nil
+	}
+	return fmt.Errorf("unknown -max-prefix-action %q (want drop or truncate)", action)
+}
+
+// asnList is a repeatable flag of comma-separated ASNs and inclusive ASN
+// ranges, e.g. "13335,AS64512-AS65534"; "bogon" stands for all bogon ASN
+// ranges of -label-bogon-asns.
+type asnList []asnRange
+
+func (l *asnList) String() string {
+	parts := make([]string, len(*l))
+	for i, r := range *l {
+		parts[i] = strconv.FormatUint(uint64(r.first), 10)
+		if r.last != r.first {
+			parts[i] += "-" + strconv.FormatUint(uint64(r.last), 10)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *asnList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if strings.EqualFold(part, "bogon") {
+			*l = append(*l, bogonASNs...)
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		lo, err := parseFilterASN(first)
+		if err != nil {
+			return err
+		}
+		hi := lo
+		if isRange {
+			if hi, err = parseFilterASN(last); err != nil {
+				return err
+			}
+			if hi < lo {
+				return fmt.Errorf("invalid ASN range %q: the end is before the start", part)
+			}
+		}
+		*l = append(*l, asnRange{first: lo, last: hi})
+	}
+	return nil
+}
+
+func parseFilterASN(s string) (uint32, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && strings.EqualFold(s[:2], "as") {
+		s = s[2:]
+	}
+	asn, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ASN %q", s)
+	}
+	return uint32(asn), nil
+}
+
+func (l asnList) contains(asn uint32) bool {
+	for _, r := range l {
+		if asn >= r.first && asn <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// filtersRow reports whether -include, -exclude, -include-asn or
+// -exclude-asn keep a row out of the build. A row partly inside an
+// -include prefix or covering an -exclude prefix is kept; the part outside
+// is removed by applyPrefixFilters at the end of the build.
+func filtersRow(cfg *config, row netip.Prefix, asn uint32) bool {
+	if len(cfg.includeASN) > 0 && !cfg.includeASN.contains(asn) {
+		return true
+	}
+	if cfg.excludeASN.contains(asn) {
+		return true
+	}
+	if len(cfg.include) == 0 && len(cfg.exclude) == 0 {
+		return false
+	}
+
+	for _, p := range cfg.exclude {
+		if p.Bits() <= row.Bits() && p.Contains(row.Addr()) {
+			return true
+		}
+	}
+	if len(cfg.include) == 0 {
+		return false
+	}
+	for _, p := range cfg.include {
+		if p.Overlaps(row) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyPrefixFilters removes the -exclude prefixes and everything outside
+// the -include prefixes from the tree, cutting them out of rows, aggregates
+// and tags that cover them. It returns the number of networks removed.
+func applyPrefixFilters(writer *mmdbwriter.Tree, cfg *config) (int, error) {
+	if len(cfg.include) == 0 && len(cfg.exclude) == 0 {
+		return 0, nil
+	}
+	v6 := treeOptions(cfg).IPVersion != 4
+	toTree := func(l prefixList) []netip.Prefix {
+		out := make([]netip.Prefix, 0, len(l))
+		for _, p := range l {
+			// IPv6 prefixes cannot be in an IPv4 tree.
+			if !v6 && !p.Addr().Is4() {
+				continue
+			}
+			out = append(out, treePrefix(p, v6))
+		}
+		return out
+	}
+
+	remove := toTree(cfg.exclude)
+	if len(cfg.include) > 0 {
+		root := netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		if !v6 {
+			root = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		}
+		remove = append(remove, prefixComplement(root, toTree(cfg.include))...)
+	}
+
+	policy := networkPolicy(cfg)
+	for _, p := range remove {
+		prefix := untreePrefix(p, v6)
+		// Reserved and aliased space holds no data to remove.
+		if policy.Check(prefix) != nil {
+			continue
+		}
+		network := prefixNetwork(prefix)
+		if err := writer.InsertFunc(network, inserter.Remove); err != nil {
+			return 0, fmt.Errorf("failed to remove filtered network %s: %w", network, err)
+		}
+	}
+	return len(remove), nil
+}
+
+// prefixComplement returns the prefixes within root that no prefix of set
+// overlaps, as few as possible.
+func prefixComplement(root netip.Prefix, set []netip.Prefix) []netip.Prefix {
+	var overlapping []netip.Prefix
+	for _, p := range set {
+		if p.Bits() <= root.Bits() && p.Contains(root.Addr()) {
+			return nil
+		}
+		if p.Overlaps(root) {
+			overlapping = append(overlapping, p)
+		}
+	}
+	if len(overlapping) == 0 {
+		return []netip.Prefix{root}
+	}
+	lower := netip.PrefixFrom(root.Addr(), root.Bits()+1)
+	upper := siblingPrefix(lower)
+	return append(prefixComplement(lower, overlapping), prefixComplement(upper, overlapping)...)
+}
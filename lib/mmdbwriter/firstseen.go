@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// firstSeenHistory is the -first-seen file: when each prefix was first
+// seen. Prefixes a build sees for the first time are added with its build
+// time, and prefixes that are no longer announced are kept, so that a
+// returning prefix keeps its original date.
+type firstSeenHistory struct {
+	path  string
+	seen  map[netip.Prefix]int64
+	added int
+}
+
+// loadFirstSeen reads a network,first_seen CSV file with Unix seconds or
+// RFC 3339 timestamps, e.g. one seeded from archived tables. A missing file
+// is an empty history.
+func loadFirstSeen(path string) (*firstSeenHistory, error) {
+	h := &firstSeenHistory{path: path, seen: map[netip.Prefix]int64{}}
+	fh, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open first-seen file: %w", err)
+	}
+	defer fh.Close()
+
+	r := csv.NewReader(fh)
+	r.FieldsPerRecord = -1
+	if _, err := r.Read(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read first-seen header: %w", err)
+	}
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return h, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read first-seen file: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+		prefix, err := netip.ParsePrefix(columnValue(row, 0))
+		if err != nil {
+			logger.Warn("skipping invalid network", "file", path, "line", line, "network", columnValue(row, 0))
+			continue
+		}
+		t, err := parseTimestamp(columnValue(row, 1))
+		if err != nil {
+			logger.Warn("skipping invalid first_seen", "file", path, "line", line, "first_seen", columnValue(row, 1),
+				"error", err)
+			continue
+		}
+		prefix = prefix.Masked()
+		// A history merged from several sources keeps the earliest date.
+		if seen, ok := h.seen[prefix]; !ok || t.Unix() < seen {
+			h.seen[prefix] = t.Unix()
+		}
+	}
+}
+
+// lookup returns when prefix was first seen, now if it is new.
+func (h *firstSeenHistory) lookup(prefix netip.Prefix, now int64) int64 {
+	if seen, ok := h.seen[prefix]; ok {
+		return seen
+	}
+	return now
+}
+
+// add records a prefix stored by the build as seen now, unless it was seen
+// before.
+func (h *firstSeenHistory) add(prefix netip.Prefix, now int64) {
+	if _, ok := h.seen[prefix]; !ok {
+		h.seen[prefix] = now
+		h.added++
+	}
+}
+
+// save replaces the -first-seen file with the history, sorted by network.
+func (h *firstSeenHistory) save() error {
+	prefixes := make([]netip.Prefix, 0, len(h.seen))
+	for prefix := range h.seen {
+		prefixes = append(prefixes, prefix)
+	}
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Bits(), b.Bits())
+	})
+
+	dir := filepath.Dir(h.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(h.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create first-seen file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintln(w, "network,first_seen")
+	for _, prefix := range prefixes {
+		fmt.Fprintf(w, "%s,%s\n", prefix, time.Unix(h.seen[prefix], 0).UTC().Format(time.RFC3339))
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write first-seen file: %w", err)
+	}
+	return nil
+}
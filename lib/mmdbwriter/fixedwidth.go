@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// fixedField is one field of a fixed-width record, spanning the byte
+// offsets [start, end). An end of -1 extends the field to the end of the
+// line.
+type fixedField struct {
+	name       string
+	start, end int
+}
+
+// fixedFields implements flag.Value for -fields, e.g.
+// "network:0-18,asn:18-28,org:28-".
+type fixedFields []fixedField
+
+func (f *fixedFields) String() string {
+	parts := make([]string, len(*f))
+	for i, field := range *f {
+		end := ""
+		if field.end >= 0 {
+			end = strconv.Itoa(field.end)
+		}
+		parts[i] = fmt.Sprintf("%s:%d-%s", field.name, field.start, end)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *fixedFields) Set(value string) error {
+	var fields fixedFields
+	for _, spec := range strings.Split(value, ",") {
+		name, span, ok := strings.Cut(strings.TrimSpace(spec), ":")
+		startStr, endStr, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 || name == "" {
+			return fmt.Errorf("expected name:start-end, got %q", spec)
+		}
+
+		start, err := strconv.Atoi(startStr)
+		if err != nil || start < 0 {
+			return fmt.Errorf("invalid start offset in %q", spec)
+		}
+		end := -1
+		if endStr != "" {
+			end, err = strconv.Atoi(endStr)
+			if err != nil || end <= start {
+				return fmt.Errorf("invalid end offset in %q", spec)
+			}
+		}
+		fields = append(fields, fixedField{name: strings.ToLower(name), start: start, end: end})
+	}
+	*f = fields
+	return nil
+}
+
+// fixedWidthReader reads lines of fixed-width fields and returns them in the
+// CSV column layout: network, asn, org, then any other fields in the order
+// they were defined. Blank lines are skipped.
+type fixedWidthReader struct {
+	scanner *bufio.Scanner
+	fields  []fixedField // in output column order; org may be absent
+	line    int
+	offsets []int
+}
+
+func newFixedWidthReader(r io.Reader, fields fixedFields) *fixedWidthReader {
+	ordered := make([]fixedField, 3, len(fields)+3)
+	ordered[2] = fixedField{name: "org", start: -1}
+	var rest []fixedField
+	for _, field := range fields {
+		switch field.name {
+		case "network":
+			ordered[0] = field
+		case "asn":
+			ordered[1] = field
+		case "org":
+			ordered[2] = field
+		default:
+			rest = append(rest, field)
+		}
+	}
+	return &fixedWidthReader{
+		scanner: bufio.NewScanner(r),
+		fields:  append(ordered, rest...),
+	}
+}
+
+// validateFixedFields checks that the network and asn fields are defined.
+func validateFixedFields(fields fixedFields) error {
+	var hasNetwork, hasASN bool
+	for _, field := range fields {
+		hasNetwork = hasNetwork || field.name == "network"
+		hasASN = hasASN || field.name == "asn"
+	}
+	if !hasNetwork || !hasASN {
+		return errors.New("-format fixed needs -fields defining at least network and asn")
+	}
+	return nil
+}
+
+func (fr *fixedWidthReader) header() []string {
+	names := make([]string, len(fr.fields))
+	for i, field := range fr.fields {
+		names[i] = field.name
+	}
+	return names
+}
+
+func (fr *fixedWidthReader) Read() ([]string, error) {
+	for fr.scanner.Scan() {
+		fr.line++
+		line := strings.TrimRight(fr.scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		row := make([]string, len(fr.fields))
+		fr.offsets = make([]int, len(fr.fields))
+		for i, field := range fr.fields {
+			fr.offsets[i] = field.start
+			if field.start < 0 || field.start >= len(line) {
+				continue
+			}
+			end := field.end
+			if end < 0 || end > len(line) {
+				end = len(line)
+			}
+			row[i] = strings.TrimSpace(line[field.start:end])
+		}
+		return row, nil
+	}
+	if err := fr.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (fr *fixedWidthReader) FieldPos(field int) (line, column int) {
+	column = 1
+	if field >= 0 && field < len(fr.offsets) && fr.offsets[field] >= 0 {
+		column = fr.offsets[field] + 1
+	}
+	return fr.line, column
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFixedFieldsSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    fixedFields
+		wantErr bool
+	}{
+		{
+			value: "network:0-18,ASN:18-28,org:28-",
+			want:  fixedFields{{"network", 0, 18}, {"asn", 18, 28}, {"org", 28, -1}},
+		},
+		{value: "network", wantErr: true},
+		{value: "network:0", wantErr: true},
+		{value: ":0-4", wantErr: true},
+		{value: "network:x-4", wantErr: true},
+		{value: "network:-1-4", wantErr: true},
+		{value: "network:4-4", wantErr: true},
+		{value: "network:4-2", wantErr: true},
+	}
+	for _, tt := range tests {
+		var got fixedFields
+		err := got.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q): got error %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Set(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+		if !tt.wantErr && got.String() != "network:0-18,asn:18-28,org:28-" {
+			t.Errorf("String() = %q", got.String())
+		}
+	}
+}
+
+func TestFixedWidthReader(t *testing.T) {
+	var fields fixedFields
+	if err := fields.Set("asn:18-28,network:0-18,cc:28-30,org:30-"); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateFixedFields(fields); err != nil {
+		t.Fatal(err)
+	}
+	input := "" +
+		"1.1.1.0/24        13335     USCloudflare, Inc.\r\n" +
+		"\n" +
+		"2a01:4f8::/32     24940     DE\n" +
+		"8.8.8.0/24        15169\n"
+	fr := newFixedWidthReader(strings.NewReader(input), fields)
+	if got, want := fr.header(), []string{"network", "asn", "org", "cc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("header() = %q, want %q", got, want)
+	}
+
+	want := []struct {
+		row        []string
+		line       int
+		orgColumn  int
+		ccColumn   int
+		asnColumn  int
+		netColumns int
+	}{
+		{[]string{"1.1.1.0/24", "13335", "Cloudflare, Inc.", "US"}, 1, 31, 29, 19, 1},
+		{[]string{"2a01:4f8::/32", "24940", "", "DE"}, 3, 31, 29, 19, 1},
+		{[]string{"8.8.8.0/24", "15169", "", ""}, 4, 31, 29, 19, 1},
+	}
+	for _, w := range want {
+		row, err := fr.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(row, w.row) {
+			t.Errorf("got %q, want %q", row, w.row)
+		}
+		for field, column := range []int{w.netColumns, w.asnColumn, w.orgColumn, w.ccColumn} {
+			if line, col := fr.FieldPos(field); line != w.line || col != column {
+				t.Errorf("FieldPos(%d) = %d:%d, want %d:%d", field, line, col, w.line, column)
+			}
+		}
+	}
+	if _, err := fr.Read(); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v after the last row, want io.EOF", err)
+	}
+}
+
+func TestValidateFixedFields(t *testing.T) {
+	var fields fixedFields
+	if err := fields.Set("network:0-18,org:18-"); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateFixedFields(fields); err == nil {
+		t.Error("fields without asn were accepted")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// fixtureBuildEpoch pins the build time of the fixture so that it is
+// byte-for-byte reproducible.
+const fixtureBuildEpoch = 1700000000
+
+// fixtureNetworks is the content of the conformance fixture. It uses
+// documentation prefixes and covers every field type of the schema,
+// including a more specific network nested in a less specific one.
+var fixtureNetworks = []struct {
+	network string
+	record  mmdbtype.Map
+}{
+	{"192.0.2.0/24", mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(64496),
+		"autonomous_system_organization": mmdbtype.String("Example Networks"),
+	}},
+	{"192.0.2.128/25", mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(64497),
+		"autonomous_system_organization": mmdbtype.String("Example Subnet"),
+		"reverse_dns":                    mmdbtype.String("example.net"),
+		"rpki_status":                    mmdbtype.String("valid"),
+	}},
+	{"198.51.100.0/24", mmdbtype.Map{
+		"autonomous_system_number": mmdbtype.Uint32(64498),
+	}},
+	{"203.0.113.0/24", mmdbtype.Map{
+		"autonomous_system_organization": mmdbtype.String("Unannounced"),
+		"expires":                        mmdbtype.Uint64(1900000000),
+	}},
+	{"2001:db8::/32", mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(64499),
+		"autonomous_system_organization": mmdbtype.String("Example IPv6"),
+	}},
+	{"2001:db8:1::/48", mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(65536),
+		"autonomous_system_organization": mmdbtype.String("Example IPv6 Customer"),
+		"is_aggregate":                   mmdbtype.Bool(false),
+	}},
+}
+
+// fixtureLookups are the addresses whose expected results are recorded,
+// including addresses without data.
+var fixtureLookups = []string{
+	"192.0.2.1",
+	"192.0.2.200",
+	"198.51.100.7",
+	"203.0.113.255",
+	"2001:db8::1",
+	"2001:db8:1::1",
+	"2001:db8:2::1",
+	"192.0.3.1",
+	"2001:db9::1",
+}
+
+// fixtureLookup is one expected lookup. Record is null and Network is the
+// empty network containing the address when there is no data.
+type fixtureLookup struct {
+	IP      string         `json:"ip"`
+	Network string         `json:"network"`
+	Record  map[string]any `json:"record"`
+}
+
+type fixtureExpectations struct {
+	Lookups []fixtureLookup `json:"lookups"`
+}
+
+// runGenFixture implements `gen-fixture out.mmdb out.expected.json`: it
+// writes a small deterministic database with this tool's schema and the
+// lookups a conforming reader must return for it.
+func runGenFixture(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s gen-fixture <out.mmdb> <out.expected.json>", os.Args[0])
+	}
+	mmdbFile, expectedFile := args[0], args[1]
+
+	opts := mmdbbuild.DefaultOptions()
+	opts.BuildEpoch = fixtureBuildEpoch
+	// The documentation prefixes are reserved networks.
+	opts.IncludeReservedNetworks = true
+	writer, err := mmdbwriter.New(opts)
+	if err != nil {
+		return err
+	}
+	for _, n := range fixtureNetworks {
+		_, network, err := net.ParseCIDR(n.network)
+		if err != nil {
+			return err
+		}
+		if err := writer.Insert(network, n.record); err != nil {
+			return fmt.Errorf("failed to insert record for %s: %w", network, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := writer.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	// The expectations are read back from the serialized fixture, so they
+	// always match what was written.
+	db, err := maxminddb.FromBytes(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to read back fixture: %w", err)
+	}
+	var expected fixtureExpectations
+	for _, ip := range fixtureLookups {
+		network, record, err := lookupRecord(db, net.ParseIP(ip))
+		if err != nil {
+			return fmt.Errorf("failed to look up %s: %w", ip, err)
+		}
+		lookup := fixtureLookup{IP: ip, Network: network.String()}
+		if record != nil {
+			lookup.Record = mmdbToJSON(record).(map[string]any)
+		}
+		expected.Lookups = append(expected.Lookups, lookup)
+	}
+
+	data, err := json.MarshalIndent(expected, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(mmdbFile, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write fixture: %w", err)
+	}
+	if err := os.WriteFile(expectedFile, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write expectations: %w", err)
+	}
+
+	fmt.Printf("Wrote fixture %s with %d networks and %d expected lookups to %s\n",
+		mmdbFile, len(fixtureNetworks), len(expected.Lookups), expectedFile)
+	return nil
+}
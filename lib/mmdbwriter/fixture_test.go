@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestGenFixture(t *testing.T) {
+	var outputs [2][2][]byte
+	for i := range outputs {
+		dir := t.TempDir()
+		mmdbFile, expectedFile := filepath.Join(dir, "fixture.mmdb"), filepath.Join(dir, "fixture.expected.json")
+		if err := runGenFixture([]string{mmdbFile, expectedFile}); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := maxminddb.Open(mmdbFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyExpectations(db, expectedFile); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+
+		for j, path := range []string{mmdbFile, expectedFile} {
+			if outputs[i][j], err = os.ReadFile(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for j, name := range []string{"database", "expectations"} {
+		if !bytes.Equal(outputs[0][j], outputs[1][j]) {
+			t.Errorf("the %s differ between runs", name)
+		}
+	}
+}
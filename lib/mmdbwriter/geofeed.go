@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// geofeedSources implements flag.Value for the repeatable -geofeed flag.
+type geofeedSources []string
+
+func (s *geofeedSources) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *geofeedSources) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// geofeedFields are the record fields a geofeed entry sets: its country,
+// region and city.
+var geofeedFields = []string{"geo_country", "geo_region", "geo_city"}
+
+// geofeedEntry is one line of an RFC 8805 geofeed. Empty fields are
+// unknown.
+type geofeedEntry struct {
+	prefix  netip.Prefix
+	country string
+	region  string
+	city    string
+}
+
+// loadGeofeeds reads RFC 8805 geofeeds: CSV lines of
+// prefix,country,region,city[,postal code] with # starting a comment, such
+// as the feeds linked from the geofeed: attributes of RPSL inetnum objects.
+// Sources may be files or URLs. The deprecated postal code is ignored, and
+// invalid entries are reported and skipped.
+func loadGeofeeds(ctx context.Context, sources []string, userAgent string, retries int) ([]geofeedEntry, error) {
+	var entries []geofeedEntry
+	for _, source := range sources {
+		path := source
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			dir, err := os.MkdirTemp("", "mmdbwriter-geofeed-")
+			if err != nil {
+				return nil, err
+			}
+			defer os.RemoveAll(dir)
+			path = filepath.Join(dir, "geofeed.csv")
+			if _, err := fetchFile(ctx, source, path, userAgent, retries); err != nil {
+				return nil, fmt.Errorf("failed to fetch geofeed from %s: %w", source, err)
+			}
+		}
+
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open geofeed: %w", err)
+		}
+		r := csv.NewReader(fh)
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		for {
+			fields, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				fh.Close()
+				return nil, fmt.Errorf("failed to read geofeed %s: %w", source, err)
+			}
+			line, _ := r.FieldPos(0)
+			entry, err := parseGeofeedEntry(fields)
+			if err != nil {
+				logger.Warn("skipping invalid geofeed entry", "source", source, "line", line, "error", err)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		fh.Close()
+	}
+	return entries, nil
+}
+
+func parseGeofeedEntry(fields []string) (geofeedEntry, error) {
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	prefix, err := netip.ParsePrefix(fields[0])
+	if err != nil {
+		return geofeedEntry{}, fmt.Errorf("invalid prefix %q", fields[0])
+	}
+	if prefix != prefix.Masked() {
+		return geofeedEntry{}, fmt.Errorf("prefix %s has host bits set", fields[0])
+	}
+
+	entry := geofeedEntry{
+		prefix:  prefix,
+		country: strings.ToUpper(fields[1]),
+		region:  strings.ToUpper(fields[2]),
+		city:    fields[3],
+	}
+	if entry.country != "" && !isAlpha2(entry.country) {
+		return geofeedEntry{}, fmt.Errorf("invalid country code %q", fields[1])
+	}
+	// An ISO 3166-2 region code starts with the code of its country.
+	if entry.region != "" {
+		country, _, ok := strings.Cut(entry.region, "-")
+		if !ok || !isAlpha2(country) || (entry.country != "" && country != entry.country) {
+			return geofeedEntry{}, fmt.Errorf("invalid region code %q for country %q", fields[2], entry.country)
+		}
+	}
+	return entry, nil
+}
+
+func isAlpha2(s string) bool {
+	return len(s) == 2 && s[0] >= 'A' && s[0] <= 'Z' && s[1] >= 'A' && s[1] <= 'Z'
+}
+
+// geofeedEnricher is the geofeed stage of the enrichment pipeline.
+type geofeedEnricher []geofeedEntry
+
+func (e geofeedEnricher) enrichNetworks(writer *mmdbwriter.Tree, cfg *config, stats *buildStats) error {
+	var err error
+	stats.geofeedPrefixes, err = applyGeofeeds(writer, cfg, e)
+	return err
+}
+
+// applyGeofeeds sets the geo_country, geo_region and geo_city fields of
+// every record within a geofeed prefix and returns how many prefixes
+// matched a record. Less specific prefixes are applied first, so the most
+// specific entry covering an address decides all three fields. Like
+// -anycast, no records are created in space without data.
+func applyGeofeeds(writer *mmdbwriter.Tree, cfg *config, entries []geofeedEntry) (int, error) {
+	entries = slices.Clone(entries)
+	slices.SortStableFunc(entries, func(a, b geofeedEntry) int {
+		return a.prefix.Bits() - b.prefix.Bits()
+	})
+
+	policy := networkPolicy(cfg)
+	matched := 0
+	for _, entry := range entries {
+		if excludesFamily(cfg, entry.prefix) {
+			continue
+		}
+		if err := policy.Check(entry.prefix); err != nil {
+			logger.Warn("skipping unsupported geofeed prefix", "network", entry.prefix, "error", err)
+			continue
+		}
+		found := false
+		err := writer.InsertFunc(prefixNetwork(entry.prefix), func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+			record, ok := existing.(mmdbtype.Map)
+			if !ok {
+				return existing, nil
+			}
+			found = true
+			located := record.Copy().(mmdbtype.Map)
+			for i, value := range []string{entry.country, entry.region, entry.city} {
+				key := mmdbtype.String(geofeedFields[i])
+				delete(located, key)
+				if value != "" {
+					located[key] = mmdbtype.String(value)
+				}
+			}
+			return located, nil
+		})
+		if err != nil {
+			return matched, fmt.Errorf("failed to apply geofeed prefix %s: %w", entry.prefix, err)
+		}
+		if found {
+			matched++
+		}
+	}
+	return matched, nil
+}
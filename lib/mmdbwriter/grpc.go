@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"mmdbwriter/pkg/lookuppb"
+)
+
+// grpcLookupService is the LookupService of pkg/lookuppb/lookup.proto,
+// answered from the database of a lookupServer.
+type grpcLookupService struct {
+	lookuppb.UnimplementedLookupServiceServer
+	s *lookupServer
+}
+
+// serveGRPC serves the gRPC service of s on addr without TLS, as gRPC
+// clients with insecure credentials expect.
+func serveGRPC(addr string, s *lookupServer) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return newGRPCServer(s).Serve(ln)
+}
+
+func newGRPCServer(s *lookupServer) *grpc.Server {
+	srv := grpc.NewServer()
+	lookuppb.RegisterLookupServiceServer(srv, &grpcLookupService{s: s})
+	return srv
+}
+
+func (g *grpcLookupService) Lookup(_ context.Context, req *lookuppb.LookupRequest) (*lookuppb.LookupResponse, error) {
+	resp, err := g.s.grpcLookupIP(req.GetIp())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, status.Error(codes.InvalidArgument, resp.Error)
+	}
+	return resp, nil
+}
+
+// BulkLookup answers requests as they arrive. grpc-go buffers the
+// responses and writes them out together while further requests wait.
+func (g *grpcLookupService) BulkLookup(stream grpc.BidiStreamingServer[lookuppb.LookupRequest, lookuppb.LookupResponse]) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := g.s.grpcLookupIP(req.GetIp())
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// grpcLookupIP looks ipText up. Invalid addresses are reported in the
+// response; only database failures are errors.
+func (s *lookupServer) grpcLookupIP(ipText string) (*lookuppb.LookupResponse, error) {
+	s.lookups.Add(1)
+	resp := &lookuppb.LookupResponse{Ip: ipText}
+	ip := net.ParseIP(ipText)
+	if ip == nil {
+		s.invalid.Add(1)
+		resp.Error = "invalid IP address"
+		return resp, nil
+	}
+
+	network, record, err := s.lookup(ip)
+	if err != nil {
+		s.failed.Add(1)
+		if err == errNoDatabase {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp.Ip, resp.Network = ip.String(), network.String()
+	if record == nil {
+		s.notFound.Add(1)
+		return resp, nil
+	}
+
+	resp.Found = true
+	if m, ok := record.(mmdbtype.Map); ok {
+		if asn, ok := m["autonomous_system_number"].(mmdbtype.Uint32); ok {
+			resp.AutonomousSystemNumber = uint32(asn)
+		}
+		if org, ok := m["autonomous_system_organization"].(mmdbtype.String); ok {
+			resp.AutonomousSystemOrganization = string(org)
+		}
+	}
+	data, err := json.Marshal(mmdbToJSON(record))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp.RecordJson = string(data)
+	return resp, nil
+}
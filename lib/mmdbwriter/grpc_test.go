@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"mmdbwriter/pkg/lookuppb"
+)
+
+// newGRPCTestConn serves input with the gRPC server of serve and returns
+// a connection to it.
+func newGRPCTestConn(t *testing.T, input string) *grpc.ClientConn {
+	t.Helper()
+	data, _ := buildTestMMDB(t, testConfig(t), input)
+	s := &lookupServer{}
+	s.db.Store(openTestDB(t, data))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newGRPCServer(s)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// grpcTestResponse is a LookupResponse without its record JSON.
+type grpcTestResponse struct {
+	ip, network string
+	found       bool
+	asn         uint32
+	org         string
+	err         string
+}
+
+// decodeGRPCTest returns the fields of a LookupResponse and its record
+// JSON decoded.
+func decodeGRPCTest(t *testing.T, resp *lookuppb.LookupResponse) (grpcTestResponse, map[string]any) {
+	t.Helper()
+	got := grpcTestResponse{
+		ip:      resp.GetIp(),
+		network: resp.GetNetwork(),
+		found:   resp.GetFound(),
+		asn:     resp.GetAutonomousSystemNumber(),
+		org:     resp.GetAutonomousSystemOrganization(),
+		err:     resp.GetError(),
+	}
+	var record map[string]any
+	if recordJSON := resp.GetRecordJson(); recordJSON != "" {
+		if err := json.Unmarshal([]byte(recordJSON), &record); err != nil {
+			t.Errorf("record_json %q: %v", recordJSON, err)
+		}
+	}
+	return got, record
+}
+
+const grpcTestInput = "network,asn,org\n1.1.1.0/24,13335,\"Cloudflare, Inc.\"\n2606:4700::/32,13335,Cloudflare\n"
+
+func TestGRPCLookup(t *testing.T) {
+	c := lookuppb.NewLookupServiceClient(newGRPCTestConn(t, grpcTestInput))
+	tests := []struct {
+		ip      string
+		want    grpcTestResponse
+		code    codes.Code
+		message string
+	}{
+		{ip: "1.1.1.1", want: grpcTestResponse{ip: "1.1.1.1", network: "1.1.1.0/24", found: true, asn: 13335, org: "Cloudflare, Inc."}},
+		{ip: "2606:4700::1111", want: grpcTestResponse{ip: "2606:4700::1111", network: "2606:4700::/32", found: true, asn: 13335, org: "Cloudflare"}},
+		{ip: "9.9.9.9", want: grpcTestResponse{ip: "9.9.9.9", network: "8.0.0.0/7"}},
+		{ip: "not-an-ip", code: codes.InvalidArgument, message: "invalid IP address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			resp, err := c.Lookup(context.Background(), &lookuppb.LookupRequest{Ip: tt.ip})
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("got status %v (%v), want %v", got, err, tt.code)
+			}
+			if err != nil {
+				if msg := status.Convert(err).Message(); msg != tt.message {
+					t.Errorf("got message %q, want %q", msg, tt.message)
+				}
+				return
+			}
+			got, record := decodeGRPCTest(t, resp)
+			if got.found && (record["autonomous_system_number"] != float64(tt.want.asn) ||
+				record["autonomous_system_organization"] != tt.want.org) {
+				t.Errorf("got record %v", record)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCBulkLookup(t *testing.T) {
+	c := lookuppb.NewLookupServiceClient(newGRPCTestConn(t, grpcTestInput))
+	stream, err := c.BulkLookup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := []string{"1.1.1.1", "not-an-ip", "2606:4700::1", "9.9.9.9"}
+	for _, ip := range ips {
+		if err := stream.Send(&lookuppb.LookupRequest{Ip: ip}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []grpcTestResponse{
+		{ip: "1.1.1.1", network: "1.1.1.0/24", found: true, asn: 13335, org: "Cloudflare, Inc."},
+		{ip: "not-an-ip", err: "invalid IP address"},
+		{ip: "2606:4700::1", network: "2606:4700::/32", found: true, asn: 13335, org: "Cloudflare"},
+		{ip: "9.9.9.9", network: "8.0.0.0/7"},
+	}
+	var got []grpcTestResponse
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := decodeGRPCTest(t, resp)
+		got = append(got, r)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d responses, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("response %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGRPCUnknownMethod(t *testing.T) {
+	conn := newGRPCTestConn(t, grpcTestInput)
+	err := conn.Invoke(context.Background(), "/bgptools.opendb.v1.LookupService/Reverse",
+		&lookuppb.LookupRequest{Ip: "1.1.1.1"}, new(lookuppb.LookupResponse))
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("got %v, want Unimplemented", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// historyCacheSize is how many historical databases serve keeps in memory
+// for -history lookups.
+const historyCacheSize = 4
+
+// errNoVersion fails a lookup as of a date before the first published
+// version, errBadAsOf one whose date is invalid and errNoHistory one of a
+// server without -history.
+var (
+	errNoVersion = errors.New("no version published as of")
+	errBadAsOf   = errors.New("invalid as-of date")
+	errNoHistory = errors.New("as_of needs serve -history")
+)
+
+// asOfTime parses the date of a time-travel lookup: a YYYY-MM-DD day, which
+// selects the version published for that day or the last one before it,
+// or Unix seconds or an RFC 3339 timestamp, which select the last version
+// built at or before that time.
+type asOfTime struct {
+	day  string
+	time time.Time
+}
+
+func parseAsOf(s string) (asOfTime, error) {
+	if day, err := time.Parse(publishDateDisplay, s); err == nil {
+		return asOfTime{day: day.Format(publishDateDisplay)}, nil
+	}
+	t, err := parseTimestamp(s)
+	if err != nil {
+		return asOfTime{}, fmt.Errorf("%w %q: want YYYY-MM-DD, Unix seconds or an RFC 3339 timestamp", errBadAsOf, s)
+	}
+	return asOfTime{time: t}, nil
+}
+
+func (a asOfTime) String() string {
+	if a.day != "" {
+		return a.day
+	}
+	return a.time.UTC().Format(time.RFC3339)
+}
+
+// versionAsOf returns the version of a publish index, newest first, that
+// was current at a.
+func versionAsOf(versions []publishVersion, a asOfTime) (publishVersion, error) {
+	for _, v := range versions {
+		if a.day != "" && v.Date <= a.day || a.day == "" && int64(v.BuildEpoch) <= a.time.Unix() {
+			return v, nil
+		}
+	}
+	return publishVersion{}, fmt.Errorf("%w %s", errNoVersion, a)
+}
+
+// readHistoryIndex reads the index.json of a publish directory, whatever
+// database name it holds.
+func readHistoryIndex(dir string) (*publishIndex, error) {
+	file := filepath.Join(dir, publishIndexFile)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read publish index: %w", err)
+	}
+	index := &publishIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("invalid index %s: %w", file, err)
+	}
+	return index, nil
+}
+
+// history selects and opens the versions of a publish directory for
+// serve -history. The index is read again when publish rewrites it, and the
+// databases last used are kept in memory like the served one.
+type history struct {
+	dir string
+
+	mu       sync.Mutex
+	modTime  time.Time
+	versions []publishVersion
+	// open holds the databases last used, least recently used first.
+	open []historyDB
+}
+
+type historyDB struct {
+	path string
+	db   *maxminddb.Reader
+}
+
+// at returns the database current at a and its version.
+func (h *history) at(a asOfTime) (*maxminddb.Reader, publishVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	info, err := os.Stat(filepath.Join(h.dir, publishIndexFile))
+	if err != nil {
+		return nil, publishVersion{}, fmt.Errorf("failed to read publish index: %w", err)
+	}
+	if !info.ModTime().Equal(h.modTime) {
+		index, err := readHistoryIndex(h.dir)
+		if err != nil {
+			return nil, publishVersion{}, err
+		}
+		h.versions, h.modTime = index.Versions, info.ModTime()
+	}
+	v, err := versionAsOf(h.versions, a)
+	if err != nil {
+		return nil, publishVersion{}, err
+	}
+
+	if i := slices.IndexFunc(h.open, func(o historyDB) bool { return o.path == v.Path }); i >= 0 {
+		o := h.open[i]
+		h.open = append(slices.Delete(h.open, i, i+1), o)
+		return o.db, v, nil
+	}
+	db, err := loadDatabase(filepath.Join(h.dir, filepath.FromSlash(v.Path)))
+	if err != nil {
+		return nil, publishVersion{}, err
+	}
+	if len(h.open) == historyCacheSize {
+		h.open = slices.Delete(h.open, 0, 1)
+	}
+	h.open = append(h.open, historyDB{path: v.Path, db: db})
+	return db, v, nil
+}
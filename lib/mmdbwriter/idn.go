@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// IDN normalization modes accepted by -idn.
+const (
+	idnNone      = "none"
+	idnToASCII   = "to-ascii"
+	idnToUnicode = "to-unicode"
+)
+
+func validateIDNMode(mode string) error {
+	switch mode {
+	case idnNone, idnToASCII, idnToUnicode:
+		return nil
+	}
+	return fmt.Errorf("unknown -idn mode %q (want %s, %s or %s)", mode, idnToASCII, idnToUnicode, idnNone)
+}
+
+// normalizeIDN converts a domain name to its punycode (to-ascii) or Unicode
+// (to-unicode) form.
+func normalizeIDN(name, mode string) (string, error) {
+	switch mode {
+	case idnToASCII:
+		return idna.Lookup.ToASCII(name)
+	case idnToUnicode:
+		return idna.Display.ToUnicode(name)
+	}
+	return name, nil
+}
+
+// isDomainLike reports whether an organization value is a bare domain name,
+// such as "münchen.de", rather than free text. Only such values are
+// IDN-normalized.
+func isDomainLike(s string) bool {
+	return strings.Contains(s, ".") && !strings.ContainsAny(s, " \t,")
+}
+
+// isValidDomain is isDomainName for names that may contain internationalized
+// labels, which are checked in their punycode form.
+func isValidDomain(name string) bool {
+	ascii, err := idna.Punycode.ToASCII(name)
+	return err == nil && isDomainName(ascii)
+}
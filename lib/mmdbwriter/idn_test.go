@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestNormalizeIDN(t *testing.T) {
+	tests := []struct {
+		name, mode, want string
+		wantErr          bool
+	}{
+		{"bücher.example", idnToASCII, "xn--bcher-kva.example", false},
+		{"xn--bcher-kva.example", idnToUnicode, "bücher.example", false},
+		{"MÜNCHEN.de", idnToASCII, "xn--mnchen-3ya.de", false},
+		{"example.net", idnToASCII, "example.net", false},
+		{"bücher.example", idnNone, "bücher.example", false},
+		{"xn--a.example", idnToUnicode, "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeIDN(tt.name, tt.mode)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeIDN(%q, %s): got error %v, want error %t", tt.name, tt.mode, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("normalizeIDN(%q, %s) = %q, want %q", tt.name, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestIsDomainLike(t *testing.T) {
+	for s, want := range map[string]bool{
+		"münchen.de":           true,
+		"example.net":          true,
+		"Example Networks Inc": false,
+		"Example, Inc.":        false,
+		"Example":              false,
+	} {
+		if got := isDomainLike(s); got != want {
+			t.Errorf("isDomainLike(%q) = %t, want %t", s, got, want)
+		}
+	}
+}
+
+func TestIsValidDomain(t *testing.T) {
+	for name, want := range map[string]bool{
+		"example.net":    true,
+		"example.net.":   true,
+		"bücher.example": true,
+		"not a domain":   false,
+		"":               false,
+		"-bad.example":   false,
+	} {
+		if got := isValidDomain(name); got != want {
+			t.Errorf("isValidDomain(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// infoKeys are the standard metadata keys in the order info prints them.
+var infoKeys = []string{
+	"database_type", "description", "languages", "build_epoch", "ip_version",
+	"record_size", "node_count", "binary_format_major_version", "binary_format_minor_version",
+}
+
+// runInfo implements `info [flags] <db.mmdb>`: it prints the metadata of a
+// database, the provenance of its data first and the whole map with -json.
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "write the metadata map as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s info [flags] <db.mmdb>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("info needs a database")
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read MMDB file: %w", err)
+	}
+	// Opening the database validates it before its metadata is decoded.
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("failed to open MMDB file: %w", err)
+	}
+	defer db.Close()
+	md, err := readMetadataMap(data)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(md)
+	}
+
+	var custom []string
+	for k := range md {
+		if !standardMetadataKeys[k] && !slices.Contains(provenanceKeys, k) {
+			custom = append(custom, k)
+		}
+	}
+	slices.Sort(custom)
+	width := 0
+	for _, k := range slices.Concat(provenanceKeys, infoKeys, custom) {
+		width = max(width, len(k))
+	}
+	line := func(k, v string) { fmt.Printf("%-*s  %s\n", width, k, v) }
+
+	for _, k := range provenanceKeys {
+		v, ok := md[k]
+		if !ok {
+			v = "(not recorded)"
+		}
+		line(k, fmt.Sprint(v))
+	}
+	for _, k := range infoKeys {
+		switch v := md[k].(type) {
+		case nil:
+		case map[string]any:
+			langs := make([]string, 0, len(v))
+			for lang := range v {
+				langs = append(langs, lang)
+			}
+			slices.Sort(langs)
+			for _, lang := range langs {
+				line(k+"."+lang, fmt.Sprint(v[lang]))
+			}
+		case []any:
+			if len(v) == 0 {
+				continue
+			}
+			parts := make([]string, len(v))
+			for i, e := range v {
+				parts[i] = fmt.Sprint(e)
+			}
+			line(k, strings.Join(parts, ","))
+		default:
+			if k == "build_epoch" {
+				line(k, fmt.Sprintf("%v (%s)", v, time.Unix(int64(db.Metadata.BuildEpoch), 0).UTC().Format(time.RFC3339)))
+				continue
+			}
+			line(k, fmt.Sprint(v))
+		}
+	}
+	for _, k := range custom {
+		line(k, fmt.Sprint(md[k]))
+	}
+	return nil
+}
+
+// readMetadataMap decodes the whole metadata map of a serialized database,
+// including the custom keys maxminddb.Metadata has no field for.
+func readMetadataMap(data []byte) (map[string]any, error) {
+	i := bytes.LastIndex(data, metadataStartMarker)
+	if i < 0 {
+		return nil, errors.New("invalid MMDB file: no metadata section")
+	}
+	d := metadataDecoder{buf: data[i+len(metadataStartMarker):]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	md, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("failed to decode metadata: not a map")
+	}
+	return md, nil
+}
+
+// metadataDecoder decodes values of the MaxMind DB data format within one
+// section, the offsets of pointers being relative to its start.
+type metadataDecoder struct {
+	buf []byte
+}
+
+// MaxMind DB data types.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbSlice
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// maxMetadataDepth bounds the nesting of maps, slices and pointers, so a
+// corrupt file cannot recurse without end.
+const maxMetadataDepth = 32
+
+// decode returns the value at offset and the offset after it.
+func (d metadataDecoder) decode(offset, depth int) (any, int, error) {
+	if depth > maxMetadataDepth {
+		return nil, 0, errors.New("values nested too deeply")
+	}
+	typeNum, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typeNum {
+	case mmdbPointer:
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, next, err
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if m[key], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbSlice:
+		s := make([]any, 0, min(size, len(d.buf)))
+		for range size {
+			var v any
+			if v, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			s = append(s, v)
+		}
+		return s, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(d.buf) {
+		return nil, 0, errors.New("value extends past the end of the metadata")
+	}
+	b, next := d.buf[offset:offset+size], offset+size
+	switch typeNum {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes:
+		return slices.Clone(b), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		if typeNum == mmdbInt32 {
+			return int32(uint32(u)), next, nil
+		}
+		return u, next, nil
+	case mmdbUint128:
+		return new(big.Int).SetBytes(b), next, nil
+	}
+	return nil, 0, fmt.Errorf("unexpected data type %d", typeNum)
+}
+
+// control reads the control byte at offset and returns the type and size
+// of the value and the offset of its payload.
+func (d metadataDecoder) control(offset int) (typeNum, size, next int, err error) {
+	if offset >= len(d.buf) {
+		return 0, 0, 0, errors.New("unexpected end of the metadata")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typeNum = int(ctrl >> 5)
+	if typeNum == mmdbExtended {
+		if offset >= len(d.buf) {
+			return 0, 0, 0, errors.New("unexpected end of the metadata")
+		}
+		typeNum = 7 + int(d.buf[offset])
+		offset++
+	}
+	size = int(ctrl & 0x1f)
+	if typeNum == mmdbPointer || size < 29 {
+		return typeNum, size, offset, nil
+	}
+
+	n := size - 28
+	if offset+n > len(d.buf) {
+		return 0, 0, 0, errors.New("unexpected end of the metadata")
+	}
+	var extra int
+	for _, c := range d.buf[offset : offset+n] {
+		extra = extra<<8 | int(c)
+	}
+	switch n {
+	case 1:
+		size = 29 + extra
+	case 2:
+		size = 285 + extra
+	default:
+		size = 65821 + extra
+	}
+	return typeNum, size, offset + n, nil
+}
+
+// pointer returns the target of a pointer whose control byte had the given
+// size bits, and the offset after it.
+func (d metadataDecoder) pointer(size, offset int) (int, int, error) {
+	n := (size>>3)&3 + 1
+	if offset+n > len(d.buf) {
+		return 0, 0, errors.New("unexpected end of the metadata")
+	}
+	var target int
+	if n < 4 {
+		target = size & 7
+	}
+	for _, c := range d.buf[offset : offset+n] {
+		target = target<<8 | int(c)
+	}
+	switch n {
+	case 2:
+		target += 2048
+	case 3:
+		target += 526336
+	}
+	return target, offset + n, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// stdioPath as the input or output file selects stdin or stdout.
+const stdioPath = "-"
+
+// Input formats accepted by -format.
+const (
+	formatCSV   = "csv"
+	formatFixed = "fixed"
+	formatTable = "table"
+	formatJSONL = "jsonl"
+	formatMRT   = "mrt"
+
+	// formatIPtoASN and formatIPinfo read the range-based datasets of
+	// iptoasn.com and IPinfo.
+	formatIPtoASN = "iptoasn"
+	formatIPinfo  = "ipinfo"
+)
+
+// rowReader yields the rows of an input file as fields, in the column
+// layout of the CSV format. *csv.Reader implements it.
+type rowReader interface {
+	Read() ([]string, error)
+	// FieldPos returns the line and column of the given field of the row
+	// most recently returned by Read.
+	FieldPos(field int) (line, column int)
+}
+
+// newRowReader returns a reader for the configured input format together
+// with the header describing its columns.
+func newRowReader(cfg *config, r io.Reader) (rowReader, []string, error) {
+	switch cfg.format {
+	case formatCSV:
+		cr := csv.NewReader(r)
+		// Rows may mix the two-column and three-column formats, so the
+		// field count is checked per row instead of against the first
+		// record.
+		cr.FieldsPerRecord = -1
+
+		// Skip header row
+		header, err := cr.Read()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CSV header: %w", err)
+		}
+		return cr, header, nil
+	case formatFixed:
+		fr := newFixedWidthReader(r, cfg.fixedFields)
+		return fr, fr.header(), nil
+	case formatTable:
+		tr := newTableReader(r)
+		return tr, tr.header(), nil
+	case formatJSONL:
+		jr := newJSONLReader(r)
+		return jr, jr.header(), nil
+	case formatMRT:
+		mr := newMRTReader(r)
+		return mr, mr.header(), nil
+	case formatIPtoASN:
+		ir := newIPtoASNReader(r)
+		return ir, ir.header(), nil
+	case formatIPinfo:
+		ir, err := newIPinfoReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ir, ir.header(), nil
+	}
+	return nil, nil, fmt.Errorf("unknown input format %q", cfg.format)
+}
+
+// formatFromExtension returns the input format implied by the extension of
+// a file name or URL, or "" when it implies none. Inputs are decompressed,
+// so asns.csv.gz is CSV.
+func formatFromExtension(name string) string {
+	name = trimCompressionExt(name)
+	switch {
+	case strings.HasSuffix(name, ".jsonl"):
+		return formatJSONL
+	case strings.HasSuffix(name, ".csv"):
+		return formatCSV
+	}
+	return ""
+}
+
+// decompressInput returns r decompressed when it is gzip, bzip2 or zstd
+// compressed, detected by the magic bytes, and r as it is otherwise.
+func decompressInput(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip data: %w", err)
+		}
+		return zr, nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd data: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// Values of -partial-line.
+const (
+	partialLineSkip = "skip"
+	partialLineKeep = "keep"
+	partialLineFail = "fail"
+)
+
+// partialLineReader passes its input through whole lines at a time and
+// handles a final line without a newline by mode: when stdin is a pipe from
+// a download that stopped early, that line is usually cut short, and a cut
+// row such as 192.0.2.0/2 of 192.0.2.0/24 can look valid. Bytes after the
+// last newline are held back until more data or the end of the input
+// arrives, so lines are held in memory only while incomplete.
+type partialLineReader struct {
+	r       io.Reader
+	mode    string
+	pending []byte
+	buf     []byte
+	eof     bool
+
+	// skipped counts the lines dropped with partialLineSkip.
+	skipped int
+}
+
+func newPartialLineReader(r io.Reader, mode string) *partialLineReader {
+	return &partialLineReader{r: r, mode: mode, buf: make([]byte, 32<<10)}
+}
+
+func (pr *partialLineReader) Read(p []byte) (int, error) {
+	for {
+		// Complete lines are handed out first.
+		if i := bytes.LastIndexByte(pr.pending, '\n'); i >= 0 {
+			n := copy(p, pr.pending[:i+1])
+			pr.pending = pr.pending[n:]
+			return n, nil
+		}
+		if pr.eof {
+			if len(pr.pending) == 0 {
+				return 0, io.EOF
+			}
+			switch pr.mode {
+			case partialLineKeep:
+				n := copy(p, pr.pending)
+				pr.pending = pr.pending[n:]
+				return n, nil
+			case partialLineFail:
+				return 0, fmt.Errorf("input ends in a partial line of %d bytes without a newline", len(pr.pending))
+			}
+			logger.Warn("skipping partial last line without a newline", "bytes", len(pr.pending))
+			pr.skipped++
+			pr.pending = nil
+			return 0, io.EOF
+		}
+		n, err := pr.r.Read(pr.buf)
+		pr.pending = append(pr.pending, pr.buf[:n]...)
+		if err == io.EOF {
+			pr.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// checkHeader compares the input header against the comma-separated
+// expected column names, case-insensitively and in order. The error lists
+// every position that differs.
+func checkHeader(expected string, header []string) error {
+	want := strings.Split(expected, ",")
+
+	var diff []string
+	for i := 0; i < max(len(want), len(header)); i++ {
+		w, h := "(none)", "(none)"
+		if i < len(want) {
+			w = strings.TrimSpace(want[i])
+		}
+		if i < len(header) {
+			h = strings.TrimSpace(header[i])
+		}
+		if !strings.EqualFold(w, h) {
+			diff = append(diff, fmt.Sprintf("  column %d: expected %q, got %q", i+1, w, h))
+		}
+	}
+	if len(diff) > 0 {
+		return fmt.Errorf("input header does not match -expect-header:\n%s", strings.Join(diff, "\n"))
+	}
+	return nil
+}
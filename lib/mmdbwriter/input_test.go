@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCheckHeader(t *testing.T) {
+	tests := []struct {
+		expected string
+		header   []string
+		wantDiff []string
+	}{
+		{"network,asn,org", []string{"network", "asn", "org"}, nil},
+		{"network, ASN ,org", []string{"Network", "asn", " org"}, nil},
+		{"network,asn,org", []string{"network", "asn"}, []string{`column 3: expected "org", got "(none)"`}},
+		{"network,asn", []string{"network", "asn", "org"}, []string{`column 3: expected "(none)", got "org"`}},
+		{"network,asn,org", []string{"prefix", "asn", "name"}, []string{
+			`column 1: expected "network", got "prefix"`,
+			`column 3: expected "org", got "name"`,
+		}},
+	}
+	for _, tt := range tests {
+		err := checkHeader(tt.expected, tt.header)
+		if tt.wantDiff == nil {
+			if err != nil {
+				t.Errorf("checkHeader(%q, %q): %v", tt.expected, tt.header, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("checkHeader(%q, %q) succeeded", tt.expected, tt.header)
+			continue
+		}
+		for _, diff := range tt.wantDiff {
+			if !strings.Contains(err.Error(), diff) {
+				t.Errorf("checkHeader(%q, %q) = %q, want it to report %s", tt.expected, tt.header, err, diff)
+			}
+		}
+	}
+}
+
+// compressTestContent is the content of the compressed inputs of tests.
+const compressTestContent = "network,asn\n1.1.1.0/24,13335\n"
+
+// bzip2TestContent is compressTestContent compressed by bzip2, for which
+// Go has no encoder.
+var bzip2TestContent = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xf6, 0xda, 0xda, 0x13, 0x00, 0x00,
+	0x0b, 0xd9, 0x80, 0x00, 0x10, 0x00, 0x05, 0xfe, 0x00, 0x22, 0x09, 0x9c, 0x80, 0x20, 0x00, 0x31,
+	0x4c, 0x98, 0x99, 0x06, 0x46, 0x15, 0xa0, 0x18, 0xd4, 0xd1, 0x88, 0xca, 0xac, 0x84, 0x86, 0x5b,
+	0x34, 0xc8, 0xa0, 0xae, 0x07, 0x9c, 0xe6, 0x1e, 0x27, 0xe2, 0xee, 0x48, 0xa7, 0x0a, 0x12, 0x1e,
+	0xdb, 0x5b, 0x42, 0x60,
+}
+
+// compressTest returns compressTestContent compressed as compression.
+func compressTest(t testing.TB, compression string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case "":
+		return []byte(compressTestContent)
+	case "bzip2":
+		return bzip2TestContent
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := io.WriteString(w, compressTestContent); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressInput(t *testing.T) {
+	// Decompression must not depend on commands such as zstd.
+	t.Setenv("PATH", "")
+	for _, compression := range []string{"", "gzip", "bzip2", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			r, err := decompressInput(bytes.NewReader(compressTest(t, compression)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if data, err := io.ReadAll(r); err != nil || string(data) != compressTestContent {
+				t.Errorf("got %q (%v), want %q", data, err, compressTestContent)
+			}
+		})
+	}
+
+	// A corrupt frame after valid magic bytes fails the read.
+	corrupt := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, bytes.Repeat([]byte{0xff}, 16)...)
+	if r, err := decompressInput(bytes.NewReader(corrupt)); err == nil {
+		_, err = io.ReadAll(r)
+		r.Close()
+		if err == nil {
+			t.Error("corrupt zstd input was read without an error")
+		}
+	}
+}
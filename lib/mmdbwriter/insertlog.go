@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// insertLog is the -insert-log file. The lines of a build are appended to
+// a copy of the log next to it, which acceptBuild renames over the log, so
+// a build that fails or is refused adds nothing.
+type insertLog struct {
+	*bufio.Writer
+	fh   *os.File
+	path string
+}
+
+func openInsertLog(path string) (*insertLog, error) {
+	fh, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open insert log: %w", err)
+	}
+	l := &insertLog{Writer: bufio.NewWriter(fh), fh: fh, path: path}
+	if old, err := os.Open(path); err == nil {
+		_, err = io.Copy(fh, old)
+		old.Close()
+		if err != nil {
+			l.discard()
+			return nil, fmt.Errorf("failed to copy insert log: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		l.discard()
+		return nil, fmt.Errorf("failed to open insert log: %w", err)
+	}
+	return l, nil
+}
+
+func (l *insertLog) add(network *net.IPNet, asn uint64) error {
+	if _, err := fmt.Fprintf(l, "%s,%d\n", network, asn); err != nil {
+		return fmt.Errorf("failed to write insert log: %w", err)
+	}
+	return nil
+}
+
+// close completes the copy of the log, which replaces it once the build
+// is accepted.
+func (l *insertLog) close() (pendingFile, error) {
+	err := l.Flush()
+	if cerr := l.fh.Close(); err == nil {
+		err = cerr
+	}
+	// CreateTemp makes the file private; match the mode of os.Create.
+	if err == nil {
+		err = os.Chmod(l.fh.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(l.fh.Name())
+		return pendingFile{}, fmt.Errorf("failed to write insert log: %w", err)
+	}
+	return pendingFile{tmp: l.fh.Name(), path: l.path}, nil
+}
+
+// discard removes the copy, leaving the log as it was.
+func (l *insertLog) discard() {
+	l.fh.Close()
+	os.Remove(l.fh.Name())
+}
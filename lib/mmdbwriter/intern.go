@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// recordInterner hands out one shared record for rows whose records are
+// equal, and one shared organization string for rows with the same
+// organization, so that an ASN with thousands of prefixes holds one record
+// instead of a map and a CSV line per row. The tree deduplicates what it
+// stores by itself; this matters for the rows held while the inputs are
+// read. Shared records must not be modified in place.
+type recordInterner struct {
+	seed    maphash.Seed
+	records map[uint64]mmdbtype.Map
+	// collisions holds the further records of a hash, which are rare.
+	collisions map[uint64][]mmdbtype.Map
+	orgs       map[mmdbtype.String]mmdbtype.String
+
+	// rows and distinct count the records interned and the different
+	// ones among them.
+	rows, distinct int
+}
+
+func newRecordInterner() *recordInterner {
+	return &recordInterner{
+		seed:       maphash.MakeSeed(),
+		records:    map[uint64]mmdbtype.Map{},
+		collisions: map[uint64][]mmdbtype.Map{},
+		orgs:       map[mmdbtype.String]mmdbtype.String{},
+	}
+}
+
+// hashRecord hashes v without allocating. Map entries are combined in an
+// order-independent way, so the keys need not be sorted.
+func hashRecord(seed maphash.Seed, v mmdbtype.DataType) uint64 {
+	var h maphash.Hash
+	h.SetSeed(seed)
+	var buf [8]byte
+	putUint := func(kind byte, n uint64) {
+		h.WriteByte(kind)
+		binary.LittleEndian.PutUint64(buf[:], n)
+		h.Write(buf[:])
+	}
+	switch v := v.(type) {
+	case mmdbtype.Map:
+		var sum uint64
+		for key, value := range v {
+			sum += maphash.String(seed, string(key)) ^ hashRecord(seed, value)
+		}
+		putUint('m', sum)
+	case mmdbtype.Slice:
+		h.WriteByte('s')
+		for _, item := range v {
+			binary.LittleEndian.PutUint64(buf[:], hashRecord(seed, item))
+			h.Write(buf[:])
+		}
+	case mmdbtype.String:
+		h.WriteByte('S')
+		h.WriteString(string(v))
+	case mmdbtype.Bytes:
+		h.WriteByte('b')
+		h.Write(v)
+	case mmdbtype.Bool:
+		if v {
+			putUint('B', 1)
+		} else {
+			putUint('B', 0)
+		}
+	case mmdbtype.Uint16:
+		putUint('u', uint64(v))
+	case mmdbtype.Uint32:
+		putUint('u', uint64(v))
+	case mmdbtype.Uint64:
+		putUint('u', uint64(v))
+	case mmdbtype.Int32:
+		putUint('i', uint64(v))
+	case mmdbtype.Float32:
+		putUint('f', uint64(math.Float32bits(float32(v))))
+	case mmdbtype.Float64:
+		putUint('f', math.Float64bits(float64(v)))
+	default:
+		// Rare types only cost a comparison with the records of the
+		// same kind.
+		h.WriteString(fmt.Sprintf("%T", v))
+	}
+	return h.Sum64()
+}
+
+// intern returns the shared record equal to record, which becomes the
+// shared one when it is the first of its kind.
+func (in *recordInterner) intern(record mmdbtype.Map) mmdbtype.Map {
+	in.rows++
+	if org, ok := record["autonomous_system_organization"].(mmdbtype.String); ok {
+		shared, ok := in.orgs[org]
+		if !ok {
+			// A copy, as the field of a CSV row keeps the whole line.
+			shared = mmdbtype.String(strings.Clone(string(org)))
+			in.orgs[shared] = shared
+		}
+		record["autonomous_system_organization"] = shared
+	}
+
+	h := hashRecord(in.seed, record)
+	in.distinct++
+	shared, ok := in.records[h]
+	if !ok {
+		in.records[h] = record
+		return record
+	}
+	if shared.Equal(record) {
+		in.distinct--
+		return shared
+	}
+	for _, shared := range in.collisions[h] {
+		if shared.Equal(record) {
+			in.distinct--
+			return shared
+		}
+	}
+	in.collisions[h] = append(in.collisions[h], record)
+	return record
+}
+
+// ratio returns how many rows share each distinct record.
+func (in *recordInterner) ratio() float64 {
+	if in.distinct == 0 {
+		return 0
+	}
+	return math.Round(100*float64(in.rows)/float64(in.distinct)) / 100
+}
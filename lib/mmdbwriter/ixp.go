@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/inserter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// peeringDBList is the envelope of a PeeringDB API object list.
+type peeringDBList[T any] struct {
+	Data []T `json:"data"`
+}
+
+type peeringDBIX struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type peeringDBIXLan struct {
+	ID   int `json:"id"`
+	IXID int `json:"ix_id"`
+}
+
+type peeringDBIXPfx struct {
+	IXLanID int    `json:"ixlan_id"`
+	Prefix  string `json:"prefix"`
+}
+
+// peeringDBExport is a PeeringDB JSON dump, which holds the object lists
+// of the API keyed by object type.
+type peeringDBExport struct {
+	IX    peeringDBList[peeringDBIX]    `json:"ix"`
+	IXLan peeringDBList[peeringDBIXLan] `json:"ixlan"`
+	IXPfx peeringDBList[peeringDBIXPfx] `json:"ixpfx"`
+}
+
+// ixpPrefix is a peering LAN prefix with the name of its exchange.
+type ixpPrefix struct {
+	prefix netip.Prefix
+	name   string
+}
+
+// loadIXPPrefixes reads the IXLAN prefixes of PeeringDB from a JSON dump,
+// or from the API when source is a URL such as
+// https://www.peeringdb.com/api, whose ix, ixlan and ixpfx endpoints are
+// fetched.
+func loadIXPPrefixes(ctx context.Context, source, userAgent string, retries int) ([]ixpPrefix, error) {
+	var export peeringDBExport
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		dir, err := os.MkdirTemp("", "mmdbwriter-peeringdb-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		base := strings.TrimSuffix(source, "/")
+		lists := []struct {
+			name string
+			list any
+		}{{"ix", &export.IX}, {"ixlan", &export.IXLan}, {"ixpfx", &export.IXPfx}}
+		for _, l := range lists {
+			name, list := l.name, l.list
+			path := filepath.Join(dir, name+".json")
+			if _, err := fetchFile(ctx, base+"/"+name, path, userAgent, retries); err != nil {
+				return nil, fmt.Errorf("failed to fetch PeeringDB %s objects: %w", name, err)
+			}
+			if err := readJSONFile(path, list); err != nil {
+				return nil, fmt.Errorf("failed to parse PeeringDB %s objects: %w", name, err)
+			}
+		}
+	} else if err := readJSONFile(source, &export); err != nil {
+		return nil, fmt.Errorf("failed to parse PeeringDB export %s: %w", source, err)
+	}
+
+	ixNames := make(map[int]string, len(export.IX.Data))
+	for _, ix := range export.IX.Data {
+		ixNames[ix.ID] = ix.Name
+	}
+	lanNames := make(map[int]string, len(export.IXLan.Data))
+	for _, lan := range export.IXLan.Data {
+		lanNames[lan.ID] = ixNames[lan.IXID]
+	}
+
+	prefixes := make([]ixpPrefix, 0, len(export.IXPfx.Data))
+	for _, pfx := range export.IXPfx.Data {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(pfx.Prefix))
+		if err != nil {
+			logger.Warn("skipping invalid IXP prefix", "prefix", pfx.Prefix, "error", err)
+			continue
+		}
+		prefixes = append(prefixes, ixpPrefix{prefix: prefix.Masked(), name: lanNames[pfx.IXLanID]})
+	}
+	return prefixes, nil
+}
+
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ixpEnricher is the IXP stage of the enrichment pipeline.
+type ixpEnricher []ixpPrefix
+
+func (e ixpEnricher) enrichNetworks(writer *mmdbwriter.Tree, cfg *config, stats *buildStats) error {
+	var err error
+	stats.ixpPrefixes, err = tagIXPNetworks(writer, cfg, e)
+	return err
+}
+
+// tagIXPNetworks stores is_ixp and ixp_name for every peering LAN prefix
+// and returns how many were tagged. Rows inside a prefix keep their data
+// and gain the two fields; the rest of the prefix gets a record of its own.
+// Prefixes the database cannot hold, e.g. in reserved space or of a family
+// the build leaves out, are skipped.
+func tagIXPNetworks(writer *mmdbwriter.Tree, cfg *config, prefixes []ixpPrefix) (int, error) {
+	policy := networkPolicy(cfg)
+	tagged := 0
+	for _, p := range prefixes {
+		if excludesFamily(cfg, p.prefix) {
+			continue
+		}
+		if err := policy.Check(p.prefix); err != nil {
+			logger.Warn("skipping unsupported IXP prefix", "network", p.prefix, "ixp", p.name, "error", err)
+			continue
+		}
+		tag := mmdbbuild.Record{Fields: map[string]mmdbtype.DataType{"is_ixp": mmdbtype.Bool(true)}}
+		if p.name != "" {
+			tag.Fields["ixp_name"] = mmdbtype.String(p.name)
+		}
+		if err := writer.InsertFunc(prefixNetwork(p.prefix), inserter.TopLevelMergeWith(tag.Map())); err != nil {
+			return tagged, fmt.Errorf("failed to tag IXP prefix %s: %w", p.prefix, err)
+		}
+		tagged++
+	}
+	return tagged, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// jsonlEntry is one line of the bgp.tools table.jsonl dump.
+type jsonlEntry struct {
+	CIDR string      `json:"CIDR"`
+	ASN  json.Number `json:"ASN"`
+	Hits json.Number `json:"Hits"`
+}
+
+// jsonlReader reads the bgp.tools table.jsonl dump as network, asn and
+// hits columns. Lines that are not valid JSON are reported and skipped.
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	line    int
+	// onInvalid, when set, is told about the invalid lines instead of the
+	// log.
+	onInvalid func(line int, err error)
+}
+
+func newJSONLReader(r io.Reader) *jsonlReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	return &jsonlReader{scanner: scanner}
+}
+
+func (jr *jsonlReader) header() []string {
+	return []string{"network", "asn", hitsColumn}
+}
+
+func (jr *jsonlReader) Read() ([]string, error) {
+	for jr.scanner.Scan() {
+		jr.line++
+		line := strings.TrimSpace(jr.scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var entry jsonlEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			if jr.onInvalid != nil {
+				jr.onInvalid(jr.line, err)
+			} else {
+				logger.Warn("skipping invalid JSON", "line", jr.line, "error", err)
+			}
+			continue
+		}
+		return []string{entry.CIDR, entry.ASN.String(), entry.Hits.String()}, nil
+	}
+	if err := jr.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (jr *jsonlReader) FieldPos(field int) (line, column int) {
+	return jr.line, 1
+}
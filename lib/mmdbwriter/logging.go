@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Log formats accepted by -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logger receives the progress, warning and summary messages of a build.
+// Until setupLogging runs it logs text at the info level.
+var logger = slog.New(slog.NewTextHandler(stdoutWriter{}, nil))
+
+// stdoutWriter writes to whatever os.Stdout is at the time, so that logs
+// follow it to stderr when the database is streamed to stdout.
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+// setupLogging configures logger from -log-format, -quiet and -verbose.
+// -quiet keeps only warnings and errors, -verbose adds per-row progress.
+func setupLogging(format string, quiet, verbose bool) error {
+	if quiet && verbose {
+		return errors.New("-quiet and -verbose are mutually exclusive")
+	}
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	switch {
+	case quiet:
+		opts.Level = slog.LevelWarn
+	case verbose:
+		opts.Level = slog.LevelDebug
+	}
+
+	switch format {
+	case logFormatText:
+		logger = slog.New(slog.NewTextHandler(stdoutWriter{}, opts))
+	case logFormatJSON:
+		logger = slog.New(slog.NewJSONHandler(stdoutWriter{}, opts))
+	default:
+		return fmt.Errorf("unknown -log-format %q (want text or json)", format)
+	}
+	return nil
+}
+
+// fatal logs the error and exits like log.Fatal, but through logger so
+// that it keeps the configured format and survives -quiet.
+func fatal(args ...any) {
+	logger.Error(fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+// fatalf is the formatted variant of fatal.
+func fatalf(format string, args ...any) {
+	logger.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Output formats of the lookup command.
+const (
+	lookupJSON    = "json"
+	lookupCompact = "compact"
+)
+
+// runLookup implements `lookup [flags] <db.mmdb> <ip|->...`: it prints the
+// record of each address, reading addresses one per line from stdin for
+// "-", for spot checks without mmdblookup. With -as-of the first argument
+// is a publish directory, and the version current at that date is used.
+func runLookup(args []string) error {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	format := fs.String("format", lookupJSON,
+		"output `format`: json (an object per line, as GET /lookup/{ip} of serve) or compact (ip, network and key=value fields)")
+	asOfFlag := fs.String("as-of", "",
+		"look up in the version of the publish directory given instead of the database that was current at this `date` (YYYY-MM-DD, Unix seconds or RFC 3339)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s lookup [flags] <db.mmdb|publish-dir> <ip|->...\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("lookup needs a database and an address")
+	}
+	if *format != lookupJSON && *format != lookupCompact {
+		return fmt.Errorf("invalid -format %q: must be %s or %s", *format, lookupJSON, lookupCompact)
+	}
+
+	dbFile, version := fs.Arg(0), ""
+	if *asOfFlag != "" {
+		asOf, err := parseAsOf(*asOfFlag)
+		if err != nil {
+			return err
+		}
+		index, err := readHistoryIndex(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		v, err := versionAsOf(index.Versions, asOf)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fs.Arg(0), err)
+		}
+		dbFile, version = filepath.Join(fs.Arg(0), filepath.FromSlash(v.Path)), v.Path
+		logger.Info("looking up in a published version", "as_of", asOf.String(), "version", v.Path,
+			"built", time.Unix(int64(v.BuildEpoch), 0).UTC().Format(time.RFC3339))
+	}
+	db, err := maxminddb.Open(dbFile)
+	if err != nil {
+		return fmt.Errorf("failed to open MMDB file: %w", err)
+	}
+	defer db.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	invalid := 0
+	lookup := func(s string) error {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			invalid++
+			logger.Warn("skipping invalid IP address", "ip", s)
+			return nil
+		}
+		network, record, err := lookupRecord(db, ip)
+		if err != nil {
+			return fmt.Errorf("failed to look up %s: %w", ip, err)
+		}
+		resp := lookupResponse{IP: ip.String(), Network: network.String(), Version: version}
+		if m, ok := mmdbToJSON(record).(map[string]any); ok {
+			resp.Record = m
+		}
+		if *format == lookupCompact {
+			_, err = fmt.Fprintln(w, compactLookup(resp))
+			return err
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	for _, arg := range fs.Args()[1:] {
+		if arg != "-" {
+			if err := lookup(arg); err != nil {
+				return err
+			}
+			continue
+		}
+		r := bufio.NewReader(os.Stdin)
+		for {
+			line, err := r.ReadString('\n')
+			if s := strings.TrimSpace(line); s != "" && !strings.HasPrefix(s, "#") {
+				if err := lookup(s); err != nil {
+					return err
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read addresses: %w", err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid IP addresses", invalid)
+	}
+	return nil
+}
+
+// compactLookup formats a lookup as one line: the address, the network and
+// the top-level fields of the record as key=value in key order, with
+// nested values as JSON. An address without data shows "-" for the record.
+func compactLookup(resp lookupResponse) string {
+	fields := []string{resp.IP, resp.Network}
+	if resp.Record == nil {
+		return strings.Join(append(fields, "-"), " ")
+	}
+	keys := make([]string, 0, len(resp.Record))
+	for k := range resp.Record {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		v, ok := resp.Record[k].(string)
+		// Strings are only quoted when they would not read as one field.
+		if !ok || v == "" || strings.ContainsAny(v, " \t\"") {
+			data, _ := json.Marshal(resp.Record[k])
+			v = string(data)
+		}
+		fields = append(fields, k+"="+v)
+	}
+	return strings.Join(fields, " ")
+}
@@ -1,173 +1,2217 @@
 package main
 
 import (
-	"encoding/csv"
-	"errors"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
 	"net"
+	"net/netip"
 	"os"
-	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/maxmind/mmdbwriter"
 	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+
+	"mmdbwriter/pkg/bgptools"
 )
 
+// config holds the command line options for a build.
+type config struct {
+	csvFile    string
+	outputFile string
+
+	// extraInputs are read after csvFile into the same database, in
+	// order of priority; they come from the inputs of a -config file and
+	// the -input flags. inputPriority is the priority of csvFile.
+	extraInputs   []inputSource
+	inputs        inputList
+	inputPriority int
+
+	// configFile is the -config file the settings were loaded from.
+	configFile string
+
+	// format is the input format; fixedFields describes the layout of the
+	// fixed-width format.
+	format      string
+	fixedFields fixedFields
+
+	// requireCanonical skips rows whose network column is not already
+	// written in canonical CIDR form.
+	requireCanonical bool
+
+	// orgMerge picks which organization survives when a record is
+	// inserted over an existing one; empty means last-wins.
+	orgMerge string
+
+	// mergeStrategy decides what happens when a CIDR appears again.
+	mergeStrategy string
+
+	// orgHash stores a short stable hash of the organization instead of
+	// the plaintext name.
+	orgHash bool
+
+	// insertLog, when set, is appended with one "network,asn" line per
+	// inserted prefix.
+	insertLog string
+
+	// storeZeroASN stores ASN 0 explicitly instead of omitting the field;
+	// skipZeroASN drops rows with ASN 0 altogether.
+	storeZeroASN bool
+	skipZeroASN  bool
+
+	// onlyIPv4 and onlyIPv6 build a database of one address family: rows
+	// of the other family are skipped, and the tree holds only that family.
+	onlyIPv4 bool
+	onlyIPv6 bool
+
+	// includeReserved stores rows in reserved address space and
+	// disableAliasing turns off the IPv4 aliases of the IPv6 tree: the
+	// IncludeReservedNetworks and DisableIPv4Aliasing mmdbwriter options.
+	includeReserved bool
+	disableAliasing bool
+
+	// include and exclude keep rows within (or outside) the given
+	// prefixes, and includeASN and excludeASN rows of the given ASNs.
+	include    prefixList
+	exclude    prefixList
+	includeASN asnList
+	excludeASN asnList
+
+	// maxPrefixLen limits the prefix length of rows per address family,
+	// and maxPrefixAction drops the longer ones or truncates them to it.
+	maxPrefixLen    maxPrefixLen
+	maxPrefixAction string
+
+	// recordTemplate is a YAML file mapping the input columns to record
+	// fields with their types.
+	recordTemplate string
+
+	// columnTypes gives extra columns a non-default interpretation, keyed
+	// by 1-based column number.
+	columnTypes columnTypes
+
+	// columns maps the network, ASN and organization to input columns,
+	// ahead of the names of the header.
+	columns columnMap
+
+	// compareBase is a previous build to report churn against, and
+	// maxChurnPercent fails the build when too much of it changed.
+	compareBase     string
+	maxChurnPercent float64
+
+	// minRecords and minCoverage fail the build when it stores fewer
+	// records or covers less of the unicast space, as after a truncated
+	// download.
+	minRecords  int
+	minCoverage minCoverage
+
+	// sqlite, when set, is a SQLite database populated with the inserted
+	// prefixes in the same pass (requires -tags sqlite).
+	sqlite string
+
+	// outputFormat selects what the output file is: an MMDB database, a
+	// Parquet file of the final networks or, with -tags sqlite, a SQLite
+	// database of them.
+	outputFormat string
+
+	// upload is an s3:// or gs:// URL the finished output is uploaded to.
+	upload string
+
+	// checksum writes a .sha256 sidecar next to the output, which signKey
+	// signs with signMethod.
+	checksum   bool
+	signKey    string
+	signMethod string
+
+	// manifest writes a .manifest.json sidecar describing the build for
+	// the reproduce command, with args, the build arguments after the
+	// subcommand.
+	manifest bool
+	args     []string
+
+	// metricsListen serves build metrics over HTTP and metricsTextfile
+	// writes them for the node_exporter textfile collector after every
+	// build; metrics holds them when either is set.
+	metricsListen   string
+	metricsTextfile string
+	metrics         *buildMetrics
+
+	// orgNormalize rewrites organization names, keeping the original in
+	// orgRawField when it changes.
+	orgNormalize orgNormalize
+
+	// maxOrgLen truncates organization names to this many runes (0 means
+	// no limit), ending them with an ellipsis when orgEllipsis is set.
+	maxOrgLen   int
+	orgEllipsis bool
+
+	// crosscheck is a reference database that every inserted prefix is
+	// looked up in after the build; any difference fails the build.
+	crosscheck string
+
+	// sample keeps each data row with this probability (1 keeps all). The
+	// random source is seeded with seed so sampled builds are repeatable.
+	sample float64
+	seed   int64
+
+	// shardMaxSize splits the output into shards of at most this many
+	// megabytes, described by a JSON index (0 writes a single file).
+	shardMaxSize float64
+
+	// splitBy also writes the output partitioned by RIR or continent, one
+	// database per part, described by a JSON index.
+	splitBy string
+
+	// sizeReport prints the output size and write time at each record
+	// size before writing the output.
+	sizeReport bool
+
+	// dryRun reads, validates and merges the inputs and predicts the
+	// output size without writing anything.
+	dryRun bool
+
+	// setRules derive or override record fields from expressions over the
+	// row's columns.
+	setRules setRules
+
+	// whoisOrgs is an RPSL export whose aut-num objects are authoritative
+	// for the organization of their ASN.
+	whoisOrgs string
+
+	// asnNames is a bgp.tools asns.csv supplying the organization of rows
+	// that have none.
+	asnNames string
+
+	// whoisEnrich looks up the ASNs of the input that asnNames does not
+	// name over bgp.tools bulk WHOIS, for their name and country. Answers
+	// are kept in whoisCache; whoisServer is the host:port asked.
+	whoisEnrich bool
+	whoisCache  string
+	whoisServer string
+
+	// rirStats are RIR delegated statistics files annotating each prefix
+	// with its registry, country and allocation date.
+	rirStats rirStatsFiles
+	// tagUnannounced also stores the delegated space no row covers, with
+	// announced false, so that dark space differs from unallocated space.
+	tagUnannounced bool
+	// anomalies is a CSV report of announcements of reserved space, of
+	// space outside rirStats and, with compareBase, of origin ASNs with
+	// more than anomalyGrowth times their networks in it, counting those
+	// with at least anomalyMinPrefixes.
+	anomalies          string
+	anomalyGrowth      float64
+	anomalyMinPrefixes int
+
+	// firstSeen is a network,first_seen history file giving each prefix
+	// the first_seen field; the build adds the prefixes new to it.
+	firstSeen string
+
+	// idn normalizes internationalized domain names in the rdns field and
+	// in domain-like organizations: to-ascii, to-unicode or none.
+	idn string
+
+	// progressFile receives the periodic progress lines instead of stdout,
+	// appended to when progressAppend is set.
+	progressFile   string
+	progressAppend bool
+
+	// progressBar draws an interactive progress bar on stderr.
+	progressBar bool
+
+	// strict fails the build on malformed rows instead of skipping them;
+	// rejects, when set, is a CSV file listing every skipped row.
+	strict  bool
+	rejects string
+
+	// aggregates also inserts a summary record at the covering /N of each
+	// inserted prefix, filling only otherwise empty space.
+	aggregates aggregateLengths
+
+	// collapsePrefixes buffers the rows and merges adjacent and contained
+	// prefixes with identical records before inserting them.
+	collapsePrefixes bool
+
+	// externalSort spills the rows to sorted runs in spillDir and inserts
+	// them in prefix order, and maxMemory is a soft limit on the heap in
+	// megabytes (0 leaves it to GOMEMLIMIT).
+	externalSort bool
+	spillDir     string
+	maxMemory    float64
+
+	// labelBogonASNs replaces the organization of private and reserved
+	// ASNs with a descriptive label.
+	labelBogonASNs bool
+
+	// tagBogonNetworks stores reserved, private and other special-purpose
+	// ranges with an is_bogon record instead of leaving them out.
+	tagBogonNetworks bool
+
+	// peeringDB is a PeeringDB JSON export or API URL whose IXLAN
+	// prefixes are tagged with is_ixp and the exchange name.
+	peeringDB string
+
+	// anycast are prefix lists whose records are marked is_anycast.
+	anycast anycastSources
+
+	// geofeeds are RFC 8805 geofeeds whose locations are added to the
+	// records within their prefixes.
+	geofeeds geofeedSources
+
+	// enrichers lists the enrichment stages to run, in order; nil runs
+	// every stage whose source is set, in the default order.
+	enrichers enricherList
+
+	// patch is a CSV file of rows to add, replace or delete, applied
+	// after everything else the build adds.
+	patch string
+
+	// compareAliasing rebuilds the output without IPv4 aliasing and
+	// fails if any IPv4 lookup differs between the two.
+	compareAliasing bool
+
+	// coverageIndex is the path of an optional bitmap of the top-level
+	// prefixes the output covers.
+	coverageIndex string
+
+	// coverageReport is the path of the -coverage-report, in
+	// coverageFormat, listing the coverageGaps largest gaps and comparing
+	// with the manifest or JSON report coverageBase.
+	coverageReport string
+	coverageFormat string
+	coverageGaps   int
+	coverageBase   string
+
+	// emitNormalized is the path of a JSONL copy of the networks and
+	// records of the output, as export writes it.
+	emitNormalized string
+
+	// expectHeader is the comma-separated header the input must have.
+	expectHeader string
+
+	// dropExpired skips rows whose expires column is before buildTime,
+	// which defaults to the current time and can be pinned with
+	// -build-time, given as buildTimeArg.
+	dropExpired  bool
+	buildTime    time.Time
+	buildTimeArg string
+
+	// workers is the number of goroutines parsing and validating rows.
+	workers int
+
+	// writeWorkers bounds how many output trees are serialized at once.
+	writeWorkers int
+
+	// readBuffer is the size of the read buffer of the inputs in
+	// kilobytes, and partialLine how a stdin input ending in a line
+	// without a newline is handled: skip, keep or fail.
+	readBuffer  int
+	partialLine string
+
+	// onControlChar and onInvalidUTF8 are how ASCII control characters
+	// and invalid UTF-8 in string fields are handled: stripped, replaced,
+	// warned about, rejected with the row or treated as fatal.
+	onControlChar string
+	onInvalidUTF8 string
+
+	// fetchURL, when set, is downloaded to csvFile before the build.
+	fetchURL     string
+	userAgent    string
+	fetchRetries int
+	// sourceSHA256 pins the input: a csv-file with another SHA-256, as
+	// downloaded and decompressed by -fetch, fails the build.
+	sourceSHA256 string
+
+	// reportOrgless lists ASNs that never appear with an organization;
+	// failOnOrgless turns a non-empty list into a build failure.
+	reportOrgless bool
+	failOnOrgless bool
+
+	// databaseType, descriptions and recordSize override the metadata of
+	// the output; metadata adds custom string keys to its metadata map.
+	// With recordSizeAuto, recordSize is the size being tried and grows
+	// when the database does not fit it.
+	databaseType   string
+	descriptions   keyValues
+	recordSize     int
+	recordSizeAuto bool
+	metadata       keyValues
+
+	// license and snapshotDate are written to the license and
+	// snapshot_date metadata keys with the other provenance of the data.
+	license      string
+	snapshotDate string
+
+	// link is an ASN database built by asn-db that the metadata of the
+	// output references by file name and SHA-256.
+	link string
+
+	// rpki is a VRP export (file or URL) the origin of every prefix is
+	// validated against, replacing any rpki column.
+	rpki string
+
+	// asRel is a CAIDA as-rel or upstream list (file or URL) adding the
+	// upstreams of the origin ASN to every record, and its peers with
+	// asRelPeers.
+	asRel      string
+	asRelPeers bool
+
+	// daemon rebuilds the output every interval, replacing it atomically
+	// and then notifying consumers through reloadPIDFile (SIGHUP) and
+	// reloadWebhook.
+	daemon        bool
+	interval      time.Duration
+	reloadPIDFile string
+	reloadWebhook string
+
+	// notifyURL receives the summary or failure of every build, in the
+	// notifyFormat payload, warning when the records drop by
+	// notifyShrinkPercent or more.
+	notifyURL           string
+	notifyFormat        string
+	notifyShrinkPercent float64
+	notifier            *buildNotifier
+
+	// logFormat selects the log handler; quiet and verbose raise or lower
+	// the level from the default info.
+	logFormat string
+	quiet     bool
+	verbose   bool
+
+	// schema selects the fields stored in each record: everything, or
+	// only those of a GeoLite2-ASN database.
+	schema string
+
+	// cpuProfile and memProfile are pprof files the CPU profile of the
+	// build and its allocations are written to.
+	cpuProfile string
+	memProfile string
+}
+
+// buildStats counts what happened to the rows of the input file.
+type buildStats struct {
+	rows         int
+	records      int
+	shortRows    int
+	invalidCIDR  int
+	invalidASN   int
+	unsupported  int
+	nonCanonical int
+	zeroASN      int
+	otherFamily  int
+	filtered     int
+	tooSpecific  int
+	truncated    int
+	invalidJSON  int
+	badTemplate  int
+	orgTruncated int
+	unsampled    int
+	invalidRDNS  int
+	setErrors    int
+	idnErrors    int
+	invalidRPKI  int
+	aggregates   int
+	collapsed    int
+	overridden   int
+	bogonLabeled int
+	expired      int
+	badExpires   int
+	controlChars int
+	invalidUTF8  int
+	badStrings   int
+	invalidHits  int
+	badVis       int
+	badPathLen   int
+	partialLines int
+	orgsFromASNs int
+	duplicates   int
+	rirMatched   int
+	rirUnmatched int
+	ixpPrefixes  int
+	asRelMatched int
+
+	// orgsNormalized counts organizations -org-normalize changed.
+	orgsNormalized int
+
+	// asSets counts rows whose origin is an AS_SET.
+	asSets int
+
+	// unannounced counts the delegations -tag-unannounced stored dark
+	// space of.
+	unannounced int
+
+	// coverage is the -coverage-report of the build.
+	coverage *coverageReport
+
+	// anomalies collects the findings of -anomalies.
+	anomalies *anomalyReport
+
+	// firstSeen is the -first-seen history with the prefixes of the
+	// build added; firstSeenNew counts those it saw for the first time.
+	firstSeen    *firstSeenHistory
+	firstSeenNew int
+
+	// estimate collects the networks of a dry run.
+	estimate *sizeEstimate
+
+	// pending are the -insert-log and -sqlite files of the build, written
+	// next to their paths until acceptBuild renames them.
+	pending []pendingFile
+
+	// whoisEnriched counts the ASNs -whois-enrich found, orgsFromWHOIS the
+	// rows that took their organization from it.
+	whoisEnriched int
+	orgsFromWHOIS int
+
+	// anycastPrefixes counts the -anycast prefixes that matched a record.
+	anycastPrefixes int
+
+	// geofeedPrefixes counts the -geofeed prefixes that matched a record.
+	geofeedPrefixes int
+
+	// distinctRecords counts the different records of the stored rows,
+	// which share one map each.
+	distinctRecords int
+
+	// patched counts the -patch rows applied by action.
+	patched patchStats
+
+	// orgConflicts counts inserts that met a different existing org and
+	// orgRetained how many of those kept the existing org.
+	orgConflicts int
+	orgRetained  int
+
+	// precedenceConflicts counts rows of a higher-priority input that
+	// replaced another origin ASN of a lower-priority one.
+	precedenceConflicts int
+
+	// inserted lists the inserted networks; it is only collected when a
+	// check needs them after the build.
+	inserted []*net.IPNet
+
+	// asnHasOrg records, per ASN, whether any row carried an org. It is
+	// only collected for -report-orgless-asns.
+	asnHasOrg map[uint32]bool
+
+	// whoisMatched records, per ASN of the input, whether -whois-orgs had
+	// an organization for it.
+	whoisMatched map[uint32]bool
+
+	// moasPrefixes holds the prefixes that ended up with several ASNs
+	// under -merge-strategy merge-into-array.
+	moasPrefixes map[netip.Prefix]bool
+
+	// rpkiStatus counts the stored rpki_status values.
+	rpkiStatus map[string]int
+
+	// insertSeconds is the histogram of tree insert durations; it is only
+	// collected for -metrics-listen and -metrics-textfile.
+	insertSeconds *histogram
+
+	// enrichStages names the enrichment stages of the build in the order
+	// they ran, and enrichTime holds the time each took, summed over the
+	// workers.
+	enrichStages []string
+	enrichTime   map[string]time.Duration
+}
+
+// summary returns the build counters as slog attributes. Counters for
+// options that are off are left out, as are skip counters that stayed at
+// zero.
+func (s *buildStats) summary(cfg *config) []any {
+	skipped := s.shortRows + s.invalidCIDR + s.invalidASN + s.unsupported +
+		s.nonCanonical + s.expired + s.zeroASN + s.otherFamily + s.filtered + s.tooSpecific + s.badStrings
+	attrs := []any{"records", s.records, "skipped", skipped}
+	add := func(key string, value int, always bool) {
+		if always || value > 0 {
+			attrs = append(attrs, key, value)
+		}
+	}
+	add("unsampled", s.unsampled, cfg.sample < 1)
+	add("short_rows", s.shortRows, false)
+	add("invalid_cidr", s.invalidCIDR, false)
+	add("invalid_asn", s.invalidASN, false)
+	add("unsupported_networks", s.unsupported, false)
+	add("non_canonical", s.nonCanonical, cfg.requireCanonical)
+	add("expired", s.expired, cfg.dropExpired)
+	add("zero_asn", s.zeroASN, cfg.skipZeroASN)
+	add("other_family", s.otherFamily, cfg.onlyIPv4 || cfg.onlyIPv6)
+	add("filtered", s.filtered, len(cfg.include)+len(cfg.exclude)+len(cfg.includeASN)+len(cfg.excludeASN) > 0)
+	if cfg.maxPrefixLen != (maxPrefixLen{}) {
+		add("too_specific", s.tooSpecific, cfg.maxPrefixAction == maxPrefixDrop)
+		add("truncated_prefixes", s.truncated, cfg.maxPrefixAction == maxPrefixTruncate)
+	}
+	add("control_chars", s.controlChars, false)
+	add("invalid_utf8", s.invalidUTF8, false)
+	add("rejected_string_rows", s.badStrings, cfg.onControlChar == controlCharReject || cfg.onInvalidUTF8 == controlCharReject)
+	add("invalid_expires", s.badExpires, false)
+	add("invalid_hits", s.invalidHits, false)
+	add("invalid_visibility", s.badVis, false)
+	add("invalid_path_length", s.badPathLen, false)
+	add("partial_lines", s.partialLines, false)
+	add("as_set_origins", s.asSets, false)
+	add("invalid_rdns", s.invalidRDNS, false)
+	add("invalid_json", s.invalidJSON, false)
+	add("invalid_template_values", s.badTemplate, false)
+	add("set_errors", s.setErrors, false)
+	add("idn_errors", s.idnErrors, false)
+	if len(cfg.rirStats) > 0 {
+		add("rir_matched", s.rirMatched, true)
+		add("rir_unmatched", s.rirUnmatched, true)
+		add("unannounced_delegations", s.unannounced, cfg.tagUnannounced)
+	}
+	add("orgs_from_asn_names", s.orgsFromASNs, cfg.asnNames != "")
+	add("first_seen_new_prefixes", s.firstSeenNew, cfg.firstSeen != "")
+	if s.anomalies != nil {
+		add("anomalies", len(s.anomalies.found), true)
+	}
+	if cfg.whoisEnrich {
+		add("asns_whois_enriched", s.whoisEnriched, true)
+		add("orgs_from_whois", s.orgsFromWHOIS, true)
+	}
+	add("rows_with_upstreams", s.asRelMatched, cfg.asRel != "")
+	add("bogon_asns_relabeled", s.bogonLabeled, cfg.labelBogonASNs)
+	add("aggregates", s.aggregates, cfg.aggregates.enabled())
+	add("prefixes_collapsed", s.collapsed, cfg.collapsePrefixes)
+	add("rows_overridden", s.overridden, cfg.externalSort)
+	add("precedence_conflicts", s.precedenceConflicts, layeredInputs(cfg))
+	add("ixp_prefixes", s.ixpPrefixes, cfg.peeringDB != "")
+	add("anycast_prefixes", s.anycastPrefixes, len(cfg.anycast) > 0)
+	add("geofeed_prefixes", s.geofeedPrefixes, len(cfg.geofeeds) > 0)
+	add("patch_added", s.patched.added, cfg.patch != "")
+	add("patch_replaced", s.patched.replaced, cfg.patch != "")
+	add("patch_deleted", s.patched.deleted, cfg.patch != "")
+	add("distinct_records", s.distinctRecords, false)
+	add("orgs_truncated", s.orgTruncated, cfg.maxOrgLen > 0)
+	add("orgs_normalized", s.orgsNormalized, cfg.orgNormalize.enabled())
+	for _, stage := range s.enrichStages {
+		attrs = append(attrs, "enrich_"+stage+"_seconds", s.enrichTime[stage].Seconds())
+	}
+	if s.rpkiStatus != nil {
+		for _, status := range rpkiStatuses {
+			add("rpki_"+status, s.rpkiStatus[status], true)
+		}
+		add("invalid_rpki", s.invalidRPKI, true)
+	}
+	if cfg.mergeStrategy != mergeReplace {
+		add("duplicates", s.duplicates, true)
+		if cfg.mergeStrategy == mergeIntoArray {
+			add("moas_prefixes", len(s.moasPrefixes), true)
+		}
+	}
+	if cfg.orgMerge != "" {
+		add("org_conflicts", s.orgConflicts, true)
+		add("orgs_retained", s.orgRetained, true)
+	}
+	if cfg.whoisOrgs != "" {
+		matched := 0
+		for _, ok := range s.whoisMatched {
+			if ok {
+				matched++
+			}
+		}
+		add("whois_matched", matched, true)
+		add("whois_unmatched", len(s.whoisMatched)-matched, true)
+	}
+	return attrs
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <csv-file> [output-file]\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Example: %s asn-blocks.csv asn.mmdb\n", os.Args[0])
+	if len(os.Args) > 1 {
+		if c := findSubcommand(os.Args[1]); c != nil {
+			if err := c.run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	cfg := newBuildConfig(flag.CommandLine)
+	flag.Usage = func() {
+		printUsage(flag.CommandLine.Output())
+		fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+		flag.PrintDefaults()
+	}
+
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "build":
+			args = args[1:]
+		case "help":
+			if err := runHelp(args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "completion":
+			if err := runCompletion(os.Stdout, args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	flag.CommandLine.Parse(args)
+	cfg.args = args
+
+	if cfg.configFile != "" {
+		if err := loadConfigFile(cfg, cfg.configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	cfg.extraInputs = append(cfg.extraInputs, cfg.inputs...)
+	if err := setupLogging(cfg.logFormat, cfg.quiet, cfg.verbose); err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.NArg() < 1 && cfg.csvFile == "" {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	csvFile := os.Args[1]
-	outputFile := "asn.mmdb"
+	if flag.NArg() >= 1 {
+		cfg.csvFile = flag.Arg(0)
+	}
+	if flag.NArg() >= 2 {
+		cfg.outputFile = flag.Arg(1)
+	}
+
+	if cfg.fetchURL != "" && cfg.csvFile == stdioPath {
+		fatal("-fetch needs a csv-file to download to")
+	}
+	if cfg.sourceSHA256 != "" {
+		if cfg.csvFile == stdioPath {
+			fatal("-source-sha256 needs a csv-file to hash")
+		}
+		sum, err := hex.DecodeString(cfg.sourceSHA256)
+		if err != nil || len(sum) != sha256.Size {
+			fatalf("invalid -source-sha256 %q: must be 64 hex digits", cfg.sourceSHA256)
+		}
+		cfg.sourceSHA256 = hex.EncodeToString(sum)
+	}
+	if !flagSet("format") {
+		// Downloads are decompressed, so table.txt.gz is a table.
+		fetchName := trimCompressionExt(cfg.fetchURL)
+		switch {
+		case cfg.fetchURL != "" && strings.HasSuffix(fetchName, ".txt"):
+			cfg.format = formatTable
+		case cfg.fetchURL != "" && formatFromExtension(fetchName) != "":
+			cfg.format = formatFromExtension(fetchName)
+		case formatFromExtension(cfg.csvFile) != "":
+			cfg.format = formatFromExtension(cfg.csvFile)
+		}
+	}
+
+	switch cfg.format {
+	case formatCSV, formatTable, formatJSONL, formatMRT, formatIPtoASN, formatIPinfo:
+	case formatFixed:
+		if err := validateFixedFields(cfg.fixedFields); err != nil {
+			fatal(err)
+		}
+	default:
+		fatalf("unknown -format %q (want csv, fixed, table, jsonl, mrt, iptoasn or ipinfo)", cfg.format)
+	}
+	if err := resolveInputFormats(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateIDNMode(cfg.idn); err != nil {
+		fatal(err)
+	}
+	if err := validateOrgMerge(cfg.orgMerge); err != nil {
+		fatal(err)
+	}
+	if err := validateMergeStrategy(cfg.mergeStrategy); err != nil {
+		fatal(err)
+	}
+	if err := validateMaxPrefixAction(cfg.maxPrefixAction); err != nil {
+		fatal(err)
+	}
+	if err := validateControlCharMode("on-control-char", cfg.onControlChar); err != nil {
+		fatal(err)
+	}
+	if err := validateControlCharMode("on-invalid-utf8", cfg.onInvalidUTF8); err != nil {
+		fatal(err)
+	}
+	if err := validateMetadata(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateSchema(cfg); err != nil {
+		fatal(err)
+	}
+	if cfg.storeZeroASN && cfg.skipZeroASN {
+		fatal("-store-zero-asn and -skip-zero-asn are mutually exclusive")
+	}
+	if cfg.onlyIPv4 && cfg.onlyIPv6 {
+		fatal("-only-ipv4 and -only-ipv6 are mutually exclusive")
+	}
+	if cfg.onlyIPv4 && cfg.disableAliasing {
+		fatal("-disable-ipv4-aliasing has no effect with -only-ipv4, whose IPv4 tree has no aliases")
+	}
+	if cfg.failOnOrgless {
+		cfg.reportOrgless = true
+	}
+	if cfg.sample <= 0 || cfg.sample > 1 {
+		fatal("-sample must be in (0, 1]")
+	}
+	if err := resolveSeed(cfg); err != nil {
+		fatal(err)
+	}
+	if cfg.shardMaxSize < 0 {
+		fatal("-shard-max-size must not be negative")
+	}
+	if cfg.maxOrgLen < 0 {
+		fatal("-max-org-len must not be negative")
+	}
+	cfg.buildTime = time.Now()
+	if cfg.buildTimeArg != "" {
+		t, err := parseTimestamp(cfg.buildTimeArg)
+		if err != nil {
+			fatalf("invalid -build-time %q: %v", cfg.buildTimeArg, err)
+		}
+		cfg.buildTime = t
+	}
+	if cfg.snapshotDate != "" {
+		date, err := parseSnapshotDate(cfg.snapshotDate)
+		if err != nil {
+			fatalf("invalid -snapshot-date %q: %v", cfg.snapshotDate, err)
+		}
+		cfg.snapshotDate = date
+	}
+	if cfg.fetchRetries < 0 {
+		fatal("-fetch-retries must not be negative")
+	}
+	if cfg.workers < 1 {
+		fatal("-workers must be at least 1")
+	}
+	if cfg.writeWorkers < 1 {
+		fatal("-write-workers must be at least 1")
+	}
+	if cfg.readBuffer < 1 {
+		fatal("-read-buffer must be at least 1")
+	}
+	switch cfg.partialLine {
+	case partialLineSkip, partialLineKeep, partialLineFail:
+	default:
+		fatalf("invalid -partial-line %q: must be %s, %s or %s", cfg.partialLine, partialLineSkip, partialLineKeep, partialLineFail)
+	}
+	if cfg.tagUnannounced && len(cfg.rirStats) == 0 {
+		fatal("-tag-unannounced requires -rir-stats")
+	}
+	if cfg.anomalyGrowth < 1 {
+		fatal("-anomaly-growth must be at least 1")
+	}
+	if cfg.asRelPeers && cfg.asRel == "" {
+		fatal("-as-rel-peers requires -as-rel")
+	}
+	if cfg.whoisEnrich && cfg.csvFile == stdioPath {
+		fatal("-whois-enrich reads the input ahead of the build and cannot read it from stdin")
+	}
+	if cfg.collapsePrefixes && (cfg.mergeStrategy != mergeReplace || cfg.orgMerge != "") {
+		fatal("-collapse-prefixes requires -merge-strategy replace and cannot be combined with -org-merge")
+	}
+	if layeredInputs(cfg) && (cfg.mergeStrategy != mergeReplace || cfg.collapsePrefixes || cfg.externalSort) {
+		fatal("inputs of different priorities require -merge-strategy replace and cannot be combined with -collapse-prefixes or -external-sort")
+	}
+	if cfg.externalSort && (cfg.mergeStrategy != mergeReplace || cfg.orgMerge != "" || cfg.collapsePrefixes) {
+		fatal("-external-sort requires -merge-strategy replace and cannot be combined with -org-merge or -collapse-prefixes")
+	}
+	if cfg.spillDir != "" && !cfg.externalSort {
+		fatal("-spill-dir requires -external-sort")
+	}
+	if cfg.maxMemory < 0 {
+		fatal("-max-memory must not be negative")
+	}
+	if cfg.maxChurnPercent != 0 && cfg.compareBase == "" {
+		fatal("-max-churn-percent requires -compare-base")
+	}
+	if cfg.minRecords < 0 {
+		fatal("-min-records must not be negative")
+	}
+	if cfg.outputFile == stdioPath && cfg.shardMaxSize > 0 {
+		fatal("-shard-max-size cannot be used when writing to stdout")
+	}
+	if err := validateOutputFormat(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateChecksum(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateManifest(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateCoverageReport(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateUpload(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateDaemon(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateSplit(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateNotify(cfg); err != nil {
+		fatal(err)
+	}
+	if err := validateDryRun(cfg); err != nil {
+		fatal(err)
+	}
+	if cfg.daemon && (cfg.cpuProfile != "" || cfg.memProfile != "") {
+		fatal("-daemon cannot be combined with -cpuprofile or -memprofile")
+	}
+
+	if cfg.maxMemory > 0 {
+		debug.SetMemoryLimit(int64(cfg.maxMemory * 1024 * 1024))
+	}
+
+	// The database is the only thing written to stdout when streaming it,
+	// so all progress and warning messages go to stderr instead.
+	stdout := os.Stdout
+	if cfg.outputFile == stdioPath {
+		os.Stdout = os.Stderr
+	}
+
+	if cfg.metricsListen != "" || cfg.metricsTextfile != "" {
+		cfg.metrics = newBuildMetrics()
+	}
+	if cfg.notifyURL != "" {
+		cfg.notifier = newBuildNotifier(cfg)
+	}
+	if cfg.metricsListen != "" {
+		go func() {
+			if err := cfg.metrics.serveMetrics(cfg.metricsListen); err != nil {
+				fatalf("failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	ctx := cancelOnSignal()
+	if cfg.daemon {
+		runDaemon(ctx, cfg)
+		return
+	}
+
+	stopProfiles, err := startProfiles(cfg)
+	if err != nil {
+		fatal(err)
+	}
+	if _, err = fetchInput(ctx, cfg); err == nil {
+		err = runBuild(ctx, cfg, stdout)
+	} else {
+		notifyBuild(cfg, err)
+	}
+	// The profiles of a failed build are still written.
+	if perr := stopProfiles(); perr != nil {
+		logger.Error("failed to write profile", "error", perr)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// newBuildConfig registers the flags of a build on fs and returns the
+// config they fill in.
+func newBuildConfig(fs *flag.FlagSet) *config {
+	cfg := &config{
+		outputFile:   "asn.mmdb",
+		columnTypes:  columnTypes{},
+		descriptions: keyValues{},
+		metadata:     keyValues{},
+	}
+
+	fs.StringVar(&cfg.configFile, "config", "",
+		"YAML `file` with the inputs, output and flag settings of the build; command-line flags take precedence")
+	fs.Var(&cfg.inputs, "input",
+		"additional input `file[,priority=N][,format=F]` read after the csv-file; higher priorities override lower ones (default 0); repeatable")
+	fs.StringVar(&cfg.format, "format", formatCSV,
+		"input format: csv, fixed (fixed-width fields, see -fields), table (bgp.tools table.txt), jsonl (bgp.tools table.jsonl), mrt (TABLE_DUMP_V2/BGP4MP, optionally gzip/bzip2), iptoasn (iptoasn.com ip2asn TSV) or ipinfo (IPinfo country_asn or Lite CSV); default from the file extension, else csv")
+	fs.Var(&cfg.fixedFields, "fields",
+		"fixed-width field byte offsets for -format fixed, e.g. `network:0-18,asn:18-28,org:28-`")
+
+	fs.BoolVar(&cfg.requireCanonical, "require-canonical", false,
+		"skip rows whose network is not in canonical CIDR form (no host bits, canonical IPv6 compression)")
+	fs.StringVar(&cfg.orgMerge, "org-merge", "",
+		"organization merge strategy for conflicting inserts: prefer-nonempty, prefer-longer or prefer-first (default last-wins)")
+	fs.BoolVar(&cfg.orgHash, "org-hash", false,
+		"store the first 8 hex chars of the SHA-256 of the org under autonomous_system_organization_hash instead of the plaintext org")
+	fs.StringVar(&cfg.insertLog, "insert-log", "",
+		"append one \"network,asn\" line per successfully inserted prefix to `path`")
+	fs.BoolVar(&cfg.storeZeroASN, "store-zero-asn", false,
+		"store ASN 0 as autonomous_system_number: 0 instead of omitting the field")
+	fs.BoolVar(&cfg.skipZeroASN, "skip-zero-asn", false,
+		"skip rows with ASN 0 instead of inserting them without an ASN")
+	fs.BoolVar(&cfg.onlyIPv4, "only-ipv4", false,
+		"build an IPv4 database: skip IPv6 rows and write an IPv4 search tree")
+	fs.BoolVar(&cfg.onlyIPv6, "only-ipv6", false,
+		"build an IPv6 database without IPv4 data: skip IPv4 rows and do not alias IPv4 space")
+	fs.Var(&cfg.include, "include",
+		"only build the given comma-separated `CIDRs`; data outside them is left out (repeatable)")
+	fs.Var(&cfg.exclude, "exclude",
+		"leave the given comma-separated `CIDRs` out of the database (repeatable)")
+	fs.Var(&cfg.includeASN, "include-asn",
+		"only keep rows of these comma-separated `ASNs` and ranges, e.g. 13335,64512-65534 (repeatable)")
+	fs.Var(&cfg.excludeASN, "exclude-asn",
+		"skip rows of these comma-separated `ASNs` and ranges; \"bogon\" is every private and reserved ASN (repeatable)")
+	fs.Var(&cfg.maxPrefixLen, "max-prefix-len",
+		"longest prefix length kept per address family, e.g. `v4=24,v6=48`; see -max-prefix-action")
+	fs.StringVar(&cfg.maxPrefixAction, "max-prefix-action", maxPrefixDrop,
+		"what to do with rows longer than -max-prefix-len: drop them, or truncate them to the limit")
+	fs.StringVar(&cfg.recordTemplate, "record-template", "",
+		"YAML `file` mapping input columns to record fields and types (uint32, string, bool, array)")
+	fs.Var(cfg.columnTypes, "column-type",
+		"interpret column `N=type` (1-based) specially; supported types: json (repeatable)")
+	fs.Var(&cfg.columns, "columns",
+		"1-based positions of the network, ASN and organization columns, e.g. `network=1,asn=3,org=5` (default detected from the header)")
+	fs.StringVar(&cfg.compareBase, "compare-base", "",
+		"report added/removed/changed networks versus this previous `mmdb` build")
+	fs.Float64Var(&cfg.maxChurnPercent, "max-churn-percent", 0,
+		"with -compare-base, fail the build if more than this percentage of base networks changed or were removed (0 disables)")
+	fs.IntVar(&cfg.minRecords, "min-records", 0,
+		"fail the build if it stores fewer than `N` records (0 disables)")
+	fs.Var(&cfg.minCoverage, "min-coverage",
+		"fail the build if it covers less than this `percentage` of the unicast space per family, e.g. v4=60,v6=20; a bare number is for IPv4")
+	fs.StringVar(&cfg.sqlite, "sqlite", "",
+		"also write the inserted prefixes to this SQLite `database` for range lookups (requires building with -tags sqlite)")
+	fs.StringVar(&cfg.outputFormat, "output-format", outputFormatMMDB,
+		"output `format`: mmdb, parquet or sqlite (sqlite requires building with -tags sqlite)")
+	fs.StringVar(&cfg.upload, "upload", "",
+		"upload the finished output to this s3://bucket/key or gs://bucket/key `url` (a key ending in / gets the output file name)")
+	fs.BoolVar(&cfg.checksum, "checksum", true,
+		"write a sha256sum-style <output>.sha256 sidecar next to the output file")
+	fs.BoolVar(&cfg.manifest, "manifest", false,
+		"write an <output>.manifest.json sidecar with the input hashes, tool version, arguments, record counts and output hash of the build, see reproduce")
+	fs.StringVar(&cfg.signKey, "sign-key", "",
+		"sign the .sha256 sidecar with this `key`: a minisign secret key file, a gpg key ID or an ed25519 PEM private key, see -sign-method")
+	fs.StringVar(&cfg.signMethod, "sign-method", signMinisign,
+		"signature `method` of -sign-key: minisign, gpg or ed25519")
+	fs.StringVar(&cfg.metricsListen, "metrics-listen", "",
+		"serve Prometheus build metrics on this `address` at /metrics (most useful with -daemon)")
+	fs.StringVar(&cfg.metricsTextfile, "metrics-textfile", "",
+		"write Prometheus build metrics to this `file` after every build, for the node_exporter textfile collector")
+	fs.Var(&cfg.orgNormalize, "org-normalize",
+		"normalize organization names with these comma-separated `steps`: whitespace, legal-suffix, ascii or all; the original is kept in "+orgRawField)
+	fs.IntVar(&cfg.maxOrgLen, "max-org-len", 0,
+		"truncate organization names to `N` runes (0 disables)")
+	fs.BoolVar(&cfg.orgEllipsis, "org-ellipsis", false,
+		"end organization names shortened by -max-org-len with \"…\" (counted in the limit)")
+	fs.StringVar(&cfg.crosscheck, "crosscheck", "",
+		"after building, compare the lookup of every inserted prefix against this reference `mmdb` and fail on differences")
+	fs.Float64Var(&cfg.sample, "sample", 1,
+		"keep each data row with this probability, e.g. 0.01 for a 1% sample")
+	fs.Int64Var(&cfg.seed, "seed", 0,
+		"random seed for -sample (default $SOURCE_DATE_EPOCH, else the current time)")
+	fs.BoolVar(&cfg.reportOrgless, "report-orgless-asns", false,
+		"report ASNs that never appear with an organization anywhere in the file")
+	fs.BoolVar(&cfg.failOnOrgless, "fail-on-orgless", false,
+		"fail the build if any ASN never appears with an organization (implies -report-orgless-asns)")
+	fs.Float64Var(&cfg.shardMaxSize, "shard-max-size", 0,
+		"split the output into shards of at most this many `MB` covering contiguous prefix ranges, plus a .shards.json index")
+	fs.StringVar(&cfg.splitBy, "split-by", "",
+		"also write the output partitioned by `rir` or continent, one database per part plus a .split.json index")
+	fs.Var(&cfg.setRules, "set",
+		"set a record field from an expression, e.g. 'country_iso_code=upper($cc)'; functions: upper, lower, trim, concat (repeatable)")
+	fs.BoolVar(&cfg.sizeReport, "size-report", false,
+		"report the output size and write time at record sizes 24, 28 and 32")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false,
+		"read, validate and merge the inputs and report the statistics and predicted output size per record size, writing nothing")
+	fs.StringVar(&cfg.whoisOrgs, "whois-orgs", "",
+		"RPSL/WHOIS `file` whose aut-num objects (descr, else as-name) override the organization of their ASN")
+	fs.StringVar(&cfg.idn, "idn", idnNone,
+		"normalize internationalized domain names in rdns and domain-like org values: to-ascii, to-unicode or none")
+	fs.StringVar(&cfg.progressFile, "progress-file", "",
+		"write periodic progress lines (records, percent, elapsed, ETA) to this `file` instead of stdout")
+	fs.BoolVar(&cfg.progressAppend, "progress-append", false,
+		"append to -progress-file instead of truncating it")
+	fs.BoolVar(&cfg.progressBar, "progress", false,
+		"draw a progress bar with records/s and ETA on stderr")
+	fs.BoolVar(&cfg.strict, "strict", false,
+		"fail the build on a row with too few columns, an invalid CIDR or an invalid ASN instead of skipping it")
+	fs.StringVar(&cfg.rejects, "rejects", "",
+		"write every skipped row with its file, line and reason to this CSV `file`")
+	fs.Var(&cfg.aggregates, "also-insert-aggregate",
+		"also insert a summary record at the covering `/N` (or v4/N,v6/M) of every prefix where nothing else is stored")
+	fs.BoolVar(&cfg.collapsePrefixes, "collapse-prefixes", false,
+		"merge adjacent and contained prefixes with identical records (e.g. two /25s into a /24) before inserting")
+	fs.BoolVar(&cfg.externalSort, "external-sort", false,
+		"spill the parsed rows to sorted temporary files and insert them in prefix order")
+	fs.StringVar(&cfg.spillDir, "spill-dir", "",
+		"`directory` for the -external-sort files (default the system temporary directory)")
+	fs.Float64Var(&cfg.maxMemory, "max-memory", 0,
+		"soft limit on the heap in `MB`; the garbage collector works harder to stay below it (default $GOMEMLIMIT)")
+	fs.BoolVar(&cfg.labelBogonASNs, "label-bogon-asns", false,
+		"replace the organization of private/reserved ASNs with a label such as \"Private ASN\"")
+	fs.BoolVar(&cfg.includeReserved, "include-reserved-networks", false,
+		"store rows in private, documentation and other reserved ranges instead of skipping them")
+	fs.BoolVar(&cfg.disableAliasing, "disable-ipv4-aliasing", false,
+		"do not alias ::ffff:0:0/96, 2001::/32 and 2002::/16 to the IPv4 space, so rows in them are stored")
+	fs.BoolVar(&cfg.tagBogonNetworks, "tag-bogon-networks", false,
+		"store private, reserved and other special-purpose ranges with {\"is_bogon\": true, \"bogon_type\": ...} instead of skipping them")
+	fs.StringVar(&cfg.peeringDB, "peeringdb", "",
+		"PeeringDB JSON export or API `file-or-url` (e.g. https://www.peeringdb.com/api) whose IXLAN prefixes are tagged with is_ixp and ixp_name")
+	fs.Var(&cfg.anycast, "anycast",
+		"prefix list `file-or-url` (e.g. bgp.tools anycatch-v4-prefixes.txt) whose networks are marked is_anycast; repeatable")
+	fs.Var(&cfg.geofeeds, "geofeed",
+		"RFC 8805 geofeed `file-or-url` whose country, region and city are added to the records within its prefixes; repeatable")
+	fs.Var(&cfg.enrichers, "enrichers",
+		"comma-separated enrichment `stages` to run, in order: rpki, country, upstreams, ixp, anycast, geofeed; stages left out are skipped (default every stage whose source is set)")
+	fs.StringVar(&cfg.patch, "patch", "",
+		"CSV `file` of rows to add, replace or delete by prefix, applied last to correct known-bad upstream rows")
+	fs.BoolVar(&cfg.compareAliasing, "compare-aliasing", false,
+		"rebuild without IPv4 aliasing and fail if any IPv4 lookup differs")
+	fs.StringVar(&cfg.coverageIndex, "coverage-index", "",
+		"also write a bitmap of the covered IPv4 /8s and IPv6 /16s to `path`")
+	fs.StringVar(&cfg.coverageReport, "coverage-report", "",
+		"write how much of the unicast space has an origin ASN and its largest gaps to `path` (- for stdout)")
+	fs.StringVar(&cfg.coverageFormat, "coverage-format", coverageText,
+		"format of -coverage-report: text or json")
+	fs.IntVar(&cfg.coverageGaps, "coverage-gaps", 10,
+		"number of the largest gaps per family in -coverage-report")
+	fs.StringVar(&cfg.coverageBase, "coverage-base", "",
+		"compare -coverage-report with the coverage in this -manifest or JSON -coverage-report `file` of an earlier build")
+	fs.StringVar(&cfg.emitNormalized, "emit-normalized", "",
+		"also write every network of the output with its record as JSON Lines to `path`")
+	fs.StringVar(&cfg.expectHeader, "expect-header", "",
+		"abort unless the input header matches these comma-separated `columns` (case-insensitive, in order)")
+	fs.BoolVar(&cfg.dropExpired, "drop-expired", false,
+		"skip rows whose expires column is before the build time")
+	fs.StringVar(&cfg.buildTimeArg, "build-time", "",
+		"build `time` for the metadata and -drop-expired, as Unix seconds or RFC 3339 (default now)")
+	fs.IntVar(&cfg.workers, "workers", 1,
+		"number of goroutines parsing and validating rows; inserts stay in input order")
+	fs.IntVar(&cfg.writeWorkers, "write-workers", runtime.NumCPU(),
+		"maximum number of output trees serialized concurrently")
+	fs.IntVar(&cfg.readBuffer, "read-buffer", 64,
+		"size of the input read buffer in `KB`")
+	fs.StringVar(&cfg.partialLine, "partial-line", partialLineSkip,
+		"handling of a stdin input ending in a line without a newline, as a cut download does: skip, keep or fail")
+	fs.StringVar(&cfg.onControlChar, "on-control-char", controlCharStrip,
+		"handling of control characters in string fields: strip, replace (with U+FFFD), warn, reject (skip the row) or fail")
+	fs.StringVar(&cfg.onInvalidUTF8, "on-invalid-utf8", controlCharReplace,
+		"handling of invalid UTF-8 in string fields: strip, replace (with U+FFFD), warn, reject (skip the row) or fail")
+	fs.StringVar(&cfg.fetchURL, "fetch", "",
+		"download the input from `url` (e.g. https://bgp.tools/table.txt) to csv-file first, skipping the download when unchanged")
+	fs.StringVar(&cfg.userAgent, "user-agent", defaultUserAgent,
+		"User-Agent sent by -fetch; bgp.tools requires one identifying you")
+	fs.IntVar(&cfg.fetchRetries, "fetch-retries", 3,
+		"retries of a failed -fetch, with exponential backoff")
+	fs.StringVar(&cfg.sourceSHA256, "source-sha256", "",
+		"fail the build unless the SHA-256 of csv-file, after -fetch downloaded and decompressed it, is this hex `digest`")
+	fs.StringVar(&cfg.asnNames, "asn-names", "",
+		"bgp.tools asns.csv `file` naming the organization of rows without one")
+	fs.BoolVar(&cfg.whoisEnrich, "whois-enrich", false,
+		"look up the name and country of ASNs that -asn-names does not name over bgp.tools bulk WHOIS")
+	fs.StringVar(&cfg.whoisCache, "whois-cache", defaultWhoisCache(),
+		"`file` keeping -whois-enrich answers for a week; empty to disable")
+	fs.StringVar(&cfg.whoisServer, "whois-server", bgptools.DefaultWhoisAddr,
+		"`host:port` of the bulk WHOIS server asked by -whois-enrich")
+	fs.StringVar(&cfg.mergeStrategy, "merge-strategy", mergeReplace,
+		"handling of a CIDR that appears more than once: replace, keep-first or merge-into-array")
+	fs.Var(&cfg.rirStats, "rir-stats",
+		"RIR delegated-extended stats `file` adding country, rir and allocated_at fields; repeat for each RIR")
+	fs.BoolVar(&cfg.tagUnannounced, "tag-unannounced", false,
+		"also store the -rir-stats delegated space no row covers, with {\"announced\": false}")
+	fs.StringVar(&cfg.anomalies, "anomalies", "",
+		"warn about announcements of reserved space, of space outside -rir-stats and, with -compare-base, of ASNs with far more networks than in it, and write them to this CSV `file`")
+	fs.Float64Var(&cfg.anomalyGrowth, "anomaly-growth", 3,
+		"with -anomalies and -compare-base, report origin ASNs with more than this `factor` times their networks in the base")
+	fs.IntVar(&cfg.anomalyMinPrefixes, "anomaly-min-prefixes", 50,
+		"only report origin ASNs with at least `N` networks for -anomaly-growth")
+	fs.StringVar(&cfg.firstSeen, "first-seen", "",
+		"network,first_seen history `file` adding first_seen to records; prefixes new to it are added with the build time")
+	fs.StringVar(&cfg.databaseType, "database-type", "",
+		"database_type written to the metadata (default \"BGP-Tools-ASN-DB\")")
+	fs.Var(cfg.descriptions, "description",
+		"`lang=text` description written to the metadata; repeat for each language")
+	cfg.recordSize, cfg.recordSizeAuto = 24, true
+	fs.Var(recordSizeFlag{cfg}, "record-size",
+		"search tree record `size` in bits: 24, 28, 32 or auto, the smallest that fits")
+	fs.Var(cfg.metadata, "metadata",
+		"custom `key=value` added to the metadata map; repeatable")
+	fs.StringVar(&cfg.license, "license", "",
+		"license `text` of the data written to the license metadata key")
+	fs.StringVar(&cfg.snapshotDate, "snapshot-date", "",
+		"`date` of the upstream data written to the snapshot_date metadata key, as YYYY-MM-DD, Unix seconds or RFC 3339 (default the Last-Modified date of -fetch)")
+	fs.StringVar(&cfg.link, "link", "",
+		"ASN database `file` built by asn-db to reference in the metadata as asn_database and asn_database_sha256")
+	fs.StringVar(&cfg.rpki, "rpki", "",
+		"rpki-client or RIPE validator VRP JSON `file-or-url` to validate each prefix's origin against (sets rpki_status)")
+	fs.StringVar(&cfg.asRel, "as-rel", "",
+		"CAIDA as-rel or \"asn,upstream\" list `file-or-url` (optionally gzip/bzip2) adding the upstreams of each origin ASN")
+	fs.BoolVar(&cfg.asRelPeers, "as-rel-peers", false,
+		"with -as-rel, also add the peers of each origin ASN")
+	fs.BoolVar(&cfg.daemon, "daemon", false,
+		"keep running and rebuild the output every -interval, refetching -fetch first")
+	fs.DurationVar(&cfg.interval, "interval", 24*time.Hour,
+		"time between builds in -daemon mode")
+	fs.StringVar(&cfg.reloadPIDFile, "reload-pid-file", "",
+		"in -daemon mode, send SIGHUP to the process whose PID is in this `file` after each build")
+	fs.StringVar(&cfg.reloadWebhook, "reload-webhook", "",
+		"in -daemon mode, POST a JSON notification to this `url` after each build")
+	fs.StringVar(&cfg.notifyURL, "notify-url", "",
+		"POST the build summary, or the error of a failed build, to this webhook `url` after every build")
+	fs.StringVar(&cfg.notifyFormat, "notify-format", notifyJSON,
+		"-notify-url payload `format`: json, or slack for a Slack incoming webhook")
+	fs.Float64Var(&cfg.notifyShrinkPercent, "notify-shrink-percent", 10,
+		"warn in the notification when the records drop by this many `percent` since the previous build")
+	fs.StringVar(&cfg.logFormat, "log-format", logFormatText,
+		"log output `format`: text or json")
+	fs.BoolVar(&cfg.quiet, "quiet", false, "only log warnings and errors")
+	fs.BoolVar(&cfg.verbose, "verbose", false, "also log debug messages such as per-row progress")
+	fs.StringVar(&cfg.schema, "schema", schemaDefault,
+		"record schema: bgp-tools, geolite2-asn for a drop-in GeoLite2-ASN replacement, or geoip2-city for a combined ASN and City database")
+	fs.StringVar(&cfg.cpuProfile, "cpuprofile", "",
+		"write a CPU profile of the build to `file` for go tool pprof")
+	fs.StringVar(&cfg.memProfile, "memprofile", "",
+		"write an allocation profile of the build to `file` for go tool pprof")
+	return cfg
+}
+
+// fetchInput downloads -fetch to the input file and reports whether it
+// changed, then checks the pin of -source-sha256. Without either there is
+// nothing to do.
+func fetchInput(ctx context.Context, cfg *config) (bool, error) {
+	if cfg.fetchURL == "" {
+		return false, verifySourceSHA256(cfg)
+	}
+	logger.Info("fetching", "url", cfg.fetchURL)
+	updated, err := fetchFile(ctx, cfg.fetchURL, cfg.csvFile, cfg.userAgent, cfg.fetchRetries)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch %s: %w", cfg.fetchURL, err)
+	}
+	if updated {
+		logger.Info("downloaded", "url", cfg.fetchURL, "file", cfg.csvFile)
+	} else {
+		logger.Info("source unchanged, using cached file", "url", cfg.fetchURL, "file", cfg.csvFile)
+	}
+	return updated, verifySourceSHA256(cfg)
+}
+
+// verifySourceSHA256 fails when the input is not the snapshot pinned by
+// -source-sha256, so that a pipeline only builds the dataset it reviewed.
+func verifySourceSHA256(cfg *config) error {
+	if cfg.sourceSHA256 == "" {
+		return nil
+	}
+	sum, err := fileSHA256(cfg.csvFile)
+	if err != nil {
+		return fmt.Errorf("failed to hash input: %w", err)
+	}
+	if got := hex.EncodeToString(sum); got != cfg.sourceSHA256 {
+		return fmt.Errorf("input %s has SHA-256 %s, -source-sha256 pins %s", cfg.csvFile, got, cfg.sourceSHA256)
+	}
+	logger.Info("input matches -source-sha256", "file", cfg.csvFile, "sha256", cfg.sourceSHA256)
+	return nil
+}
+
+// build converts the input into the configured outputs. stdout receives
+// the database when it is streamed. With -record-size auto, a database
+// that outgrows the record size is built again with the next larger one,
+// which later daemon builds keep.
+func build(ctx context.Context, cfg *config, stdout io.Writer) error {
+	if cfg.dryRun {
+		return dryRun(ctx, cfg)
+	}
+	for {
+		err := buildOnce(ctx, cfg, stdout)
+		next, ok := largerRecordSize(cfg.recordSize)
+		if err == nil || !cfg.recordSizeAuto || !ok || !isRecordCapacityError(err) {
+			return err
+		}
+		if cfg.csvFile == stdioPath {
+			return fmt.Errorf("%w; stdin cannot be read again, rerun with -record-size %d", err, next)
+		}
+		logger.Warn("database exceeds the record size, rebuilding", "record_size", cfg.recordSize, "next", next)
+		cfg.recordSize = next
+	}
+}
+
+// checkInputFiles reports a missing input file before anything is read.
+func checkInputFiles(cfg *config) error {
+	if cfg.csvFile != stdioPath {
+		if _, err := os.Stat(cfg.csvFile); os.IsNotExist(err) {
+			return fmt.Errorf("CSV file does not exist: %s", cfg.csvFile)
+		}
+	}
+	for _, in := range cfg.extraInputs {
+		if _, err := os.Stat(in.file); os.IsNotExist(err) {
+			return fmt.Errorf("input file does not exist: %s", in.file)
+		}
+	}
+	return nil
+}
 
-	if len(os.Args) >= 3 {
-		outputFile = os.Args[2]
+// buildOnce is a build at the current record size.
+func buildOnce(ctx context.Context, cfg *config, stdout io.Writer) error {
+	outputFile := cfg.outputFile
+	if err := checkInputFiles(cfg); err != nil {
+		return err
 	}
 
-	// Validate CSV file exists
-	if _, err := os.Stat(csvFile); os.IsNotExist(err) {
-		log.Fatalf("CSV file does not exist: %s", csvFile)
+	var manifestFiles []manifestFile
+	if cfg.manifest {
+		var err error
+		if manifestFiles, err = hashManifestInputs(cfg); err != nil {
+			return err
+		}
 	}
 
 	// Create MMDB writer
-	writer, err := mmdbwriter.New(
-		mmdbwriter.Options{
-			DatabaseType: "BGP-Tools-ASN-DB",
-			RecordSize:   24,
-			Description: map[string]string{
-				"en": "BGP.Tools ASN Database",
-			},
-		},
-	)
+	writer, err := mmdbwriter.New(treeOptions(cfg))
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	start := time.Now()
+	stats, err := processCSVFile(ctx, writer, cfg)
+	if err != nil {
+		return err
+	}
+	defer stats.discardPending()
+	if err := checkMinRecords(cfg, stats); err != nil {
+		return err
+	}
+	processed := time.Now()
+
+	// The summary is logged once the output is complete, whichever kind
+	// it is. The output paths fill in the node count and size for the
+	// metrics as far as they know them.
+	nodes, outputBytes := int64(-1), int64(-1)
+	summarize := func() {
+		attrs := stats.summary(cfg)
+		attrs = append(attrs,
+			"process_seconds", processed.Sub(start).Seconds(),
+			"output_seconds", time.Since(processed).Seconds(),
+			"total_seconds", time.Since(start).Seconds())
+		logger.Info("build summary", attrs...)
+		if cfg.notifier != nil {
+			cfg.notifier.recordSummary(attrs)
+		}
+		if cfg.metrics != nil {
+			cfg.metrics.recordSuccess(cfg, stats, time.Since(start), nodes, outputBytes)
+		}
+	}
+
+	// The output is serialized in memory first when it has to be checked
+	// before anything is written to disk.
+	metadata, err := linkMetadata(cfg)
+	if err != nil {
+		return err
+	}
+	var tree io.WriterTo = writer
+	if len(metadata) > 0 {
+		tree = extraMetadata{db: writer, extra: metadata}
+	}
+	var serialized []byte
+	if cfg.compareBase != "" || cfg.crosscheck != "" || cfg.shardMaxSize > 0 || cfg.sizeReport ||
+		cfg.anomalies != "" || cfg.compareAliasing || cfg.coverageIndex != "" || cfg.coverageReport != "" || cfg.emitNormalized != "" ||
+		cfg.splitBy != "" || cfg.outputFormat != outputFormatMMDB || cfg.minCoverage.enabled() {
+		var buf bytes.Buffer
+		if _, err := tree.WriteTo(&buf); err != nil {
+			return err
+		}
+		built, err := maxminddb.FromBytes(buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to read back new database: %w", err)
+		}
+		nodes = int64(built.Metadata.NodeCount)
+		if cfg.sizeReport {
+			if err := printSizeReport(os.Stdout, built, cfg.writeWorkers); err != nil {
+				return err
+			}
+		}
+		// The anomalies are reported even when the build is refused.
+		if stats.anomalies != nil {
+			if err := checkAnomalies(cfg, built, stats.anomalies); err != nil {
+				return err
+			}
+		}
+		if cfg.compareBase != "" {
+			if err := checkChurn(cfg, built); err != nil {
+				return err
+			}
+		}
+		if cfg.compareAliasing {
+			if err := checkAliasing(built); err != nil {
+				return err
+			}
+		}
+		if cfg.crosscheck != "" {
+			if err := checkAgainstReference(cfg.crosscheck, built, stats.inserted); err != nil {
+				return err
+			}
+		}
+		if cfg.coverageReport != "" {
+			if stats.coverage, err = buildCoverageReport(cfg, built); err != nil {
+				return err
+			}
+		}
+		if cfg.minCoverage.enabled() {
+			report := stats.coverage
+			if report == nil {
+				if report, err = measureCoverage(built, 0); err != nil {
+					return err
+				}
+			}
+			if err := checkMinCoverage(cfg, report); err != nil {
+				return err
+			}
+		}
+		if err := acceptBuild(cfg, stats, built); err != nil {
+			return err
+		}
+		if cfg.emitNormalized != "" {
+			sink, err := openOutputSink(outputFormatJSONL, sinkTarget{path: cfg.emitNormalized})
+			if err != nil {
+				return err
+			}
+			networks, err := writeSink(ctx, sink, built, nil)
+			if err != nil {
+				return err
+			}
+			logger.Info("normalized records written", "file", cfg.emitNormalized, "networks", networks)
+		}
+		if cfg.shardMaxSize > 0 {
+			// The metadata does not record the aliasing of the build.
+			opts := treeOptionsFrom(built.Metadata)
+			opts.DisableIPv4Aliasing = treeOptions(cfg).DisableIPv4Aliasing
+			if err := writeShards(ctx, built, opts, outputFile, int(cfg.shardMaxSize*(1<<20)), metadata); err != nil {
+				return err
+			}
+			summarize()
+			return nil
+		}
+		if cfg.splitBy != "" {
+			opts := treeOptionsFrom(built.Metadata)
+			opts.DisableIPv4Aliasing = treeOptions(cfg).DisableIPv4Aliasing
+			if err := writeSplit(ctx, built, opts, cfg.splitBy, outputFile, metadata, cfg.writeWorkers); err != nil {
+				return err
+			}
+		}
+		if cfg.outputFormat != outputFormatMMDB {
+			logger.Info("writing output", "file", outputFile, "format", cfg.outputFormat)
+			sink, err := openOutputSink(cfg.outputFormat,
+				sinkTarget{path: outputFile, metadata: built.Metadata, extra: metadata})
+			if err != nil {
+				return err
+			}
+			networks, err := writeSink(ctx, sink, built, nil)
+			if err != nil {
+				return err
+			}
+			logger.Info("output written", "file", outputFile, "networks", networks)
+			if info, err := os.Stat(outputFile); err == nil {
+				outputBytes = info.Size()
+			}
+			if err := writeOutputChecksum(cfg); err != nil {
+				return err
+			}
+			if err := writeOutputManifest(cfg, manifestFiles, stats); err != nil {
+				return err
+			}
+			if err := uploadOutput(ctx, cfg); err != nil {
+				return err
+			}
+			summarize()
+			return nil
+		}
+		serialized = buf.Bytes()
+	} else if err := acceptBuild(cfg, stats, nil); err != nil {
+		return err
 	}
 
-	fmt.Printf("Processing CSV file: %s\n", csvFile)
+	if outputFile == stdioPath {
+		// A failure partway would leave a truncated database on stdout
+		// for the next build to follow.
+		output := tree
+		if serialized != nil {
+			output = bytes.NewReader(serialized)
+		} else if cfg.recordSizeAuto {
+			if _, err := tree.WriteTo(io.Discard); err != nil {
+				return err
+			}
+		}
+		n, err := output.WriteTo(contextWriter{ctx, stdout})
+		if err != nil {
+			return fmt.Errorf("failed to write MMDB to stdout: %w", err)
+		}
+		outputBytes = n
+		summarize()
+		return nil
+	}
 
-	err = processCSVFile(writer, csvFile)
+	logger.Info("writing output", "file", outputFile)
+	sink, err := openOutputSink(outputFormatMMDB, sinkTarget{
+		path: outputFile, extra: metadata, tree: writer, serialized: serialized, ctx: ctx})
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := sink.close(); err != nil {
+		sink.abort()
+		return err
+	}
+
+	logger.Info("output written", "file", outputFile)
+	if cfg.metrics != nil {
+		if info, err := os.Stat(outputFile); err == nil {
+			outputBytes = info.Size()
+		}
+		if nodes < 0 {
+			nodes = outputNodes(outputFile)
+		}
+	}
+	if err := writeOutputChecksum(cfg); err != nil {
+		return err
+	}
+	if err := writeOutputManifest(cfg, manifestFiles, stats); err != nil {
+		return err
+	}
+	if err := uploadOutput(ctx, cfg); err != nil {
+		return err
+	}
+	summarize()
+	return nil
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// resolveSeed fills in cfg.seed when -seed was not given, preferring
+// SOURCE_DATE_EPOCH so reproducible-build pipelines get the same sample.
+func resolveSeed(cfg *config) error {
+	if flagSet("seed") {
+		return nil
 	}
 
-	// Ensure output directory exists
-	outputDir := filepath.Dir(outputFile)
-	if outputDir != "." {
-		err = os.MkdirAll(outputDir, 0755)
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seed, err := strconv.ParseInt(epoch, 10, 64)
 		if err != nil {
-			log.Fatalf("Failed to create output directory: %v", err)
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+		}
+		cfg.seed = seed
+		return nil
+	}
+
+	cfg.seed = time.Now().UnixNano()
+	return nil
+}
+
+// acceptBuild writes what a build keeps beside its output once it passed
+// every check: the coverage index and report of built, nil when the build
+// was not read back, the -first-seen history, and the insert log and
+// SQLite sidecar written during the build. A refused build leaves them as
+// they were, so the next one is compared with the last accepted.
+func acceptBuild(cfg *config, stats *buildStats, built *maxminddb.Reader) error {
+	pending := stats.pending
+	stats.pending = nil
+	for i, f := range pending {
+		if err := f.commit(); err != nil {
+			for _, f := range pending[i+1:] {
+				os.Remove(f.tmp)
+			}
+			return err
+		}
+	}
+	if cfg.sqlite != "" {
+		logger.Info("SQLite sidecar written", "file", cfg.sqlite)
+	}
+	if cfg.coverageIndex != "" {
+		if err := writeCoverageIndex(built, cfg.coverageIndex); err != nil {
+			return err
+		}
+	}
+	if stats.coverage != nil {
+		if err := writeCoverageReport(cfg, stats.coverage); err != nil {
+			return err
 		}
 	}
+	if stats.firstSeen != nil {
+		if err := stats.firstSeen.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	fmt.Printf("Writing MMDB file: %s\n", outputFile)
+// discardPending removes the side files of a build that was not accepted.
+func (s *buildStats) discardPending() {
+	for _, f := range s.pending {
+		os.Remove(f.tmp)
+	}
+	s.pending = nil
+}
 
-	fh, err := os.Create(outputFile)
+// checkChurn compares the serialized build against -compare-base and
+// enforces -max-churn-percent.
+func checkChurn(cfg *config, current *maxminddb.Reader) error {
+	base, err := maxminddb.Open(cfg.compareBase)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to open base database: %w", err)
 	}
-	defer fh.Close()
+	defer base.Close()
 
-	_, err = writer.WriteTo(fh)
+	report, err := compareWithBase(base, current)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	report.print()
 
-	fmt.Printf("Successfully created MMDB file: %s\n", outputFile)
+	if cfg.maxChurnPercent > 0 && report.churnPercent() > cfg.maxChurnPercent {
+		return fmt.Errorf("churn of %.2f%% exceeds -max-churn-percent %.2f (mostly %s networks); refusing to write %s",
+			report.churnPercent(), cfg.maxChurnPercent, report.dominant(), cfg.outputFile)
+	}
+	return nil
 }
 
-func processCSVFile(writer *mmdbwriter.Tree, filename string) error {
-	fh, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("failed to open CSV file: %w", err)
+// processCSVFile reads the inputs into writer. A nil writer is a dry run:
+// the rows are read, validated and merged as in a build, but collected in
+// the size estimate of the stats instead of a tree, and the stages that
+// work on the tree are left out.
+func processCSVFile(ctx context.Context, writer *mmdbwriter.Tree, cfg *config) (*buildStats, error) {
+	inputs := buildInputs(cfg)
+
+	// Progress covers all inputs, so the reader counting the bytes is
+	// moved from one input to the next.
+	input := &countingReader{}
+	var total int64
+	if cfg.csvFile != stdioPath {
+		for _, in := range inputs {
+			if info, err := os.Stat(in.file); err == nil && info.Mode().IsRegular() {
+				total += info.Size()
+			}
+		}
+	}
+	var err error
+	var progress *progressFile
+	if cfg.progressFile != "" {
+		progress, err = openProgressFile(cfg.progressFile, cfg.progressAppend, input, total)
+		if err != nil {
+			return nil, err
+		}
+		defer progress.close()
+	}
+	var bar *progressBar
+	if cfg.progressBar {
+		bar = startProgressBar(os.Stderr, input, total)
+		defer bar.stop()
 	}
-	defer fh.Close()
 
-	r := csv.NewReader(fh)
+	var inserted *insertLog
+	if cfg.insertLog != "" {
+		inserted, err = openInsertLog(cfg.insertLog)
+		if err != nil {
+			return nil, err
+		}
+		// Closed explicitly on success; this covers the early returns.
+		defer func() {
+			if inserted != nil {
+				inserted.discard()
+			}
+		}()
+	}
 
-	// Skip header row
-	header, err := r.Read()
-	if err != nil {
-		return fmt.Errorf("failed to read CSV header: %w", err)
+	var rejects *rejectLog
+	if cfg.rejects != "" {
+		rejects, err = openRejectLog(cfg.rejects)
+		if err != nil {
+			return nil, err
+		}
+		// Closed explicitly on success; this covers the early returns.
+		defer func() {
+			if rejects != nil {
+				rejects.close()
+			}
+		}()
 	}
 
-	fmt.Printf("CSV header: %v\n", header)
+	var sidecar *sqliteSidecar
+	if cfg.sqlite != "" {
+		sidecar, err = openSQLiteSidecar(cfg.sqlite)
+		if err != nil {
+			return nil, err
+		}
+		// A failed build keeps the previous database.
+		defer func() {
+			if sidecar != nil {
+				sidecar.abort()
+			}
+		}()
+	}
 
-	recordCount := 0
+	var asnNames map[uint32]string
+	if cfg.asnNames != "" {
+		asnNames, err = loadASNNames(cfg.asnNames)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("loaded ASN names", "count", len(asnNames), "file", cfg.asnNames)
+	}
 
-	for {
-		row, err := r.Read()
-		if errors.Is(err, io.EOF) {
-			break
+	var delegations rirDelegations
+	if len(cfg.rirStats) > 0 {
+		delegations, err = loadRIRStats(cfg.rirStats)
+		if err != nil {
+			return nil, err
 		}
+		logger.Info("loaded RIR delegations", "count", len(delegations), "files", len(cfg.rirStats))
+	}
+
+	var firstSeen *firstSeenHistory
+	if cfg.firstSeen != "" {
+		firstSeen, err = loadFirstSeen(cfg.firstSeen)
 		if err != nil {
-			return fmt.Errorf("failed to read CSV row: %w", err)
+			return nil, err
 		}
+		logger.Info("loaded first-seen history", "prefixes", len(firstSeen.seen), "file", cfg.firstSeen)
+	}
 
-		// Support multiple CSV formats
-		// Format 1: network, asn, organization
-		// Format 2: network, asn
-		if len(row) < 2 {
-			continue // Skip invalid format rows
+	var template *recordTemplate
+	if cfg.recordTemplate != "" {
+		template, err = loadRecordTemplate(cfg.recordTemplate)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		network := strings.TrimSpace(row[0])
-		asnStr := strings.TrimSpace(row[1])
+	var whoisOrgs map[uint32]string
+	if cfg.whoisOrgs != "" {
+		whoisOrgs, err = loadWhoisOrgs(cfg.whoisOrgs)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("loaded WHOIS organizations", "count", len(whoisOrgs), "file", cfg.whoisOrgs)
+	}
 
-		// Parse network CIDR
-		_, cidr, err := net.ParseCIDR(network)
+	var enriched map[uint32]whoisASN
+	if cfg.whoisEnrich {
+		var queried int
+		enriched, queried, err = whoisEnrich(ctx, cfg, asnNames, template)
 		if err != nil {
-			fmt.Printf("Skipping invalid CIDR: %s - %v\n", network, err)
-			continue
+			return nil, err
 		}
+		logger.Info("enriched ASNs over WHOIS", "count", len(enriched), "queried", queried)
+	}
 
-		// Parse ASN
-		asn, err := strconv.ParseUint(asnStr, 10, 32)
+	pipeline, err := loadEnrichPipeline(ctx, cfg, delegations)
+	if err != nil {
+		return nil, err
+	}
+
+	var patch []patchRow
+	if cfg.patch != "" {
+		patch, err = loadPatch(cfg.patch, func(header []string) (*rowBuilder, error) {
+			return newRowBuilder(cfg, header, asnNames, whoisOrgs, enriched, pipeline, template)
+		})
 		if err != nil {
-			fmt.Printf("Skipping invalid ASN: %s - %v\n", asnStr, err)
-			continue
+			return nil, err
 		}
+		logger.Info("loaded patch", "rows", len(patch), "file", cfg.patch)
+	}
+
+	var agg *aggregator
+	if cfg.aggregates.enabled() {
+		agg = newAggregator(cfg.aggregates)
+	}
+
+	var sampler *rand.Rand
+	if cfg.sample < 1 {
+		sampler = rand.New(rand.NewPCG(uint64(cfg.seed), 0))
+		logger.Info("sampling rows", "fraction", cfg.sample, "seed", cfg.seed)
+	}
+
+	stats := &buildStats{
+		whoisEnriched: len(enriched),
+		enrichStages:  pipeline.names(),
+		enrichTime:    map[string]time.Duration{},
+	}
+	if cfg.anomalies != "" {
+		stats.anomalies = &anomalyReport{delegations: delegations}
+	}
+	if cfg.metrics != nil {
+		stats.insertSeconds = newHistogram()
+	}
+	if writer == nil {
+		stats.estimate = newSizeEstimate(treeOptions(cfg).IPVersion)
+	}
 
-		// Build record
-		record := mmdbtype.Map{}
+	// seen holds the record stored for every CIDR, so that a repeat of
+	// it only merges with its own record.
+	var seen map[netip.Prefix]mmdbtype.Map
+	if cfg.mergeStrategy != mergeReplace || cfg.orgMerge != "" {
+		seen = map[netip.Prefix]mmdbtype.Map{}
+	}
+	if cfg.mergeStrategy != mergeReplace {
+		stats.moasPrefixes = map[netip.Prefix]bool{}
+	}
 
-		if asn != 0 {
-			record["autonomous_system_number"] = mmdbtype.Uint32(asn)
+	var current string
+	reject := func(row *builtRow, reason string) error {
+		if rejects == nil {
+			return nil
 		}
+		return rejects.add(current, row.source, reason)
+	}
+
+	var collapser *prefixCollapser
+	if cfg.collapsePrefixes {
+		collapser = newPrefixCollapser(treeOptions(cfg).IPVersion)
+	}
+	var spiller *rowSpiller
+	if cfg.externalSort {
+		spiller = newRowSpiller(cfg.spillDir, treeOptions(cfg).IPVersion)
+		defer spiller.close()
+	}
+	// Spilled rows are written out, so there is nothing to share, and
+	// seen tells CIDRs apart by their records.
+	var interner *recordInterner
+	if spiller == nil && seen == nil {
+		interner = newRecordInterner()
+	}
 
-		// If there is a third column (organization name)
-		if len(row) >= 3 && strings.TrimSpace(row[2]) != "" {
-			record["autonomous_system_organization"] = mmdbtype.String(strings.TrimSpace(row[2]))
+	policy := networkPolicy(cfg)
+	// store inserts a valid row into the tree and the row-oriented outputs.
+	store := func(row *builtRow) error {
+		network, prefix, asn, record := row.network, row.prefix, row.asn, row.record
+		if firstSeen != nil {
+			// The record is shared with the other rows equal to it.
+			record = maps.Clone(record)
+			record["first_seen"] = mmdbtype.Uint64(firstSeen.lookup(prefix, cfg.buildTime.Unix()))
 		}
 
 		// Insert record
-		err = writer.Insert(cidr, record)
-		if err != nil {
-			// Check if this is an aliased network error - skip it instead of failing
-			errMsg := err.Error()
-			if strings.Contains(errMsg, "aliased network") ||
-				strings.Contains(errMsg, "reserved network") ||
-				strings.Contains(errMsg, "private network") {
-				fmt.Printf("⚠️  Skipping problematic network %s: %v\n", network, err)
-				continue
+		var err error
+		var insertStart time.Time
+		if stats.insertSeconds != nil {
+			insertStart = time.Now()
+		}
+		// Announcements are checked for anomalies even when the network
+		// cannot be stored.
+		if stats.anomalies != nil {
+			stats.anomalies.checkPrefix(prefix, uint32(asn))
+		}
+		// Aliased and reserved networks are skipped instead of failing
+		if err := policy.Check(prefix); err != nil {
+			logger.Warn("skipping unsupported network", "network", network, "error", err)
+			stats.unsupported++
+			return reject(row, rejectUnsupported)
+		}
+		// mmdbwriter takes the network as a net.IPNet, which is only
+		// allocated for rows that are stored.
+		cidr := prefixNetwork(prefix)
+		own, duplicate := seen[prefix]
+		stored := record
+		switch {
+		case writer == nil:
+			// A dry run keeps the rows for its estimate instead.
+			if duplicate && cfg.mergeStrategy != mergeReplace {
+				stats.duplicates++
+				if cfg.mergeStrategy == mergeKeepFirst {
+					return reject(row, rejectDuplicate)
+				}
 			}
-			// For other errors, still fail
+			stats.estimate.add(prefix, record)
+		case row.truncated:
+			// A truncated announcement does not replace the rows of the
+			// shorter prefix, whatever their order.
+			err = writer.InsertFunc(cidr, func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+				if existing != nil {
+					return existing, nil
+				}
+				return record, nil
+			})
+		case duplicate && cfg.mergeStrategy == mergeKeepFirst:
+			stats.duplicates++
+			return reject(row, rejectDuplicate)
+		case duplicate && cfg.mergeStrategy == mergeIntoArray:
+			stats.duplicates++
+			moas := false
+			stored = nil
+			err = writer.InsertFunc(cidr, moasInserter(own, record, &stored, &moas))
+			if moas {
+				stats.moasPrefixes[prefix] = true
+			}
+			// A covering network replaced the record of the CIDR since,
+			// so this is stored as if it were the first.
+			if err == nil && stored == nil {
+				stored = record
+				err = writer.Insert(cidr, record)
+			}
+		case duplicate && cfg.orgMerge != "":
+			err = writer.InsertFunc(cidr, orgMergeInserter(cfg.orgMerge, own, record, stats, &stored))
+		default:
+			err = writer.Insert(cidr, record)
+		}
+		if err != nil {
 			return fmt.Errorf("failed to insert record for %s: %w", network, err)
 		}
+		if stats.insertSeconds != nil {
+			stats.insertSeconds.observe(time.Since(insertStart).Seconds())
+		}
+
+		stats.records++
+		if seen != nil && !row.truncated {
+			seen[prefix] = stored
+		}
+		if firstSeen != nil {
+			firstSeen.add(prefix, cfg.buildTime.Unix())
+		}
+		if cfg.crosscheck != "" {
+			stats.inserted = append(stats.inserted, cidr)
+		}
+
+		if agg != nil {
+			agg.add(cidr, record)
+		}
+
+		if inserted != nil {
+			if err := inserted.add(cidr, asn); err != nil {
+				return err
+			}
+		}
+
+		if sidecar != nil {
+			if err := sidecar.add(cidr, record); err != nil {
+				return err
+			}
+		}
 
-		recordCount++
+		if bar != nil {
+			bar.update(stats.records)
+		}
 
 		// Output progress every 10k records
-		if recordCount%10000 == 0 {
-			fmt.Printf("Processed %d records...\n", recordCount)
+		if stats.records%10000 == 0 {
+			// Rows held back by -collapse-prefixes or -external-sort
+			// are stored after the inputs are read.
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			if progress != nil {
+				if err := progress.report(stats.records); err != nil {
+					return fmt.Errorf("failed to write progress file: %w", err)
+				}
+			} else if bar == nil {
+				logger.Debug("progress", "records", stats.records)
+			}
+		}
+		return nil
+	}
+
+	// Rows of an input above the lowest priority are held back until all
+	// inputs of their priority are read, and checked for conflicts with
+	// the lower-priority data before any of them is inserted.
+	layered := layeredInputs(cfg)
+	var held []collapsedRow
+	var holding bool
+	flushHeld := func() error {
+		for _, h := range held {
+			// Unsupported networks are reported when they are stored,
+			// and a dry run has no tree to check.
+			if policy.Check(h.row.prefix) != nil || writer == nil {
+				continue
+			}
+			asns, err := overriddenASNs(writer, h.row.prefix, h.row.record)
+			if err != nil {
+				return fmt.Errorf("failed to check %s for conflicts: %w", h.row.network, err)
+			}
+			if len(asns) > 0 {
+				stats.precedenceConflicts++
+				logger.Info("input overrides origin", "file", h.file, "line", h.row.source.lines[0],
+					"network", h.row.network, "asn", h.row.asn, "overridden_asns", asns)
+			}
+		}
+		for _, h := range held {
+			current = h.file
+			if err := store(h.row); err != nil {
+				return err
+			}
+		}
+		held = held[:0]
+		return nil
+	}
+
+	insert := func(row *builtRow) error {
+		stats.rows++
+		if row.rejected != "" {
+			return reject(row, row.rejected)
+		}
+		// Networks that cannot be stored are reported by store.
+		if interner != nil && policy.Check(row.prefix) == nil {
+			row.record = interner.intern(row.record)
+		}
+		if holding {
+			held = append(held, collapsedRow{row, current})
+			return nil
+		}
+		if collapser != nil {
+			collapser.add(row, current)
+			return nil
+		}
+		if spiller != nil {
+			return spiller.add(row, current)
+		}
+		return store(row)
+	}
+
+	for i, in := range inputs {
+		holding = layered && in.priority > inputs[0].priority
+		err := func() error {
+			fh := os.Stdin
+			if in.file != stdioPath {
+				var err error
+				fh, err = os.Open(in.file)
+				if err != nil {
+					return fmt.Errorf("failed to open CSV file: %w", err)
+				}
+				defer fh.Close()
+			}
+			input.r = bufio.NewReaderSize(contextReader{ctx, fh}, cfg.readBuffer<<10)
+			current = in.file
+
+			// Progress counts the compressed bytes, which is what the
+			// size of the file is.
+			dr, err := decompressInput(input)
+			if err != nil {
+				return fmt.Errorf("%s: %w", in.file, err)
+			}
+			defer dr.Close()
+
+			// A pipe can end partway through a line; files are complete.
+			var src io.Reader = dr
+			if in.file == stdioPath && in.format != formatMRT {
+				pr := newPartialLineReader(dr, cfg.partialLine)
+				defer func() { stats.partialLines += pr.skipped }()
+				src = pr
+			}
+
+			inCfg := *cfg
+			inCfg.format = in.format
+			r, header, err := newRowReader(&inCfg, src)
+			if err != nil {
+				return err
+			}
+			if cfg.expectHeader != "" {
+				if err := checkHeader(cfg.expectHeader, header); err != nil {
+					return err
+				}
+			}
+
+			logger.Info("processing input", "file", in.file, "format", in.format)
+			logger.Debug("input header", "columns", header)
+
+			// Line numbers are per input, so warnings name the file
+			// once there is more than one.
+			if len(inputs) > 1 {
+				defer func(base *slog.Logger) { logger = base }(logger)
+				logger = logger.With("file", in.file)
+			}
+
+			builder, err := newRowBuilder(cfg, header, asnNames, whoisOrgs, enriched, pipeline, template)
+			if err != nil {
+				return fmt.Errorf("%s: %w", in.file, err)
+			}
+			builder.initStats(stats)
+			unsampled, err := buildRows(r, sampler, builder, stats, cfg.workers, insert)
+			stats.unsampled += unsampled
+			return err
+		}()
+		if err != nil {
+			return nil, err
+		}
+		if holding && (i == len(inputs)-1 || inputs[i+1].priority != in.priority) {
+			if err := flushHeld(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if collapser != nil {
+		var rows []collapsedRow
+		rows, stats.collapsed = collapser.collapse()
+		logger.Info("collapsed prefixes", "rows", stats.collapsed+len(rows), "remaining", len(rows))
+		for _, row := range rows {
+			current = row.file
+			if err := store(row.row); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if spiller != nil {
+		stats.overridden, err = spiller.merge(func(row *builtRow, file string) error {
+			current = file
+			return store(row)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if progress != nil {
+		if err := progress.report(stats.records); err != nil {
+			return nil, fmt.Errorf("failed to write progress file: %w", err)
+		}
+	}
+	if interner != nil {
+		stats.distinctRecords = interner.distinct
+		logger.Info("deduplicated records", "rows", interner.rows, "distinct", interner.distinct,
+			"orgs", len(interner.orgs), "rows_per_record", interner.ratio())
+		interner = nil
+	}
+
+	// The history is saved once the build is accepted.
+	if firstSeen != nil {
+		stats.firstSeen = firstSeen
+		stats.firstSeenNew = firstSeen.added
+	}
+
+	if writer != nil {
+		if err := finishTree(writer, cfg, stats, agg, delegations, pipeline, patch); err != nil {
+			return nil, err
+		}
+	}
+
+	if rejects != nil {
+		if err := rejects.close(); err != nil {
+			return nil, err
+		}
+		rejects = nil
+	}
+
+	if cfg.reportOrgless {
+		orgless := orglessASNs(stats.asnHasOrg)
+		printOrglessASNs(orgless, len(stats.asnHasOrg))
+		if cfg.failOnOrgless && len(orgless) > 0 {
+			return nil, fmt.Errorf("%d ASNs have no organization (-fail-on-orgless)", len(orgless))
+		}
+	}
+
+	// The insert log and the sidecar replace their files once the build
+	// is accepted.
+	if inserted != nil {
+		f, err := inserted.close()
+		inserted = nil
+		if err != nil {
+			return nil, err
+		}
+		stats.pending = append(stats.pending, f)
+	}
+	if sidecar != nil {
+		f, err := sidecar.close()
+		if err != nil {
+			stats.discardPending()
+			return nil, err
+		}
+		sidecar = nil
+		stats.pending = append(stats.pending, f)
+	}
+	return stats, nil
+}
+
+// finishTree runs the stages that work on the tree once the rows are
+// stored: aggregates, unannounced and bogon space, the network enrichment
+// stages, -patch, the City schema and the prefix filters, in that order.
+func finishTree(writer *mmdbwriter.Tree, cfg *config, stats *buildStats, agg *aggregator,
+	delegations rirDelegations, pipeline *enrichPipeline, patch []patchRow) error {
+	var err error
+	if agg != nil {
+		stats.aggregates, err = agg.insert(writer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.tagUnannounced {
+		stats.unannounced, err = tagUnannouncedSpace(writer, cfg, delegations)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.tagBogonNetworks {
+		if err := tagBogonNetworks(writer, cfg); err != nil {
+			return err
+		}
+	}
+	if err := pipeline.enrichNetworks(writer, cfg, stats); err != nil {
+		return err
+	}
+	// Patches come after everything derived from the inputs, so that
+	// their records are stored as given.
+	if patch != nil {
+		stats.patched, err = applyPatch(writer, cfg, patch)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.schema == schemaGeoIP2City {
+		if err := applyCitySchema(writer, cfg); err != nil {
+			return err
 		}
 	}
 
-	fmt.Printf("Total records processed: %d\n", recordCount)
+	// Filtering comes last so that nothing added above covering the
+	// filtered space survives.
+	removed, err := applyPrefixFilters(writer, cfg)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		logger.Info("removed filtered networks", "networks", removed)
+	}
 	return nil
 }
+
+// hashOrg returns the first 8 hex characters of the SHA-256 of org. It is
+// stable across builds so consumers can still group records by org.
+func hashOrg(org string) string {
+	sum := sha256.Sum256([]byte(org))
+	return hex.EncodeToString(sum[:4])
+}
+
+// truncateRunes shortens s to at most n runes, never splitting a multibyte
+// character. With ellipsis the last kept rune is replaced by "…". A limit of
+// zero leaves s unchanged.
+func truncateRunes(s string, n int, ellipsis bool) (string, bool) {
+	if n <= 0 || utf8.RuneCountInString(s) <= n {
+		return s, false
+	}
+
+	keep := n
+	if ellipsis {
+		keep--
+	}
+
+	// Find the byte offset of rune number keep.
+	end := 0
+	for i := 0; i < keep; i++ {
+		_, size := utf8.DecodeRuneInString(s[end:])
+		end += size
+	}
+
+	if ellipsis {
+		return s[:end] + "…", true
+	}
+	return s[:end], true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// testConfig returns the config of a build given args as its flags.
+func testConfig(t testing.TB, args ...string) *config {
+	t.Helper()
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	cfg := newBuildConfig(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	cfg.buildTime = time.Now()
+	return cfg
+}
+
+// writeTestFile writes data to name in a temporary directory and returns
+// its path.
+func writeTestFile(t testing.TB, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// buildTestDB builds input with cfg and returns the database and the
+// stats of the build.
+func buildTestDB(t testing.TB, cfg *config, input string) (*maxminddb.Reader, *buildStats) {
+	t.Helper()
+	data, stats := buildTestMMDB(t, cfg, input)
+	return openTestDB(t, data), stats
+}
+
+// buildTestMMDB builds input with cfg and returns the serialized database
+// and the stats of the build.
+func buildTestMMDB(t testing.TB, cfg *config, input string) ([]byte, *buildStats) {
+	t.Helper()
+	cfg.csvFile = writeTestFile(t, "input.csv", input)
+	writer, err := mmdbwriter.New(treeOptions(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := processCSVFile(context.Background(), writer, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := writer.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), stats
+}
+
+// openTestDB opens the database in data.
+func openTestDB(t testing.TB, data []byte) *maxminddb.Reader {
+	t.Helper()
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// parseTestIP parses an IP address of a test case.
+func parseTestIP(t testing.TB, s string) net.IP {
+	t.Helper()
+	ip := net.ParseIP(s)
+	if ip == nil {
+		t.Fatalf("invalid IP %q", s)
+	}
+	return ip
+}
+
+// lookupTest returns the network and record of ip in db, the record being
+// nil when there is none.
+func lookupTest(t testing.TB, db *maxminddb.Reader, ip string) (string, map[string]any) {
+	t.Helper()
+	var record map[string]any
+	network, ok, err := db.LookupNetwork(parseTestIP(t, ip), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		return network.String(), nil
+	}
+	return network.String(), record
+}
+
+func TestInsertLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inserted.log")
+	if err := os.WriteFile(path, []byte("9.9.9.0/24,19281\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, "-insert-log", path)
+	_, stats := buildTestDB(t, cfg, "network,asn\n1.1.1.0/24,13335\nnot-a-network,1\n10.0.0.0/8,64500\n2a01:4f8::/32,24940\n")
+	if err := acceptBuild(cfg, stats, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The log is appended to and skips rejected and reserved networks.
+	want := "9.9.9.0/24,19281\n1.1.1.0/24,13335\n2a01:4f8::/32,24940\n"
+	if string(got) != want {
+		t.Errorf("got insert log %q, want %q", got, want)
+	}
+}
+
+// -org-hash stores the hash readers see in place of the org, and the same
+// input built twice is the same file.
+func TestOrgHash(t *testing.T) {
+	const input = "network,asn,org\n1.1.1.0/24,13335,Cloudflare\n8.8.8.0/24,15169\n"
+	dir := t.TempDir()
+	var outputs [][]byte
+	for _, name := range []string{"first.mmdb", "second.mmdb"} {
+		cfg := testConfig(t, "-org-hash")
+		cfg.buildTime = time.Unix(1700000000, 0)
+		cfg.csvFile = writeTestFile(t, "input.csv", input)
+		cfg.outputFile = filepath.Join(dir, name)
+		if err := build(context.Background(), cfg, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(cfg.outputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, data)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Error("rebuilding the same input changed the database")
+	}
+
+	db, err := maxminddb.Open(filepath.Join(dir, "first.mmdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tests := []struct {
+		ip   string
+		want map[string]any
+	}{
+		// The first 8 hex characters of the SHA-256 of "Cloudflare".
+		{"1.1.1.1", map[string]any{"autonomous_system_number": uint64(13335), "autonomous_system_organization_hash": "f9191531"}},
+		{"8.8.8.8", map[string]any{"autonomous_system_number": uint64(15169)}},
+	}
+	for _, tt := range tests {
+		if _, got := lookupTest(t, db, tt.ip); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+// manifestSuffix is appended to the output file name for the -manifest
+// sidecar.
+const manifestSuffix = ".manifest.json"
+
+// buildManifest is the -manifest sidecar: what went into a build and what
+// came out, for the reproduce command to run it again.
+type buildManifest struct {
+	Tool       manifestTool      `json:"tool"`
+	BuildTime  string            `json:"build_time"`
+	Args       []string          `json:"args"`
+	Positional []string          `json:"positional"`
+	Flags      map[string]string `json:"flags"`
+	Inputs     []manifestFile    `json:"inputs"`
+	Summary    map[string]int    `json:"summary"`
+	Coverage   *coverageReport   `json:"coverage,omitempty"`
+	Output     manifestFile      `json:"output"`
+}
+
+// manifestTool is the binary that made a build, from its Go build info.
+type manifestTool struct {
+	Version  string `json:"version"`
+	Revision string `json:"revision,omitempty"`
+	Modified bool   `json:"modified,omitempty"`
+	Go       string `json:"go"`
+}
+
+// manifestFile is an input or the output of a build. Source is the flag an
+// input was given with, or csv-file. An input given as a URL has no hash,
+// and one that did not exist, such as a new -first-seen history, is
+// missing.
+type manifestFile struct {
+	Source  string `json:"source,omitempty"`
+	File    string `json:"file"`
+	Size    int64  `json:"size,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+// reproduceOverrides are the flags the rebuild of reproduce resets when the
+// build set them, so that it only writes its own output, and does not
+// download the input again or publish anything.
+var reproduceOverrides = []string{
+	"-checksum=false", "-manifest=false", "-sign-key=", "-upload=", "-fetch=", "-daemon=false",
+	"-metrics-listen=", "-metrics-textfile=", "-sqlite=", "-insert-log=", "-rejects=", "-progress-file=",
+	"-coverage-index=", "-coverage-report=", "-emit-normalized=", "-anomalies=", "-cpuprofile=", "-memprofile=",
+}
+
+// validateManifest checks -manifest, which describes one output file
+// built from files.
+func validateManifest(cfg *config) error {
+	if !cfg.manifest {
+		return nil
+	}
+	switch {
+	case cfg.csvFile == stdioPath:
+		return errors.New("-manifest cannot be used when reading from stdin")
+	case cfg.outputFile == stdioPath:
+		return errors.New("-manifest cannot be used when writing to stdout")
+	case cfg.shardMaxSize > 0:
+		return errors.New("-manifest cannot be used with -shard-max-size")
+	}
+	return nil
+}
+
+// manifestInputs returns the files a build reads: its inputs and the files
+// and URLs of the flags that add data to the records.
+func manifestInputs(cfg *config) []manifestFile {
+	var files []manifestFile
+	add := func(source string, names ...string) {
+		for _, name := range names {
+			if name != "" {
+				files = append(files, manifestFile{Source: source, File: name})
+			}
+		}
+	}
+	add("csv-file", cfg.csvFile)
+	for _, in := range cfg.extraInputs {
+		add("-input", in.file)
+	}
+	add("-config", cfg.configFile)
+	add("-record-template", cfg.recordTemplate)
+	add("-asn-names", cfg.asnNames)
+	add("-whois-orgs", cfg.whoisOrgs)
+	if cfg.whoisEnrich {
+		add("-whois-cache", cfg.whoisCache)
+	}
+	add("-rir-stats", cfg.rirStats...)
+	add("-first-seen", cfg.firstSeen)
+	add("-peeringdb", cfg.peeringDB)
+	add("-anycast", cfg.anycast...)
+	add("-geofeed", cfg.geofeeds...)
+	add("-rpki", cfg.rpki)
+	add("-as-rel", cfg.asRel)
+	add("-link", cfg.link)
+	return files
+}
+
+// hashManifestInputs hashes the inputs of a build before it starts, as
+// some, like -first-seen, are rewritten by it.
+func hashManifestInputs(cfg *config) ([]manifestFile, error) {
+	files := manifestInputs(cfg)
+	for i := range files {
+		if err := hashManifestFile(&files[i]); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// hashManifestFile fills in the size and hash of a file, or marks it as
+// missing. URLs are left as they are.
+func hashManifestFile(f *manifestFile) error {
+	if strings.HasPrefix(f.File, "http://") || strings.HasPrefix(f.File, "https://") {
+		return nil
+	}
+	info, err := os.Stat(f.File)
+	if errors.Is(err, os.ErrNotExist) {
+		f.Missing = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", f.File, err)
+	}
+	sum, err := fileSHA256(f.File)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", f.File, err)
+	}
+	f.Size, f.SHA256 = info.Size(), hex.EncodeToString(sum)
+	return nil
+}
+
+// currentTool describes the running binary.
+func currentTool() manifestTool {
+	tool := manifestTool{Version: "unknown"}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return tool
+	}
+	tool.Version, tool.Go = info.Main.Version, info.GoVersion
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			tool.Revision = s.Value
+		case "vcs.modified":
+			tool.Modified = s.Value == "true"
+		}
+	}
+	return tool
+}
+
+// writeOutputManifest writes the -manifest sidecar of the output file,
+// replacing it atomically like the checksum.
+func writeOutputManifest(cfg *config, inputs []manifestFile, stats *buildStats) error {
+	if !cfg.manifest {
+		return nil
+	}
+	m := buildManifest{
+		Tool:       currentTool(),
+		BuildTime:  cfg.buildTime.UTC().Format(time.RFC3339Nano),
+		Args:       cfg.args,
+		Positional: flag.Args(),
+		Flags:      map[string]string{},
+		Inputs:     inputs,
+		Summary:    map[string]int{},
+		Coverage:   stats.coverage,
+		Output:     manifestFile{File: cfg.outputFile},
+	}
+	flag.Visit(func(f *flag.Flag) { m.Flags[f.Name] = f.Value.String() })
+	attrs := stats.summary(cfg)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if n, ok := attrs[i+1].(int); ok {
+			m.Summary[attrs[i].(string)] = n
+		}
+	}
+	if err := hashManifestFile(&m.Output); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	sidecar := cfg.outputFile + manifestSuffix
+	if err := writeFileAtomic(sidecar, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	logger.Info("manifest written", "file", sidecar, "inputs", len(inputs))
+	return nil
+}
+
+// runReproduce implements `reproduce [flags] <manifest.json>`: it checks
+// that the inputs of a build still match its -manifest, then runs the
+// build again with the recorded arguments and build time, to a temporary
+// file, and compares the output with the recorded hash. It runs from the
+// directory of the original build, as that is what relative paths in the
+// arguments are relative to.
+func runReproduce(args []string) error {
+	fs := flag.NewFlagSet("reproduce", flag.ExitOnError)
+	inputsOnly := fs.Bool("inputs-only", false, "only check the inputs against the manifest, without rebuilding")
+	keep := fs.String("keep", "", "keep the rebuilt output at this `path`, e.g. to diff it against the original")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s reproduce [flags] <manifest.json>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("reproduce needs a manifest")
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m buildManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("invalid manifest %s: %w", fs.Arg(0), err)
+	}
+	if m.Output.SHA256 == "" || len(m.Args) < len(m.Positional) {
+		return fmt.Errorf("invalid manifest %s: no output hash or arguments", fs.Arg(0))
+	}
+
+	changed := 0
+	for _, in := range m.Inputs {
+		got := manifestFile{File: in.File}
+		if err := hashManifestFile(&got); err != nil {
+			return err
+		}
+		switch {
+		case in.SHA256 == "" && !in.Missing:
+			logger.Warn("cannot check URL input, the rebuild downloads it again", "source", in.Source, "url", in.File)
+		case got.Missing != in.Missing || got.SHA256 != in.SHA256:
+			changed++
+			logger.Error("input changed since the build", "source", in.Source, "file", in.File,
+				"manifest_sha256", in.SHA256, "sha256", got.SHA256, "missing", got.Missing)
+		}
+	}
+	if changed > 0 {
+		return fmt.Errorf("%d of %d inputs changed since the build", changed, len(m.Inputs))
+	}
+	if *inputsOnly {
+		fmt.Printf("OK: %d inputs match %s\n", len(m.Inputs), fs.Arg(0))
+		return nil
+	}
+	if tool := currentTool(); tool.Revision != m.Tool.Revision || tool.Version != m.Tool.Version || tool.Go != m.Tool.Go {
+		logger.Warn("rebuilding with a different binary than the build", "manifest_version", m.Tool.Version,
+			"manifest_revision", m.Tool.Revision, "manifest_go", m.Tool.Go, "version", tool.Version,
+			"revision", tool.Revision, "go", tool.Go)
+	}
+
+	dir, err := os.MkdirTemp("", "mmdbwriter-reproduce-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, filepath.Base(m.Output.File))
+
+	// Flags stop at the first positional argument, so the overrides go
+	// between the recorded flags and the input, and the output of the
+	// rebuild replaces the recorded one. An input and output given by a
+	// config file are passed explicitly.
+	flagArgs := slices.Clone(m.Args[:len(m.Args)-len(m.Positional)])
+	if n := len(flagArgs); n > 0 && flagArgs[n-1] == "--" {
+		flagArgs = flagArgs[:n-1]
+	}
+	positional := slices.Clone(m.Positional)
+	if len(positional) == 0 {
+		for _, in := range m.Inputs {
+			if in.Source == "csv-file" {
+				positional = append(positional, in.File)
+			}
+		}
+	}
+	if len(positional) == 0 {
+		return fmt.Errorf("invalid manifest %s: no input", fs.Arg(0))
+	}
+	positional = append(positional[:1], output)
+	rebuildArgs := append([]string{"build"}, flagArgs...)
+	rebuildArgs = append(rebuildArgs, "-build-time="+m.BuildTime)
+	for _, override := range reproduceOverrides {
+		name, _, _ := strings.Cut(strings.TrimPrefix(override, "-"), "=")
+		if _, ok := m.Flags[name]; ok {
+			rebuildArgs = append(rebuildArgs, override)
+		}
+	}
+	rebuildArgs = append(append(rebuildArgs, "--"), positional...)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logger.Info("rebuilding", "args", rebuildArgs[1:])
+	cmd := exec.Command(exe, rebuildArgs...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rebuild failed: %w", err)
+	}
+
+	got := manifestFile{File: output}
+	if err := hashManifestFile(&got); err != nil {
+		return err
+	}
+	if *keep != "" {
+		data, err := os.ReadFile(output)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(*keep, data); err != nil {
+			return fmt.Errorf("failed to keep rebuilt output: %w", err)
+		}
+	}
+	if got.SHA256 != m.Output.SHA256 {
+		return fmt.Errorf("rebuild of %s does not match the manifest: %s has %s, rebuild is %s",
+			m.Output.File, fs.Arg(0), m.Output.SHA256, got.SHA256)
+	}
+	fmt.Printf("OK: rebuild of %s matches %s (sha256 %s)\n", m.Output.File, fs.Arg(0), got.SHA256)
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/maxmind/mmdbwriter/inserter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// Field-level merge strategies accepted by -org-merge. With no strategy the
+// last inserted record wins, org included.
+const (
+	orgMergePreferNonEmpty = "prefer-nonempty"
+	orgMergePreferLonger   = "prefer-longer"
+	orgMergePreferFirst    = "prefer-first"
+)
+
+// Strategies accepted by -merge-strategy for a CIDR that appears more
+// than once in the input, e.g. a prefix announced by several ASNs (MOAS).
+const (
+	mergeReplace   = "replace"
+	mergeKeepFirst = "keep-first"
+	mergeIntoArray = "merge-into-array"
+)
+
+func validateMergeStrategy(strategy string) error {
+	switch strategy {
+	case mergeReplace, mergeKeepFirst, mergeIntoArray:
+		return nil
+	}
+	return fmt.Errorf("unknown -merge-strategy %q (want %s, %s or %s)",
+		strategy, mergeReplace, mergeKeepFirst, mergeIntoArray)
+}
+
+func validateOrgMerge(strategy string) error {
+	switch strategy {
+	case "", orgMergePreferNonEmpty, orgMergePreferLonger, orgMergePreferFirst:
+		return nil
+	}
+	return fmt.Errorf("unknown -org-merge strategy %q (want %s, %s or %s)",
+		strategy, orgMergePreferNonEmpty, orgMergePreferLonger, orgMergePreferFirst)
+}
+
+// sameMap reports whether a and b are the same map, not merely equal
+// ones. With -merge-strategy or -org-merge every stored row has a map of
+// its own, so the map identifies the CIDR it was stored for.
+func sameMap(a, b mmdbtype.Map) bool {
+	return reflect.ValueOf(a).UnsafePointer() == reflect.ValueOf(b).UnsafePointer()
+}
+
+// orgMergeInserter returns an inserter for a repeat of a CIDR whose last
+// record was own. Where own is still stored, it is replaced with record,
+// except that the existing organization is carried over when the strategy
+// says it is the better of the two. Networks with other records, such as
+// more-specifics nested in the CIDR, are replaced with record as by a
+// plain insert: their organization belongs to another prefix. stored is
+// set to the record left where own was.
+func orgMergeInserter(strategy string, own, record mmdbtype.Map, stats *buildStats, stored *mmdbtype.Map) inserter.Func {
+	var merged mmdbtype.Map
+	return func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+		old, ok := existing.(mmdbtype.Map)
+		if !ok || !sameMap(old, own) {
+			return record, nil
+		}
+		// A CIDR split by more-specifics is met once per part.
+		if merged == nil {
+			merged = mergeOrg(strategy, old, record, stats)
+			*stored = merged
+		}
+		return merged, nil
+	}
+}
+
+// mergeOrg returns record, or a copy of it with the organization of old
+// when the strategy prefers that one.
+func mergeOrg(strategy string, old, record mmdbtype.Map, stats *buildStats) mmdbtype.Map {
+	oldOrg, hasOld := old["autonomous_system_organization"].(mmdbtype.String)
+	newOrg, _ := record["autonomous_system_organization"].(mmdbtype.String)
+	if !hasOld || oldOrg == newOrg {
+		return record
+	}
+
+	stats.orgConflicts++
+
+	keepOld := false
+	switch strategy {
+	case orgMergePreferNonEmpty:
+		keepOld = newOrg == ""
+	case orgMergePreferLonger:
+		keepOld = utf8.RuneCountInString(string(oldOrg)) > utf8.RuneCountInString(string(newOrg))
+	case orgMergePreferFirst:
+		keepOld = true
+	}
+	if !keepOld {
+		return record
+	}
+
+	stats.orgRetained++
+
+	merged := record.Copy().(mmdbtype.Map)
+	merged["autonomous_system_organization"] = oldOrg
+	return merged
+}
+
+// moasInserter returns an inserter for a repeat of a CIDR whose last record
+// was own. Where own is still stored, it is kept with the ASN of record
+// added to its autonomous_system_numbers array, which lists every ASN seen
+// for the prefix in input order. Networks with other records, such as
+// more-specifics nested in the CIDR, are left alone: the ASN did not
+// announce them. stored is set to the record left where own was, and stays
+// nil when own is stored nowhere any more; moas is set when the array ends
+// up with more than one ASN.
+func moasInserter(own, record mmdbtype.Map, stored *mmdbtype.Map, moas *bool) inserter.Func {
+	return func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+		old, ok := existing.(mmdbtype.Map)
+		if !ok || !sameMap(old, own) {
+			return existing, nil
+		}
+		// A CIDR split by more-specifics is met once per part.
+		if *stored != nil {
+			return *stored, nil
+		}
+
+		var asns mmdbtype.Slice
+		if list, ok := old["autonomous_system_numbers"].(mmdbtype.Slice); ok {
+			asns = append(asns, list...)
+		} else if asn, ok := old["autonomous_system_number"]; ok {
+			asns = append(asns, asn)
+		}
+		if asn, ok := record["autonomous_system_number"]; ok && !slices.ContainsFunc(asns, asn.Equal) {
+			asns = append(asns, asn)
+		}
+		if len(asns) < 2 {
+			*stored = old
+			return old, nil
+		}
+		*moas = true
+
+		merged := old.Copy().(mmdbtype.Map)
+		merged["autonomous_system_numbers"] = asns
+		*stored = merged
+		return merged, nil
+	}
+}
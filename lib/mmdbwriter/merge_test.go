@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrgMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		input    string
+		ip       string
+		wantASN  uint64
+		wantOrg  string
+	}{
+		{
+			name:     "prefer-longer keeps the longer org of a repeat",
+			strategy: orgMergePreferLonger,
+			input:    "network,asn,org\n1.2.3.0/24,64500,Example Networks Inc\n1.2.3.0/24,64501,Example\n",
+			ip:       "1.2.3.1",
+			wantASN:  64501,
+			wantOrg:  "Example Networks Inc",
+		},
+		{
+			name:     "prefer-nonempty keeps an org the repeat lacks",
+			strategy: orgMergePreferNonEmpty,
+			input:    "network,asn,org\n1.2.3.0/24,64500,Example\n1.2.3.0/24,64501,\n",
+			ip:       "1.2.3.1",
+			wantASN:  64501,
+			wantOrg:  "Example",
+		},
+		{
+			name:     "prefer-first keeps the first org",
+			strategy: orgMergePreferFirst,
+			input:    "network,asn,org\n1.2.3.0/24,64500,First\n1.2.3.0/24,64501,Second Org\n",
+			ip:       "1.2.3.1",
+			wantASN:  64501,
+			wantOrg:  "First",
+		},
+		{
+			name:     "a nested prefix does not take the covering org",
+			strategy: orgMergePreferLonger,
+			input:    "network,asn,org\n8.0.0.0/8,3356,Level3 Parent Long Name\n8.8.8.0/24,15169,Google\n",
+			ip:       "8.8.8.8",
+			wantASN:  15169,
+			wantOrg:  "Google",
+		},
+		{
+			name:     "a covering prefix does not take a nested org",
+			strategy: orgMergePreferLonger,
+			input:    "network,asn,org\n8.8.8.0/24,15169,Google Long Name LLC\n8.0.0.0/8,3356,Level3\n",
+			ip:       "8.8.8.8",
+			wantASN:  3356,
+			wantOrg:  "Level3",
+		},
+		{
+			name:     "a repeat merges only with its own part of a split prefix",
+			strategy: orgMergePreferLonger,
+			input: "network,asn,org\n45.3.0.0/16,65550,Long Original Org\n45.3.3.0/24,65552,Nested Org Name Longer\n" +
+				"45.3.0.0/16,65551,Short\n",
+			ip:      "45.3.3.1",
+			wantASN: 65551,
+			wantOrg: "Short",
+		},
+		{
+			name:     "the rest of a split prefix keeps its own org",
+			strategy: orgMergePreferLonger,
+			input: "network,asn,org\n45.3.0.0/16,65550,Long Original Org\n45.3.3.0/24,65552,Nested Org Name Longer\n" +
+				"45.3.0.0/16,65551,Short\n",
+			ip:      "45.3.1.1",
+			wantASN: 65551,
+			wantOrg: "Long Original Org",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := buildTestDB(t, testConfig(t, "-org-merge", tt.strategy), tt.input)
+			_, record := lookupTest(t, db, tt.ip)
+			if record["autonomous_system_number"] != tt.wantASN || record["autonomous_system_organization"] != tt.wantOrg {
+				t.Errorf("got %v, want ASN %d with org %q", record, tt.wantASN, tt.wantOrg)
+			}
+		})
+	}
+}
+
+func TestMergeStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		input    string
+		ip       string
+		wantASN  uint64
+		wantASNs []any
+	}{
+		{
+			name:     "replace keeps the last row",
+			strategy: mergeReplace,
+			input:    "network,asn\n1.2.3.0/24,64500\n1.2.3.0/24,64501\n",
+			ip:       "1.2.3.1",
+			wantASN:  64501,
+		},
+		{
+			name:     "keep-first keeps the first row",
+			strategy: mergeKeepFirst,
+			input:    "network,asn\n1.2.3.0/24,64500\n1.2.3.0/24,64501\n",
+			ip:       "1.2.3.1",
+			wantASN:  64500,
+		},
+		{
+			name:     "merge-into-array lists every origin",
+			strategy: mergeIntoArray,
+			input:    "network,asn\n1.2.3.0/24,64500\n1.2.3.0/24,64501\n1.2.3.0/24,64500\n",
+			ip:       "1.2.3.1",
+			wantASN:  64500,
+			wantASNs: []any{uint64(64500), uint64(64501)},
+		},
+		{
+			name:     "merge-into-array leaves nested prefixes alone",
+			strategy: mergeIntoArray,
+			input:    "network,asn\n45.3.0.0/16,65550\n45.3.3.0/24,65552\n45.3.0.0/16,65551\n",
+			ip:       "45.3.3.1",
+			wantASN:  65552,
+		},
+		{
+			name:     "merge-into-array merges the rest of a split prefix",
+			strategy: mergeIntoArray,
+			input:    "network,asn\n45.3.0.0/16,65550\n45.3.3.0/24,65552\n45.3.0.0/16,65551\n",
+			ip:       "45.3.200.1",
+			wantASN:  65550,
+			wantASNs: []any{uint64(65550), uint64(65551)},
+		},
+		{
+			name:     "merge-into-array stores a repeat whose record was replaced",
+			strategy: mergeIntoArray,
+			input:    "network,asn\n45.3.3.0/24,65552\n45.3.0.0/16,65550\n45.3.3.0/24,65553\n",
+			ip:       "45.3.3.1",
+			wantASN:  65553,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := buildTestDB(t, testConfig(t, "-merge-strategy", tt.strategy), tt.input)
+			_, record := lookupTest(t, db, tt.ip)
+			if record["autonomous_system_number"] != tt.wantASN {
+				t.Errorf("got ASN %v, want %d", record["autonomous_system_number"], tt.wantASN)
+			}
+			asns, _ := record["autonomous_system_numbers"].([]any)
+			if !reflect.DeepEqual(asns, tt.wantASNs) {
+				t.Errorf("got autonomous_system_numbers %v, want %v", asns, tt.wantASNs)
+			}
+		})
+	}
+}
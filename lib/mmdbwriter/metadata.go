@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// metadataStartMarker separates the data section from the metadata map.
+var metadataStartMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// standardMetadataKeys are written by mmdbwriter and cannot be set with
+// -metadata.
+var standardMetadataKeys = map[string]bool{
+	"binary_format_major_version": true,
+	"binary_format_minor_version": true,
+	"build_epoch":                 true,
+	"database_type":               true,
+	"description":                 true,
+	"ip_version":                  true,
+	"languages":                   true,
+	"node_count":                  true,
+	"record_size":                 true,
+}
+
+// Metadata keys recording the provenance of the data, printed by info.
+const (
+	metadataSourceURL    = "source_url"
+	metadataFetchedAt    = "fetched_at"
+	metadataSnapshotDate = "snapshot_date"
+	metadataLicense      = "license"
+)
+
+// provenanceKeys are the provenance keys in the order info prints them.
+var provenanceKeys = []string{metadataSourceURL, metadataFetchedAt, metadataSnapshotDate, metadataLicense}
+
+// keyValues implements flag.Value for repeatable key=value flags such as
+// -description and -metadata.
+type keyValues map[string]string
+
+func (kv keyValues) String() string {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+kv[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (kv keyValues) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	k = strings.TrimSpace(k)
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	kv[k] = v
+	return nil
+}
+
+// recordSizeFlag is -record-size: a size in bits, or auto.
+type recordSizeFlag struct{ cfg *config }
+
+func (f recordSizeFlag) String() string {
+	switch {
+	case f.cfg == nil:
+		return ""
+	case f.cfg.recordSizeAuto:
+		return "auto"
+	}
+	return strconv.Itoa(f.cfg.recordSize)
+}
+
+func (f recordSizeFlag) Set(value string) error {
+	if value == "auto" {
+		f.cfg.recordSize, f.cfg.recordSizeAuto = recordSizes[0], true
+		return nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("want 24, 28, 32 or auto, got %q", value)
+	}
+	f.cfg.recordSize, f.cfg.recordSizeAuto = size, false
+	return nil
+}
+
+// largerRecordSize returns the record size after size.
+func largerRecordSize(size int) (int, bool) {
+	i := slices.Index(recordSizes, size)
+	if i < 0 || i == len(recordSizes)-1 {
+		return 0, false
+	}
+	return recordSizes[i+1], true
+}
+
+// isRecordCapacityError reports whether err from serializing a tree means
+// that its nodes and data cannot be addressed with its record size.
+func isRecordCapacityError(err error) bool {
+	// mmdbwriter does not export a typed error for this.
+	return strings.Contains(err.Error(), "exceeded record capacity")
+}
+
+// validateMetadata checks the -record-size and -metadata flags.
+func validateMetadata(cfg *config) error {
+	switch cfg.recordSize {
+	case 24, 28, 32:
+	default:
+		return fmt.Errorf("-record-size must be 24, 28 or 32, got %d", cfg.recordSize)
+	}
+	for k := range cfg.metadata {
+		if standardMetadataKeys[k] {
+			return fmt.Errorf("-metadata cannot set the standard key %q", k)
+		}
+	}
+	return nil
+}
+
+// treeOptions returns the writer options for the build: the defaults of
+// the ASN database with the metadata flags applied.
+func treeOptions(cfg *config) mmdbwriter.Options {
+	opts := mmdbbuild.DefaultOptions()
+	switch cfg.schema {
+	case schemaGeoLite2ASN:
+		opts.DatabaseType = geolite2ASNDatabaseType
+	case schemaGeoIP2City:
+		opts.DatabaseType = geoip2CityDatabaseType
+	}
+	if cfg.databaseType != "" {
+		opts.DatabaseType = cfg.databaseType
+	}
+	if len(cfg.descriptions) > 0 {
+		opts.Description = cfg.descriptions
+	}
+	opts.RecordSize = cfg.recordSize
+	// Reserved networks are accepted when asked for or when they get
+	// tagged; rows in them are stored like any other.
+	opts.IncludeReservedNetworks = cfg.includeReserved || cfg.tagBogonNetworks
+	opts.BuildEpoch = cfg.buildTime.Unix()
+	// An IPv6-only database has nothing to alias IPv4 space to.
+	switch {
+	case cfg.onlyIPv4:
+		opts.IPVersion = 4
+	case cfg.onlyIPv6 || cfg.disableAliasing:
+		opts.DisableIPv4Aliasing = true
+	}
+	return opts
+}
+
+// networkPolicy returns the reserved and aliased space the tree of the
+// build cannot hold.
+func networkPolicy(cfg *config) mmdbbuild.NetworkPolicy {
+	return mmdbbuild.NewNetworkPolicy(treeOptions(cfg))
+}
+
+// provenanceMetadata returns the -metadata keys with the provenance of the
+// data added: -license, -snapshot-date and, with -fetch, the URL, when the
+// input was downloaded and the Last-Modified date of the upstream file as
+// the snapshot date. Keys given with -metadata are kept.
+func provenanceMetadata(cfg *config) map[string]string {
+	md := maps.Clone(cfg.metadata)
+	if md == nil {
+		md = map[string]string{}
+	}
+	set := func(key, value string) {
+		if _, ok := md[key]; !ok && value != "" {
+			md[key] = value
+		}
+	}
+	set(metadataLicense, cfg.license)
+	set(metadataSnapshotDate, cfg.snapshotDate)
+	if cfg.fetchURL == "" {
+		return md
+	}
+	set(metadataSourceURL, cfg.fetchURL)
+	state, _ := readFetchState(cfg.fetchURL, cfg.csvFile)
+	fetchedAt := state.FetchedAt
+	// State files written before fetched_at was recorded still date the
+	// download: it is the modification time of the file.
+	if info, err := os.Stat(cfg.csvFile); fetchedAt == "" && err == nil {
+		fetchedAt = info.ModTime().UTC().Format(time.RFC3339)
+	}
+	set(metadataFetchedAt, fetchedAt)
+	if t, err := http.ParseTime(state.LastModified); err == nil {
+		set(metadataSnapshotDate, t.UTC().Format(time.RFC3339))
+	}
+	return md
+}
+
+// parseSnapshotDate validates -snapshot-date: a YYYY-MM-DD date is kept
+// as it is, a timestamp is written as RFC 3339 in UTC.
+func parseSnapshotDate(s string) (string, error) {
+	if _, err := time.Parse(time.DateOnly, s); err == nil {
+		return s, nil
+	}
+	t, err := parseTimestamp(s)
+	if err != nil {
+		return "", errors.New("want a YYYY-MM-DD date, Unix seconds or an RFC 3339 timestamp")
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+// extraMetadata wraps a database so that its metadata map also carries the
+// given string keys. mmdbwriter only writes the standard keys, so the
+// serialized metadata is replaced with one that adds them; readers ignore
+// keys they do not know.
+type extraMetadata struct {
+	db    io.WriterTo
+	extra map[string]string
+}
+
+func (m extraMetadata) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if _, err := m.db.WriteTo(&buf); err != nil {
+		return 0, err
+	}
+	data, err := addMetadata(buf.Bytes(), m.extra)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// addMetadata re-encodes the metadata map of a serialized database with
+// extra added to it.
+func addMetadata(data []byte, extra map[string]string) ([]byte, error) {
+	if len(extra) == 0 {
+		return data, nil
+	}
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read back database metadata: %w", err)
+	}
+	md := db.Metadata
+
+	description := mmdbtype.Map{}
+	for k, v := range md.Description {
+		description[mmdbtype.String(k)] = mmdbtype.String(v)
+	}
+	languages := mmdbtype.Slice{}
+	for _, v := range md.Languages {
+		languages = append(languages, mmdbtype.String(v))
+	}
+	metadata := mmdbtype.Map{
+		"binary_format_major_version": mmdbtype.Uint16(md.BinaryFormatMajorVersion),
+		"binary_format_minor_version": mmdbtype.Uint16(md.BinaryFormatMinorVersion),
+		"build_epoch":                 mmdbtype.Uint64(md.BuildEpoch),
+		"database_type":               mmdbtype.String(md.DatabaseType),
+		"description":                 description,
+		"ip_version":                  mmdbtype.Uint16(md.IPVersion),
+		"languages":                   languages,
+		"node_count":                  mmdbtype.Uint32(md.NodeCount),
+		"record_size":                 mmdbtype.Uint16(md.RecordSize),
+	}
+	for k, v := range extra {
+		metadata[mmdbtype.String(k)] = mmdbtype.String(v)
+	}
+
+	start := bytes.LastIndex(data, metadataStartMarker) + len(metadataStartMarker)
+	out := metadataBuffer{bytes.NewBuffer(append([]byte(nil), data[:start]...))}
+	if _, err := metadata.WriteTo(out); err != nil {
+		return nil, fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// metadataBuffer writes mmdbtype values without pointers, as the metadata
+// section cannot refer to the data section.
+type metadataBuffer struct {
+	*bytes.Buffer
+}
+
+func (b metadataBuffer) WriteOrWritePointer(t mmdbtype.DataType) (int64, error) {
+	return t.WriteTo(b)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// insertBuckets are the upper bounds in seconds of the insert duration
+// histogram, from 1µs to about 1s.
+var insertBuckets = []float64{1e-6, 2.5e-6, 5e-6, 1e-5, 2.5e-5, 5e-5, 1e-4, 2.5e-4, 5e-4, 1e-3, 1e-2, 0.1, 1}
+
+// histogram is a Prometheus histogram with fixed buckets. It is not safe
+// for concurrent use; builds fill their own and merge it when done.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(insertBuckets))}
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range insertBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.sum += o.sum
+	h.count += o.count
+}
+
+// buildMetrics holds the metrics of -metrics-listen and -metrics-textfile.
+// The gauges describe the last successful build; the counters and the
+// insert histogram add up over all builds of a daemon.
+type buildMetrics struct {
+	mu sync.Mutex
+
+	successes, failures uint64
+	lastSuccess         time.Time
+	duration            float64
+	rows, records       int
+	skipped             map[string]int
+	nodes, outputBytes  int64
+	inserts             *histogram
+}
+
+func newBuildMetrics() *buildMetrics {
+	return &buildMetrics{inserts: newHistogram(), nodes: -1, outputBytes: -1}
+}
+
+// recordSuccess takes over the statistics of a finished build. nodes and
+// outputBytes are -1 when unknown.
+func (m *buildMetrics) recordSuccess(cfg *config, stats *buildStats, duration time.Duration, nodes, outputBytes int64) {
+	skipped := map[string]int{
+		rejectShortRow:     stats.shortRows,
+		rejectInvalidCIDR:  stats.invalidCIDR,
+		rejectNonCanonical: stats.nonCanonical,
+		rejectInvalidASN:   stats.invalidASN,
+		rejectZeroASN:      stats.zeroASN,
+		rejectExpired:      stats.expired,
+		rejectUnsupported:  stats.unsupported,
+		rejectDuplicate:    0,
+		"unsampled":        stats.unsampled,
+	}
+	// Only -merge-strategy keep-first drops duplicates; the others merge
+	// them into the existing record.
+	if cfg.mergeStrategy == mergeKeepFirst {
+		skipped[rejectDuplicate] = stats.duplicates
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.successes++
+	m.lastSuccess = time.Now()
+	m.duration = duration.Seconds()
+	m.rows, m.records = stats.rows, stats.records
+	m.skipped = skipped
+	m.nodes, m.outputBytes = nodes, outputBytes
+	if stats.insertSeconds != nil {
+		m.inserts.merge(stats.insertSeconds)
+	}
+}
+
+func (m *buildMetrics) recordFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures++
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *buildMetrics) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b bytes.Buffer
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	metric("mmdbwriter_builds_total", "counter", "Builds run, by result.")
+	fmt.Fprintf(&b, "mmdbwriter_builds_total{result=\"success\"} %d\n", m.successes)
+	fmt.Fprintf(&b, "mmdbwriter_builds_total{result=\"failure\"} %d\n", m.failures)
+
+	if m.successes > 0 {
+		gauges := []struct {
+			name, help string
+			value      any
+		}{
+			{"mmdbwriter_build_last_success_timestamp_seconds", "Unix time the last successful build finished.", m.lastSuccess.Unix()},
+			{"mmdbwriter_build_duration_seconds", "Duration of the last successful build.", m.duration},
+			{"mmdbwriter_build_rows", "Input rows parsed by the last successful build.", m.rows},
+			{"mmdbwriter_build_records", "Records inserted by the last successful build.", m.records},
+		}
+		for _, g := range gauges {
+			metric(g.name, "gauge", g.help)
+			fmt.Fprintf(&b, "%s %v\n", g.name, g.value)
+		}
+
+		metric("mmdbwriter_build_rows_skipped", "gauge", "Input rows the last successful build skipped, by reason.")
+		reasons := make([]string, 0, len(m.skipped))
+		for reason := range m.skipped {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(&b, "mmdbwriter_build_rows_skipped{reason=%q} %d\n", reason, m.skipped[reason])
+		}
+
+		if m.nodes >= 0 {
+			metric("mmdbwriter_build_tree_nodes", "gauge", "Search tree nodes of the last successful build.")
+			fmt.Fprintf(&b, "mmdbwriter_build_tree_nodes %d\n", m.nodes)
+		}
+		if m.outputBytes >= 0 {
+			metric("mmdbwriter_build_output_bytes", "gauge", "Size of the output of the last successful build.")
+			fmt.Fprintf(&b, "mmdbwriter_build_output_bytes %d\n", m.outputBytes)
+		}
+	}
+
+	metric("mmdbwriter_build_insert_duration_seconds", "histogram", "Duration of the tree insert of each row.")
+	var cumulative uint64
+	for i, bound := range insertBuckets {
+		cumulative += m.inserts.counts[i]
+		fmt.Fprintf(&b, "mmdbwriter_build_insert_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(&b, "mmdbwriter_build_insert_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.inserts.count)
+	fmt.Fprintf(&b, "mmdbwriter_build_insert_duration_seconds_sum %g\n", m.inserts.sum)
+	fmt.Fprintf(&b, "mmdbwriter_build_insert_duration_seconds_count %d\n", m.inserts.count)
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// serveMetrics serves GET /metrics on addr until the process exits.
+func (m *buildMetrics) serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+// writeTextfile writes the metrics for the textfile collector of
+// node_exporter, which needs the file to be replaced atomically.
+func (m *buildMetrics) writeTextfile(path string) error {
+	var b bytes.Buffer
+	if err := m.write(&b); err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create metrics directory: %w", err)
+		}
+	}
+	if err := writeFileAtomic(path, b.Bytes()); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	return nil
+}
+
+// outputNodes returns the search tree node count of an MMDB output file
+// from its metadata, or -1 when it cannot be read.
+func outputNodes(path string) int64 {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return -1
+	}
+	defer db.Close()
+	return int64(db.Metadata.NodeCount)
+}
+
+// runBuild runs one build and finishes its metrics.
+func runBuild(ctx context.Context, cfg *config, stdout io.Writer) error {
+	err := build(ctx, cfg, stdout)
+	finishBuildMetrics(cfg, err)
+	notifyBuild(cfg, err)
+	return err
+}
+
+// finishBuildMetrics counts a failed build and writes -metrics-textfile.
+// Successful builds have recorded their statistics already.
+func finishBuildMetrics(cfg *config, err error) {
+	if cfg.metrics == nil {
+		return
+	}
+	if err != nil {
+		cfg.metrics.recordFailure()
+	}
+	if cfg.metricsTextfile != "" {
+		if werr := cfg.metrics.writeTextfile(cfg.metricsTextfile); werr != nil {
+			logger.Warn("failed to write metrics", "file", cfg.metricsTextfile, "error", werr)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// minCoverage implements flag.Value for -min-coverage, the least
+// percentage of the unicast space of each family the build must cover,
+// e.g. "v4=60,v6=20". A bare number is the IPv4 minimum. A percentage of 0
+// sets no minimum for the family.
+type minCoverage struct {
+	v4, v6 float64
+}
+
+func (m *minCoverage) String() string {
+	var parts []string
+	if m.v4 > 0 {
+		parts = append(parts, "v4="+strconv.FormatFloat(m.v4, 'f', -1, 64))
+	}
+	if m.v6 > 0 {
+		parts = append(parts, "v6="+strconv.FormatFloat(m.v6, 'f', -1, 64))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *minCoverage) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		family, percentStr, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			family, percentStr = "v4", family
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSpace(percentStr), 64)
+		if err != nil {
+			return fmt.Errorf("expected v4=PERCENT or v6=PERCENT, got %q", part)
+		}
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("invalid percentage %g", percent)
+		}
+		switch strings.ToLower(strings.TrimSpace(family)) {
+		case "v4", "ipv4":
+			m.v4 = percent
+		case "v6", "ipv6":
+			m.v6 = percent
+		default:
+			return fmt.Errorf("unknown address family %q, want v4 or v6", family)
+		}
+	}
+	return nil
+}
+
+// enabled reports whether a minimum is set for either family.
+func (m minCoverage) enabled() bool {
+	return m != minCoverage{}
+}
+
+// checkMinRecords enforces -min-records, against publishing a database
+// built from a truncated input.
+func checkMinRecords(cfg *config, stats *buildStats) error {
+	if cfg.minRecords > 0 && stats.records < cfg.minRecords {
+		return fmt.Errorf("the build stored %d records, fewer than -min-records %d", stats.records, cfg.minRecords)
+	}
+	return nil
+}
+
+// checkMinCoverage enforces -min-coverage on the measured coverage of the
+// build. A family the database does not hold fails a minimum set for it.
+func checkMinCoverage(cfg *config, report *coverageReport) error {
+	for _, want := range []struct {
+		family  string
+		percent float64
+	}{
+		{"ipv4", cfg.minCoverage.v4},
+		{"ipv6", cfg.minCoverage.v6},
+	} {
+		if want.percent == 0 {
+			continue
+		}
+		got := 0.0
+		for _, f := range report.Families {
+			if f.Family == want.family {
+				got = f.Percent
+			}
+		}
+		if got < want.percent {
+			return fmt.Errorf("%s coverage of %.2f%% is below -min-coverage %g%%; refusing to write %s",
+				want.family, got, want.percent, cfg.outputFile)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMinimumsGateSideFiles(t *testing.T) {
+	const input = "network,asn,org\n1.1.1.0/24,13335,Cloudflare\n2606:4700::/32,13335,Cloudflare\n"
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"accepted", nil, ""},
+		{"min-records", []string{"-min-records", "3"}, "fewer than -min-records 3"},
+		{"min-coverage", []string{"-min-coverage", "v4=50"}, "below -min-coverage 50%"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sideFiles := []string{
+				filepath.Join(dir, "first-seen.csv"),
+				filepath.Join(dir, "coverage.idx"),
+				filepath.Join(dir, "coverage.txt"),
+				filepath.Join(dir, "inserted.log"),
+			}
+			args := []string{
+				"-first-seen", sideFiles[0],
+				"-coverage-index", sideFiles[1],
+				"-coverage-report", sideFiles[2],
+				"-insert-log", sideFiles[3],
+			}
+			if sqliteSupported {
+				sideFiles = append(sideFiles, filepath.Join(dir, "asn.db"))
+				args = append(args, "-sqlite", sideFiles[4])
+			}
+			cfg := testConfig(t, append(args, tt.args...)...)
+			cfg.csvFile = writeTestFile(t, "input.csv", input)
+			cfg.outputFile = filepath.Join(dir, "asn.mmdb")
+
+			err := build(context.Background(), cfg, io.Discard)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+			for _, path := range append(sideFiles, cfg.outputFile) {
+				_, err := os.Stat(path)
+				if written := err == nil; written != (tt.wantErr == "") {
+					t.Errorf("%s written: %v", filepath.Base(path), written)
+				}
+			}
+			// Nor are their temporary files left behind.
+			if entries, err := os.ReadDir(dir); err != nil {
+				t.Fatal(err)
+			} else if tt.wantErr != "" && len(entries) != 0 {
+				t.Errorf("refused build left %v", entries)
+			}
+		})
+	}
+}
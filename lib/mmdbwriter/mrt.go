@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+)
+
+// MRT record types and subtypes (RFC 6396, RFC 8050) read by mrtReader.
+const (
+	mrtTableDumpV2 = 13
+	mrtBGP4MP      = 16
+	mrtBGP4MPET    = 17
+
+	mrtRIBIPv4Unicast        = 2
+	mrtRIBIPv6Unicast        = 4
+	mrtRIBIPv4UnicastAddPath = 8
+	mrtRIBIPv6UnicastAddPath = 10
+
+	mrtBGP4MPMessage                = 1
+	mrtBGP4MPMessageAS4             = 4
+	mrtBGP4MPMessageLocal           = 6
+	mrtBGP4MPMessageAS4Local        = 7
+	mrtBGP4MPMessageAddPath         = 8
+	mrtBGP4MPMessageAS4AddPath      = 9
+	mrtBGP4MPMessageLocalAddPath    = 10
+	mrtBGP4MPMessageAS4LocalAddPath = 11
+)
+
+// mrtMaxRecordLength bounds the length of an MRT record, so a corrupt
+// header cannot make the reader allocate gigabytes. BGP messages are at
+// most 64 KiB (RFC 8654); RIB records of a few thousand peers stay well
+// below it.
+const mrtMaxRecordLength = 16 << 20
+
+// BGP path attributes and AS_PATH segment types.
+const (
+	bgpAttrASPath    = 2
+	bgpAttrMPReach   = 14
+	bgpAttrMPUnreach = 15
+	bgpAttrAS4Path   = 17
+	bgpASSet         = 1
+	bgpASSequence    = 2
+	bgpMessageUpdate = 2
+	bgpAFIIPv4       = 1
+	bgpAFIIPv6       = 2
+	bgpSAFIUnicast   = 1
+)
+
+// mrtReader reads MRT routing data as network, asn, visibility and
+// path_length columns: one row per TABLE_DUMP_V2 RIB entry, with the origin most of the
+// peers see, and one row per prefix announced in a BGP4MP UPDATE, in the
+// order of the file. visibility is the number of peers with a route to the
+// prefix and path_length the length of the shortest of their AS paths;
+// for BGP4MP these count the peers whose last UPDATE for the prefix
+// announced it, and a withdrawal repeats the row of the prefix with the
+// peers left, if any. Compressed files are decompressed by decompressInput
+// before they reach the reader. Routes whose AS_PATH ends in an AS_SET get
+// the set as their origin, e.g. {64512,64513}; routes without an AS_PATH
+// origin are skipped. FieldPos reports MRT record numbers.
+type mrtReader struct {
+	r       io.Reader
+	record  int
+	pending [][]string
+	skipped int
+
+	// routes holds the prefixes announced by BGP4MP UPDATEs.
+	routes map[netip.Prefix]*mrtRoute
+}
+
+// mrtRoute is a prefix announced by BGP4MP UPDATEs: the origin of its last
+// announcement and the path length of every peer announcing it.
+type mrtRoute struct {
+	origin string
+	peers  map[string]int
+}
+
+// row returns the row of the prefix of the route.
+func (r *mrtRoute) row(prefix netip.Prefix) []string {
+	shortest := -1
+	for _, n := range r.peers {
+		if shortest < 0 || n < shortest {
+			shortest = n
+		}
+	}
+	return []string{prefix.String(), r.origin, strconv.Itoa(len(r.peers)), strconv.Itoa(shortest)}
+}
+
+func newMRTReader(r io.Reader) *mrtReader {
+	return &mrtReader{r: bufio.NewReader(r)}
+}
+
+func (mr *mrtReader) header() []string {
+	return []string{"network", "asn", visibilityColumn, pathLengthColumn}
+}
+
+func (mr *mrtReader) Read() ([]string, error) {
+	for len(mr.pending) == 0 {
+		var hdr [12]byte
+		if _, err := io.ReadFull(mr.r, hdr[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("truncated MRT header after record %d", mr.record)
+			}
+			if err == io.EOF && mr.skipped > 0 {
+				logger.Warn("skipped MRT routes without an origin ASN", "routes", mr.skipped)
+				mr.skipped = 0
+			}
+			return nil, err
+		}
+		mr.record++
+		typ := binary.BigEndian.Uint16(hdr[4:6])
+		subtype := binary.BigEndian.Uint16(hdr[6:8])
+		length := binary.BigEndian.Uint32(hdr[8:12])
+		if length > mrtMaxRecordLength {
+			return nil, fmt.Errorf("MRT record %d is %d bytes, longer than %d", mr.record, length, mrtMaxRecordLength)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(mr.r, body); err != nil {
+			return nil, fmt.Errorf("truncated MRT record %d: %w", mr.record, err)
+		}
+
+		var err error
+		switch typ {
+		case mrtTableDumpV2:
+			err = mr.readRIB(subtype, body)
+		case mrtBGP4MPET:
+			if len(body) < 4 {
+				err = errMRTShort
+				break
+			}
+			err = mr.readBGP4MP(subtype, body[4:])
+		case mrtBGP4MP:
+			err = mr.readBGP4MP(subtype, body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid MRT record %d: %w", mr.record, err)
+		}
+	}
+
+	row := mr.pending[0]
+	mr.pending = mr.pending[1:]
+	return row, nil
+}
+
+func (mr *mrtReader) FieldPos(field int) (line, column int) {
+	return mr.record, 1
+}
+
+var errMRTShort = errors.New("record too short")
+
+// readRIB adds the prefix of a RIB_IPV4/IPV6_UNICAST record with the origin
+// of most of its entries, the lowest ASN on a tie and single ASNs before
+// AS_SETs. The visibility is the number of peers with an entry that has an
+// origin, whatever the origin, and the path length the shortest of theirs.
+func (mr *mrtReader) readRIB(subtype uint16, body []byte) error {
+	var family int
+	addPath := false
+	switch subtype {
+	case mrtRIBIPv4Unicast:
+		family = bgpAFIIPv4
+	case mrtRIBIPv6Unicast:
+		family = bgpAFIIPv6
+	case mrtRIBIPv4UnicastAddPath:
+		family, addPath = bgpAFIIPv4, true
+	case mrtRIBIPv6UnicastAddPath:
+		family, addPath = bgpAFIIPv6, true
+	default:
+		return nil
+	}
+
+	if len(body) < 4 {
+		return errMRTShort
+	}
+	prefix, n, err := parseNLRIPrefix(body[4:], family)
+	if err != nil {
+		return err
+	}
+	rest := body[4+n:]
+	if len(rest) < 2 {
+		return errMRTShort
+	}
+	count := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+
+	votes := map[string]int{}
+	peers := map[uint16]bool{}
+	shortest := -1
+	for range count {
+		// peer index, originated time and, with ADD-PATH, the path ID
+		skip := 6
+		if addPath {
+			skip += 4
+		}
+		if len(rest) < skip+2 {
+			return errMRTShort
+		}
+		peer := binary.BigEndian.Uint16(rest)
+		attrLen := int(binary.BigEndian.Uint16(rest[skip:]))
+		rest = rest[skip+2:]
+		if len(rest) < attrLen {
+			return errMRTShort
+		}
+		attrs, err := parseBGPAttributes(rest[:attrLen], 4)
+		if err != nil {
+			return err
+		}
+		rest = rest[attrLen:]
+		if attrs.hasOrigin {
+			votes[attrs.origin]++
+			// With ADD-PATH a peer can have several entries.
+			peers[peer] = true
+			if shortest < 0 || attrs.pathLength < shortest {
+				shortest = attrs.pathLength
+			}
+		}
+	}
+
+	if len(votes) == 0 {
+		mr.skipped++
+		return nil
+	}
+	var origin string
+	best := 0
+	for o, n := range votes {
+		if n > best || n == best && originLess(o, origin) {
+			origin, best = o, n
+		}
+	}
+	mr.pending = append(mr.pending, []string{prefix.String(), origin, strconv.Itoa(len(peers)), strconv.Itoa(shortest)})
+	return nil
+}
+
+// readBGP4MP adds the prefixes announced by a BGP4MP UPDATE message, and
+// updates the routes of its peer.
+func (mr *mrtReader) readBGP4MP(subtype uint16, body []byte) error {
+	asSize := 4
+	addPath := false
+	switch subtype {
+	case mrtBGP4MPMessage, mrtBGP4MPMessageLocal:
+		asSize = 2
+	case mrtBGP4MPMessageAS4, mrtBGP4MPMessageAS4Local:
+	case mrtBGP4MPMessageAddPath, mrtBGP4MPMessageLocalAddPath:
+		asSize, addPath = 2, true
+	case mrtBGP4MPMessageAS4AddPath, mrtBGP4MPMessageAS4LocalAddPath:
+		addPath = true
+	default:
+		return nil
+	}
+
+	// peer AS, local AS, interface index, AFI, peer IP, local IP
+	if len(body) < 2*asSize+4 {
+		return errMRTShort
+	}
+	afi := binary.BigEndian.Uint16(body[2*asSize+2:])
+	addrLen := 4
+	if afi == bgpAFIIPv6 {
+		addrLen = 16
+	}
+	msg := body[2*asSize+4:]
+	if len(msg) < 2*addrLen+19 {
+		return errMRTShort
+	}
+	// The peer is identified by its AS and address.
+	peer := string(body[:asSize]) + string(msg[:addrLen])
+	msg = msg[2*addrLen:]
+	// marker, length, type
+	if msg[18] != bgpMessageUpdate {
+		return nil
+	}
+	u, err := parseBGPUpdate(msg[19:], asSize, addPath)
+	if err != nil {
+		return err
+	}
+	if mr.routes == nil {
+		mr.routes = map[netip.Prefix]*mrtRoute{}
+	}
+	withdraw := func(prefix netip.Prefix) {
+		route, ok := mr.routes[prefix]
+		if !ok {
+			return
+		}
+		if _, ok := route.peers[peer]; !ok {
+			return
+		}
+		delete(route.peers, peer)
+		if len(route.peers) == 0 {
+			// The prefix keeps its last row, as before visibility was
+			// tracked.
+			delete(mr.routes, prefix)
+			return
+		}
+		mr.pending = append(mr.pending, route.row(prefix))
+	}
+	for _, prefix := range u.withdrawn {
+		withdraw(prefix)
+	}
+	if !u.hasOrigin {
+		if len(u.announced) > 0 {
+			mr.skipped++
+		}
+		// An announcement without an origin still replaces the earlier
+		// route of the peer.
+		for _, prefix := range u.announced {
+			withdraw(prefix)
+		}
+		return nil
+	}
+	for _, prefix := range u.announced {
+		route, ok := mr.routes[prefix]
+		if !ok {
+			route = &mrtRoute{peers: map[string]int{}}
+			mr.routes[prefix] = route
+		}
+		route.origin = u.origin
+		route.peers[peer] = u.pathLength
+		mr.pending = append(mr.pending, route.row(prefix))
+	}
+	return nil
+}
+
+// bgpUpdate is a decoded BGP UPDATE message.
+type bgpUpdate struct {
+	// origin is the asn column of the announced routes: an ASN or an
+	// AS_SET.
+	origin    string
+	hasOrigin bool
+
+	// pathLength is the length of the AS_PATH of the announced routes.
+	pathLength int
+
+	// announced and withdrawn hold the unicast prefixes of the message,
+	// from the NLRI and withdrawn routes fields and the MP_REACH_NLRI and
+	// MP_UNREACH_NLRI attributes.
+	announced []netip.Prefix
+	withdrawn []netip.Prefix
+}
+
+// parseBGPUpdate decodes the body of an UPDATE message, the part after the
+// marker, length and type. With addPath, every prefix is preceded by a path
+// identifier (RFC 7911), which is dropped.
+func parseBGPUpdate(msg []byte, asSize int, addPath bool) (bgpUpdate, error) {
+	var u bgpUpdate
+	prefixes := func(nlri []byte, family int) ([]netip.Prefix, error) {
+		var out []netip.Prefix
+		for len(nlri) > 0 {
+			if addPath {
+				if len(nlri) < 4 {
+					return nil, errMRTShort
+				}
+				nlri = nlri[4:]
+			}
+			prefix, n, err := parseNLRIPrefix(nlri, family)
+			if err != nil {
+				return nil, err
+			}
+			nlri = nlri[n:]
+			out = append(out, prefix)
+		}
+		return out, nil
+	}
+
+	if len(msg) < 2 {
+		return u, errMRTShort
+	}
+	withdrawnLen := int(binary.BigEndian.Uint16(msg))
+	if len(msg) < 2+withdrawnLen+2 {
+		return u, errMRTShort
+	}
+	withdrawn, err := prefixes(msg[2:2+withdrawnLen], bgpAFIIPv4)
+	if err != nil {
+		return u, err
+	}
+	msg = msg[2+withdrawnLen:]
+	attrLen := int(binary.BigEndian.Uint16(msg))
+	if len(msg) < 2+attrLen {
+		return u, errMRTShort
+	}
+	attrs, err := parseBGPAttributes(msg[2:2+attrLen], asSize)
+	if err != nil {
+		return u, err
+	}
+	u.origin, u.hasOrigin = attrs.origin, attrs.hasOrigin
+	u.pathLength = attrs.pathLength
+
+	announced, err := prefixes(msg[2+attrLen:], bgpAFIIPv4)
+	if err != nil {
+		return u, err
+	}
+	mpReach, err := prefixes(attrs.mpReach, attrs.mpReachFamily)
+	if err != nil {
+		return u, err
+	}
+	mpUnreach, err := prefixes(attrs.mpUnreach, attrs.mpUnreachFamily)
+	if err != nil {
+		return u, err
+	}
+	u.announced = append(announced, mpReach...)
+	u.withdrawn = append(withdrawn, mpUnreach...)
+	return u, nil
+}
+
+// bgpAttributes holds the path attributes the importer needs.
+type bgpAttributes struct {
+	// origin is the asn column of the route: an ASN or an AS_SET.
+	origin    string
+	hasOrigin bool
+
+	// pathLength is the length of the AS_PATH, counted as in route
+	// selection (RFC 4271): every ASN of an AS_SEQUENCE, and an AS_SET as
+	// one.
+	pathLength int
+
+	// mpReach is the NLRI of an MP_REACH_NLRI unicast attribute.
+	mpReach       []byte
+	mpReachFamily int
+
+	// mpUnreach is the withdrawn NLRI of an MP_UNREACH_NLRI unicast
+	// attribute.
+	mpUnreach       []byte
+	mpUnreachFamily int
+}
+
+// parseBGPAttributes extracts the origin ASN, preferring AS4_PATH over an
+// AS_PATH of 2-byte ASNs, the path length and the MP_REACH_NLRI and
+// MP_UNREACH_NLRI prefixes.
+func parseBGPAttributes(data []byte, asSize int) (bgpAttributes, error) {
+	var attrs bgpAttributes
+	var as4Origin string
+	hasAS4 := false
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return attrs, errMRTShort
+		}
+		flags, typ := data[0], data[1]
+		var length, hdr int
+		if flags&0x10 != 0 {
+			if len(data) < 4 {
+				return attrs, errMRTShort
+			}
+			length, hdr = int(binary.BigEndian.Uint16(data[2:])), 4
+		} else {
+			length, hdr = int(data[2]), 3
+		}
+		if len(data) < hdr+length {
+			return attrs, errMRTShort
+		}
+		value := data[hdr : hdr+length]
+		data = data[hdr+length:]
+
+		switch typ {
+		case bgpAttrASPath:
+			attrs.origin, attrs.hasOrigin = pathOrigin(value, asSize)
+			attrs.pathLength = pathLength(value, asSize)
+		case bgpAttrAS4Path:
+			as4Origin, hasAS4 = pathOrigin(value, 4)
+		case bgpAttrMPReach:
+			// AFI, SAFI, next hop length, next hop, reserved. RIB entries
+			// abbreviate this attribute to the next hop only.
+			if len(value) < 4 {
+				continue
+			}
+			afi := binary.BigEndian.Uint16(value)
+			nextHop := int(value[3])
+			if value[2] != bgpSAFIUnicast || len(value) < 5+nextHop {
+				continue
+			}
+			if afi == bgpAFIIPv4 || afi == bgpAFIIPv6 {
+				attrs.mpReach, attrs.mpReachFamily = value[5+nextHop:], int(afi)
+			}
+		case bgpAttrMPUnreach:
+			// AFI, SAFI, withdrawn routes
+			if len(value) < 3 || value[2] != bgpSAFIUnicast {
+				continue
+			}
+			if afi := binary.BigEndian.Uint16(value); afi == bgpAFIIPv4 || afi == bgpAFIIPv6 {
+				attrs.mpUnreach, attrs.mpUnreachFamily = value[3:], int(afi)
+			}
+		}
+	}
+	if hasAS4 && asSize == 2 {
+		attrs.origin, attrs.hasOrigin = as4Origin, true
+	}
+	return attrs, nil
+}
+
+// pathOrigin returns the origin of an AS_PATH as the asn column: the last
+// ASN of a path ending in an AS_SEQUENCE, or the members of a final AS_SET.
+func pathOrigin(path []byte, asSize int) (string, bool) {
+	var origin string
+	found := false
+	for len(path) >= 2 {
+		segType, count := path[0], int(path[1])
+		path = path[2:]
+		if len(path) < count*asSize {
+			return "", false
+		}
+		if count > 0 {
+			asns := make([]uint32, count)
+			for i := range asns {
+				if asSize == 2 {
+					asns[i] = uint32(binary.BigEndian.Uint16(path[i*asSize:]))
+				} else {
+					asns[i] = binary.BigEndian.Uint32(path[i*asSize:])
+				}
+			}
+			switch segType {
+			case bgpASSequence:
+				origin, found = strconv.FormatUint(uint64(asns[count-1]), 10), true
+			case bgpASSet:
+				origin, found = asSetString(asns), true
+			default:
+				found = false
+			}
+		}
+		path = path[count*asSize:]
+	}
+	return origin, found
+}
+
+// pathLength returns the length of an AS_PATH for route selection. An
+// AS_PATH of 2-byte ASNs has the length of the path merged with its
+// AS4_PATH (RFC 6793), so it is counted as it is. Confederation segments
+// do not count.
+func pathLength(path []byte, asSize int) int {
+	n := 0
+	for len(path) >= 2 {
+		segType, count := path[0], int(path[1])
+		path = path[2:]
+		if len(path) < count*asSize {
+			break
+		}
+		switch segType {
+		case bgpASSequence:
+			n += count
+		case bgpASSet:
+			if count > 0 {
+				n++
+			}
+		}
+		path = path[count*asSize:]
+	}
+	return n
+}
+
+// originLess orders the origins of RIB entries: ASNs by value, before
+// AS_SETs, which are ordered as text.
+func originLess(a, b string) bool {
+	x, errA := strconv.ParseUint(a, 10, 32)
+	y, errB := strconv.ParseUint(b, 10, 32)
+	switch {
+	case errA == nil && errB == nil:
+		return x < y
+	case errA == nil || errB == nil:
+		return errA == nil
+	}
+	return a < b
+}
+
+// parseNLRIPrefix decodes a length-prefixed NLRI prefix and returns it with
+// the number of bytes it took.
+func parseNLRIPrefix(data []byte, family int) (netip.Prefix, int, error) {
+	if len(data) < 1 {
+		return netip.Prefix{}, 0, errMRTShort
+	}
+	bits := int(data[0])
+	size := (bits + 7) / 8
+	if len(data) < 1+size {
+		return netip.Prefix{}, 0, errMRTShort
+	}
+
+	var addr netip.Addr
+	switch family {
+	case bgpAFIIPv4:
+		var b [4]byte
+		if bits > 32 {
+			return netip.Prefix{}, 0, fmt.Errorf("invalid IPv4 prefix length %d", bits)
+		}
+		copy(b[:], data[1:1+size])
+		addr = netip.AddrFrom4(b)
+	case bgpAFIIPv6:
+		var b [16]byte
+		if bits > 128 {
+			return netip.Prefix{}, 0, fmt.Errorf("invalid IPv6 prefix length %d", bits)
+		}
+		copy(b[:], data[1:1+size])
+		addr = netip.AddrFrom16(b)
+	default:
+		return netip.Prefix{}, 0, fmt.Errorf("unsupported address family %d", family)
+	}
+	return netip.PrefixFrom(addr, bits).Masked(), 1 + size, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// mrtTestRecord returns an MRT record of typ and subtype around body.
+func mrtTestRecord(typ, subtype uint16, body []byte) []byte {
+	hdr := make([]byte, 12)
+	binary.BigEndian.PutUint16(hdr[4:], typ)
+	binary.BigEndian.PutUint16(hdr[6:], subtype)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(body)))
+	return append(hdr, body...)
+}
+
+// mrtTestNLRI encodes prefix as a length-prefixed NLRI prefix.
+func mrtTestNLRI(prefix string) []byte {
+	p := netip.MustParsePrefix(prefix)
+	addr := p.Addr().AsSlice()
+	return append([]byte{byte(p.Bits())}, addr[:(p.Bits()+7)/8]...)
+}
+
+// mrtTestPath returns an AS_PATH attribute of 4-byte ASNs: an AS_SEQUENCE
+// of seq, followed by an AS_SET of set when it is not empty.
+func mrtTestPath(seq []uint32, set []uint32) []byte {
+	var path []byte
+	for _, seg := range []struct {
+		typ  byte
+		asns []uint32
+	}{{bgpASSequence, seq}, {bgpASSet, set}} {
+		if len(seg.asns) == 0 {
+			continue
+		}
+		path = append(path, seg.typ, byte(len(seg.asns)))
+		for _, asn := range seg.asns {
+			path = binary.BigEndian.AppendUint32(path, asn)
+		}
+	}
+	return append([]byte{0x40, bgpAttrASPath, byte(len(path))}, path...)
+}
+
+// mrtTestRIB returns a TABLE_DUMP_V2 RIB record of prefix with an entry per
+// set of attributes, from peers 0, 1, ...
+func mrtTestRIB(prefix string, entries ...[]byte) []byte {
+	subtype := uint16(mrtRIBIPv4Unicast)
+	if netip.MustParsePrefix(prefix).Addr().Is6() {
+		subtype = mrtRIBIPv6Unicast
+	}
+	body := append(make([]byte, 4), mrtTestNLRI(prefix)...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(entries)))
+	for peer, attrs := range entries {
+		body = binary.BigEndian.AppendUint16(body, uint16(peer))
+		body = append(body, 0, 0, 0, 0)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+		body = append(body, attrs...)
+	}
+	return mrtTestRecord(mrtTableDumpV2, subtype, body)
+}
+
+// mrtTestUpdate returns a BGP4MP_MESSAGE_AS4 record of an IPv4 UPDATE from
+// peerAS, withdrawing and announcing the given prefixes with attrs.
+func mrtTestUpdate(peerAS uint32, withdrawn, announced []string, attrs []byte) []byte {
+	body := binary.BigEndian.AppendUint32(nil, peerAS)
+	body = binary.BigEndian.AppendUint32(body, 64496)
+	body = binary.BigEndian.AppendUint16(body, 0)
+	body = binary.BigEndian.AppendUint16(body, bgpAFIIPv4)
+	body = binary.BigEndian.AppendUint32(body, peerAS) // peer IP
+	body = binary.BigEndian.AppendUint32(body, 0)      // local IP
+
+	var update, nlri []byte
+	for _, p := range withdrawn {
+		nlri = append(nlri, mrtTestNLRI(p)...)
+	}
+	update = binary.BigEndian.AppendUint16(update, uint16(len(nlri)))
+	update = append(update, nlri...)
+	update = binary.BigEndian.AppendUint16(update, uint16(len(attrs)))
+	update = append(update, attrs...)
+	for _, p := range announced {
+		update = append(update, mrtTestNLRI(p)...)
+	}
+
+	msg := bytes.Repeat([]byte{0xff}, 16)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(19+len(update)))
+	msg = append(msg, bgpMessageUpdate)
+	return mrtTestRecord(mrtBGP4MP, mrtBGP4MPMessageAS4, append(append(body, msg...), update...))
+}
+
+// readMRTTest returns the rows of an MRT stream and the error ending it,
+// nil at the end of the stream.
+func readMRTTest(data []byte) ([][]string, error) {
+	mr := newMRTReader(bytes.NewReader(data))
+	var rows [][]string
+	for {
+		row, err := mr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+// mrtTests are MRT streams and the rows read from them. They seed
+// FuzzMRTReader.
+var mrtTests = []struct {
+	name  string
+	input []byte
+	want  [][]string
+	err   bool
+}{
+	{
+		name: "rib majority origin",
+		input: mrtTestRIB("1.1.1.0/24",
+			mrtTestPath([]uint32{174, 13335}, nil),
+			mrtTestPath([]uint32{3356, 13335}, nil),
+			mrtTestPath([]uint32{64500, 64501, 64502}, nil)),
+		want: [][]string{{"1.1.1.0/24", "13335", "3", "2"}},
+	},
+	{
+		name: "rib tie takes the lowest asn",
+		input: mrtTestRIB("2001:db8::/32",
+			mrtTestPath([]uint32{174, 200}, nil),
+			mrtTestPath([]uint32{100}, nil)),
+		want: [][]string{{"2001:db8::/32", "100", "2", "1"}},
+	},
+	{
+		name:  "rib as set origin",
+		input: mrtTestRIB("9.9.9.0/24", mrtTestPath([]uint32{174}, []uint32{64512, 64513})),
+		want:  [][]string{{"9.9.9.0/24", "{64512,64513}", "1", "2"}},
+	},
+	{
+		name:  "rib without origin",
+		input: mrtTestRIB("9.9.8.0/24", nil),
+	},
+	{
+		name: "updates and withdrawal",
+		input: bytes.Join([][]byte{
+			mrtTestUpdate(174, nil, []string{"8.8.8.0/24"}, mrtTestPath([]uint32{174, 15169}, nil)),
+			mrtTestUpdate(15169, nil, []string{"8.8.8.0/24"}, mrtTestPath([]uint32{15169}, nil)),
+			mrtTestUpdate(174, []string{"8.8.8.0/24"}, nil, nil),
+		}, nil),
+		want: [][]string{
+			{"8.8.8.0/24", "15169", "1", "2"},
+			{"8.8.8.0/24", "15169", "2", "1"},
+			{"8.8.8.0/24", "15169", "1", "1"},
+		},
+	},
+	{
+		name:  "other record types",
+		input: mrtTestRecord(12, 1, []byte{1, 2, 3}),
+	},
+	{
+		name:  "truncated header",
+		input: mrtTestRIB("1.1.1.0/24", mrtTestPath([]uint32{13335}, nil))[:5],
+		err:   true,
+	},
+	{
+		name:  "truncated record",
+		input: mrtTestRIB("1.1.1.0/24", mrtTestPath([]uint32{13335}, nil))[:20],
+		err:   true,
+	},
+	{
+		name:  "short rib record",
+		input: mrtTestRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, []byte{0, 0, 0, 0, 24, 1}),
+		err:   true,
+	},
+	{
+		name:  "invalid prefix length",
+		input: mrtTestRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, []byte{0, 0, 0, 0, 33, 1, 1, 1, 1, 1, 0, 0}),
+		err:   true,
+	},
+}
+
+func TestMRTReader(t *testing.T) {
+	for _, tt := range mrtTests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := readMRTTest(tt.input)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("got rows %q, want %q", rows, tt.want)
+			}
+		})
+	}
+}
+
+// A corrupt record length is refused before its body is allocated.
+func TestMRTReaderRecordLength(t *testing.T) {
+	hdr := mrtTestRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, nil)
+	binary.BigEndian.PutUint32(hdr[8:], 0xffffffff)
+	mr := newMRTReader(io.MultiReader(bytes.NewReader(hdr), errReader{}))
+	if _, err := mr.Read(); err == nil || errors.Is(err, errTestRead) {
+		t.Errorf("got error %v, want the record length refused", err)
+	}
+}
+
+var errTestRead = errors.New("read past the header")
+
+// errReader fails every read.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errTestRead }
+
+func FuzzMRTReader(f *testing.F) {
+	for _, tt := range mrtTests {
+		f.Add(tt.input)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rows, _ := readMRTTest(data)
+		for _, row := range rows {
+			if len(row) != 4 {
+				t.Fatalf("got row %q, want 4 columns", row)
+			}
+			if _, err := netip.ParsePrefix(row[0]); err != nil {
+				t.Fatalf("got row %q: %v", row, err)
+			}
+			if _, _, err := parseOrigin(row[1]); err != nil {
+				t.Fatalf("got row %q: %v", row, err)
+			}
+		}
+	})
+}
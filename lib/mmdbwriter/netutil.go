@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+)
+
+// networkRange returns the first and last address of network, both in
+// 16-byte form so that IPv4 and IPv6 ranges sort together (IPv4 addresses
+// are IPv4-mapped).
+func networkRange(network *net.IPNet) (first, last net.IP) {
+	first = network.IP.Mask(network.Mask).To16()
+	last = make(net.IP, net.IPv6len)
+	copy(last, first)
+
+	ones, bits := network.Mask.Size()
+	hostBits := bits - ones
+	for i := net.IPv6len - 1; i >= 0 && hostBits > 0; i-- {
+		if hostBits >= 8 {
+			last[i] = 0xff
+			hostBits -= 8
+		} else {
+			last[i] |= byte(1<<hostBits) - 1
+			hostBits = 0
+		}
+	}
+	return first, last
+}
+
+// isIPv4Network reports whether network was written as an IPv4 network,
+// as opposed to an IPv6 one, including IPv4-mapped ::ffff:a.b.c.d/n.
+func isIPv4Network(network *net.IPNet) bool {
+	_, bits := network.Mask.Size()
+	return bits == 32
+}
+
+// excludesFamily reports whether -only-ipv4 or -only-ipv6 leaves prefix
+// out of the build. IPv4-mapped prefixes are IPv6, as in isIPv4Network.
+func excludesFamily(cfg *config, prefix netip.Prefix) bool {
+	if cfg.onlyIPv4 {
+		return !prefix.Addr().Is4()
+	}
+	if cfg.onlyIPv6 {
+		return prefix.Addr().Is4()
+	}
+	return false
+}
+
+// prefixNetwork converts a prefix to the network mmdbwriter takes.
+func prefixNetwork(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())}
+}
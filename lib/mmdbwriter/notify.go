@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Payload formats of -notify-format.
+const (
+	notifyJSON  = "json"
+	notifySlack = "slack"
+)
+
+// buildNotifier keeps what -notify-url reports about the build in progress
+// and the record count of the last successful one, for the shrink warning.
+type buildNotifier struct {
+	summary         map[string]any
+	previousRecords int
+	havePrevious    bool
+}
+
+// newBuildNotifier returns the notifier of a run. The record count of the
+// build before it is taken from the -manifest of the output when there is
+// one, so scheduled one-shot builds are compared too.
+func newBuildNotifier(cfg *config) *buildNotifier {
+	n := &buildNotifier{}
+	if cfg.outputFile == stdioPath {
+		return n
+	}
+	data, err := os.ReadFile(cfg.outputFile + manifestSuffix)
+	if err != nil {
+		return n
+	}
+	var manifest buildManifest
+	if json.Unmarshal(data, &manifest) != nil {
+		return n
+	}
+	if records, ok := manifest.Summary["records"]; ok {
+		n.previousRecords, n.havePrevious = records, true
+	}
+	return n
+}
+
+// buildNotification is the body POSTed to -notify-url in the json format.
+type buildNotification struct {
+	Status          string         `json:"status"`
+	Input           string         `json:"input"`
+	Output          string         `json:"output"`
+	BuildTime       string         `json:"build_time"`
+	DryRun          bool           `json:"dry_run,omitempty"`
+	Error           string         `json:"error,omitempty"`
+	Summary         map[string]any `json:"summary,omitempty"`
+	PreviousRecords *int           `json:"previous_records,omitempty"`
+	Warnings        []string       `json:"warnings,omitempty"`
+}
+
+func validateNotify(cfg *config) error {
+	if cfg.notifyFormat != notifyJSON && cfg.notifyFormat != notifySlack {
+		return fmt.Errorf("invalid -notify-format %q: must be %s or %s", cfg.notifyFormat, notifyJSON, notifySlack)
+	}
+	if cfg.notifyShrinkPercent < 0 || cfg.notifyShrinkPercent > 100 {
+		return fmt.Errorf("-notify-shrink-percent must be between 0 and 100, got %g", cfg.notifyShrinkPercent)
+	}
+	return nil
+}
+
+// recordSummary keeps the key/value pairs of the build summary.
+func (n *buildNotifier) recordSummary(attrs []any) {
+	n.summary = map[string]any{}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if key, ok := attrs[i].(string); ok {
+			n.summary[key] = attrs[i+1]
+		}
+	}
+}
+
+// notifyBuild POSTs the outcome of a build to -notify-url: its summary, or
+// err when it failed. Failures to notify are reported but do not fail the
+// build.
+func notifyBuild(cfg *config, err error) {
+	n := cfg.notifier
+	if n == nil {
+		return
+	}
+	summary := n.summary
+	n.summary = nil
+
+	note := buildNotification{
+		Status:    "success",
+		Input:     cfg.csvFile,
+		Output:    cfg.outputFile,
+		BuildTime: cfg.buildTime.UTC().Format(time.RFC3339),
+		DryRun:    cfg.dryRun,
+	}
+	if err != nil {
+		note.Status = "failure"
+		note.Error = err.Error()
+	} else {
+		note.Summary = summary
+		records, _ := summary["records"].(int)
+		if records == 0 {
+			note.Warnings = append(note.Warnings, "the build has no records")
+		}
+		if n.havePrevious {
+			previous := n.previousRecords
+			note.PreviousRecords = &previous
+			if previous > 0 && records > 0 {
+				if drop := 100 * float64(previous-records) / float64(previous); drop >= cfg.notifyShrinkPercent && drop > 0 {
+					note.Warnings = append(note.Warnings,
+						fmt.Sprintf("records dropped by %.1f%% since the previous build (%d to %d)", drop, previous, records))
+				}
+			}
+		}
+		n.previousRecords, n.havePrevious = records, true
+	}
+
+	if err := postNotification(cfg, note); err != nil {
+		logger.Warn("build notification failed", "url", cfg.notifyURL, "error", err)
+		return
+	}
+	logger.Info("build notification sent", "url", cfg.notifyURL, "status", note.Status)
+}
+
+func postNotification(cfg *config, note buildNotification) error {
+	var payload any = note
+	if cfg.notifyFormat == notifySlack {
+		payload = map[string]string{"text": note.slackText()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.notifyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", cfg.userAgent)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return nil
+}
+
+// slackText is the message of a Slack incoming webhook: one line with the
+// outcome, followed by the warnings.
+func (n buildNotification) slackText() string {
+	var b strings.Builder
+	kind := "build"
+	if n.DryRun {
+		kind = "dry run"
+	}
+	if n.Status == "failure" {
+		fmt.Fprintf(&b, ":x: mmdbwriter %s of %s failed: %s", kind, n.Output, n.Error)
+		return b.String()
+	}
+	icon := ":white_check_mark:"
+	if len(n.Warnings) > 0 {
+		icon = ":warning:"
+	}
+	fmt.Fprintf(&b, "%s mmdbwriter %s of %s succeeded: %v records, %v skipped", icon, kind, n.Output,
+		n.Summary["records"], n.Summary["skipped"])
+	if n.PreviousRecords != nil {
+		fmt.Fprintf(&b, " (previously %d)", *n.PreviousRecords)
+	}
+	for _, w := range n.Warnings {
+		fmt.Fprintf(&b, "\n• %s", w)
+	}
+	return b.String()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// maxReportedOrglessASNs caps the list printed by -report-orgless-asns.
+const maxReportedOrglessASNs = 50
+
+// orglessASNs returns, in ascending order, the ASNs that never appeared with
+// an organization. seen maps each ASN to whether any row had an org for it.
+func orglessASNs(seen map[uint32]bool) []uint32 {
+	var asns []uint32
+	for asn, hasOrg := range seen {
+		if !hasOrg {
+			asns = append(asns, asn)
+		}
+	}
+	slices.Sort(asns)
+	return asns
+}
+
+func printOrglessASNs(asns []uint32, total int) {
+	if len(asns) == 0 {
+		logger.Info("ASNs without any organization", "count", 0, "total", total)
+		return
+	}
+
+	shown := asns
+	if len(shown) > maxReportedOrglessASNs {
+		shown = shown[:maxReportedOrglessASNs]
+	}
+	parts := make([]string, len(shown))
+	for i, asn := range shown {
+		parts[i] = fmt.Sprintf("AS%d", asn)
+	}
+	list := strings.Join(parts, ", ")
+	if len(asns) > len(shown) {
+		list += fmt.Sprintf(", ... and %d more", len(asns)-len(shown))
+	}
+	logger.Info("ASNs without any organization", "count", len(asns), "total", total, "asns", list)
+}
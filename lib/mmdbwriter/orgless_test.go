@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrglessASNs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []uint32
+	}{
+		{
+			name:  "every ASN has an org",
+			input: "network,asn,org\n1.1.1.0/24,13335,Cloudflare\n8.8.8.0/24,15169,Google\n",
+		},
+		{
+			name:  "an org on any row counts",
+			input: "network,asn,org\n1.1.1.0/24,13335,\n1.0.0.0/24,13335,Cloudflare\n",
+		},
+		{
+			name:  "orgless ASNs are sorted",
+			input: "network,asn,org\n9.9.9.0/24,19281,\n8.8.8.0/24,15169,\n1.1.1.0/24,13335,Cloudflare\n",
+			want:  []uint32{15169, 19281},
+		},
+		{
+			name:  "ASN 0 is left out",
+			input: "network,asn,org\n23.128.0.0/10,0,\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, stats := buildTestDB(t, testConfig(t, "-report-orgless-asns"), tt.input)
+			if got := orglessASNs(stats.asnHasOrg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
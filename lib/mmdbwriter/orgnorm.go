@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Steps of -org-normalize.
+const (
+	orgNormWhitespace  = "whitespace"
+	orgNormLegalSuffix = "legal-suffix"
+	orgNormASCII       = "ascii"
+)
+
+// orgRawField keeps the organization as it was before -org-normalize
+// changed it.
+const orgRawField = "autonomous_system_organization_raw"
+
+// orgNormalize implements flag.Value for -org-normalize, a comma-separated
+// list of steps. The steps always run in the order ascii, whitespace,
+// legal-suffix, whatever the order of the list.
+type orgNormalize struct {
+	whitespace, legalSuffix, ascii bool
+}
+
+func (o *orgNormalize) String() string {
+	var parts []string
+	if o.whitespace {
+		parts = append(parts, orgNormWhitespace)
+	}
+	if o.legalSuffix {
+		parts = append(parts, orgNormLegalSuffix)
+	}
+	if o.ascii {
+		parts = append(parts, orgNormASCII)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (o *orgNormalize) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(part)) {
+		case orgNormWhitespace:
+			o.whitespace = true
+		case orgNormLegalSuffix:
+			o.legalSuffix = true
+		case orgNormASCII:
+			o.ascii = true
+		case "all":
+			*o = orgNormalize{true, true, true}
+		default:
+			return fmt.Errorf("unknown step %q (want %s, %s, %s or all)", part, orgNormWhitespace, orgNormLegalSuffix, orgNormASCII)
+		}
+	}
+	return nil
+}
+
+// enabled reports whether any step is set.
+func (o orgNormalize) enabled() bool {
+	return o != orgNormalize{}
+}
+
+// apply returns org with the steps applied. A name that would become empty
+// is returned as it is.
+func (o orgNormalize) apply(org string) string {
+	s := org
+	if o.ascii {
+		s = transliterate(s)
+	}
+	if o.whitespace || o.legalSuffix {
+		s = strings.Join(strings.Fields(s), " ")
+	}
+	if o.legalSuffix {
+		s = trimLegalSuffixes(s)
+	}
+	if s == "" {
+		return org
+	}
+	return s
+}
+
+// legalSuffixes are the company forms -org-normalize legal-suffix removes
+// from the end of a name, compared case-insensitively and without dots.
+// Forms that are also common words, such as the Norwegian AS, are left
+// out.
+var legalSuffixes = []string{
+	"inc", "incorporated", "llc", "llp", "lp", "ltd", "limited", "pty ltd",
+	"co ltd", "co", "corp", "corporation", "plc", "gmbh",
+	"gmbh & co kg", "ag", "kg", "ev", "sa", "sas", "sarl", "srl", "spa",
+	"sp z oo", "bv", "nv", "oy", "oyj", "ab", "aps", "a/s", "kk", "sro",
+	"llc fz", "jsc", "pjsc", "ooo", "zao", "oao",
+}
+
+// trimLegalSuffixes removes legal suffixes, and the comma or space before
+// them, from the end of name until none is left, keeping at least one word.
+func trimLegalSuffixes(name string) string {
+	for {
+		trimmed := trimLegalSuffix(name)
+		if trimmed == name {
+			return name
+		}
+		name = trimmed
+	}
+}
+
+func trimLegalSuffix(name string) string {
+	words := strings.Fields(name)
+	// The longest suffix first: "Co Ltd" before "Ltd".
+	for n := min(4, len(words)-1); n >= 1; n-- {
+		tail := strings.ToLower(strings.Join(words[len(words)-n:], " "))
+		tail = strings.NewReplacer(".", "", "(", "", ")", "").Replace(tail)
+		for _, suffix := range legalSuffixes {
+			if tail == suffix {
+				rest := strings.Join(words[:len(words)-n], " ")
+				return strings.TrimRight(rest, " ,-&")
+			}
+		}
+	}
+	return name
+}
+
+// asciiFolds are the letters transliterate replaces that have no
+// decomposition into an ASCII letter and combining marks.
+var asciiFolds = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "Th", 'ł': "l",
+	'Ł': "L", 'ı': "i", 'ħ': "h", 'Ħ': "H",
+	'‘': "'", '’': "'", '“': "\"", '”': "\"", '–': "-", '—': "-", '…': "...",
+}
+
+// transliterate folds Latin letters with diacritics to ASCII, e.g.
+// "Telefónica Deutschland" to "Telefonica Deutschland", by decomposing them
+// and dropping the combining marks of ASCII letters. Characters of other
+// scripts have no ASCII form and are kept with their marks.
+func transliterate(s string) string {
+	var b strings.Builder
+	base := rune(0)
+	for _, r := range norm.NFKD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			if base >= utf8.RuneSelf {
+				b.WriteRune(r)
+			}
+			continue
+		}
+		base = r
+		if fold, ok := asciiFolds[r]; ok {
+			b.WriteString(fold)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	// Kept characters are composed again.
+	return norm.NFC.String(b.String())
+}
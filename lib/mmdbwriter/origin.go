@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// parseOrigin parses the asn column of a row with mmdbbuild.ParseOrigin,
+// which AddCSV of the library shares, widening the ASN to the type the
+// row builder keeps it in.
+func parseOrigin(s string) (uint64, []uint32, error) {
+	asn, set, err := mmdbbuild.ParseOrigin(s)
+	return uint64(asn), set, err
+}
+
+// asSetString formats the members of an AS_SET as parseOrigin reads them.
+func asSetString(set []uint32) string {
+	parts := make([]string, len(set))
+	for i, asn := range set {
+		parts[i] = strconv.FormatUint(uint64(asn), 10)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
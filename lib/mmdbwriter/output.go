@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Output formats accepted by -output-format.
+const (
+	outputFormatMMDB    = "mmdb"
+	outputFormatSQLite  = "sqlite"
+	outputFormatParquet = "parquet"
+	outputFormatJSONL   = "jsonl"
+)
+
+// errNoSQLite is returned by the SQLite outputs when the binary is built
+// without -tags sqlite.
+var errNoSQLite = errors.New("SQLite support is not compiled in; rebuild with -tags sqlite")
+
+// validateOutputFormat checks -output-format against the other output
+// options. The outputs of a sink, such as a SQLite database or Parquet
+// file, have to be written to a file in one piece.
+func validateOutputFormat(cfg *config) error {
+	switch cfg.outputFormat {
+	case outputFormatMMDB:
+		return nil
+	case outputFormatSQLite:
+		if !sqliteSupported {
+			return errNoSQLite
+		}
+	case outputFormatParquet, outputFormatJSONL:
+	default:
+		return fmt.Errorf("unknown -output-format %q (want %s, %s, %s or %s)",
+			cfg.outputFormat, outputFormatMMDB, outputFormatSQLite, outputFormatParquet, outputFormatJSONL)
+	}
+
+	switch {
+	case cfg.outputFile == stdioPath:
+		return fmt.Errorf("-output-format %s cannot be written to stdout", cfg.outputFormat)
+	case cfg.shardMaxSize > 0:
+		return fmt.Errorf("-shard-max-size cannot be used with -output-format %s", cfg.outputFormat)
+	}
+	return nil
+}
+
+// writeOutput writes the serialized database to path, creating the output
+// directory if needed. The database is written to a temporary file next to
+// path, synced to disk and renamed over path, so readers only ever see a
+// complete file: a build that fails, or is retried, leaves the previous
+// output in place and removes its temporary file. size reports the number
+// of bytes the database needs and is only called to explain an
+// out-of-space failure. Cancelling ctx fails the write the same way.
+func writeOutput(ctx context.Context, path string, output io.WriterTo, size func() int64) error {
+	outputDir := filepath.Dir(path)
+	if outputDir != "." {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return outputError("failed to create output directory", outputDir, err, size)
+		}
+	}
+
+	fh, err := os.CreateTemp(outputDir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return outputError("failed to create MMDB file", outputDir, err, size)
+	}
+	defer os.Remove(fh.Name())
+
+	if _, err := output.WriteTo(contextWriter{ctx, fh}); err != nil {
+		fh.Close()
+		return outputError("failed to write MMDB file", outputDir, err, size)
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return outputError("failed to sync MMDB file", outputDir, err, size)
+	}
+	if err := fh.Close(); err != nil {
+		return outputError("failed to write MMDB file", outputDir, err, size)
+	}
+	// CreateTemp makes the file private; match the mode of os.Create.
+	if err := os.Chmod(fh.Name(), 0644); err != nil {
+		return outputError("failed to write MMDB file", outputDir, err, size)
+	}
+	if err := os.Rename(fh.Name(), path); err != nil {
+		return outputError("failed to replace MMDB file", outputDir, err, size)
+	}
+	return nil
+}
+
+// pendingFile is a side file of a build written to tmp, which replaces
+// the file at path once the build passed its checks.
+type pendingFile struct {
+	tmp, path string
+}
+
+// commit renames the file into place.
+func (f pendingFile) commit() error {
+	if err := os.Rename(f.tmp, f.path); err != nil {
+		os.Remove(f.tmp)
+		return fmt.Errorf("failed to replace %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// outputError turns the common filesystem failures of automated
+// environments into actionable messages.
+func outputError(action, dir string, err error, size func() int64) error {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		need := size()
+		return fmt.Errorf("%s: no space left on device in %s, need ~%d bytes (%.1f MB): %w",
+			action, dir, need, float64(need)/(1<<20), err)
+	case errors.Is(err, syscall.EROFS):
+		return fmt.Errorf("%s: output directory %s is read-only: %w", action, dir, err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%s: output directory %s is not writable (permission denied): %w", action, dir, err)
+	}
+	return fmt.Errorf("%s: %w", action, err)
+}
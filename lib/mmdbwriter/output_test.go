@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// writerToFunc adapts a function to io.WriterTo.
+type writerToFunc func(w io.Writer) (int64, error)
+
+func (f writerToFunc) WriteTo(w io.Writer) (int64, error) {
+	return f(w)
+}
+
+// writeString returns an output writing s, then failing with err if set.
+func writeString(s string, err error) io.WriterTo {
+	return writerToFunc(func(w io.Writer) (int64, error) {
+		n, werr := io.WriteString(w, s)
+		if werr != nil {
+			return int64(n), werr
+		}
+		return int64(n), err
+	})
+}
+
+func TestWriteOutput(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		previous string
+		output   io.WriterTo
+		wantErr  bool
+		want     string
+	}{
+		{name: "new file", output: writeString("new", nil), want: "new"},
+		{name: "replaces the previous output", previous: "old", output: writeString("new", nil), want: "new"},
+		{
+			name:     "failed write keeps the previous output",
+			previous: "old",
+			output:   writeString("partial", errors.New("serialization failed")),
+			wantErr:  true,
+			want:     "old",
+		},
+		{
+			name:     "cancelled write keeps the previous output",
+			ctx:      cancelled,
+			previous: "old",
+			output:   writeString("new", nil),
+			wantErr:  true,
+			want:     "old",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "sub", "asn.mmdb")
+			if tt.previous != "" {
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(tt.previous), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			err := writeOutput(ctx, path, tt.output, func() int64 { return 0 })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+				t.Errorf("got mode %v (%v), want 0644", info.Mode().Perm(), err)
+			}
+			entries, err := os.ReadDir(filepath.Dir(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("got %d files in the output directory, want only the output", len(entries))
+			}
+		})
+	}
+}
+
+func TestOutputError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, "no space left on device in out, need ~2097152 bytes (2.0 MB)"},
+		{&os.PathError{Op: "open", Path: "x", Err: syscall.EROFS}, "output directory out is read-only"},
+		{&os.PathError{Op: "open", Path: "x", Err: syscall.EACCES}, "output directory out is not writable (permission denied)"},
+		{errors.New("boom"), "failed to write MMDB file: boom"},
+	}
+	for _, tt := range tests {
+		err := outputError("failed to write MMDB file", "out", tt.err, func() int64 { return 2 << 20 })
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("got %q, want it to contain %q", err, tt.want)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%q does not wrap %v", err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// parquetRowGroupRows is the number of rows per row group, small enough
+// for readers to split a file between workers.
+const parquetRowGroupRows = 1 << 17
+
+// parquetFields are the record fields exported as columns of the same
+// name, after the columns describing the network.
+var parquetFields = []struct {
+	field string
+	typ   arrow.DataType
+}{
+	{"autonomous_system_number", arrow.PrimitiveTypes.Int64},
+	{"autonomous_system_organization", arrow.BinaryTypes.String},
+	{"autonomous_system_organization_hash", arrow.BinaryTypes.String},
+	{"autonomous_system_numbers", arrow.ListOfNonNullable(arrow.PrimitiveTypes.Int64)},
+	{"autonomous_system_country", arrow.BinaryTypes.String},
+	{"rpki_status", arrow.BinaryTypes.String},
+	{"country", arrow.BinaryTypes.String},
+	{"rir", arrow.BinaryTypes.String},
+	{"allocated_at", arrow.PrimitiveTypes.Int64},
+	{"announced", arrow.FixedWidthTypes.Boolean},
+	{"first_seen", arrow.PrimitiveTypes.Int64},
+	{"route_visibility", arrow.PrimitiveTypes.Int64},
+	{"visibility", arrow.PrimitiveTypes.Int64},
+	{"path_length", arrow.PrimitiveTypes.Int64},
+	{"expires", arrow.PrimitiveTypes.Int64},
+	{"is_aggregate", arrow.FixedWidthTypes.Boolean},
+	{"is_bogon", arrow.FixedWidthTypes.Boolean},
+	{"bogon_type", arrow.BinaryTypes.String},
+	{"is_ixp", arrow.FixedWidthTypes.Boolean},
+	{"ixp_name", arrow.BinaryTypes.String},
+	{"is_anycast", arrow.FixedWidthTypes.Boolean},
+	{"geo_country", arrow.BinaryTypes.String},
+	{"geo_region", arrow.BinaryTypes.String},
+	{"geo_city", arrow.BinaryTypes.String},
+	{"upstreams", arrow.ListOfNonNullable(arrow.PrimitiveTypes.Int64)},
+	{"peers", arrow.ListOfNonNullable(arrow.PrimitiveTypes.Int64)},
+	{"reverse_dns", arrow.BinaryTypes.String},
+}
+
+// parquetColumnNames renames the two ASN fields whose record keys are
+// needlessly long for SQL.
+var parquetColumnNames = map[string]string{
+	"autonomous_system_number":       "asn",
+	"autonomous_system_organization": "org",
+}
+
+// networkSchema returns the Arrow schema of the networks of the Parquet
+// output and the Arrow export, with metadata as its key-value metadata.
+func networkSchema(metadata map[string]string) *arrow.Schema {
+	fields := []arrow.Field{
+		{Name: "prefix", Type: arrow.BinaryTypes.String},
+		{Name: "ip_version", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "network_start", Type: &arrow.FixedSizeBinaryType{ByteWidth: net.IPv6len}},
+		{Name: "network_end", Type: &arrow.FixedSizeBinaryType{ByteWidth: net.IPv6len}},
+		{Name: "ipv4_start", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		{Name: "ipv4_end", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+	}
+	for _, f := range parquetFields {
+		name := f.field
+		if n, ok := parquetColumnNames[name]; ok {
+			name = n
+		}
+		fields = append(fields, arrow.Field{Name: name, Type: f.typ, Nullable: true})
+	}
+	keys := slices.Sorted(maps.Keys(metadata))
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = metadata[k]
+	}
+	md := arrow.NewMetadata(keys, values)
+	return arrow.NewSchema(fields, &md)
+}
+
+// networkBuilder appends networks as rows of networkSchema.
+type networkBuilder struct {
+	b    *array.RecordBuilder
+	rows int
+}
+
+func newNetworkBuilder(schema *arrow.Schema) *networkBuilder {
+	return &networkBuilder{b: array.NewRecordBuilder(memory.DefaultAllocator, schema)}
+}
+
+func (nb *networkBuilder) add(network *net.IPNet, record mmdbtype.Map) {
+	first, last := networkRange(network)
+	version := int32(6)
+	if isIPv4Network(network) {
+		version = 4
+	}
+	nb.b.Field(0).(*array.StringBuilder).Append(network.String())
+	nb.b.Field(1).(*array.Int32Builder).Append(version)
+	nb.b.Field(2).(*array.FixedSizeBinaryBuilder).Append(first)
+	nb.b.Field(3).(*array.FixedSizeBinaryBuilder).Append(last)
+	for i, ip := range []net.IP{first, last} {
+		b := nb.b.Field(4 + i).(*array.Int64Builder)
+		if version == 4 {
+			b.Append(int64(binary.BigEndian.Uint32(ip[12:])))
+		} else {
+			b.AppendNull()
+		}
+	}
+	for i, f := range parquetFields {
+		appendRecordField(nb.b.Field(6+i), record[mmdbtype.String(f.field)])
+	}
+	nb.rows++
+}
+
+// appendRecordField appends the record value v of a column, null when the
+// record does not have it or it has another type.
+func appendRecordField(b array.Builder, v mmdbtype.DataType) {
+	switch b := b.(type) {
+	case *array.Int64Builder:
+		if n, ok := mmdbInt(v); ok {
+			b.Append(n)
+			return
+		}
+	case *array.BooleanBuilder:
+		if v, ok := v.(mmdbtype.Bool); ok {
+			b.Append(bool(v))
+			return
+		}
+	case *array.StringBuilder:
+		if v, ok := v.(mmdbtype.String); ok {
+			b.Append(string(v))
+			return
+		}
+	case *array.ListBuilder:
+		if s, ok := v.(mmdbtype.Slice); ok {
+			b.Append(true)
+			elems := b.ValueBuilder().(*array.Int64Builder)
+			for _, e := range s {
+				if n, ok := mmdbInt(e); ok {
+					elems.Append(n)
+				}
+			}
+			return
+		}
+	}
+	b.AppendNull()
+}
+
+// newRecord returns the rows added since the last call as a record, which
+// the caller releases.
+func (nb *networkBuilder) newRecord() arrow.Record {
+	nb.rows = 0
+	return nb.b.NewRecord()
+}
+
+func (nb *networkBuilder) release() {
+	nb.b.Release()
+}
+
+func mmdbInt(v mmdbtype.DataType) (int64, bool) {
+	switch v := v.(type) {
+	case mmdbtype.Uint16:
+		return int64(v), true
+	case mmdbtype.Uint32:
+		return int64(v), true
+	case mmdbtype.Int32:
+		return int64(v), true
+	case mmdbtype.Uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// parquetSink writes the networks of a built database to a Parquet file
+// for -output-format parquet: one row per network of the final tree, like
+// -output-format sqlite, with the metadata of the build as key-value
+// metadata. The rows are built as Arrow records and written by pqarrow, a
+// row group per record. The file is built next to its path and renamed
+// over it.
+type parquetSink struct {
+	path, tmp string
+	fh        *os.File
+	bw        *bufio.Writer
+	fw        *pqarrow.FileWriter
+	nb        *networkBuilder
+}
+
+func newParquetSink(t sinkTarget) (outputSink, error) {
+	outputDir := filepath.Dir(t.path)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	tmp := filepath.Join(outputDir, "."+filepath.Base(t.path)+".tmp")
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Parquet file: %w", err)
+	}
+
+	kv := maps.Clone(t.extra)
+	if kv == nil {
+		kv = map[string]string{}
+	}
+	kv["database_type"] = t.metadata.DatabaseType
+	kv["build_epoch"] = strconv.FormatUint(uint64(t.metadata.BuildEpoch), 10)
+	schema := networkSchema(kv)
+
+	s := &parquetSink{path: t.path, tmp: tmp, fh: fh, bw: bufio.NewWriterSize(fh, 1<<20)}
+	props := parquet.NewWriterProperties(
+		parquet.WithCompression(compress.Codecs.Snappy),
+		parquet.WithMaxRowGroupLength(parquetRowGroupRows),
+		parquet.WithCreatedBy("mmdbwriter"))
+	s.fw, err = pqarrow.NewFileWriter(schema, s.bw, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		fh.Close()
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to write Parquet file: %w", err)
+	}
+	s.nb = newNetworkBuilder(schema)
+	return s, nil
+}
+
+func (s *parquetSink) add(network *net.IPNet, record mmdbtype.Map) error {
+	s.nb.add(network, record)
+	if s.nb.rows == parquetRowGroupRows {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush writes the pending rows as a row group.
+func (s *parquetSink) flush() error {
+	if s.nb.rows == 0 {
+		return nil
+	}
+	rec := s.nb.newRecord()
+	defer rec.Release()
+	if err := s.fw.Write(rec); err != nil {
+		return fmt.Errorf("failed to write Parquet file: %w", err)
+	}
+	return nil
+}
+
+func (s *parquetSink) close() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.fw.Close(); err != nil {
+		return fmt.Errorf("failed to write Parquet file: %w", err)
+	}
+	if err := s.bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write Parquet file: %w", err)
+	}
+	if err := s.fh.Close(); err != nil {
+		return fmt.Errorf("failed to write Parquet file: %w", err)
+	}
+	if err := os.Rename(s.tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace Parquet file: %w", err)
+	}
+	s.nb.release()
+	return nil
+}
+
+func (s *parquetSink) abort() {
+	s.nb.release()
+	s.fh.Close()
+	os.Remove(s.tmp)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// writeParquetTest writes rows with the -output-format parquet sink and
+// returns the path of the file.
+func writeParquetTest(t testing.TB, rows int, row func(i int) (string, mmdbtype.Map)) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "asn.parquet")
+	sink, err := newParquetSink(sinkTarget{
+		path:     path,
+		metadata: maxminddb.Metadata{DatabaseType: "BGP-Tools-ASN", BuildEpoch: 1700000000},
+		extra:    map[string]string{"source": "table.jsonl"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range rows {
+		network, record := row(i)
+		if err := sink.add(exportTestNetwork(t, network), record); err != nil {
+			sink.abort()
+			t.Fatal(err)
+		}
+	}
+	if err := sink.close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readParquetTest decodes a Parquet file with the reader of the Arrow
+// project and returns it as one record, with the file for its metadata.
+func readParquetTest(t testing.TB, path string) (*file.Reader, arrow.Record) {
+	t.Helper()
+	pf, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pf.Close() })
+	fr, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := fr.ReadTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Release()
+	tr := array.NewTableReader(table, max(table.NumRows(), 1))
+	defer tr.Release()
+	if !tr.Next() {
+		t.Fatal("no rows")
+	}
+	rec := tr.Record()
+	rec.Retain()
+	t.Cleanup(rec.Release)
+	return pf, rec
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	path := writeParquetTest(t, len(exportTestRows), func(i int) (string, mmdbtype.Map) {
+		return exportTestRows[i].network, exportTestRows[i].record
+	})
+	pf, rec := readParquetTest(t, path)
+
+	kv := pf.MetaData().KeyValueMetadata()
+	for _, want := range [][2]string{{"database_type", "BGP-Tools-ASN"}, {"build_epoch", "1700000000"}, {"source", "table.jsonl"}} {
+		if got := kv.FindValue(want[0]); got == nil || *got != want[1] {
+			t.Errorf("got metadata %s %v, want %q", want[0], got, want[1])
+		}
+	}
+	for _, name := range []string{"prefix", "ip_version", "network_start", "network_end"} {
+		if i := pf.MetaData().Schema.ColumnIndexByName(name); i < 0 {
+			t.Errorf("no column %s", name)
+		} else if col := pf.MetaData().Schema.Column(i); col.MaxDefinitionLevel() != 0 {
+			t.Errorf("column %s is not required", name)
+		}
+	}
+
+	if rec.NumRows() != int64(len(exportTestRows)) {
+		t.Fatalf("got %d rows, want %d", rec.NumRows(), len(exportTestRows))
+	}
+	for i, row := range exportTestRows {
+		checkExportRecord(t, rec, i, row.want)
+	}
+}
+
+func TestParquetRowGroups(t *testing.T) {
+	rows := parquetRowGroupRows + 3
+	path := writeParquetTest(t, rows, func(i int) (string, mmdbtype.Map) {
+		record := mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(i)}
+		if i%2 == 0 {
+			record["upstreams"] = mmdbtype.Slice{mmdbtype.Uint32(i), mmdbtype.Uint32(i + 1)}
+		}
+		return arrowTestPrefix(i), record
+	})
+	pf, rec := readParquetTest(t, path)
+
+	if pf.NumRowGroups() != 2 {
+		t.Errorf("got %d row groups, want 2", pf.NumRowGroups())
+	}
+	if rec.NumRows() != int64(rows) {
+		t.Fatalf("got %d rows, want %d", rec.NumRows(), rows)
+	}
+	upstreams := rec.Schema().FieldIndices("upstreams")[0]
+	for _, i := range []int{0, 1, parquetRowGroupRows - 1, parquetRowGroupRows, rows - 1} {
+		if got := arrowValue(t, rec.Column(0), i); got != arrowTestPrefix(i) {
+			t.Errorf("row %d: got prefix %v", i, got)
+		}
+		if got := arrowValue(t, rec.Column(6), i); got != int64(i) {
+			t.Errorf("row %d: got asn %v", i, got)
+		}
+		got, _ := arrowValue(t, rec.Column(upstreams), i).([]int64)
+		if (i%2 == 0) != (len(got) == 2) {
+			t.Errorf("row %d: got upstreams %v", i, got)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/inserter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// Actions of a -patch row.
+const (
+	patchAdd     = "add"
+	patchReplace = "replace"
+	patchDelete  = "delete"
+)
+
+// patchRow is one correction of a -patch file. Delete rows have no record.
+type patchRow struct {
+	action string
+	line   int
+	prefix netip.Prefix
+	record mmdbtype.Map
+}
+
+// patchStats counts the -patch rows applied by action.
+type patchStats struct {
+	added, replaced, deleted int
+}
+
+// loadPatch reads a -patch file: a CSV file whose first column is the
+// action and whose other columns are laid out like the input, header
+// included, e.g.
+//
+//	action,CIDR,ASN,Hits
+//	add,192.0.2.0/24,64500,Example
+//	delete,198.51.100.0/24
+//
+// The records of add and replace rows are built by newBuilder like those of
+// input rows. A patch is written by hand, so a row that is not valid fails
+// the build; rows a filter or an address family option leaves out of the
+// build are skipped.
+func loadPatch(path string, newBuilder func(header []string) (*rowBuilder, error)) ([]patchRow, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open patch file: %w", err)
+	}
+	defer fh.Close()
+
+	r := csv.NewReader(fh)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("patch file %s is empty", path)
+		}
+		return nil, fmt.Errorf("failed to read patch file %s: %w", path, err)
+	}
+	if !strings.EqualFold(strings.TrimSpace(header[0]), "action") || len(header) < 2 {
+		return nil, fmt.Errorf("patch file %s: the first column must be action, followed by the columns of the input", path)
+	}
+	builder, err := newBuilder(header[1:])
+	if err != nil {
+		return nil, fmt.Errorf("patch file %s: %w", path, err)
+	}
+	stats := builder.newStats()
+
+	var rows []patchRow
+	for {
+		fields, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read patch file %s: %w", path, err)
+		}
+		line, _ := r.FieldPos(0)
+		action := strings.ToLower(strings.TrimSpace(fields[0]))
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("patch file %s line %d: row has no network", path, line)
+		}
+		switch action {
+		case patchDelete:
+			network := strings.TrimSpace(fields[1])
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				return nil, fmt.Errorf("patch file %s line %d: invalid CIDR %q: %w", path, line, network, err)
+			}
+			rows = append(rows, patchRow{action: action, line: line, prefix: prefix.Masked()})
+		case patchAdd, patchReplace:
+			in := inputRow{fields: fields[1:], lines: make([]int, len(fields)-1)}
+			for i := range in.lines {
+				in.lines[i], _ = r.FieldPos(i + 1)
+			}
+			row, err := builder.build(in, stats)
+			if err != nil {
+				return nil, fmt.Errorf("patch file %s: %w", path, err)
+			}
+			switch row.rejected {
+			case "":
+			case rejectOtherFamily, rejectFiltered, rejectTooSpecific, rejectZeroASN, rejectExpired:
+				logger.Debug("skipping patch row left out of the build", "file", path, "line", line, "reason", row.rejected)
+				continue
+			default:
+				return nil, fmt.Errorf("patch file %s line %d: %s row rejected: %s", path, line, action, row.rejected)
+			}
+			rows = append(rows, patchRow{action: action, line: line, prefix: row.prefix, record: row.record})
+		default:
+			return nil, fmt.Errorf("patch file %s line %d: unknown action %q (want add, replace or delete)", path, line, fields[0])
+		}
+	}
+	return rows, nil
+}
+
+// applyPatch applies the -patch rows in file order. add stores its record
+// over everything within the prefix, whether the inputs had data there or
+// not; replace swaps the records within the prefix for its record but
+// leaves space without data empty; delete removes the data within the
+// prefix.
+func applyPatch(writer *mmdbwriter.Tree, cfg *config, rows []patchRow) (patchStats, error) {
+	var stats patchStats
+	policy := networkPolicy(cfg)
+	for _, row := range rows {
+		if excludesFamily(cfg, row.prefix) {
+			continue
+		}
+		if err := policy.Check(row.prefix); err != nil {
+			logger.Warn("skipping unsupported patch network", "file", cfg.patch, "line", row.line, "network", row.prefix, "error", err)
+			continue
+		}
+		network := prefixNetwork(row.prefix)
+		var err error
+		switch row.action {
+		case patchAdd:
+			err = writer.Insert(network, row.record)
+			stats.added++
+		case patchReplace:
+			found := false
+			err = writer.InsertFunc(network, func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+				if existing == nil {
+					return existing, nil
+				}
+				found = true
+				return row.record, nil
+			})
+			if err == nil && !found {
+				logger.Warn("patch replace matched no record", "file", cfg.patch, "line", row.line, "network", row.prefix)
+				continue
+			}
+			stats.replaced++
+		case patchDelete:
+			err = writer.InsertFunc(network, inserter.Remove)
+			stats.deleted++
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to apply patch row %d for %s: %w", row.line, row.prefix, err)
+		}
+	}
+	return stats, nil
+}
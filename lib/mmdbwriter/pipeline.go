@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sync"
+)
+
+// rowBatchSize is the number of rows handed to a worker at a time.
+const rowBatchSize = 1024
+
+// rowBatch is a run of consecutive rows; seq orders the batches.
+type rowBatch struct {
+	seq   int
+	rows  []inputRow
+	built []*builtRow
+	err   error
+}
+
+// buildRows reads all rows from r, builds their records and calls insert
+// for every row, rejected ones included, in input order. With more than one
+// worker, rows are built on that many goroutines while insert keeps running
+// on the calling goroutine, so only the tree inserts are serialized. Rows
+// left out by the sampler are counted and returned; the count is only
+// valid without an error.
+func buildRows(
+	r rowReader,
+	sampler *rand.Rand,
+	b *rowBuilder,
+	stats *buildStats,
+	workers int,
+	insert func(*builtRow) error,
+) (int, error) {
+	unsampled := 0
+	// Draw for every data row so the selection only depends on the seed
+	// and the row order.
+	next := func() (inputRow, bool, error) {
+		for {
+			fields, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				return inputRow{}, false, nil
+			}
+			if err != nil {
+				return inputRow{}, false, fmt.Errorf("failed to read CSV row: %w", err)
+			}
+			if sampler != nil && sampler.Float64() >= b.cfg.sample {
+				unsampled++
+				continue
+			}
+			return readInputRow(r, fields), true, nil
+		}
+	}
+
+	if workers <= 1 {
+		for {
+			row, ok, err := next()
+			if err != nil || !ok {
+				return unsampled, err
+			}
+			built, err := b.build(row, stats)
+			if err != nil {
+				return unsampled, err
+			}
+			if err := insert(built); err != nil {
+				return unsampled, err
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// The reader hands out batches; a read error travels as the last
+	// batch so it is reported in order.
+	batches := make(chan *rowBatch, workers)
+	go func() {
+		defer close(batches)
+		for seq := 0; ; seq++ {
+			batch := &rowBatch{seq: seq}
+			for len(batch.rows) < rowBatchSize {
+				row, ok, err := next()
+				if err != nil {
+					batch.err = err
+					break
+				}
+				if !ok {
+					break
+				}
+				batch.rows = append(batch.rows, row)
+			}
+			if len(batch.rows) == 0 && batch.err == nil {
+				return
+			}
+			select {
+			case batches <- batch:
+			case <-done:
+				return
+			}
+			if batch.err != nil || len(batch.rows) < rowBatchSize {
+				return
+			}
+		}
+	}()
+
+	results := make(chan *rowBatch, workers)
+	workerStats := make([]*buildStats, workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workerStats[i] = b.newStats()
+		wg.Add(1)
+		go func(stats *buildStats) {
+			defer wg.Done()
+			for batch := range batches {
+				batch.built = make([]*builtRow, len(batch.rows))
+				for j, row := range batch.rows {
+					built, err := b.build(row, stats)
+					if err != nil {
+						batch.err = err
+						batch.built = batch.built[:j]
+						break
+					}
+					batch.built[j] = built
+				}
+				select {
+				case results <- batch:
+				case <-done:
+					return
+				}
+			}
+		}(workerStats[i])
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Batches finish out of order; hold them back until their turn.
+	pending := map[int]*rowBatch{}
+	want := 0
+	for batch := range results {
+		pending[batch.seq] = batch
+		for pending[want] != nil {
+			batch := pending[want]
+			delete(pending, want)
+			want++
+			for _, built := range batch.built {
+				if err := insert(built); err != nil {
+					return 0, err
+				}
+			}
+			if batch.err != nil {
+				return 0, batch.err
+			}
+		}
+	}
+
+	for _, ws := range workerStats {
+		stats.addRowStats(ws)
+	}
+	return unsampled, nil
+}
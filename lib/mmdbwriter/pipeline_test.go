@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildRowsWorkers(t *testing.T) {
+	sample := filepath.Join(t.TempDir(), "sample.csv")
+	if err := writeBenchSample(sample, 5000); err != nil {
+		t.Fatal(err)
+	}
+	input, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A few rejected rows, which are reported in input order too.
+	input = append(input, "not-a-network,1,Bad\n10.0.0.0/8,2,Reserved\n"...)
+
+	buildTime := time.Now()
+	var want []byte
+	for _, workers := range []int{1, 2, 4, 16} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			cfg := testConfig(t, "-workers", fmt.Sprint(workers))
+			cfg.buildTime = buildTime
+			got, stats := buildTestMMDB(t, cfg, string(input))
+			if stats.rows != 5002 {
+				t.Errorf("got %d rows, want 5002", stats.rows)
+			}
+			if want == nil {
+				want = got
+			} else if !bytes.Equal(got, want) {
+				t.Error("the database differs from the single-threaded build")
+			}
+		})
+	}
+}
+
+// BenchmarkBuildRows measures the parsing and checking of the rows on
+// goroutines.
+func BenchmarkBuildRows(b *testing.B) {
+	cfg := benchConfig(b)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			cfg.workers = workers
+			b.ReportAllocs()
+			var rows int
+			for b.Loop() {
+				var err error
+				if rows, err = parseBenchInput(cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(rows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
@@ -0,0 +1,310 @@
+// Package bgptools is a client for the bgp.tools data endpoints: the
+// table.txt and table.jsonl routing table dumps, the asns.csv ASN list and
+// the bulk mode of the WHOIS server on port 43. It follows the bgp.tools
+// usage rules: every request carries a User-Agent identifying the caller,
+// downloads are cached and revalidated instead of repeated, and requests
+// are spaced out. It does not depend on the rest of mmdbwriter.
+//
+//	c, err := bgptools.New(bgptools.Options{
+//		UserAgent: "my-pipeline - me@example.com",
+//		CacheDir:  "/var/cache/bgptools",
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	routes, err := c.Table(ctx)
+package bgptools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults of Options.
+const (
+	DefaultBaseURL     = "https://bgp.tools"
+	DefaultWhoisAddr   = "bgp.tools:43"
+	DefaultMinInterval = time.Second
+	// DefaultMaxAge matches how often bgp.tools regenerates the table
+	// dumps; fetching them more often only returns the same data.
+	DefaultMaxAge = 30 * time.Minute
+)
+
+// ErrNoUserAgent is returned by New without Options.UserAgent. bgp.tools
+// blocks clients that do not identify themselves.
+var ErrNoUserAgent = errors.New("bgptools: a User-Agent identifying you is required")
+
+// Options configure a Client. Only UserAgent is required.
+type Options struct {
+	// UserAgent is sent with every request, e.g. "my-pipeline -
+	// me@example.com". bgp.tools asks for one naming the tool and a
+	// contact.
+	UserAgent string
+
+	// CacheDir keeps downloaded files between calls and runs. Without it
+	// every call downloads the file again.
+	CacheDir string
+
+	// MaxAge is how long a cached file is used without asking bgp.tools
+	// whether it changed. Default DefaultMaxAge; a negative value always
+	// revalidates.
+	MaxAge time.Duration
+
+	// MinInterval is the least time between the start of two requests of
+	// the Client, across all endpoints. Default DefaultMinInterval.
+	MinInterval time.Duration
+
+	// HTTPClient makes the HTTP requests. Default a client with a
+	// ten-minute timeout.
+	HTTPClient *http.Client
+
+	// BaseURL and WhoisAddr point the Client elsewhere, e.g. at a mirror.
+	// Defaults DefaultBaseURL and DefaultWhoisAddr.
+	BaseURL   string
+	WhoisAddr string
+}
+
+// Client fetches bgp.tools data. It is safe for concurrent use; requests
+// wait for their turn under the rate limit.
+type Client struct {
+	opts Options
+
+	mu   sync.Mutex
+	next time.Time // earliest start of the next request
+}
+
+// New returns a Client with opts, filling in the defaults.
+func New(opts Options) (*Client, error) {
+	if opts.UserAgent == "" {
+		return nil, ErrNoUserAgent
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = DefaultMaxAge
+	}
+	if opts.MinInterval <= 0 {
+		opts.MinInterval = DefaultMinInterval
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 10 * time.Minute}
+	}
+	if opts.BaseURL == "" {
+		opts.BaseURL = DefaultBaseURL
+	}
+	if opts.WhoisAddr == "" {
+		opts.WhoisAddr = DefaultWhoisAddr
+	}
+	return &Client{opts: opts}, nil
+}
+
+// wait blocks until the rate limit allows a request, or ctx is done.
+func (c *Client) wait(ctx context.Context) error {
+	c.mu.Lock()
+	now := time.Now()
+	start := now
+	if c.next.After(now) {
+		start = c.next
+	}
+	c.next = start.Add(c.opts.MinInterval)
+	c.mu.Unlock()
+
+	if start.Equal(now) {
+		return nil
+	}
+	t := time.NewTimer(start.Sub(now))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backOff keeps requests from starting before d has passed, as asked by a
+// Retry-After response.
+func (c *Client) backOff(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until := time.Now().Add(d); until.After(c.next) {
+		c.next = until
+	}
+}
+
+// StatusError is returned for an HTTP response other than 200 or 304.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	// RetryAfter is the wait a 429 or 503 response asked for, if any. The
+	// Client already holds back its next request for it.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bgptools: HTTP %s - %s", e.Status, e.URL)
+}
+
+// cacheState is stored next to a cached file as <file>.json.
+type cacheState struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// Open returns the file at path on the bgp.tools site, such as
+// "/table.txt", from the cache while it is younger than MaxAge and
+// otherwise with a conditional request. The caller must close it.
+func (c *Client) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	url := c.opts.BaseURL + path
+	if c.opts.CacheDir == "" {
+		resp, err := c.get(ctx, url, cacheState{})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+
+	file := filepath.Join(c.opts.CacheDir, filepath.Base(path))
+	state, cached := readCacheState(file)
+	if cached && c.opts.MaxAge > 0 && time.Since(state.FetchedAt) < c.opts.MaxAge {
+		if fh, err := os.Open(file); err == nil {
+			return fh, nil
+		}
+		cached = false
+	}
+	if !cached {
+		state = cacheState{}
+	}
+
+	resp, err := c.get(ctx, url, state)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := storeCache(file, resp.Body); err != nil {
+			return nil, err
+		}
+		state = cacheState{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	}
+	state.FetchedAt = time.Now().UTC()
+	if err := writeCacheState(file, state); err != nil {
+		return nil, err
+	}
+	return os.Open(file)
+}
+
+// get makes a GET request, conditional on state when it has validators. It
+// returns the 200 or 304 response.
+func (c *Client) get(ctx context.Context, url string, state cacheState) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if state.ETag != "" {
+		req.Header.Set("If-None-Match", state.ETag)
+	}
+	if state.LastModified != "" {
+		req.Header.Set("If-Modified-Since", state.LastModified)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	serr := &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		serr.RetryAfter = retryAfter(resp.Header.Get("Retry-After"))
+	}
+	return nil, serr
+}
+
+// Do sends req, built by the caller, e.g. with Range headers, under the
+// rate limit and with the User-Agent of the Client. It returns the response
+// whatever its status; a 429 or 503 response holds back the next request
+// of the Client for its Retry-After.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if err := c.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.opts.UserAgent)
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("bgptools: %w", err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		c.backOff(retryAfter(resp.Header.Get("Retry-After")))
+	}
+	return resp, nil
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date.
+func retryAfter(v string) time.Duration {
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+func readCacheState(file string) (cacheState, bool) {
+	var state cacheState
+	data, err := os.ReadFile(file + ".json")
+	if err != nil || json.Unmarshal(data, &state) != nil {
+		return cacheState{}, false
+	}
+	if _, err := os.Stat(file); err != nil {
+		return cacheState{}, false
+	}
+	return state, true
+}
+
+func writeCacheState(file string, state cacheState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file+".json", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("bgptools: failed to write cache state: %w", err)
+	}
+	return nil
+}
+
+// storeCache writes r to file through a temporary file, so an interrupted
+// download never replaces a good cached copy.
+func storeCache(file string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("bgptools: failed to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("bgptools: failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("bgptools: download interrupted: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("bgptools: failed to store download: %w", err)
+	}
+	return nil
+}
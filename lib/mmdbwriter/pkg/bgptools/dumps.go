@@ -0,0 +1,167 @@
+package bgptools
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Route is a prefix of the routing table and the ASN originating it.
+type Route struct {
+	Prefix netip.Prefix
+	ASN    uint32
+	// Hits is how many bgp.tools peers see the route. Only table.jsonl
+	// has it.
+	Hits int
+}
+
+// ASN is a row of asns.csv.
+type ASN struct {
+	ASN  uint32
+	Name string
+	// Class is the bgp.tools classification, e.g. Eyeball or Content.
+	Class string
+	// CC is the country code of the registration.
+	CC string
+}
+
+// Table returns the routes of /table.txt, one "prefix ASN" pair per line.
+func (c *Client) Table(ctx context.Context) ([]Route, error) {
+	r, err := c.Open(ctx, "/table.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var routes []Route
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bgptools: table.txt line %d: want prefix and ASN", line)
+		}
+		route, err := parseRoute(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("bgptools: table.txt line %d: %w", line, err)
+		}
+		routes = append(routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("bgptools: failed to read table.txt: %w", err)
+	}
+	return routes, nil
+}
+
+// TableJSONL returns the routes of /table.jsonl, with their Hits.
+func (c *Client) TableJSONL(ctx context.Context) ([]Route, error) {
+	r, err := c.Open(ctx, "/table.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var routes []Route
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var entry struct {
+			CIDR string      `json:"CIDR"`
+			ASN  json.Number `json:"ASN"`
+			Hits json.Number `json:"Hits"`
+		}
+		if err := dec.Decode(&entry); errors.Is(err, io.EOF) {
+			return routes, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("bgptools: table.jsonl entry %d: %w", line, err)
+		}
+		route, err := parseRoute(entry.CIDR, entry.ASN.String())
+		if err != nil {
+			return nil, fmt.Errorf("bgptools: table.jsonl entry %d: %w", line, err)
+		}
+		if entry.Hits != "" {
+			hits, err := strconv.Atoi(entry.Hits.String())
+			if err != nil {
+				return nil, fmt.Errorf("bgptools: table.jsonl entry %d: invalid hits: %w", line, err)
+			}
+			route.Hits = hits
+		}
+		routes = append(routes, route)
+	}
+}
+
+func parseRoute(prefix, asn string) (Route, error) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return Route{}, err
+	}
+	n, err := strconv.ParseUint(asn, 10, 32)
+	if err != nil {
+		return Route{}, fmt.Errorf("invalid ASN %q", asn)
+	}
+	return Route{Prefix: p, ASN: uint32(n)}, nil
+}
+
+// ASNs returns the rows of /asns.csv.
+func (c *Client) ASNs(ctx context.Context) ([]ASN, error) {
+	r, err := c.Open(ctx, "/asns.csv")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("bgptools: failed to read asns.csv header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	asnIndex, ok := columns["asn"]
+	if !ok {
+		return nil, errors.New("bgptools: asns.csv has no asn column")
+	}
+	column := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var asns []ASN
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return asns, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bgptools: failed to read asns.csv: %w", err)
+		}
+		if asnIndex >= len(row) {
+			continue
+		}
+		s := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(row[asnIndex])), "AS")
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			line, _ := cr.FieldPos(asnIndex)
+			return nil, fmt.Errorf("bgptools: asns.csv line %d: invalid ASN %q", line, row[asnIndex])
+		}
+		asns = append(asns, ASN{
+			ASN:   uint32(n),
+			Name:  column(row, "name"),
+			Class: column(row, "class"),
+			CC:    column(row, "cc"),
+		})
+	}
+}
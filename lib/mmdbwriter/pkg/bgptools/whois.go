@@ -0,0 +1,109 @@
+package bgptools
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WhoisResult is a line of a verbose bulk WHOIS answer.
+type WhoisResult struct {
+	// ASN originates Prefix, or is the ASN asked for; 0 when an address is
+	// not announced.
+	ASN uint32
+	// Query is the address or prefix the line answers, as bgp.tools
+	// echoes it, or AS<n> for an ASN query, whose answer has no Prefix.
+	Query     string
+	Prefix    netip.Prefix
+	CC        string
+	Registry  string
+	Allocated string
+	Name      string
+}
+
+// Whois looks up addresses, prefixes or ASNs (written AS13335) in one bulk
+// mode session of the WHOIS server, which bgp.tools asks for instead of a
+// connection per query. Results come in the order of the answer lines; lines that are not
+// a verbose result column set, such as notices, are left out.
+func (c *Client) Whois(ctx context.Context, queries []string) ([]WhoisResult, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.opts.WhoisAddr)
+	if err != nil {
+		return nil, fmt.Errorf("bgptools: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(10 * time.Minute))
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "begin\nverbose\n")
+	for _, q := range queries {
+		if strings.ContainsAny(q, "\r\n") {
+			return nil, fmt.Errorf("bgptools: invalid WHOIS query %q", q)
+		}
+		fmt.Fprintf(w, "%s\n", q)
+	}
+	fmt.Fprintf(w, "end\n")
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("bgptools: failed to send WHOIS queries: %w", err)
+	}
+
+	var results []WhoisResult
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if result, ok := parseWhoisLine(scanner.Text()); ok {
+			results = append(results, result)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("bgptools: failed to read WHOIS answer: %w", err)
+	}
+	return results, nil
+}
+
+// parseWhoisLine parses the answer to an address or prefix, "AS | IP |
+// BGP Prefix | CC | Registry | Allocated | AS Name", or to an ASN, "AS | CC
+// | Registry | Allocated | AS Name". A column header has no numeric ASN and
+// is not a result.
+func parseWhoisLine(line string) (WhoisResult, bool) {
+	fields := strings.Split(line, "|")
+	if len(fields) < 5 {
+		return WhoisResult{}, false
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	asn, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return WhoisResult{}, false
+	}
+	result := WhoisResult{ASN: uint32(asn)}
+	if len(fields) >= 7 {
+		result.Query = fields[1]
+		// Unannounced addresses have no prefix.
+		result.Prefix, _ = netip.ParsePrefix(fields[2])
+		fields = fields[2:]
+	} else {
+		result.Query = "AS" + fields[0]
+	}
+	result.CC, result.Registry, result.Allocated = fields[1], fields[2], fields[3]
+	// The name is the last column and may itself contain "|".
+	result.Name = strings.Join(fields[4:], " | ")
+	return result, true
+}
@@ -0,0 +1,6 @@
+// Package lookuppb holds the messages and the gRPC client and server of
+// lookup.proto, the service of `mmdbwriter serve -grpc-listen`. Generated
+// with protoc-gen-go v1.35.1 and protoc-gen-go-grpc v1.5.1.
+package lookuppb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative lookup.proto
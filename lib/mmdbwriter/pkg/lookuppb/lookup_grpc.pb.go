@@ -0,0 +1,167 @@
+// gRPC interface of `mmdbwriter serve -grpc-listen`. lookup.pb.go and
+// lookup_grpc.pb.go are generated from this file; see doc.go.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: lookup.proto
+
+package lookuppb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	LookupService_Lookup_FullMethodName     = "/bgptools.opendb.v1.LookupService/Lookup"
+	LookupService_BulkLookup_FullMethodName = "/bgptools.opendb.v1.LookupService/BulkLookup"
+)
+
+// LookupServiceClient is the client API for LookupService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LookupServiceClient interface {
+	// Lookup returns the record of one address. An invalid address fails
+	// the call with INVALID_ARGUMENT.
+	Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*LookupResponse, error)
+	// BulkLookup answers a stream of addresses in order, one response per
+	// request. Invalid addresses get a response with error set instead of
+	// ending the stream.
+	BulkLookup(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[LookupRequest, LookupResponse], error)
+}
+
+type lookupServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLookupServiceClient(cc grpc.ClientConnInterface) LookupServiceClient {
+	return &lookupServiceClient{cc}
+}
+
+func (c *lookupServiceClient) Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*LookupResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LookupResponse)
+	err := c.cc.Invoke(ctx, LookupService_Lookup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lookupServiceClient) BulkLookup(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[LookupRequest, LookupResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LookupService_ServiceDesc.Streams[0], LookupService_BulkLookup_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[LookupRequest, LookupResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LookupService_BulkLookupClient = grpc.BidiStreamingClient[LookupRequest, LookupResponse]
+
+// LookupServiceServer is the server API for LookupService service.
+// All implementations must embed UnimplementedLookupServiceServer
+// for forward compatibility.
+type LookupServiceServer interface {
+	// Lookup returns the record of one address. An invalid address fails
+	// the call with INVALID_ARGUMENT.
+	Lookup(context.Context, *LookupRequest) (*LookupResponse, error)
+	// BulkLookup answers a stream of addresses in order, one response per
+	// request. Invalid addresses get a response with error set instead of
+	// ending the stream.
+	BulkLookup(grpc.BidiStreamingServer[LookupRequest, LookupResponse]) error
+	mustEmbedUnimplementedLookupServiceServer()
+}
+
+// UnimplementedLookupServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedLookupServiceServer struct{}
+
+func (UnimplementedLookupServiceServer) Lookup(context.Context, *LookupRequest) (*LookupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Lookup not implemented")
+}
+func (UnimplementedLookupServiceServer) BulkLookup(grpc.BidiStreamingServer[LookupRequest, LookupResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method BulkLookup not implemented")
+}
+func (UnimplementedLookupServiceServer) mustEmbedUnimplementedLookupServiceServer() {}
+func (UnimplementedLookupServiceServer) testEmbeddedByValue()                       {}
+
+// UnsafeLookupServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LookupServiceServer will
+// result in compilation errors.
+type UnsafeLookupServiceServer interface {
+	mustEmbedUnimplementedLookupServiceServer()
+}
+
+func RegisterLookupServiceServer(s grpc.ServiceRegistrar, srv LookupServiceServer) {
+	// If the following call pancis, it indicates UnimplementedLookupServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&LookupService_ServiceDesc, srv)
+}
+
+func _LookupService_Lookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LookupServiceServer).Lookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LookupService_Lookup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LookupServiceServer).Lookup(ctx, req.(*LookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LookupService_BulkLookup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LookupServiceServer).BulkLookup(&grpc.GenericServerStream[LookupRequest, LookupResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LookupService_BulkLookupServer = grpc.BidiStreamingServer[LookupRequest, LookupResponse]
+
+// LookupService_ServiceDesc is the grpc.ServiceDesc for LookupService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LookupService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "bgptools.opendb.v1.LookupService",
+	HandlerType: (*LookupServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Lookup",
+			Handler:    _LookupService_Lookup_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "BulkLookup",
+			Handler:       _LookupService_BulkLookup_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "lookup.proto",
+}
@@ -0,0 +1,190 @@
+package mmdbbuild
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Header names of the network, ASN and organization columns, matched
+// case-insensitively in order of preference.
+var (
+	NetworkColumnNames = []string{"network", "prefix", "cidr"}
+	ASNColumnNames     = []string{"asn", "as_number"}
+	OrgColumnNames     = []string{"org", "organization", "name", "description"}
+)
+
+// CSVColumns are the 1-based positions of the network, ASN and
+// organization columns of a CSV file. Zero leaves a column to the header.
+type CSVColumns struct {
+	Network, ASN, Org int
+}
+
+// Find returns the 0-based positions of the columns: those of c, else the
+// first header column named like one, else the first, second and third
+// column. named reports whether the organization column was mapped or
+// named rather than assumed.
+func (c CSVColumns) Find(header []string) (network, asn, org int, named bool) {
+	find := func(col int, names []string, fallback int) (int, bool) {
+		if col > 0 {
+			return col - 1, true
+		}
+		for _, name := range names {
+			if i := HeaderIndex(header, name); i >= 0 {
+				return i, true
+			}
+		}
+		return fallback, false
+	}
+	network, _ = find(c.Network, NetworkColumnNames, 0)
+	asn, _ = find(c.ASN, ASNColumnNames, 1)
+	org, named = find(c.Org, OrgColumnNames, 2)
+	return network, asn, org, named
+}
+
+// HeaderIndex returns the position of the header column called name,
+// ignoring case and surrounding space, or -1.
+func HeaderIndex(header []string, name string) int {
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ASTrans is AS_TRANS (RFC 6793), the placeholder 2-byte speakers put in
+// the AS_PATH for a 4-byte ASN they cannot express.
+const ASTrans = 23456
+
+// ParseOrigin parses the ASN column of a row: a decimal ASN, written as is
+// or as AS13335, in the asdot notation of RFC 5396 (1.10 for 65546) or as
+// AS_TRANS, or the AS_SET origin of an aggregated route, {64512,64513} or
+// {64512 64513}. A set returns its distinct members in order, without
+// AS_TRANS when other members are known, and a set of one ASN is that ASN.
+func ParseOrigin(s string) (uint32, []uint32, error) {
+	inner, ok := strings.CutPrefix(s, "{")
+	if !ok {
+		asn, err := ParseASN(s)
+		return asn, nil, err
+	}
+	inner, ok = strings.CutSuffix(inner, "}")
+	if !ok {
+		return 0, nil, errors.New("unterminated AS_SET")
+	}
+
+	var set []uint32
+	for _, member := range strings.FieldsFunc(inner, func(r rune) bool { return r == ',' || r == ' ' }) {
+		asn, err := ParseASN(member)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid AS_SET member: %w", err)
+		}
+		if !slices.Contains(set, asn) {
+			set = append(set, asn)
+		}
+	}
+	if i := slices.Index(set, ASTrans); i >= 0 && len(set) > 1 {
+		set = slices.Delete(set, i, i+1)
+	}
+	switch len(set) {
+	case 0:
+		return 0, nil, errors.New("empty AS_SET")
+	case 1:
+		return set[0], nil, nil
+	}
+	return 0, set, nil
+}
+
+// ParseASN parses a single ASN in any of the notations of ParseOrigin.
+func ParseASN(s string) (uint32, error) {
+	if strings.EqualFold(s, "AS_TRANS") {
+		return ASTrans, nil
+	}
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	if high, low, ok := strings.Cut(s, "."); ok {
+		h, err := strconv.ParseUint(high, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid asdot ASN %q: %w", s, err)
+		}
+		l, err := strconv.ParseUint(low, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid asdot ASN %q: %w", s, err)
+		}
+		return uint32(h<<16 | l), nil
+	}
+	asn, err := strconv.ParseUint(s, 10, 32)
+	return uint32(asn), err
+}
+
+// CSVStats summarizes an AddCSV call.
+type CSVStats struct {
+	// Records is the number of prefixes added.
+	Records int
+	// Skipped is the number of rows left out because they were too short,
+	// had an invalid network, ASN or organization, or held an unsupported
+	// network.
+	Skipped int
+}
+
+// AddCSV adds the rows of a CSV file with a header row, reading them like
+// the mmdbwriter command: the columns are found by CSVColumns.Find, the
+// organization column is optional per row, and the ASN column takes the
+// notations of ParseOrigin. Rows that cannot be stored are skipped and
+// counted; only read and insert failures are returned.
+func (b *Builder) AddCSV(r io.Reader) (CSVStats, error) {
+	var stats CSVStats
+
+	cr := csv.NewReader(r)
+	// Rows may mix the two-column and three-column formats.
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return stats, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	networkIndex, asnIndex, orgIndex, _ := CSVColumns{}.Find(header)
+
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read CSV row: %w", err)
+		}
+		if len(row) <= max(networkIndex, asnIndex) {
+			stats.Skipped++
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(row[networkIndex]))
+		if err != nil {
+			stats.Skipped++
+			continue
+		}
+		asn, set, err := ParseOrigin(strings.TrimSpace(row[asnIndex]))
+		if err != nil {
+			stats.Skipped++
+			continue
+		}
+		record := Record{ASN: asn, ASNs: set}
+		if orgIndex < len(row) {
+			record.Organization = strings.TrimSpace(row[orgIndex])
+		}
+
+		if err := b.AddPrefix(prefix, record); err != nil {
+			if errors.Is(err, ErrUnsupportedNetwork) || errors.Is(err, ErrInvalidRecord) {
+				stats.Skipped++
+				continue
+			}
+			return stats, err
+		}
+		stats.Records++
+	}
+}
@@ -0,0 +1,139 @@
+package mmdbbuild
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAddCSV(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		stats CSVStats
+		// want maps addresses to their ASN, 0 for none, and org.
+		want map[string][2]any
+	}{
+		{
+			name:  "mixed formats",
+			input: "network,asn,org\n1.1.1.0/24,13335,\"Cloudflare, Inc.\"\n8.8.8.0/24,15169\n",
+			stats: CSVStats{Records: 2},
+			want:  map[string][2]any{"1.1.1.1": {uint64(13335), "Cloudflare, Inc."}, "8.8.8.8": {uint64(15169), nil}},
+		},
+		{
+			name:  "columns by header",
+			input: "org,prefix,as_number\nCloudflare,1.1.1.0/24,13335\n",
+			stats: CSVStats{Records: 1},
+			want:  map[string][2]any{"1.1.1.1": {uint64(13335), "Cloudflare"}},
+		},
+		{
+			name:  "asn notations",
+			input: "network,asn\n1.1.1.0/24,AS13335\n1.0.0.0/24,1.10\n",
+			stats: CSVStats{Records: 2},
+			want:  map[string][2]any{"1.1.1.1": {uint64(13335), nil}, "1.0.0.1": {uint64(65546), nil}},
+		},
+		{
+			name:  "skipped rows",
+			input: "network,asn,org\n1.1.1.0/24\nnot-a-network,1,\n2.2.2.0/24,-1,\n10.0.0.0/8,1,\n3.3.3.0/24,2,bad\xfforg\n4.4.4.0/24,4,Four\n",
+			stats: CSVStats{Records: 1, Skipped: 5},
+			want:  map[string][2]any{"4.4.4.4": {uint64(4), "Four"}, "2.2.2.2": {nil, nil}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBuilder(t)
+			stats, err := b.AddCSV(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats != tt.stats {
+				t.Errorf("got %+v, want %+v", stats, tt.stats)
+			}
+			db := writeTest(t, b)
+			for ip, want := range tt.want {
+				_, got := lookupTest(t, db, ip)
+				if got["autonomous_system_number"] != want[0] || got["autonomous_system_organization"] != want[1] {
+					t.Errorf("%s: got %v, want %v", ip, got, want)
+				}
+			}
+		})
+	}
+}
+
+// An AS_SET origin is stored as its members.
+func TestAddCSVASSet(t *testing.T) {
+	b := newTestBuilder(t)
+	if _, err := b.AddCSV(strings.NewReader("network,asn\n9.9.9.0/24,\"{64512,64513}\"\n")); err != nil {
+		t.Fatal(err)
+	}
+	_, got := lookupTest(t, writeTest(t, b), "9.9.9.9")
+	if !reflect.DeepEqual(got, map[string]any{"autonomous_system_numbers": []any{uint64(64512), uint64(64513)}}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestAddCSVEmpty(t *testing.T) {
+	b := newTestBuilder(t)
+	if _, err := b.AddCSV(strings.NewReader("")); err == nil {
+		t.Error("AddCSV without a header succeeded")
+	}
+}
+
+func TestParseOrigin(t *testing.T) {
+	tests := []struct {
+		in  string
+		asn uint32
+		set []uint32
+		err bool
+	}{
+		{in: "13335", asn: 13335},
+		{in: "AS13335", asn: 13335},
+		{in: "as13335", asn: 13335},
+		{in: "1.10", asn: 65546},
+		{in: "AS_TRANS", asn: ASTrans},
+		{in: "{64512,64513}", set: []uint32{64512, 64513}},
+		{in: "{64512 64513 64512}", set: []uint32{64512, 64513}},
+		{in: "{23456,64512}", asn: 64512},
+		{in: "{13335}", asn: 13335},
+		{in: "4294967296", err: true},
+		{in: "1.65536", err: true},
+		{in: "{}", err: true},
+		{in: "{1,2", err: true},
+		{in: "{1,x}", err: true},
+		{in: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			asn, set, err := ParseOrigin(tt.in)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if err == nil && asn != tt.asn || !slices.Equal(set, tt.set) {
+				t.Errorf("got %d %v, want %d %v", asn, set, tt.asn, tt.set)
+			}
+		})
+	}
+}
+
+func TestCSVColumnsFind(t *testing.T) {
+	tests := []struct {
+		name              string
+		cols              CSVColumns
+		header            []string
+		network, asn, org int
+		named             bool
+	}{
+		{name: "positional", header: []string{"a", "b", "c"}, network: 0, asn: 1, org: 2},
+		{name: "named", header: []string{"Name", " CIDR ", "ASN"}, network: 1, asn: 2, org: 0, named: true},
+		{name: "mapped", cols: CSVColumns{Network: 3, ASN: 1, Org: 2}, header: []string{"network", "asn", "org"}, network: 2, asn: 0, org: 1, named: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, asn, org, named := tt.cols.Find(tt.header)
+			if network != tt.network || asn != tt.asn || org != tt.org || named != tt.named {
+				t.Errorf("got %d %d %d %v, want %d %d %d %v", network, asn, org, named, tt.network, tt.asn, tt.org, tt.named)
+			}
+		})
+	}
+}
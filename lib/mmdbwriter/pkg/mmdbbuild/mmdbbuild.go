@@ -0,0 +1,185 @@
+// Package mmdbbuild builds the BGP.Tools ASN database from prefix data. It
+// is the conversion core of the mmdbwriter command, for Go programs that
+// want to embed it instead of running the CLI.
+//
+//	b, err := mmdbbuild.New()
+//	if err != nil {
+//		return err
+//	}
+//	if _, err := b.AddCSV(csvFile); err != nil {
+//		return err
+//	}
+//	_, err = b.WriteTo(out)
+package mmdbbuild
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/inserter"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ErrUnsupportedNetwork is returned by AddPrefix for networks the database
+// cannot hold, such as reserved or IPv4-aliased address space.
+var ErrUnsupportedNetwork = errors.New("unsupported network")
+
+// DefaultOptions returns the writer options of the ASN database.
+func DefaultOptions() mmdbwriter.Options {
+	return mmdbwriter.Options{
+		DatabaseType: "BGP-Tools-ASN-DB",
+		RecordSize:   24,
+		Description: map[string]string{
+			"en": "BGP.Tools ASN Database",
+		},
+	}
+}
+
+// Builder accumulates prefixes into a database. A prefix added later
+// replaces the data of an earlier overlapping one.
+//
+// A Builder is safe for concurrent use: AddPrefix, RemovePrefix, AddCSV,
+// WriteTo and BuildReader may be called from several goroutines, e.g. one
+// per BGP session. Each change is applied atomically, in the order the
+// calls take the lock, so overlapping prefixes fed from different
+// goroutines end with whichever came last. WriteTo and BuildReader see
+// every change made before they started and none made during them; an
+// AddCSV is not atomic as a whole, and its rows may interleave with other
+// changes.
+type Builder struct {
+	mu     sync.Mutex
+	tree   *mmdbwriter.Tree
+	policy NetworkPolicy
+	// ipv4 is set for an IPv4 database, which cannot hold IPv6 networks.
+	ipv4 bool
+}
+
+// New returns a Builder with DefaultOptions.
+func New() (*Builder, error) {
+	return NewWithOptions(DefaultOptions())
+}
+
+// NewWithOptions returns a Builder writing a database with opts.
+func NewWithOptions(opts mmdbwriter.Options) (*Builder, error) {
+	tree, err := mmdbwriter.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Builder{tree: tree, policy: NewNetworkPolicy(opts), ipv4: opts.IPVersion == 4}, nil
+}
+
+// Load returns a Builder that starts from the networks of an existing
+// database, keeping its metadata. Whatever the database contains is
+// loaded, including reserved networks.
+func Load(path string) (*Builder, error) {
+	opts := mmdbwriter.Options{IncludeReservedNetworks: true}
+	tree, err := mmdbwriter.Load(path, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	// The loaded tree takes its IP version from the metadata.
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	opts.IPVersion = int(db.Metadata.IPVersion)
+	db.Close()
+	return &Builder{tree: tree, policy: NewNetworkPolicy(opts), ipv4: opts.IPVersion == 4}, nil
+}
+
+// AddPrefix stores record for prefix. Networks the database cannot hold
+// return an error wrapping ErrUnsupportedNetwork, and ErrReservedNetwork or
+// ErrAliasedNetwork for reserved and aliased space. A record that fails
+// Validate is not stored and its error returned.
+func (b *Builder) AddPrefix(prefix netip.Prefix, record Record) error {
+	if err := record.Validate(); err != nil {
+		return fmt.Errorf("record for %s: %w", prefix, err)
+	}
+	network, err := b.ipNetwork(prefix)
+	if err != nil {
+		return err
+	}
+	prefix = prefix.Masked()
+
+	b.mu.Lock()
+	err = b.tree.Insert(network, record.Map())
+	b.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to insert record for %s: %w", prefix, err)
+	}
+	return nil
+}
+
+// RemovePrefix deletes the data of prefix, including that of any more
+// specific prefix within it. Addresses it covered have no data afterwards;
+// the record of a covering prefix is not restored.
+func (b *Builder) RemovePrefix(prefix netip.Prefix) error {
+	network, err := b.ipNetwork(prefix)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	err = b.tree.InsertFunc(network, inserter.Remove)
+	b.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %w", prefix, err)
+	}
+	return nil
+}
+
+// ipNetwork converts a valid prefix to the masked network mmdbwriter takes,
+// checking it against the policy of the database. IPv6 prefixes cannot be
+// stored in an IPv4 database.
+func (b *Builder) ipNetwork(prefix netip.Prefix) (*net.IPNet, error) {
+	if !prefix.IsValid() {
+		return nil, fmt.Errorf("invalid prefix %s", prefix)
+	}
+	if b.ipv4 && !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("%w %s: IPv6 network in an IPv4 database", ErrUnsupportedNetwork, prefix)
+	}
+	prefix = prefix.Masked()
+	if err := b.policy.Check(prefix); err != nil {
+		return nil, err
+	}
+	return &net.IPNet{
+		IP:   net.IP(prefix.Addr().AsSlice()),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}, nil
+}
+
+// WriteTo serializes the database to w.
+// Changes wait until it returns, so a slow w holds them up; BuildReader
+// does not.
+func (b *Builder) WriteTo(w io.Writer) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tree.WriteTo(w)
+}
+
+// BuildReader serializes the database in memory and returns a reader for
+// it, for programs that look up the data they build without writing a file.
+// The reader is a snapshot: prefixes added afterwards are not visible to it.
+// It needs no Close.
+func (b *Builder) BuildReader() (*maxminddb.Reader, error) {
+	var buf bytes.Buffer
+	b.mu.Lock()
+	_, err := b.tree.WriteTo(&buf)
+	b.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize database: %w", err)
+	}
+	return maxminddb.FromBytes(buf.Bytes())
+}
+
+// Tree returns the underlying mmdbwriter tree for operations the Builder
+// does not cover. The tree is not protected by the lock of the Builder: it
+// must not be used while other goroutines call the Builder.
+func (b *Builder) Tree() *mmdbwriter.Tree {
+	return b.tree
+}
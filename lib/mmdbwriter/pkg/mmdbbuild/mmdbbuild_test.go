@@ -0,0 +1,275 @@
+package mmdbbuild
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// lookupTest returns the record of ip in db and the network holding it,
+// nil when there is none.
+func lookupTest(t *testing.T, db *maxminddb.Reader, ip string) (string, map[string]any) {
+	t.Helper()
+	var record map[string]any
+	network, ok, err := db.LookupNetwork(net.ParseIP(ip), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		return network.String(), nil
+	}
+	return network.String(), record
+}
+
+// writeTest serializes b with WriteTo and opens the result.
+func writeTest(t *testing.T, b *Builder) *maxminddb.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := b.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	db, err := maxminddb.FromBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestBuilder(t *testing.T) *Builder {
+	t.Helper()
+	b, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestAddPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		record Record
+		err    error
+	}{
+		{name: "ipv4", prefix: "1.1.1.0/24", record: Record{ASN: 13335, Organization: "Cloudflare, Inc."}},
+		{name: "ipv6", prefix: "2606:4700::/32", record: Record{ASN: 13335}},
+		{name: "host bits", prefix: "8.8.8.8/24", record: Record{ASN: 15169}},
+		{name: "as set", prefix: "9.9.9.0/24", record: Record{ASNs: []uint32{64512, 64513}}},
+		{name: "reserved", prefix: "10.0.0.0/8", record: Record{ASN: 1}, err: ErrReservedNetwork},
+		{name: "aliased", prefix: "2002::/16", record: Record{ASN: 1}, err: ErrAliasedNetwork},
+		{name: "asn and set", prefix: "9.9.8.0/24", record: Record{ASN: 1, ASNs: []uint32{2, 3}}, err: ErrInvalidRecord},
+		{name: "bad country", prefix: "9.9.7.0/24", record: Record{ASN: 1, Country: "usa"}, err: ErrInvalidRecord},
+	}
+	b := newTestBuilder(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := b.AddPrefix(netip.MustParsePrefix(tt.prefix), tt.record)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	db := writeTest(t, b)
+	for _, tt := range []struct {
+		ip, network string
+		want        map[string]any
+	}{
+		{"1.1.1.1", "1.1.1.0/24", map[string]any{"autonomous_system_number": uint64(13335), "autonomous_system_organization": "Cloudflare, Inc."}},
+		{"2606:4700::1", "2606:4700::/32", map[string]any{"autonomous_system_number": uint64(13335)}},
+		{"8.8.8.8", "8.8.8.0/24", map[string]any{"autonomous_system_number": uint64(15169)}},
+		{"9.9.9.9", "9.9.9.0/24", map[string]any{"autonomous_system_numbers": []any{uint64(64512), uint64(64513)}}},
+		{"9.9.8.1", "9.9.8.0/24", nil},
+	} {
+		network, got := lookupTest(t, db, tt.ip)
+		if network != tt.network || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %s %v, want %s %v", tt.ip, network, got, tt.network, tt.want)
+		}
+	}
+}
+
+// A later prefix replaces the data of an earlier overlapping one.
+func TestAddPrefixOverlap(t *testing.T) {
+	b := newTestBuilder(t)
+	for _, p := range []struct {
+		prefix string
+		asn    uint32
+	}{{"1.0.0.0/16", 1}, {"1.0.1.0/24", 2}, {"1.0.0.0/23", 3}} {
+		if err := b.AddPrefix(netip.MustParsePrefix(p.prefix), Record{ASN: p.asn}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := writeTest(t, b)
+	for ip, want := range map[string]uint64{"1.0.0.1": 3, "1.0.1.1": 3, "1.0.2.1": 1} {
+		_, got := lookupTest(t, db, ip)
+		if got["autonomous_system_number"] != want {
+			t.Errorf("%s: got %v, want ASN %d", ip, got, want)
+		}
+	}
+}
+
+func TestRemovePrefix(t *testing.T) {
+	b := newTestBuilder(t)
+	for _, p := range []string{"1.0.0.0/16", "1.0.1.0/24", "1.0.128.0/17"} {
+		if err := b.AddPrefix(netip.MustParsePrefix(p), Record{ASN: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.RemovePrefix(netip.MustParsePrefix("1.0.0.0/17")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RemovePrefix(netip.MustParsePrefix("10.0.0.0/8")); !errors.Is(err, ErrReservedNetwork) {
+		t.Errorf("removing reserved space: got %v, want ErrReservedNetwork", err)
+	}
+
+	db := writeTest(t, b)
+	// The removed /17 takes the more specific /24 with it and does not
+	// bring back the covering /16.
+	for ip, found := range map[string]bool{"1.0.0.1": false, "1.0.1.1": false, "1.0.127.1": false, "1.0.128.1": true, "1.1.0.1": false} {
+		if _, got := lookupTest(t, db, ip); (got != nil) != found {
+			t.Errorf("%s: got %v, want found %v", ip, got, found)
+		}
+	}
+}
+
+// WriteTo writes what a reader opens with the metadata of the options,
+// and an IPv4 database refuses IPv6 prefixes.
+func TestWriteTo(t *testing.T) {
+	opts := DefaultOptions()
+	opts.IPVersion = 4
+	opts.RecordSize = 28
+	b, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddPrefix(netip.MustParsePrefix("1.1.1.0/24"), Record{ASN: 13335}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddPrefix(netip.MustParsePrefix("2606:4700::/32"), Record{ASN: 13335}); !errors.Is(err, ErrUnsupportedNetwork) {
+		t.Errorf("IPv6 prefix in an IPv4 database: got %v, want ErrUnsupportedNetwork", err)
+	}
+
+	db := writeTest(t, b)
+	md := db.Metadata
+	if md.DatabaseType != "BGP-Tools-ASN-DB" || md.IPVersion != 4 || md.RecordSize != 28 || md.Description["en"] != "BGP.Tools ASN Database" {
+		t.Errorf("got metadata %+v", md)
+	}
+	if _, got := lookupTest(t, db, "1.1.1.1"); got["autonomous_system_number"] != uint64(13335) {
+		t.Errorf("got %v", got)
+	}
+
+	// WriteTo is repeatable, and BuildReader sees the same database.
+	var first, second bytes.Buffer
+	if _, err := b.WriteTo(&first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.WriteTo(&second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("two WriteTo calls differ")
+	}
+	r, err := b.BuildReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, got := lookupTest(t, r, "1.1.1.1"); got["autonomous_system_number"] != uint64(13335) {
+		t.Errorf("BuildReader: got %v", got)
+	}
+}
+
+// concurrentTestPrefixes are disjoint, so the database does not depend on
+// the order they are added in.
+func concurrentTestPrefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for i := range 2048 {
+		prefixes = append(prefixes,
+			netip.PrefixFrom(netip.AddrFrom4([4]byte{11, byte(i >> 8), byte(i), 0}), 24),
+			netip.PrefixFrom(netip.AddrFrom16([16]byte{0x26, 0x00, byte(i >> 8), byte(i)}), 32))
+	}
+	return prefixes
+}
+
+// Goroutines adding prefixes, and writing the database meanwhile, end with
+// the database of a serial build. Run with -race.
+func TestBuilderConcurrent(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BuildEpoch = 1700000000
+	prefixes := concurrentTestPrefixes()
+	record := func(i int) Record {
+		return Record{ASN: uint32(64500 + i%100), Organization: fmt.Sprintf("Org %d", i%100)}
+	}
+
+	serial, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, prefix := range prefixes {
+		if err := serial.AddPrefix(prefix, record(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want bytes.Buffer
+	if _, err := serial.WriteTo(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{2, 8} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			b, err := NewWithOptions(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			errs := make(chan error, workers+1)
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := w; i < len(prefixes); i += workers {
+						if err := b.AddPrefix(prefixes[i], record(i)); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+			// A reader of the database while it is being built.
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 3 {
+					if _, err := b.WriteTo(io.Discard); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			var got bytes.Buffer
+			if _, err := b.WriteTo(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Error("the database differs from the serial build")
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package mmdbbuild
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/maxmind/mmdbwriter"
+)
+
+// ErrReservedNetwork and ErrAliasedNetwork are the unsupported networks a
+// NetworkPolicy rejects. Both wrap ErrUnsupportedNetwork.
+var (
+	ErrReservedNetwork = fmt.Errorf("%w: reserved network", ErrUnsupportedNetwork)
+	ErrAliasedNetwork  = fmt.Errorf("%w: IPv4-aliased network", ErrUnsupportedNetwork)
+)
+
+// reservedIPv4 and reservedIPv6 are the networks mmdbwriter refuses data in
+// unless Options.IncludeReservedNetworks is set, and aliasedIPv6 those it
+// maps onto the IPv4 subtree of an IPv6 database unless
+// Options.DisableIPv4Aliasing is set. They mirror mmdbwriter v1.0.0.
+var (
+	reservedIPv4 = []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/29", "192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16",
+		"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	}
+	reservedIPv6 = []string{
+		"100::/64", "2001:1::/32", "2001:2::/31", "2001:4::/30", "2001:8::/29", "2001:10::/28",
+		"2001:20::/27", "2001:40::/26", "2001:80::/25", "2001:100::/24", "2001:db8::/32",
+		"fc00::/7", "fe80::/10", "ff00::/8",
+	}
+	aliasedIPv6 = []string{"::ffff:0:0/96", "2001::/32", "2002::/16"}
+)
+
+// NetworkPolicy tells which networks a tree written with some options can
+// hold, before they are inserted, so that callers can skip reserved and
+// aliased space by error type rather than by the text of an mmdbwriter
+// error. Like mmdbwriter, it only rejects networks within such space: a
+// network that contains some is inserted, and the space left out.
+type NetworkPolicy struct {
+	ipv4    bool
+	blocked []blockedNetwork
+}
+
+type blockedNetwork struct {
+	prefix netip.Prefix
+	err    error
+}
+
+// NewNetworkPolicy returns the policy of a tree written with opts.
+func NewNetworkPolicy(opts mmdbwriter.Options) NetworkPolicy {
+	p := NetworkPolicy{ipv4: opts.IPVersion == 4}
+	block := func(networks []string, err error) {
+		for _, network := range networks {
+			prefix := netip.MustParsePrefix(network)
+			// IPv4 networks are stored at ::/96 of an IPv6 tree.
+			if !p.ipv4 && prefix.Addr().Is4() {
+				prefix = netip.PrefixFrom(ipv4Root(prefix.Addr()), prefix.Bits()+96)
+			}
+			p.blocked = append(p.blocked, blockedNetwork{prefix, err})
+		}
+	}
+	if !opts.IncludeReservedNetworks {
+		block(reservedIPv4, ErrReservedNetwork)
+		if !p.ipv4 {
+			block(reservedIPv6, ErrReservedNetwork)
+		}
+	}
+	if !p.ipv4 && !opts.DisableIPv4Aliasing {
+		block(aliasedIPv6, ErrAliasedNetwork)
+	}
+	return p
+}
+
+// Check returns an error wrapping ErrReservedNetwork or ErrAliasedNetwork
+// when the tree cannot hold data within prefix, and nil otherwise.
+// Prefixes of the wrong family, such as IPv6 in an IPv4 tree, are left to
+// the tree to reject. An IPv4-mapped prefix, ::ffff:a.b.c.d/n, is IPv6
+// space.
+func (p NetworkPolicy) Check(prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return nil
+	}
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if !p.ipv4 && addr.Is4() {
+		addr, bits = ipv4Root(addr), bits+96
+	}
+	for _, b := range p.blocked {
+		if b.prefix.Bits() <= bits && b.prefix.Contains(addr) {
+			return fmt.Errorf("%w %s (within %s)", b.err, prefix.Masked(), blockedDisplay(b.prefix))
+		}
+	}
+	return nil
+}
+
+// ipv4Root returns the address of an IPv4 address in the IPv4 subtree of
+// an IPv6 tree, ::a.b.c.d.
+func ipv4Root(addr netip.Addr) netip.Addr {
+	var b [16]byte
+	v4 := addr.Unmap().As4()
+	copy(b[12:], v4[:])
+	return netip.AddrFrom16(b)
+}
+
+// blockedDisplay writes a blocked network of the IPv4 subtree as the IPv4
+// network it was given as.
+func blockedDisplay(prefix netip.Prefix) string {
+	b := prefix.Addr().As16()
+	if prefix.Bits() >= 96 && [12]byte(b[:12]) == [12]byte{} {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(b[12:])), prefix.Bits()-96).String()
+	}
+	return prefix.String()
+}
@@ -0,0 +1,268 @@
+package mmdbbuild
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// ErrInvalidRecord is returned by Record.Validate, and by AddPrefix for the
+// records it rejects.
+var ErrInvalidRecord = errors.New("invalid record")
+
+// MaxStringLength is the longest string, in bytes, a record may hold.
+const MaxStringLength = 4096
+
+// RPKI validation states accepted in Record.RPKIStatus.
+const (
+	RPKIValid   = "valid"
+	RPKIInvalid = "invalid"
+	RPKIUnknown = "unknown"
+)
+
+// fieldKeys are the record fields Record has a typed field for. Fields may
+// not use them.
+var fieldKeys = []string{
+	"autonomous_system_number",
+	"autonomous_system_numbers",
+	"autonomous_system_organization",
+	"country",
+	"rpki_status",
+	"announced",
+	"is_anycast",
+	"is_bogon",
+	"is_aggregate",
+}
+
+// Record is the data stored for a prefix. Map converts it to the record
+// of the database, with the field names the mmdbwriter command uses, and
+// RecordFromMap reads one back.
+type Record struct {
+	// ASN is stored as autonomous_system_number. ASN 0 means "not
+	// announced" and is left out.
+	ASN uint32
+
+	// ASNs are the members of an AS_SET origin, stored as
+	// autonomous_system_numbers. A record has ASN or ASNs, not both.
+	ASNs []uint32
+
+	// Organization is stored as autonomous_system_organization when not
+	// empty.
+	Organization string
+
+	// Country is the ISO 3166 alpha-2 code of the prefix, stored as
+	// country when not empty.
+	Country string
+
+	// RPKIStatus is stored as rpki_status when not empty: RPKIValid,
+	// RPKIInvalid or RPKIUnknown.
+	RPKIStatus string
+
+	// Unannounced stores announced false, for delegated space without a
+	// route.
+	Unannounced bool
+
+	// IsAnycast, IsBogon and IsAggregate are stored as is_anycast,
+	// is_bogon and is_aggregate when set.
+	IsAnycast   bool
+	IsBogon     bool
+	IsAggregate bool
+
+	// Fields are stored in addition to the above, e.g. reverse_dns. They
+	// may not use the names of the fields above.
+	Fields map[string]mmdbtype.DataType
+}
+
+// Map returns the database record of r. It does not validate r.
+func (r Record) Map() mmdbtype.Map {
+	record := make(mmdbtype.Map, len(r.Fields)+4)
+	for key, value := range r.Fields {
+		record[mmdbtype.String(key)] = value
+	}
+	if r.ASN != 0 {
+		record["autonomous_system_number"] = mmdbtype.Uint32(r.ASN)
+	}
+	if len(r.ASNs) > 0 {
+		members := make(mmdbtype.Slice, len(r.ASNs))
+		for i, asn := range r.ASNs {
+			members[i] = mmdbtype.Uint32(asn)
+		}
+		record["autonomous_system_numbers"] = members
+	}
+	if r.Organization != "" {
+		record["autonomous_system_organization"] = mmdbtype.String(r.Organization)
+	}
+	if r.Country != "" {
+		record["country"] = mmdbtype.String(r.Country)
+	}
+	if r.RPKIStatus != "" {
+		record["rpki_status"] = mmdbtype.String(r.RPKIStatus)
+	}
+	if r.Unannounced {
+		record["announced"] = mmdbtype.Bool(false)
+	}
+	for key, set := range map[mmdbtype.String]bool{
+		"is_anycast":   r.IsAnycast,
+		"is_bogon":     r.IsBogon,
+		"is_aggregate": r.IsAggregate,
+	} {
+		if set {
+			record[key] = mmdbtype.Bool(true)
+		}
+	}
+	return record
+}
+
+// Validate reports the first problem of r as an error wrapping
+// ErrInvalidRecord: both ASN and ASNs set, a malformed country code or
+// RPKI state, Fields using the name of a typed field, nil values, and
+// strings, anywhere in the record, that are not UTF-8 or longer than
+// MaxStringLength.
+func (r Record) Validate() error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalidRecord, fmt.Sprintf(format, args...))
+	}
+	if r.ASN != 0 && len(r.ASNs) > 0 {
+		return invalid("both ASN and ASNs are set")
+	}
+	if err := checkString("autonomous_system_organization", r.Organization); err != nil {
+		return invalid("%v", err)
+	}
+	if r.Country != "" && !isCountryCode(r.Country) {
+		return invalid("country %q is not an ISO 3166 alpha-2 code", r.Country)
+	}
+	switch r.RPKIStatus {
+	case "", RPKIValid, RPKIInvalid, RPKIUnknown:
+	default:
+		return invalid("rpki_status %q is not %s, %s or %s", r.RPKIStatus, RPKIValid, RPKIInvalid, RPKIUnknown)
+	}
+
+	keys := make([]string, 0, len(r.Fields))
+	for key := range r.Fields {
+		keys = append(keys, key)
+	}
+	// Sorted, so the same record always reports the same problem.
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch {
+		case key == "":
+			return invalid("field with an empty name")
+		case slices.Contains(fieldKeys, key):
+			return invalid("field %s must be set through its Record field", key)
+		}
+		if err := checkValue(key, r.Fields[key]); err != nil {
+			return invalid("%v", err)
+		}
+	}
+	return nil
+}
+
+// checkValue checks the strings within value, which is at path.
+func checkValue(path string, value mmdbtype.DataType) error {
+	switch v := value.(type) {
+	case nil:
+		return fmt.Errorf("%s has no value", path)
+	case mmdbtype.String:
+		return checkString(path, string(v))
+	case mmdbtype.Map:
+		for key, item := range v {
+			if err := checkString(path+" key", string(key)); err != nil {
+				return err
+			}
+			if err := checkValue(path+"."+string(key), item); err != nil {
+				return err
+			}
+		}
+	case mmdbtype.Slice:
+		for i, item := range v {
+			if err := checkValue(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkString(path, s string) error {
+	switch {
+	case !utf8.ValidString(s):
+		return fmt.Errorf("%s is not valid UTF-8", path)
+	case len(s) > MaxStringLength:
+		return fmt.Errorf("%s is %d bytes, longer than %d", path, len(s), MaxStringLength)
+	}
+	return nil
+}
+
+func isCountryCode(s string) bool {
+	return len(s) == 2 && s[0] >= 'A' && s[0] <= 'Z' && s[1] >= 'A' && s[1] <= 'Z'
+}
+
+// RecordFromMap returns the Record of a database record, such as one read
+// from an existing database. Fields without a typed field go to Fields; a
+// typed field of the wrong type is an error wrapping ErrInvalidRecord.
+// Flags holding their default, such as is_anycast false or announced true,
+// read as unset, so Map leaves them out.
+func RecordFromMap(m mmdbtype.Map) (Record, error) {
+	var r Record
+	wrongType := func(key string, value mmdbtype.DataType) error {
+		return fmt.Errorf("%w: %s has type %T", ErrInvalidRecord, key, value)
+	}
+	for key, value := range m {
+		var ok bool
+		switch key {
+		case "autonomous_system_number":
+			var v mmdbtype.Uint32
+			v, ok = value.(mmdbtype.Uint32)
+			r.ASN = uint32(v)
+		case "autonomous_system_numbers":
+			var members mmdbtype.Slice
+			if members, ok = value.(mmdbtype.Slice); ok {
+				for _, member := range members {
+					asn, isASN := member.(mmdbtype.Uint32)
+					if !isASN {
+						return Record{}, wrongType(string(key)+" member", member)
+					}
+					r.ASNs = append(r.ASNs, uint32(asn))
+				}
+			}
+		case "autonomous_system_organization", "country", "rpki_status":
+			var v mmdbtype.String
+			v, ok = value.(mmdbtype.String)
+			switch key {
+			case "autonomous_system_organization":
+				r.Organization = string(v)
+			case "country":
+				r.Country = string(v)
+			default:
+				r.RPKIStatus = string(v)
+			}
+		case "announced", "is_anycast", "is_bogon", "is_aggregate":
+			var v mmdbtype.Bool
+			v, ok = value.(mmdbtype.Bool)
+			switch key {
+			case "announced":
+				r.Unannounced = ok && !bool(v)
+			case "is_anycast":
+				r.IsAnycast = bool(v)
+			case "is_bogon":
+				r.IsBogon = bool(v)
+			default:
+				r.IsAggregate = bool(v)
+			}
+		default:
+			if r.Fields == nil {
+				r.Fields = map[string]mmdbtype.DataType{}
+			}
+			r.Fields[string(key)] = value
+			ok = true
+		}
+		if !ok {
+			return Record{}, wrongType(string(key), value)
+		}
+	}
+	return r, nil
+}
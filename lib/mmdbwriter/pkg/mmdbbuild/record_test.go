@@ -0,0 +1,19 @@
+package mmdbbuild
+
+import (
+	"testing"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// Map and RecordFromMap convert between Record and database records.
+func TestRecordMap(t *testing.T) {
+	r := Record{ASN: 13335, Organization: "Cloudflare, Inc.", Country: "US", Fields: map[string]mmdbtype.DataType{"reverse_dns": mmdbtype.String("one.one.one.one")}}
+	back, err := RecordFromMap(r.Map())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.ASN != r.ASN || back.Organization != r.Organization || back.Country != r.Country || back.Fields["reverse_dns"] != r.Fields["reverse_dns"] {
+		t.Errorf("got %+v, want %+v", back, r)
+	}
+}
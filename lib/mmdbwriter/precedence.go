@@ -0,0 +1,93 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// inputList is the repeatable -input flag: `file[,priority=N][,format=F]`.
+type inputList []inputSource
+
+func (l *inputList) String() string {
+	parts := make([]string, len(*l))
+	for i, in := range *l {
+		parts[i] = in.file
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *inputList) Set(value string) error {
+	parts := strings.Split(value, ",")
+	in := inputSource{file: parts[0]}
+	if in.file == "" {
+		return fmt.Errorf("input %q has no file", value)
+	}
+	for _, opt := range parts[1:] {
+		k, v, _ := strings.Cut(opt, "=")
+		switch strings.TrimSpace(k) {
+		case "priority":
+			p, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("invalid priority %q of input %s", v, in.file)
+			}
+			in.priority = p
+		case "format":
+			in.format = strings.TrimSpace(v)
+		default:
+			return fmt.Errorf("unknown option %q of input %s (want priority or format)", opt, in.file)
+		}
+	}
+	*l = append(*l, in)
+	return nil
+}
+
+// buildInputs returns the inputs of a build in the order they are read:
+// by ascending priority, so that inputs of a higher priority override the
+// address space of lower ones, and in the given order within a priority.
+func buildInputs(cfg *config) []inputSource {
+	inputs := append([]inputSource{{file: cfg.csvFile, format: cfg.format, priority: cfg.inputPriority}}, cfg.extraInputs...)
+	slices.SortStableFunc(inputs, func(a, b inputSource) int { return cmp.Compare(a.priority, b.priority) })
+	return inputs
+}
+
+// layeredInputs reports whether the inputs of a build have more than one
+// priority, so that conflicts between them are checked.
+func layeredInputs(cfg *config) bool {
+	if cfg.extraInputs == nil {
+		return false
+	}
+	for _, in := range cfg.extraInputs {
+		if in.priority != cfg.inputPriority {
+			return true
+		}
+	}
+	return false
+}
+
+// overriddenASNs returns the origin ASNs, other than that of record, of the
+// data in the tree that inserting record at network would replace. The
+// tree is left as it is.
+func overriddenASNs(writer *mmdbwriter.Tree, prefix netip.Prefix, record mmdbtype.Map) ([]uint32, error) {
+	asn, hasASN := record["autonomous_system_number"].(mmdbtype.Uint32)
+	var asns []uint32
+	err := writer.InsertFunc(prefixNetwork(prefix), func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+		m, ok := existing.(mmdbtype.Map)
+		if !ok {
+			return existing, nil
+		}
+		old, ok := m["autonomous_system_number"].(mmdbtype.Uint32)
+		if ok && (!hasASN || old != asn) && !slices.Contains(asns, uint32(old)) {
+			asns = append(asns, uint32(old))
+		}
+		return existing, nil
+	})
+	slices.Sort(asns)
+	return asns, err
+}
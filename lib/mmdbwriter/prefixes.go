@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Output formats of the prefixes command.
+const (
+	prefixesCIDR = "cidr"
+	prefixesJSON = "json"
+	prefixesBIRD = "bird"
+	prefixesIOS  = "ios"
+)
+
+// asnPrefixes are the prefixes originated by one ASN, IPv4 before IPv6,
+// each in address order.
+type asnPrefixes struct {
+	ASN      uint32         `json:"asn"`
+	Prefixes []netip.Prefix `json:"prefixes"`
+}
+
+// runPrefixes implements `prefixes [flags] <db.mmdb>`: it lists the
+// networks whose origin is one of the -asn ASNs, as a CIDR list, JSON or a
+// BIRD or IOS prefix list for route filters.
+func runPrefixes(args []string) error {
+	fs := flag.NewFlagSet("prefixes", flag.ExitOnError)
+	var asns asnList
+	fs.Var(&asns, "asn", "origin `ASNs` to list, comma-separated ASNs and ranges, e.g. 13335 or AS64512-AS65534 (repeatable)")
+	format := fs.String("format", prefixesCIDR,
+		"output `format`: cidr (one prefix per line), json, bird (prefix set definitions) or ios (prefix-list commands)")
+	family := fs.Int("family", 0, "only list IPv4 (4) or IPv6 (6) prefixes (default both)")
+	aggregate := fs.Bool("aggregate", false, "merge adjacent prefixes of an ASN into the fewest covering them")
+	maxLen := fs.Int("max-len", 0,
+		"with bird and ios, also accept more specifics up to this prefix `length` (default exact matches)")
+	name := fs.String("name", "", "`name` of the bird and ios prefix lists (default AS<asn>, one list per ASN; with several ASNs, one list of all)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s prefixes [flags] <db.mmdb>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("prefixes needs a database")
+	}
+	if len(asns) == 0 {
+		return errors.New("prefixes needs -asn")
+	}
+	switch *format {
+	case prefixesCIDR, prefixesJSON, prefixesBIRD, prefixesIOS:
+	default:
+		return fmt.Errorf("invalid -format %q: must be %s, %s, %s or %s", *format, prefixesCIDR, prefixesJSON, prefixesBIRD, prefixesIOS)
+	}
+	if *family != 0 && *family != 4 && *family != 6 {
+		return fmt.Errorf("invalid -family %d: must be 4 or 6", *family)
+	}
+	if *maxLen < 0 || *maxLen > 128 {
+		return errors.New("-max-len must be between 0 and 128")
+	}
+
+	db, err := maxminddb.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open MMDB file: %w", err)
+	}
+	defer db.Close()
+
+	lists, err := originPrefixes(db, asns, *family)
+	if err != nil {
+		return err
+	}
+	if *aggregate {
+		for i := range lists {
+			lists[i].Prefixes = aggregatePrefixes(lists[i].Prefixes)
+		}
+	}
+	for _, l := range lists {
+		logger.Debug("prefixes found", "asn", l.ASN, "prefixes", len(l.Prefixes))
+	}
+	if len(lists) == 0 {
+		logger.Warn("no prefixes found", "asns", asns.String())
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	switch *format {
+	case prefixesCIDR:
+		for _, l := range lists {
+			for _, p := range l.Prefixes {
+				fmt.Fprintln(w, p)
+			}
+		}
+	case prefixesJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if lists == nil {
+			lists = []asnPrefixes{}
+		}
+		if err := enc.Encode(lists); err != nil {
+			return err
+		}
+	default:
+		// A named list holds the prefixes of every ASN.
+		if *name != "" {
+			var all []netip.Prefix
+			for _, l := range lists {
+				all = append(all, l.Prefixes...)
+			}
+			slices.SortFunc(all, comparePrefixes)
+			writePrefixList(w, *format, *name, all, *maxLen)
+			break
+		}
+		for _, l := range lists {
+			writePrefixList(w, *format, fmt.Sprintf("AS%d", l.ASN), l.Prefixes, *maxLen)
+		}
+	}
+	return w.Flush()
+}
+
+// originPrefixes walks db for the networks whose autonomous_system_number
+// is in asns, limited to family 4 or 6 unless it is 0, and returns them by
+// ASN in ASN order. AS_SET origins have no single origin and are left out.
+// IPv4 networks of an IPv6 database are listed as IPv4.
+func originPrefixes(db *maxminddb.Reader, asns asnList, family int) ([]asnPrefixes, error) {
+	found := map[uint32][]netip.Prefix{}
+	err := walkDatabase(db, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+		m, _ := record.(mmdbtype.Map)
+		asn, ok := m["autonomous_system_number"].(mmdbtype.Uint32)
+		if !ok || !asns.contains(uint32(asn)) {
+			return nil
+		}
+		addr, _ := netip.AddrFromSlice(network.IP)
+		ones, _ := network.Mask.Size()
+		prefix := netip.PrefixFrom(addr.Unmap(), ones)
+		if family == 4 && !prefix.Addr().Is4() || family == 6 && prefix.Addr().Is4() {
+			return nil
+		}
+		found[uint32(asn)] = append(found[uint32(asn)], prefix)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	lists := make([]asnPrefixes, 0, len(found))
+	for asn, prefixes := range found {
+		slices.SortFunc(prefixes, comparePrefixes)
+		lists = append(lists, asnPrefixes{ASN: asn, Prefixes: prefixes})
+	}
+	slices.SortFunc(lists, func(a, b asnPrefixes) int { return cmp.Compare(a.ASN, b.ASN) })
+	return lists, nil
+}
+
+// comparePrefixes orders IPv4 before IPv6, then by address and length.
+func comparePrefixes(a, b netip.Prefix) int {
+	if a.Addr().Is4() != b.Addr().Is4() {
+		if a.Addr().Is4() {
+			return -1
+		}
+		return 1
+	}
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// aggregatePrefixes merges the adjacent prefixes of a sorted, disjoint
+// list into the fewest prefixes covering the same addresses.
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	var ranges []addrRange
+	for _, p := range prefixes {
+		r := addrRange{p.Masked().Addr(), prefixLast(p)}
+		if n := len(ranges); n > 0 && ranges[n-1].last.Next() == r.first {
+			ranges[n-1].last = r.last
+		} else {
+			ranges = append(ranges, r)
+		}
+	}
+	out := []netip.Prefix{}
+	for _, r := range ranges {
+		out = append(out, rangePrefixes(r.first, r.last)...)
+	}
+	return out
+}
+
+// writePrefixList writes the prefixes as BIRD prefix set definitions or IOS
+// prefix-list commands, one list per address family as both need. With
+// maxLen, more specifics of each prefix up to that length match too.
+func writePrefixList(w io.Writer, format, name string, prefixes []netip.Prefix, maxLen int) {
+	var v4, v6 []netip.Prefix
+	for _, p := range prefixes {
+		if p.Addr().Is4() {
+			v4 = append(v4, p)
+		} else {
+			v6 = append(v6, p)
+		}
+	}
+	// le must be at least the length of the prefix, and within the family.
+	upTo := func(p netip.Prefix) int {
+		if maxLen <= p.Bits() {
+			return 0
+		}
+		return min(maxLen, p.Addr().BitLen())
+	}
+	for _, fam := range []struct {
+		prefixes []netip.Prefix
+		suffix   string
+		ios      string
+	}{
+		{v4, "_V4", "ip"},
+		{v6, "_V6", "ipv6"},
+	} {
+		if len(fam.prefixes) == 0 {
+			continue
+		}
+		if format == prefixesBIRD {
+			entries := make([]string, len(fam.prefixes))
+			for i, p := range fam.prefixes {
+				entries[i] = p.String()
+				if le := upTo(p); le > 0 {
+					entries[i] += fmt.Sprintf("{%d,%d}", p.Bits(), le)
+				}
+			}
+			fmt.Fprintf(w, "define %s%s = [\n    %s\n];\n", name, fam.suffix, strings.Join(entries, ",\n    "))
+			continue
+		}
+		listName := name
+		if fam.ios == "ipv6" {
+			listName += "-v6"
+		}
+		fmt.Fprintf(w, "no %s prefix-list %s\n", fam.ios, listName)
+		for i, p := range fam.prefixes {
+			fmt.Fprintf(w, "%s prefix-list %s seq %d permit %s", fam.ios, listName, (i+1)*5, p)
+			if le := upTo(p); le > 0 {
+				fmt.Fprintf(w, " le %d", le)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
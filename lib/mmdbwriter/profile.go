@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiles starts the -cpuprofile profile and returns the function
+// that stops it and writes the -memprofile allocation profile, to be called
+// once the build is done. Both are pprof files for `go tool pprof`.
+func startProfiles(cfg *config) (func() error, error) {
+	var cpu *os.File
+	if cfg.cpuProfile != "" {
+		fh, err := os.Create(cfg.cpuProfile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(fh); err != nil {
+			fh.Close()
+			return nil, fmt.Errorf("failed to start CPU profile: %w", err)
+		}
+		cpu = fh
+	}
+
+	return func() error {
+		var errs []error
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			if err := cpu.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to write CPU profile: %w", err))
+			}
+		}
+		if cfg.memProfile != "" {
+			errs = append(errs, writeMemProfile(cfg.memProfile))
+		}
+		return errors.Join(errs...)
+	}, nil
+}
+
+// writeMemProfile writes the allocations since the start of the process,
+// which `go tool pprof -sample_index=alloc_space` shows by size and the
+// default inuse_space by what was still live at the last GC.
+func writeMemProfile(path string) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create memory profile: %w", err)
+	}
+	// An up-to-date heap needs a completed GC cycle.
+	runtime.GC()
+	if err := pprof.Lookup("allocs").WriteTo(fh, 0); err != nil {
+		fh.Close()
+		return fmt.Errorf("failed to write memory profile: %w", err)
+	}
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("failed to write memory profile: %w", err)
+	}
+	return nil
+}
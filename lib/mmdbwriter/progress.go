@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// countingReader counts the bytes read through it, which tells how far into
+// the input the build is.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// progressFile writes periodic progress lines to a file that can be tailed
+// in headless runs, keeping progress out of stdout.
+type progressFile struct {
+	fh    *os.File
+	input *countingReader
+	total int64
+	start time.Time
+}
+
+// openProgressFile opens path, truncating it unless appending. total is the
+// input size in bytes, or 0 when unknown.
+func openProgressFile(path string, appendMode bool, input *countingReader, total int64) (*progressFile, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendMode {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	fh, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open progress file: %w", err)
+	}
+	return &progressFile{fh: fh, input: input, total: total, start: time.Now()}, nil
+}
+
+// report writes one line with the records processed so far, the share of
+// the input consumed, the elapsed time and the estimated time remaining.
+func (p *progressFile) report(records int) error {
+	elapsed := time.Since(p.start)
+
+	percent, eta := "?", "?"
+	if read := p.input.n.Load(); p.total > 0 && read > 0 {
+		fraction := float64(read) / float64(p.total)
+		if fraction > 1 {
+			fraction = 1
+		}
+		percent = fmt.Sprintf("%.1f", fraction*100)
+		remaining := time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+		eta = remaining.Round(time.Millisecond).String()
+	}
+
+	_, err := fmt.Fprintf(p.fh, "%s records=%d percent=%s elapsed=%s eta=%s\n",
+		time.Now().UTC().Format(time.RFC3339), records, percent, elapsed.Round(time.Millisecond), eta)
+	return err
+}
+
+func (p *progressFile) close() error {
+	return p.fh.Close()
+}
+
+// progressBar redraws a single status line on a terminal with the share of
+// the input consumed, the record rate and the estimated time remaining. It
+// renders on its own ticker so the build only pays for an atomic store per
+// record.
+type progressBar struct {
+	w       io.Writer
+	input   *countingReader
+	total   int64
+	start   time.Time
+	records atomic.Int64
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// progressBarWidth is the number of cells of the bar itself.
+const progressBarWidth = 30
+
+// startProgressBar starts redrawing the bar on w. total is the input size
+// in bytes, or 0 when unknown, in which case only the records and rate are
+// shown.
+func startProgressBar(w io.Writer, input *countingReader, total int64) *progressBar {
+	p := &progressBar{
+		w:       w,
+		input:   input,
+		total:   total,
+		start:   time.Now(),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render()
+			case <-p.done:
+				p.render()
+				fmt.Fprintln(p.w)
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progressBar) update(records int) {
+	p.records.Store(int64(records))
+}
+
+func (p *progressBar) render() {
+	elapsed := time.Since(p.start)
+	records := p.records.Load()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(records) / elapsed.Seconds()
+	}
+
+	if p.total <= 0 {
+		fmt.Fprintf(p.w, "\r%d records  %.0f/s  %s ", records, rate, elapsed.Round(time.Second))
+		return
+	}
+
+	fraction := float64(p.input.n.Load()) / float64(p.total)
+	if fraction > 1 {
+		fraction = 1
+	}
+	eta := "?"
+	if fraction > 0 {
+		eta = time.Duration(float64(elapsed) * (1 - fraction) / fraction).Round(time.Second).String()
+	}
+	filled := int(fraction * progressBarWidth)
+	fmt.Fprintf(p.w, "\r[%s%s] %5.1f%%  %d records  %.0f/s  ETA %s ",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		fraction*100, records, rate, eta)
+}
+
+// stop draws the final state and ends the line.
+func (p *progressBar) stop() {
+	close(p.done)
+	<-p.stopped
+}
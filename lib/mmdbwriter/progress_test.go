@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// progressLine matches a line of -progress-file, capturing the records and
+// percent.
+var progressLine = regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ records=(\d+) percent=([0-9.]+|\?) elapsed=\S+ eta=\S+$`)
+
+func TestProgressFile(t *testing.T) {
+	// 20005 rows: a line every 10000 records and one at the end.
+	var input strings.Builder
+	input.WriteString("network,asn\n")
+	const rows = 20005
+	for i := range rows {
+		fmt.Fprintf(&input, "11.%d.%d.0/24,%d\n", i>>8, i&0xff, 64500+i%10)
+	}
+	wantRecords := []string{"10000", "20000", "20005"}
+
+	tests := []struct {
+		name   string
+		args   []string
+		builds int
+		want   []string
+	}{
+		{"one build", nil, 1, wantRecords},
+		{"truncated", nil, 2, wantRecords},
+		{"-progress-append", []string{"-progress-append"}, 2, append(wantRecords, wantRecords...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "progress.log")
+			for range tt.builds {
+				buildTestDB(t, testConfig(t, append([]string{"-progress-file", path}, tt.args...)...), input.String())
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got %d progress lines, want %d:\n%s", len(lines), len(tt.want), data)
+			}
+			for i, line := range lines {
+				m := progressLine.FindStringSubmatch(line)
+				if m == nil {
+					t.Errorf("malformed progress line %q", line)
+					continue
+				}
+				if m[1] != tt.want[i] {
+					t.Errorf("line %d: got records=%s, want %s", i+1, m[1], tt.want[i])
+				}
+				// The input size is known, so every line has a percent,
+				// and the last of a build has read all of it.
+				if m[2] == "?" || m[1] == wantRecords[len(wantRecords)-1] && m[2] != "100.0" {
+					t.Errorf("line %d: got percent=%s", i+1, m[2])
+				}
+			}
+		})
+	}
+}
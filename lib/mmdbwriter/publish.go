@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Files the publish command maintains at the top of its directory.
+const (
+	publishIndexFile   = "index.json"
+	publishLatestLink  = "latest"
+	publishLatestFile  = "latest.txt"
+	publishDateLayout  = "2006/01/02"
+	publishDateDisplay = "2006-01-02"
+)
+
+// publishIndex is the index.json of a publish directory: every version of
+// the database, newest first.
+type publishIndex struct {
+	Name     string           `json:"name"`
+	Latest   string           `json:"latest"`
+	Versions []publishVersion `json:"versions"`
+}
+
+// publishVersion is one published database. Its path and those of its
+// sidecars are relative to the publish directory, with forward slashes.
+type publishVersion struct {
+	Date       string   `json:"date"`
+	Path       string   `json:"path"`
+	Size       int64    `json:"size"`
+	SHA256     string   `json:"sha256"`
+	BuildEpoch uint     `json:"build_epoch"`
+	Sidecars   []string `json:"sidecars,omitempty"`
+}
+
+// publishSidecarSuffixes are the sidecars of a database that are published
+// with it when they exist: the checksum, its signatures and the manifest.
+func publishSidecarSuffixes() []string {
+	suffixes := []string{checksumSuffix}
+	for _, method := range []string{signMinisign, signGPG, signEd25519} {
+		suffixes = append(suffixes, checksumSuffix+signatureSuffixes[method])
+	}
+	return append(suffixes, manifestSuffix)
+}
+
+// runPublish implements `publish [flags] <db.mmdb> <dir>`: it copies a
+// database and its sidecars to dir/YYYY/MM/DD/, points the latest symlink
+// and latest.txt at the newest version and rewrites index.json, for mirrors
+// to pick up. The date is the build time of the database.
+func runPublish(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	date := fs.String("date", "", "publish under this `YYYY-MM-DD` date instead of the build date of the database (UTC)")
+	keep := fs.Int("keep", 0, "only keep the newest `N` versions, removing older ones (0 keeps all)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s publish [flags] <db.mmdb> <dir>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("publish needs a database and a directory")
+	}
+	if *keep < 0 {
+		return errors.New("-keep must not be negative")
+	}
+	src, dir := fs.Arg(0), fs.Arg(1)
+	name := filepath.Base(src)
+
+	db, err := maxminddb.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open MMDB file: %w", err)
+	}
+	day := time.Unix(int64(db.Metadata.BuildEpoch), 0).UTC()
+	db.Close()
+	if *date != "" {
+		if day, err = time.Parse(publishDateDisplay, *date); err != nil {
+			return fmt.Errorf("invalid -date %q: want YYYY-MM-DD", *date)
+		}
+	}
+
+	index, err := readPublishIndex(dir, name)
+	if err != nil {
+		return err
+	}
+	rel := path.Join(day.Format(publishDateLayout), name)
+	dest := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := copyFileAtomic(src, dest); err != nil {
+		return err
+	}
+	for _, suffix := range publishSidecarSuffixes() {
+		sidecar := dest + suffix
+		err := copyFileAtomic(src+suffix, sidecar)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// A sidecar an earlier publish of the day left behind would
+			// not match the new database.
+			if err := os.Remove(sidecar); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+	}
+	logger.Info("database published", "file", dest, "date", day.Format(publishDateDisplay))
+
+	versions, err := scanPublishVersions(dir, name, index.Versions, rel)
+	if err != nil {
+		return err
+	}
+	if *keep > 0 && len(versions) > *keep {
+		for _, v := range versions[*keep:] {
+			if err := removePublishVersion(dir, v); err != nil {
+				return err
+			}
+			logger.Info("removed old version", "path", v.Path)
+		}
+		versions = versions[:*keep]
+	}
+	index.Versions = versions
+	index.Latest = ""
+	if len(versions) > 0 {
+		index.Latest = versions[0].Path
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, publishIndexFile), append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if index.Latest != "" {
+		if err := writePublishLatest(dir, index.Latest); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("published %s (latest %s, %d versions)\n", rel, index.Latest, len(versions))
+	return nil
+}
+
+// readPublishIndex reads the index.json of dir, or returns an empty index
+// when there is none yet. A directory holds the versions of one database.
+func readPublishIndex(dir, name string) (*publishIndex, error) {
+	index := &publishIndex{Name: name}
+	data, err := os.ReadFile(filepath.Join(dir, publishIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("invalid index %s: %w", filepath.Join(dir, publishIndexFile), err)
+	}
+	if index.Name != name {
+		return nil, fmt.Errorf("%s publishes %s, not %s", dir, index.Name, name)
+	}
+	return index, nil
+}
+
+// scanPublishVersions lists the versions of name under dir, newest first.
+// Versions of the previous index are kept as they were when their size did
+// not change, so only new files are hashed; published is always hashed.
+func scanPublishVersions(dir, name string, previous []publishVersion, published string) ([]publishVersion, error) {
+	known := map[string]publishVersion{}
+	for _, v := range previous {
+		known[v.Path] = v
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]", name))
+	if err != nil {
+		return nil, err
+	}
+	var versions []publishVersion
+	for _, match := range matches {
+		rel, err := filepath.Rel(dir, match)
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+		day, err := time.Parse(publishDateLayout, path.Dir(rel))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := known[rel]
+		if !ok || rel == published || v.Size != info.Size() {
+			if v, err = describePublishVersion(match, rel, info.Size()); err != nil {
+				return nil, err
+			}
+		}
+		v.Date = day.Format(publishDateDisplay)
+		v.Sidecars = nil
+		for _, suffix := range publishSidecarSuffixes() {
+			if _, err := os.Stat(match + suffix); err == nil {
+				v.Sidecars = append(v.Sidecars, rel+suffix)
+			}
+		}
+		versions = append(versions, v)
+	}
+	slices.SortFunc(versions, func(a, b publishVersion) int {
+		return strings.Compare(b.Path, a.Path)
+	})
+	return versions, nil
+}
+
+// describePublishVersion hashes a published database and reads its build
+// time.
+func describePublishVersion(file, rel string, size int64) (publishVersion, error) {
+	sum, err := fileSHA256(file)
+	if err != nil {
+		return publishVersion{}, fmt.Errorf("failed to hash %s: %w", file, err)
+	}
+	db, err := maxminddb.Open(file)
+	if err != nil {
+		return publishVersion{}, fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer db.Close()
+	return publishVersion{Path: rel, Size: size, SHA256: hex.EncodeToString(sum), BuildEpoch: db.Metadata.BuildEpoch}, nil
+}
+
+// removePublishVersion deletes a version with its sidecars, and its day,
+// month and year directories once they are empty.
+func removePublishVersion(dir string, v publishVersion) error {
+	for _, rel := range append([]string{v.Path}, v.Sidecars...) {
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(rel))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	for parent := path.Dir(v.Path); parent != "."; parent = path.Dir(parent) {
+		// Removing a directory that is not empty fails, which ends the
+		// walk up.
+		if os.Remove(filepath.Join(dir, filepath.FromSlash(parent))) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// writePublishLatest writes latest.txt with the path of the newest version
+// and points the latest symlink at its directory. Both are replaced
+// atomically. The symlink is optional, for filesystems and mirrors without
+// symlinks latest.txt is enough.
+func writePublishLatest(dir, latest string) error {
+	if err := writeFileAtomic(filepath.Join(dir, publishLatestFile), []byte(latest+"\n")); err != nil {
+		return fmt.Errorf("failed to write %s: %w", publishLatestFile, err)
+	}
+	link := filepath.Join(dir, publishLatestLink)
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	err := os.Symlink(filepath.FromSlash(path.Dir(latest)), tmp)
+	if err == nil {
+		err = os.Rename(tmp, link)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		logger.Warn("failed to update latest symlink, only latest.txt points at the newest version",
+			"link", link, "error", err)
+	}
+	return nil
+}
+
+// copyFileAtomic copies src to dst like writeOutput: dst is replaced only
+// once the copy is complete.
+func copyFileAtomic(src, dst string) error {
+	fh, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	size := func() int64 {
+		info, err := fh.Stat()
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+	return writeOutput(context.Background(), dst, fh, size)
+}
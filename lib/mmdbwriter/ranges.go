@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// rangePrefixRows returns one row per prefix of the fewest prefixes
+// covering the addresses start to end, each the prefix followed by fields.
+func rangePrefixRows(start, end string, fields []string) ([][]string, error) {
+	first, err := netip.ParseAddr(start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range start %q", start)
+	}
+	last, err := netip.ParseAddr(end)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range end %q", end)
+	}
+	first, last = first.Unmap(), last.Unmap()
+	if first.BitLen() != last.BitLen() || last.Less(first) {
+		return nil, fmt.Errorf("invalid range %s-%s", first, last)
+	}
+	var rows [][]string
+	for _, prefix := range rangePrefixes(first, last) {
+		rows = append(rows, append([]string{prefix.String()}, fields...))
+	}
+	return rows, nil
+}
+
+// iptoasnReader reads the ip2asn TSV files of iptoasn.com
+// (range_start, range_end, AS_number, country_code, AS_description, tab
+// separated, optionally gzip compressed) as network, asn, org and country
+// columns, one row per prefix of each range. The "Not routed" ranges, with
+// ASN 0, are skipped, and lines that are not ranges are reported and
+// skipped.
+type iptoasnReader struct {
+	scanner *bufio.Scanner
+	line    int
+	pending [][]string
+	skipped int
+}
+
+func newIPtoASNReader(r io.Reader) *iptoasnReader {
+	return &iptoasnReader{scanner: bufio.NewScanner(r)}
+}
+
+func (ir *iptoasnReader) header() []string {
+	return []string{"network", "asn", "org", "country"}
+}
+
+func (ir *iptoasnReader) Read() ([]string, error) {
+	for len(ir.pending) == 0 {
+		if !ir.scanner.Scan() {
+			if err := ir.scanner.Err(); err != nil {
+				return nil, err
+			}
+			if ir.skipped > 0 {
+				logger.Info("skipped iptoasn ranges that are not routed", "ranges", ir.skipped)
+				ir.skipped = 0
+			}
+			return nil, io.EOF
+		}
+		ir.line++
+		line := strings.TrimRight(ir.scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			logger.Warn("skipping invalid iptoasn line", "line", ir.line, "error", "expected at least 3 tab-separated fields")
+			continue
+		}
+		for len(fields) < 5 {
+			fields = append(fields, "")
+		}
+		asn := strings.TrimSpace(fields[2])
+		if asn == "0" {
+			ir.skipped++
+			continue
+		}
+		country := strings.TrimSpace(fields[3])
+		if country == "None" {
+			country = ""
+		}
+		rows, err := rangePrefixRows(strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]),
+			[]string{asn, strings.TrimSpace(fields[4]), country})
+		if err != nil {
+			logger.Warn("skipping invalid iptoasn line", "line", ir.line, "error", err)
+			continue
+		}
+		ir.pending = rows
+	}
+	row := ir.pending[0]
+	ir.pending = ir.pending[1:]
+	return row, nil
+}
+
+func (ir *iptoasnReader) FieldPos(field int) (line, column int) {
+	return ir.line, 1
+}
+
+// ipinfoReader reads the IPinfo country_asn and IPinfo Lite CSV files,
+// optionally gzip compressed, by their header: the start_ip and end_ip
+// range or the network, asn and as_name become the network, asn and org
+// columns, followed by the other columns of the file, such as country and
+// as_domain. A range gives one row per prefix. Rows without an ASN are
+// skipped.
+type ipinfoReader struct {
+	cr      *csv.Reader
+	columns []string
+	pending [][]string
+	skipped int
+
+	startIndex, endIndex, networkIndex, asnIndex, orgIndex int
+	rest                                                   []int
+}
+
+func newIPinfoReader(r io.Reader) (*ipinfoReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IPinfo header: %w", err)
+	}
+	ir := &ipinfoReader{
+		cr:           cr,
+		columns:      []string{"network", "asn", "org"},
+		startIndex:   mmdbbuild.HeaderIndex(header, "start_ip"),
+		endIndex:     mmdbbuild.HeaderIndex(header, "end_ip"),
+		networkIndex: mmdbbuild.HeaderIndex(header, "network"),
+		asnIndex:     mmdbbuild.HeaderIndex(header, "asn"),
+		orgIndex:     mmdbbuild.HeaderIndex(header, "as_name"),
+	}
+	switch {
+	case ir.asnIndex < 0:
+		return nil, errors.New("IPinfo header has no asn column")
+	case ir.networkIndex < 0 && (ir.startIndex < 0 || ir.endIndex < 0):
+		return nil, errors.New("IPinfo header has neither start_ip and end_ip nor network columns")
+	}
+	used := []int{ir.startIndex, ir.endIndex, ir.networkIndex, ir.asnIndex, ir.orgIndex}
+	for i, name := range header {
+		if !slices.Contains(used, i) {
+			ir.rest = append(ir.rest, i)
+			ir.columns = append(ir.columns, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+	return ir, nil
+}
+
+func (ir *ipinfoReader) header() []string {
+	return ir.columns
+}
+
+func (ir *ipinfoReader) Read() ([]string, error) {
+	for len(ir.pending) == 0 {
+		row, err := ir.cr.Read()
+		if err == io.EOF && ir.skipped > 0 {
+			logger.Info("skipped IPinfo ranges without an ASN", "ranges", ir.skipped)
+			ir.skipped = 0
+		}
+		if err != nil {
+			return nil, err
+		}
+		asn := columnValue(row, ir.asnIndex)
+		if asn == "" {
+			ir.skipped++
+			continue
+		}
+		fields := []string{asn, columnValue(row, ir.orgIndex)}
+		for _, i := range ir.rest {
+			fields = append(fields, columnValue(row, i))
+		}
+		if ir.networkIndex >= 0 && columnValue(row, ir.networkIndex) != "" {
+			ir.pending = [][]string{append([]string{columnValue(row, ir.networkIndex)}, fields...)}
+			continue
+		}
+		rows, err := rangePrefixRows(columnValue(row, ir.startIndex), columnValue(row, ir.endIndex), fields)
+		if err != nil {
+			line, _ := ir.cr.FieldPos(0)
+			logger.Warn("skipping invalid IPinfo row", "line", line, "error", err)
+			continue
+		}
+		ir.pending = rows
+	}
+	row := ir.pending[0]
+	ir.pending = ir.pending[1:]
+	return row, nil
+}
+
+func (ir *ipinfoReader) FieldPos(field int) (line, column int) {
+	line, _ = ir.cr.FieldPos(0)
+	return line, 1
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// recordDecoder rebuilds mmdbtype values from a database so that records
+// can be copied into a new tree without losing their exact types. It
+// implements the deserializer interface of maxminddb-golang.
+type recordDecoder struct {
+	key   *mmdbtype.String
+	rv    mmdbtype.DataType
+	stack []*decoderFrame
+}
+
+type decoderFrame struct {
+	value   mmdbtype.DataType
+	curSize int
+}
+
+func (d *recordDecoder) ShouldSkip(uintptr) (bool, error) { return false, nil }
+
+func (d *recordDecoder) StartSlice(size uint) error {
+	// Allocate the final size up front; values are assigned by index.
+	return d.add(make(mmdbtype.Slice, size))
+}
+
+func (d *recordDecoder) StartMap(size uint) error { return d.add(make(mmdbtype.Map, size)) }
+
+func (d *recordDecoder) End() error {
+	if len(d.stack) == 0 {
+		return errors.New("received an End but the stack is empty")
+	}
+	d.stack = d.stack[:len(d.stack)-1]
+	return nil
+}
+
+func (d *recordDecoder) String(v string) error   { return d.add(mmdbtype.String(v)) }
+func (d *recordDecoder) Float64(v float64) error { return d.add(mmdbtype.Float64(v)) }
+func (d *recordDecoder) Bytes(v []byte) error    { return d.add(mmdbtype.Bytes(v)) }
+func (d *recordDecoder) Uint16(v uint16) error   { return d.add(mmdbtype.Uint16(v)) }
+func (d *recordDecoder) Uint32(v uint32) error   { return d.add(mmdbtype.Uint32(v)) }
+func (d *recordDecoder) Int32(v int32) error     { return d.add(mmdbtype.Int32(v)) }
+func (d *recordDecoder) Uint64(v uint64) error   { return d.add(mmdbtype.Uint64(v)) }
+func (d *recordDecoder) Bool(v bool) error       { return d.add(mmdbtype.Bool(v)) }
+func (d *recordDecoder) Float32(v float32) error { return d.add(mmdbtype.Float32(v)) }
+
+func (d *recordDecoder) Uint128(v *big.Int) error {
+	t := mmdbtype.Uint128(*v)
+	return d.add(&t)
+}
+
+func (d *recordDecoder) add(v mmdbtype.DataType) error {
+	if len(d.stack) == 0 {
+		d.rv = v
+	} else {
+		top := d.stack[len(d.stack)-1]
+		switch parent := top.value.(type) {
+		case mmdbtype.Map:
+			if d.key == nil {
+				key, ok := v.(mmdbtype.String)
+				if !ok {
+					return fmt.Errorf("expected a String map key but received %T", v)
+				}
+				d.key = &key
+				return nil
+			}
+			parent[*d.key] = v
+			d.key = nil
+			top.curSize++
+		case mmdbtype.Slice:
+			parent[top.curSize] = v
+			top.curSize++
+		}
+	}
+
+	switch v.(type) {
+	case mmdbtype.Map, mmdbtype.Slice:
+		d.stack = append(d.stack, &decoderFrame{value: v})
+	}
+	return nil
+}
+
+func (d *recordDecoder) reset() {
+	d.rv = nil
+	d.key = nil
+	d.stack = d.stack[:0]
+}
+
+// walkDatabase calls fn for every network in db that lies within the given
+// network (or every network when within is nil), skipping IPv4 aliases.
+func walkDatabase(
+	db *maxminddb.Reader,
+	within *net.IPNet,
+	fn func(network *net.IPNet, record mmdbtype.DataType) error,
+) error {
+	var networks *maxminddb.Networks
+	if within != nil {
+		networks = db.NetworksWithin(within, maxminddb.SkipAliasedNetworks)
+	} else {
+		networks = db.Networks(maxminddb.SkipAliasedNetworks)
+	}
+
+	dec := &recordDecoder{}
+	for networks.Next() {
+		dec.reset()
+		network, err := networks.Network(dec)
+		if err != nil {
+			return fmt.Errorf("failed to decode record: %w", err)
+		}
+		if err := fn(network, dec.rv); err != nil {
+			return err
+		}
+	}
+	return networks.Err()
+}
+
+// treeOptionsFrom returns writer options that reproduce the metadata of an
+// existing database. Reserved networks are allowed because whatever the
+// source contains has to be copied as-is.
+func treeOptionsFrom(metadata maxminddb.Metadata) mmdbwriter.Options {
+	return mmdbwriter.Options{
+		DatabaseType:            metadata.DatabaseType,
+		Description:             metadata.Description,
+		IPVersion:               int(metadata.IPVersion),
+		Languages:               metadata.Languages,
+		RecordSize:              int(metadata.RecordSize),
+		IncludeReservedNetworks: true,
+	}
+}
+
+// lookupRecord returns the record for ip and the network it belongs to. The
+// record is nil when the database has no data for ip.
+func lookupRecord(db *maxminddb.Reader, ip net.IP) (*net.IPNet, mmdbtype.DataType, error) {
+	dec := &recordDecoder{}
+	network, ok, err := db.LookupNetwork(ip, dec)
+	if err != nil || !ok {
+		return network, nil, err
+	}
+	return network, dec.rv, nil
+}
+
+// recordsEqual reports whether two decoded records hold the same data. Nil
+// records (no data) are only equal to each other.
+func recordsEqual(a, b mmdbtype.DataType) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
+
+// copyDatabase inserts every network of db within the given network (all of
+// them when within is nil) into a new tree built with opts, and returns the
+// tree with the number of networks copied.
+func copyDatabase(
+	db *maxminddb.Reader,
+	within *net.IPNet,
+	opts mmdbwriter.Options,
+) (*mmdbwriter.Tree, int, error) {
+	writer, err := mmdbwriter.New(opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	copied := 0
+	err = walkDatabase(db, within, func(network *net.IPNet, record mmdbtype.DataType) error {
+		if err := writer.Insert(network, record); err != nil {
+			return fmt.Errorf("failed to insert record for %s: %w", network, err)
+		}
+		copied++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return writer, copied, nil
+}
+
+// mmdbToJSON converts a decoded record into values encoding/json marshals
+// naturally.
+func mmdbToJSON(value mmdbtype.DataType) any {
+	switch v := value.(type) {
+	case mmdbtype.Map:
+		m := make(map[string]any, len(v))
+		for key, item := range v {
+			m[string(key)] = mmdbToJSON(item)
+		}
+		return m
+	case mmdbtype.Slice:
+		s := make([]any, len(v))
+		for i, item := range v {
+			s[i] = mmdbToJSON(item)
+		}
+		return s
+	case mmdbtype.String:
+		return string(v)
+	case mmdbtype.Bool:
+		return bool(v)
+	case mmdbtype.Uint16:
+		return uint16(v)
+	case mmdbtype.Uint32:
+		return uint32(v)
+	case mmdbtype.Uint64:
+		return uint64(v)
+	case mmdbtype.Int32:
+		return int32(v)
+	case mmdbtype.Float32:
+		return float32(v)
+	case mmdbtype.Float64:
+		return float64(v)
+	case *mmdbtype.Uint128:
+		return (*big.Int)(v).String()
+	case mmdbtype.Bytes:
+		return []byte(v)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// rejectLog writes every skipped row to the -rejects CSV file with its
+// input file, line and the reason it was left out, for later auditing.
+type rejectLog struct {
+	fh *os.File
+	w  *csv.Writer
+}
+
+func openRejectLog(path string) (*rejectLog, error) {
+	fh, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rejects file: %w", err)
+	}
+	l := &rejectLog{fh: fh, w: csv.NewWriter(fh)}
+	if err := l.w.Write([]string{"file", "line", "reason", "row"}); err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("failed to write rejects file: %w", err)
+	}
+	return l, nil
+}
+
+// add records a rejected row. The row column holds the fields of the row
+// as one CSV line, so rows of any width fit the same four columns.
+func (l *rejectLog) add(file string, in inputRow, reason string) error {
+	var row bytes.Buffer
+	rw := csv.NewWriter(&row)
+	rw.Write(in.fields)
+	rw.Flush()
+
+	err := l.w.Write([]string{file, fmt.Sprint(in.line(0)), reason, strings.TrimSuffix(row.String(), "\n")})
+	if err != nil {
+		return fmt.Errorf("failed to write rejects file: %w", err)
+	}
+	return nil
+}
+
+func (l *rejectLog) close() error {
+	l.w.Flush()
+	if err := l.w.Error(); err != nil {
+		l.fh.Close()
+		return fmt.Errorf("failed to write rejects file: %w", err)
+	}
+	return l.fh.Close()
+}
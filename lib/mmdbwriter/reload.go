@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// fileChanged reports whether a file was rewritten or replaced by a rename
+// between two stats, nil standing for no file.
+func fileChanged(old, cur os.FileInfo) bool {
+	if old == nil || cur == nil {
+		return old != cur
+	}
+	return !os.SameFile(old, cur) || !old.ModTime().Equal(cur.ModTime()) || old.Size() != cur.Size()
+}
+
+// loadDatabase opens path with openOrBuild and checks it is valid, so a
+// truncated or corrupt file is never swapped in.
+func loadDatabase(path string) (*maxminddb.Reader, error) {
+	db, err := openOrBuild(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Verify(); err != nil {
+		return nil, fmt.Errorf("invalid database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// watchDatabase reloads the database of s whenever path changes, checking
+// every interval (never when it is 0), and on SIGHUP, as sent by -daemon
+// with -reload-pid-file. The new database replaces the old one atomically:
+// lookups in flight finish on the old reader, which lives in memory and is
+// collected once they are done. A database that fails to load is logged
+// and the previous one kept.
+func (s *lookupServer) watchDatabase(path string, interval time.Duration, loaded os.FileInfo) {
+	watchFile(path, interval, loaded, &s.reloads, &s.reloadFailures, func() error {
+		db, err := loadDatabase(path)
+		if err != nil {
+			return err
+		}
+		s.db.Store(db)
+		log.Printf("Reloaded %s: built %s, %d nodes", path,
+			time.Unix(int64(db.Metadata.BuildEpoch), 0).UTC().Format(time.RFC3339), db.Metadata.NodeCount)
+		return nil
+	})
+}
+
+// watchASNDatabase reloads the -asn-db of s like watchDatabase, so it is
+// refreshed along with the database a build job writes next to it.
+func (s *lookupServer) watchASNDatabase(path string, interval time.Duration, loaded os.FileInfo) {
+	watchFile(path, interval, loaded, &s.asnReloads, &s.asnReloadFailures, func() error {
+		asns, err := readASNDatabase(path)
+		if err != nil {
+			return err
+		}
+		s.asns.Store(&asns)
+		log.Printf("Reloaded %s: %d ASNs", path, len(asns))
+		return nil
+	})
+}
+
+// watchFile calls load whenever path changes, checking every interval
+// (never when it is 0), and on SIGHUP, counting the reloads and failed
+// ones. A failed load keeps what was loaded before.
+func watchFile(path string, interval time.Duration, loaded os.FileInfo, reloads, failures *atomic.Uint64, load func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// failed is the file that last failed to load, so a broken file is
+	// reported once rather than at every tick.
+	var failed os.FileInfo
+	for {
+		forced := false
+		select {
+		case <-tick:
+		case <-hup:
+			forced = true
+		}
+		current, err := os.Stat(path)
+		if err != nil {
+			if forced {
+				log.Printf("Reload of %s failed: %v", path, err)
+				failures.Add(1)
+			}
+			continue
+		}
+		if !forced && (!fileChanged(loaded, current) || !fileChanged(failed, current)) {
+			continue
+		}
+
+		if err := load(); err != nil {
+			log.Printf("Reload of %s failed, keeping the loaded data: %v", path, err)
+			failures.Add(1)
+			failed = current
+			continue
+		}
+		reloads.Add(1)
+		loaded, failed = current, nil
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// rirStatsFiles implements flag.Value for the repeatable -rir-stats flag.
+type rirStatsFiles []string
+
+func (f *rirStatsFiles) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *rirStatsFiles) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// rirDelegation is an address range delegated by a RIR. allocated is the
+// Unix time of the delegation date, 0 when the record has none.
+type rirDelegation struct {
+	first, last netip.Addr
+	country     string
+	rir         string
+	allocated   int64
+}
+
+// rirDelegations answers which delegation an address belongs to.
+type rirDelegations []rirDelegation
+
+// loadRIRStats reads RIR delegated(-extended) statistics files
+// (registry|cc|type|start|value|date|status|...) and returns their
+// allocated and assigned IPv4 and IPv6 ranges sorted by first address.
+func loadRIRStats(paths []string) (rirDelegations, error) {
+	var delegations rirDelegations
+	for _, path := range paths {
+		loaded, err := loadRIRStatsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		delegations = append(delegations, loaded...)
+	}
+	sort.Slice(delegations, func(i, j int) bool {
+		return delegations[i].first.Less(delegations[j].first)
+	})
+	return delegations, nil
+}
+
+func loadRIRStatsFile(path string) (rirDelegations, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open RIR stats file: %w", err)
+	}
+	defer fh.Close()
+
+	var delegations rirDelegations
+	scanner := bufio.NewScanner(fh)
+	lineCount := 0
+	for scanner.Scan() {
+		lineCount++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		// The version line has fewer fields and summary lines have "*"
+		// as the country.
+		if len(fields) < 7 || fields[1] == "*" {
+			continue
+		}
+		registry, cc, typ, start, value, status := fields[0], strings.ToUpper(fields[1]), fields[2], fields[3], fields[4], fields[6]
+		if (typ != "ipv4" && typ != "ipv6") || (status != "allocated" && status != "assigned") || cc == "" {
+			continue
+		}
+
+		first, err := netip.ParseAddr(start)
+		if err != nil {
+			logger.Warn("skipping invalid start address", "file", path, "line", lineCount, "start", start)
+			continue
+		}
+		count, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || count == 0 {
+			logger.Warn("skipping invalid value", "file", path, "line", lineCount, "value", value)
+			continue
+		}
+
+		// IPv4 records give the number of addresses, IPv6 records the
+		// prefix length.
+		var last netip.Addr
+		if typ == "ipv4" {
+			last = addrAdd(first, count-1)
+		} else {
+			prefix, err := first.Prefix(int(count))
+			if err != nil {
+				logger.Warn("skipping invalid prefix length", "file", path, "line", lineCount, "value", value)
+				continue
+			}
+			last = prefixLast(prefix)
+		}
+		if !last.IsValid() {
+			logger.Warn("skipping range overflowing the address space", "file", path, "line", lineCount)
+			continue
+		}
+		allocated, _ := parseRIRDate(fields[5])
+		delegations = append(delegations, rirDelegation{first: first, last: last, country: cc, rir: registry,
+			allocated: allocated})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read RIR stats file: %w", err)
+	}
+	return delegations, nil
+}
+
+// lookup returns the delegation containing addr.
+func (d rirDelegations) lookup(addr netip.Addr) (rirDelegation, bool) {
+	// The first delegation starting after addr; only the one before it can
+	// contain addr.
+	i := sort.Search(len(d), func(i int) bool {
+		return addr.Less(d[i].first)
+	})
+	if i == 0 || d[i-1].last.Less(addr) || d[i-1].first.BitLen() != addr.BitLen() {
+		return rirDelegation{}, false
+	}
+	return d[i-1], true
+}
+
+// enrich adds the country, registry and allocation date of the delegation
+// containing the first address of prefix.
+func (d rirDelegations) enrich(prefix netip.Prefix, record *mmdbbuild.Record, stats *buildStats) {
+	delegation, ok := d.lookup(prefix.Addr().Unmap())
+	if !ok {
+		stats.rirUnmatched++
+		return
+	}
+	record.Country = delegation.country
+	record.Fields["rir"] = mmdbtype.String(delegation.rir)
+	if delegation.allocated > 0 {
+		record.Fields["allocated_at"] = mmdbtype.Uint64(delegation.allocated)
+	}
+	stats.rirMatched++
+}
+
+// addrAdd returns addr plus n, or the zero Addr when that overflows the
+// address family.
+func addrAdd(addr netip.Addr, n uint64) netip.Addr {
+	sum := new(big.Int).SetBytes(addr.AsSlice())
+	sum.Add(sum, new(big.Int).SetUint64(n))
+	b := sum.Bytes()
+	size := addr.BitLen() / 8
+	if len(b) > size {
+		return netip.Addr{}
+	}
+	buf := make([]byte, size)
+	copy(buf[size-len(b):], b)
+	result, _ := netip.AddrFromSlice(buf)
+	return result
+}
+
+// prefixLast returns the last address of prefix.
+func prefixLast(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	last, _ := netip.AddrFromSlice(b)
+	return last
+}
+
+// rangePrefixes returns the fewest prefixes covering first to last, in
+// address order.
+func rangePrefixes(first, last netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for !last.Less(first) {
+		// The largest prefix starting at first that ends within the range.
+		var prefix netip.Prefix
+		for bits := 0; bits <= first.BitLen(); bits++ {
+			prefix = netip.PrefixFrom(first, bits)
+			if prefix.Masked().Addr() == first && !last.Less(prefixLast(prefix)) {
+				break
+			}
+		}
+		prefixes = append(prefixes, prefix)
+		first = prefixLast(prefix).Next()
+		if !first.IsValid() {
+			break
+		}
+	}
+	return prefixes
+}
+
+// tagUnannouncedSpace stores the delegated space no row covers with
+// announced false and the country, rir and allocated_at of its delegation,
+// and returns the number of delegations that had any. Records already in
+// the tree are kept as they are, so only the gaps between announced
+// prefixes are filled. Space the database cannot hold is skipped.
+func tagUnannouncedSpace(writer *mmdbwriter.Tree, cfg *config, delegations rirDelegations) (int, error) {
+	policy := networkPolicy(cfg)
+	tagged := 0
+	for _, d := range delegations {
+		record := mmdbtype.Map{
+			"announced": mmdbtype.Bool(false),
+			"country":   mmdbtype.String(d.country),
+			"rir":       mmdbtype.String(d.rir),
+		}
+		if d.allocated > 0 {
+			record["allocated_at"] = mmdbtype.Uint64(d.allocated)
+		}
+		filled := false
+		fill := func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+			if existing != nil {
+				return existing, nil
+			}
+			filled = true
+			return record, nil
+		}
+		for _, prefix := range rangePrefixes(d.first, d.last) {
+			if excludesFamily(cfg, prefix) {
+				continue
+			}
+			if err := policy.Check(prefix); err != nil {
+				logger.Debug("skipping unsupported delegated prefix", "network", prefix, "error", err)
+				continue
+			}
+			if err := writer.InsertFunc(prefixNetwork(prefix), fill); err != nil {
+				return tagged, fmt.Errorf("failed to tag unannounced prefix %s: %w", prefix, err)
+			}
+		}
+		if filled {
+			tagged++
+		}
+	}
+	return tagged, nil
+}
+
+// rirASNBlock is a range of AS numbers delegated by a RIR.
+type rirASNBlock struct {
+	first, last uint32
+	country     string
+	rir         string
+}
+
+// rirASNBlocks answers which delegation an AS number belongs to.
+type rirASNBlocks []rirASNBlock
+
+// loadRIRASNs reads the allocated and assigned asn records
+// (registry|cc|asn|start|count|...) of RIR delegated(-extended) statistics
+// files and returns them sorted by first AS number.
+func loadRIRASNs(paths []string) (rirASNBlocks, error) {
+	var blocks rirASNBlocks
+	for _, path := range paths {
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open RIR stats file: %w", err)
+		}
+		scanner := bufio.NewScanner(fh)
+		lineCount := 0
+		for scanner.Scan() {
+			lineCount++
+			fields := strings.Split(strings.TrimSpace(scanner.Text()), "|")
+			if len(fields) < 7 || fields[1] == "*" || fields[2] != "asn" {
+				continue
+			}
+			registry, cc, status := fields[0], strings.ToUpper(fields[1]), fields[6]
+			if (status != "allocated" && status != "assigned") || cc == "" {
+				continue
+			}
+			first, err1 := strconv.ParseUint(fields[3], 10, 32)
+			count, err2 := strconv.ParseUint(fields[4], 10, 32)
+			if err1 != nil || err2 != nil || count == 0 || first+count-1 > 1<<32-1 {
+				logger.Warn("skipping invalid ASN delegation", "file", path, "line", lineCount)
+				continue
+			}
+			blocks = append(blocks, rirASNBlock{first: uint32(first), last: uint32(first + count - 1), country: cc, rir: registry})
+		}
+		err = scanner.Err()
+		fh.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RIR stats file: %w", err)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].first < blocks[j].first
+	})
+	return blocks, nil
+}
+
+// lookup returns the delegation containing asn.
+func (b rirASNBlocks) lookup(asn uint32) (rirASNBlock, bool) {
+	i := sort.Search(len(b), func(i int) bool {
+		return asn < b[i].first
+	})
+	if i == 0 || b[i-1].last < asn {
+		return rirASNBlock{}, false
+	}
+	return b[i-1], true
+}
+
+// parseRIRDate parses the YYYYMMDD date of a RIR statistics record. Many
+// old delegations have none, written as an empty field or 00000000.
+func parseRIRDate(s string) (int64, bool) {
+	t, err := time.Parse("20060102", strings.TrimSpace(s))
+	if err != nil {
+		return 0, false
+	}
+	return t.Unix(), true
+}
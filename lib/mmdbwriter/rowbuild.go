@@ -0,0 +1,605 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// inputRow is a data row together with the line of each of its fields,
+// captured when it was read so the row can be processed later.
+type inputRow struct {
+	fields []string
+	lines  []int
+}
+
+// readInputRow captures the fields of the row most recently read from r.
+func readInputRow(r rowReader, fields []string) inputRow {
+	lines := make([]int, max(len(fields), 1))
+	for i := range lines {
+		lines[i], _ = r.FieldPos(i)
+	}
+	return inputRow{fields: fields, lines: lines}
+}
+
+// line returns the input line of the given field.
+func (in inputRow) line(field int) int {
+	if field < 0 || field >= len(in.lines) {
+		return in.lines[0]
+	}
+	return in.lines[field]
+}
+
+// builtRow is a validated row with the record to insert for it, or a
+// skipped row with the reason it was rejected.
+type builtRow struct {
+	network string
+	prefix  netip.Prefix
+	asn     uint64
+	record  mmdbtype.Map
+
+	// truncated is set on rows -max-prefix-action truncate shortened,
+	// which only fill the space no other row holds.
+	truncated bool
+
+	source   inputRow
+	rejected string
+}
+
+// Reasons a row is rejected, as written to -rejects.
+const (
+	rejectShortRow     = "short_row"
+	rejectInvalidCIDR  = "invalid_cidr"
+	rejectNonCanonical = "non_canonical"
+	rejectInvalidASN   = "invalid_asn"
+	rejectZeroASN      = "zero_asn"
+	rejectOtherFamily  = "other_family"
+	rejectFiltered     = "filtered"
+	rejectTooSpecific  = "too_specific"
+	rejectInvalidUTF8  = "invalid_utf8"
+	rejectControlChars = "control_chars"
+	rejectExpired      = "expired"
+	rejectUnsupported  = "unsupported_network"
+	rejectDuplicate    = "duplicate"
+)
+
+// rejectRow returns the result of a skipped row.
+func rejectRow(in inputRow, reason string) *builtRow {
+	return &builtRow{source: in, rejected: reason}
+}
+
+// rowBuilder turns input rows into records. It only reads shared state, so
+// one builder can be used by several goroutines as long as each passes its
+// own buildStats.
+type rowBuilder struct {
+	cfg          *config
+	header       []string
+	typedColumns []int
+
+	networkIndex int
+	asnIndex     int
+	rdnsIndex    int
+	rpkiIndex    int
+	expiresIndex int
+	hitsIndex    int
+	visIndex     int
+	pathLenIndex int
+	orgIndex     int
+
+	// templateColumns are the -record-template fields other than the
+	// organization, which goes through the usual org handling.
+	templateColumns []templateColumn
+
+	asnNames  map[uint32]string
+	whoisOrgs map[uint32]string
+	enriched  map[uint32]whoisASN
+
+	// pipeline runs the row stages of the enrichment pipeline; nil runs
+	// none. validatesRPKI is set when it has the rpki stage.
+	pipeline      *enrichPipeline
+	validatesRPKI bool
+}
+
+func newRowBuilder(
+	cfg *config,
+	header []string,
+	asnNames, whoisOrgs map[uint32]string,
+	enriched map[uint32]whoisASN,
+	pipeline *enrichPipeline,
+	template *recordTemplate,
+) (*rowBuilder, error) {
+	b := &rowBuilder{
+		cfg:           cfg,
+		header:        header,
+		typedColumns:  cfg.columnTypes.columns(),
+		rdnsIndex:     mmdbbuild.HeaderIndex(header, rdnsColumn),
+		rpkiIndex:     mmdbbuild.HeaderIndex(header, rpkiColumn),
+		expiresIndex:  mmdbbuild.HeaderIndex(header, expiresColumn),
+		hitsIndex:     mmdbbuild.HeaderIndex(header, hitsColumn),
+		visIndex:      mmdbbuild.HeaderIndex(header, visibilityColumn),
+		pathLenIndex:  mmdbbuild.HeaderIndex(header, pathLengthColumn),
+		asnNames:      asnNames,
+		whoisOrgs:     whoisOrgs,
+		enriched:      enriched,
+		pipeline:      pipeline,
+		validatesRPKI: pipeline.has("rpki"),
+	}
+
+	// Without -columns or a header naming it, the third column is the
+	// organization unless it was claimed by a named or typed column.
+	var orgNamed bool
+	b.networkIndex, b.asnIndex, b.orgIndex, orgNamed = inputColumns(cfg.columns, header)
+	if !orgNamed && (b.rdnsIndex == b.orgIndex || b.rpkiIndex == b.orgIndex || b.expiresIndex == b.orgIndex ||
+		b.hitsIndex == b.orgIndex || b.visIndex == b.orgIndex || b.pathLenIndex == b.orgIndex || cfg.columnTypes[b.orgIndex+1] != "") {
+		b.orgIndex = -1
+	}
+	for _, col := range b.typedColumns {
+		if col-1 == b.networkIndex || col-1 == b.asnIndex {
+			return nil, fmt.Errorf("-column-type %d: the column is the network or ASN", col)
+		}
+	}
+	if template != nil {
+		if err := b.applyTemplate(template); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// applyTemplate resolves the columns of a -record-template against the
+// header. The template describes the whole layout, so there is no
+// organization column unless it maps one.
+func (b *rowBuilder) applyTemplate(t *recordTemplate) error {
+	var err error
+	if t.Network != "" {
+		if b.networkIndex, err = templateIndex(b.header, t.Network); err != nil {
+			return fmt.Errorf("record template network: %w", err)
+		}
+	}
+	if t.ASN != "" {
+		if b.asnIndex, err = templateIndex(b.header, t.ASN); err != nil {
+			return fmt.Errorf("record template asn: %w", err)
+		}
+	}
+	b.orgIndex = -1
+	for _, f := range t.Fields {
+		index, err := templateIndex(b.header, f.Column)
+		if err != nil {
+			return fmt.Errorf("record template field %s: %w", f.Field, err)
+		}
+		if f.Field == "autonomous_system_organization" {
+			b.orgIndex = index
+			continue
+		}
+		b.templateColumns = append(b.templateColumns, templateColumn{index: index, templateField: f})
+	}
+	return nil
+}
+
+// newStats returns empty statistics with the per-ASN and per-status maps
+// the configuration needs.
+func (b *rowBuilder) newStats() *buildStats {
+	stats := &buildStats{}
+	b.initStats(stats)
+	return stats
+}
+
+// initStats allocates the maps of stats that rows of this builder fill in
+// and that are still missing, e.g. when an earlier input had no rpki
+// column.
+func (b *rowBuilder) initStats(stats *buildStats) {
+	if b.cfg.reportOrgless && stats.asnHasOrg == nil {
+		stats.asnHasOrg = map[uint32]bool{}
+	}
+	if b.cfg.whoisOrgs != "" && stats.whoisMatched == nil {
+		stats.whoisMatched = map[uint32]bool{}
+	}
+	if (b.rpkiIndex >= 0 || b.validatesRPKI) && stats.rpkiStatus == nil {
+		stats.rpkiStatus = map[string]int{}
+	}
+	if b.pipeline != nil && stats.enrichTime == nil {
+		stats.enrichTime = map[string]time.Duration{}
+	}
+}
+
+// build validates a row and returns the record for it. Skipped rows are
+// reported, counted in stats and returned with the reason they were
+// rejected; with -strict, malformed rows fail the build instead.
+func (b *rowBuilder) build(in inputRow, stats *buildStats) (*builtRow, error) {
+	row := in.fields
+
+	// Support multiple CSV formats, detected per row by field count
+	// Format 1: network, asn, organization
+	// Format 2: network, asn
+	if len(row) <= max(b.networkIndex, b.asnIndex) {
+		line := in.line(0)
+		if b.cfg.strict {
+			return nil, fmt.Errorf("line %d: row has too few columns (-strict)", line)
+		}
+		logger.Warn("skipping row with too few columns", "line", line, "row", row)
+		stats.shortRows++
+		return rejectRow(in, rejectShortRow), nil
+	}
+
+	network := strings.TrimSpace(row[b.networkIndex])
+	asnStr := strings.TrimSpace(row[b.asnIndex])
+
+	// Parse network CIDR; host bits are cleared, so 10.0.0.1/8 is
+	// 10.0.0.0/8
+	prefix, err := netip.ParsePrefix(network)
+	if err != nil {
+		if b.cfg.strict {
+			return nil, fmt.Errorf("line %d: invalid CIDR %q (-strict): %w", in.line(b.networkIndex), network, err)
+		}
+		logger.Warn("skipping invalid CIDR", "line", in.line(b.networkIndex), "network", network, "error", err)
+		stats.invalidCIDR++
+		return rejectRow(in, rejectInvalidCIDR), nil
+	}
+	prefix = prefix.Masked()
+
+	// In strict mode the input must already be canonical, e.g.
+	// "10.0.0.1/8" or "2001:DB8::/32" are rejected.
+	if b.cfg.requireCanonical && network != prefix.String() {
+		logger.Warn("skipping non-canonical CIDR", "line", in.line(b.networkIndex), "network", network, "canonical", prefix.String())
+		stats.nonCanonical++
+		return rejectRow(in, rejectNonCanonical), nil
+	}
+
+	// Rows of the other family are expected with -only-ipv4/-only-ipv6,
+	// so they are counted but not logged.
+	if excludesFamily(b.cfg, prefix) {
+		stats.otherFamily++
+		return rejectRow(in, rejectOtherFamily), nil
+	}
+
+	truncated := false
+	// Announcements longer than -max-prefix-len, e.g. /32s leaked by a
+	// router, are dropped or replaced by their covering prefix.
+	if limit := b.cfg.maxPrefixLen.limit(prefix); limit > 0 {
+		if prefix.Bits() > limit {
+			if b.cfg.maxPrefixAction == maxPrefixDrop {
+				stats.tooSpecific++
+				return rejectRow(in, rejectTooSpecific), nil
+			}
+			prefix, _ = prefix.Addr().Prefix(limit)
+			network = prefix.String()
+			truncated = true
+			stats.truncated++
+		}
+	}
+
+	// Parse ASN; an AS_SET origin has no single ASN and records its
+	// members instead
+	asn, asSet, err := parseOrigin(asnStr)
+	if err != nil {
+		if b.cfg.strict {
+			return nil, fmt.Errorf("line %d: invalid ASN %q (-strict): %w", in.line(b.asnIndex), asnStr, err)
+		}
+		logger.Warn("skipping invalid ASN", "line", in.line(b.asnIndex), "asn", asnStr, "error", err)
+		stats.invalidASN++
+		return rejectRow(in, rejectInvalidASN), nil
+	}
+
+	filtered := filtersRow(b.cfg, prefix, uint32(asn))
+	if asSet != nil {
+		// A set is kept if any of its members is.
+		filtered = !slices.ContainsFunc(asSet, func(member uint32) bool { return !filtersRow(b.cfg, prefix, member) })
+	}
+	if filtered {
+		stats.filtered++
+		return rejectRow(in, rejectFiltered), nil
+	}
+
+	// ASN 0 means "not announced": by default the prefix is kept
+	// without an ASN field
+	if asn == 0 && asSet == nil && b.cfg.skipZeroASN {
+		stats.zeroASN++
+		return rejectRow(in, rejectZeroASN), nil
+	}
+
+	var expires time.Time
+	if value := columnValue(row, b.expiresIndex); value != "" {
+		if expires, err = parseTimestamp(value); err != nil {
+			line := in.line(b.expiresIndex)
+			logger.Warn("ignoring invalid expires", "line", line, "value", value, "error", err)
+			stats.badExpires++
+		} else if b.cfg.dropExpired && expires.Before(b.cfg.buildTime) {
+			stats.expired++
+			return rejectRow(in, rejectExpired), nil
+		}
+	}
+
+	// Build the fields of the fixed columns and the pipeline as a Record;
+	// the template, JSON and -set fields are merged into its Map below.
+	rec := mmdbbuild.Record{ASN: uint32(asn), ASNs: asSet, Fields: map[string]mmdbtype.DataType{}}
+	if !expires.IsZero() {
+		rec.Fields["expires"] = mmdbtype.Uint64(expires.Unix())
+	}
+	if asSet != nil {
+		stats.asSets++
+	}
+
+	// Only rows in format 1 carry an organization name
+	org := columnValue(row, b.orgIndex)
+	if org == "" && b.asnNames != nil && asn != 0 {
+		if name, ok := b.asnNames[uint32(asn)]; ok {
+			org = name
+			stats.orgsFromASNs++
+		}
+	}
+	if e, ok := b.enriched[uint32(asn)]; ok && asSet == nil {
+		if org == "" && e.Name != "" {
+			org = e.Name
+			stats.orgsFromWHOIS++
+		}
+		if e.CC != "" {
+			rec.Fields["autonomous_system_country"] = mmdbtype.String(e.CC)
+		}
+	}
+	if b.whoisOrgs != nil && asn != 0 {
+		whoisOrg, ok := b.whoisOrgs[uint32(asn)]
+		if ok {
+			org = whoisOrg
+		}
+		stats.whoisMatched[uint32(asn)] = ok
+	}
+	if b.cfg.labelBogonASNs && asn != 0 {
+		if label, ok := bogonLabel(uint32(asn)); ok {
+			org = label
+			stats.bogonLabeled++
+		}
+	}
+	hasOrg := org != ""
+	if stats.asnHasOrg != nil && asn != 0 {
+		stats.asnHasOrg[uint32(asn)] = stats.asnHasOrg[uint32(asn)] || hasOrg
+	}
+	if hasOrg && b.cfg.idn != idnNone && isDomainLike(org) {
+		if normalized, err := normalizeIDN(org, b.cfg.idn); err != nil {
+			line := in.line(b.orgIndex)
+			logger.Warn("keeping org unnormalized", "line", line, "org", org, "error", err)
+			stats.idnErrors++
+		} else {
+			org = normalized
+		}
+	}
+	if hasOrg && b.cfg.orgNormalize.enabled() {
+		if normalized := b.cfg.orgNormalize.apply(org); normalized != org {
+			// The hash stands in for the plaintext, so the original is
+			// not stored next to it.
+			if !b.cfg.orgHash {
+				rec.Fields[orgRawField] = mmdbtype.String(org)
+			}
+			org = normalized
+			stats.orgsNormalized++
+		}
+	}
+	if hasOrg {
+		if b.cfg.orgHash {
+			rec.Fields["autonomous_system_organization_hash"] = mmdbtype.String(hashOrg(org))
+		} else {
+			if short, truncated := truncateRunes(org, b.cfg.maxOrgLen, b.cfg.orgEllipsis); truncated {
+				org = short
+				stats.orgTruncated++
+			}
+			rec.Organization = org
+		}
+	}
+
+	if rdns := columnValue(row, b.rdnsIndex); rdns != "" {
+		if b.cfg.idn != idnNone {
+			if normalized, err := normalizeIDN(rdns, b.cfg.idn); err != nil {
+				line := in.line(b.rdnsIndex)
+				logger.Warn("keeping rdns unnormalized", "line", line, "rdns", rdns, "error", err)
+				stats.idnErrors++
+			} else {
+				rdns = normalized
+			}
+		}
+		if isValidDomain(rdns) {
+			rec.Fields["reverse_dns"] = mmdbtype.String(rdns)
+		} else {
+			line := in.line(b.rdnsIndex)
+			logger.Warn("ignoring invalid rdns", "line", line, "rdns", rdns)
+			stats.invalidRDNS++
+		}
+	}
+
+	// The rpki stage of the pipeline takes precedence over the rpki
+	// column.
+	if b.pipeline != nil {
+		b.pipeline.enrichRow(prefix, &rec, stats)
+	}
+	if rpki := strings.ToLower(columnValue(row, b.rpkiIndex)); rpki != "" && !b.validatesRPKI {
+		if slices.Contains(rpkiStatuses, rpki) {
+			rec.RPKIStatus = rpki
+			stats.rpkiStatus[rpki]++
+		} else {
+			line := in.line(b.rpkiIndex)
+			logger.Warn("ignoring invalid rpki status", "line", line, "rpki", rpki)
+			stats.invalidRPKI++
+		}
+	}
+
+	if hits := columnValue(row, b.hitsIndex); hits != "" {
+		if n, err := strconv.ParseUint(hits, 10, 32); err == nil {
+			rec.Fields["route_visibility"] = mmdbtype.Uint32(n)
+		} else {
+			line := in.line(b.hitsIndex)
+			logger.Warn("ignoring invalid hits", "line", line, "hits", hits)
+			stats.invalidHits++
+		}
+	}
+	if vis := columnValue(row, b.visIndex); vis != "" {
+		if n, err := strconv.ParseUint(vis, 10, 32); err == nil {
+			rec.Fields["visibility"] = mmdbtype.Uint32(n)
+		} else {
+			line := in.line(b.visIndex)
+			logger.Warn("ignoring invalid visibility", "line", line, "visibility", vis)
+			stats.badVis++
+		}
+	}
+	if pathLen := columnValue(row, b.pathLenIndex); pathLen != "" {
+		if n, err := strconv.ParseUint(pathLen, 10, 32); err == nil {
+			rec.Fields["path_length"] = mmdbtype.Uint32(n)
+		} else {
+			line := in.line(b.pathLenIndex)
+			logger.Warn("ignoring invalid path_length", "line", line, "path_length", pathLen)
+			stats.badPathLen++
+		}
+	}
+
+	record := rec.Map()
+	// Record leaves ASN 0 out; -store-zero-asn keeps it.
+	if asn == 0 && asSet == nil && b.cfg.storeZeroASN {
+		record["autonomous_system_number"] = mmdbtype.Uint32(0)
+	}
+
+	// Template fields, like typed columns, do not replace fields that are
+	// already set
+	for _, col := range b.templateColumns {
+		key := mmdbtype.String(col.Field)
+		value := columnValue(row, col.index)
+		if _, exists := record[key]; exists || value == "" {
+			continue
+		}
+		v, err := templateValue(col.templateField, value)
+		if err != nil {
+			logger.Warn("ignoring invalid template value", "line", in.line(col.index), "field", col.Field, "error", err)
+			stats.badTemplate++
+			continue
+		}
+		record[key] = v
+	}
+
+	// Merge typed columns; fields from the fixed columns take precedence
+	for _, col := range b.typedColumns {
+		if col > len(row) || b.cfg.columnTypes[col] != columnTypeJSON {
+			continue
+		}
+		value := strings.TrimSpace(row[col-1])
+		if value == "" {
+			continue
+		}
+		fields, err := jsonColumnFields(value)
+		if err != nil {
+			line := in.line(col - 1)
+			logger.Warn("ignoring invalid JSON column", "line", line, "column", col, "error", err)
+			stats.invalidJSON++
+			continue
+		}
+		for key, v := range fields {
+			if _, exists := record[key]; !exists {
+				record[key] = v
+			}
+		}
+	}
+
+	// Derived fields are applied last and override anything above
+	if len(b.cfg.setRules) > 0 {
+		vars := rowVars{header: b.header, row: row}
+		for _, rule := range b.cfg.setRules {
+			value, err := rule.expr.eval(vars)
+			if err != nil {
+				line := in.line(0)
+				logger.Warn("failed to set field", "line", line, "field", rule.field, "error", err)
+				stats.setErrors++
+				continue
+			}
+			if value != "" {
+				record[mmdbtype.String(rule.field)] = mmdbtype.String(value)
+			}
+		}
+	}
+
+	record = applySchema(b.cfg.schema, record)
+
+	// Invalid UTF-8 and control characters break some readers and JSON
+	// consumers of the database. UTF-8 is checked first, so replacing it
+	// leaves valid strings for the control character check.
+	checks := []struct {
+		check  stringCheck
+		mode   string
+		what   string
+		count  *int
+		reason string
+	}{
+		{invalidUTF8, b.cfg.onInvalidUTF8, "invalid UTF-8", &stats.invalidUTF8, rejectInvalidUTF8},
+		{controlChars, b.cfg.onControlChar, "control characters", &stats.controlChars, rejectControlChars},
+	}
+	for _, c := range checks {
+		paths := c.check.find(record, c.mode)
+		if len(paths) == 0 {
+			continue
+		}
+		*c.count += len(paths)
+		line := in.line(0)
+		switch c.mode {
+		case controlCharWarn:
+			logger.Warn(c.what+" in fields", "line", line, "fields", strings.Join(paths, ", "))
+		case controlCharReject:
+			logger.Warn("skipping row with "+c.what, "line", line, "fields", strings.Join(paths, ", "))
+			stats.badStrings++
+			return rejectRow(in, c.reason), nil
+		case controlCharFail:
+			return nil, fmt.Errorf("%s in %s on line %d", c.what, strings.Join(paths, ", "), line)
+		}
+	}
+
+	return &builtRow{network: network, prefix: prefix, asn: asn, record: record, truncated: truncated, source: in}, nil
+}
+
+// addRowStats adds the row statistics collected by another builder
+// goroutine to s.
+func (s *buildStats) addRowStats(o *buildStats) {
+	s.shortRows += o.shortRows
+	s.invalidCIDR += o.invalidCIDR
+	s.invalidASN += o.invalidASN
+	s.nonCanonical += o.nonCanonical
+	s.zeroASN += o.zeroASN
+	s.otherFamily += o.otherFamily
+	s.filtered += o.filtered
+	s.tooSpecific += o.tooSpecific
+	s.truncated += o.truncated
+	s.invalidJSON += o.invalidJSON
+	s.badTemplate += o.badTemplate
+	s.orgTruncated += o.orgTruncated
+	s.orgsNormalized += o.orgsNormalized
+	s.invalidRDNS += o.invalidRDNS
+	s.setErrors += o.setErrors
+	s.idnErrors += o.idnErrors
+	s.invalidRPKI += o.invalidRPKI
+	s.bogonLabeled += o.bogonLabeled
+	s.expired += o.expired
+	s.badExpires += o.badExpires
+	s.controlChars += o.controlChars
+	s.invalidUTF8 += o.invalidUTF8
+	s.badStrings += o.badStrings
+	s.invalidHits += o.invalidHits
+	s.badVis += o.badVis
+	s.badPathLen += o.badPathLen
+	s.asSets += o.asSets
+	s.orgsFromASNs += o.orgsFromASNs
+	s.orgsFromWHOIS += o.orgsFromWHOIS
+	s.rirMatched += o.rirMatched
+	s.rirUnmatched += o.rirUnmatched
+	s.asRelMatched += o.asRelMatched
+	for asn, hasOrg := range o.asnHasOrg {
+		s.asnHasOrg[asn] = s.asnHasOrg[asn] || hasOrg
+	}
+	for asn, ok := range o.whoisMatched {
+		s.whoisMatched[asn] = ok
+	}
+	for status, n := range o.rpkiStatus {
+		s.rpkiStatus[status] += n
+	}
+	for stage, d := range o.enrichTime {
+		s.enrichTime[stage] += d
+	}
+}
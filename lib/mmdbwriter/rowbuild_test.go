@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+func TestRowBuild(t *testing.T) {
+	threeColumns := []string{"network", "asn", "org"}
+	tests := []struct {
+		name         string
+		args         []string
+		header       []string
+		row          []string
+		wantRejected string
+		wantPrefix   string
+		wantRecord   mmdbtype.Map
+	}{
+		{
+			name:       "network, asn and org",
+			row:        []string{"1.1.1.0/24", "13335", "Cloudflare, Inc."},
+			wantPrefix: "1.1.1.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":       mmdbtype.Uint32(13335),
+				"autonomous_system_organization": mmdbtype.String("Cloudflare, Inc."),
+			},
+		},
+		{
+			name:       "two columns",
+			row:        []string{"1.1.1.0/24", "13335"},
+			wantPrefix: "1.1.1.0/24",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(13335)},
+		},
+		{
+			name:       "padded fields",
+			row:        []string{" 2a01:4f8::/32 ", " AS24940 ", "Hetzner"},
+			wantPrefix: "2a01:4f8::/32",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":       mmdbtype.Uint32(24940),
+				"autonomous_system_organization": mmdbtype.String("Hetzner"),
+			},
+		},
+		{
+			name:       "host bits are cleared",
+			row:        []string{"1.2.3.4/16", "64500"},
+			wantPrefix: "1.2.0.0/16",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(64500)},
+		},
+		{
+			name:       "32-bit asdot ASN",
+			row:        []string{"1.2.3.0/24", "1.10"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(65546)},
+		},
+		{
+			name:       "AS_SET",
+			row:        []string{"1.2.3.0/24", "{64500,64501}"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_numbers": mmdbtype.Slice{mmdbtype.Uint32(64500), mmdbtype.Uint32(64501)},
+			},
+		},
+		{
+			name:         "too few columns",
+			row:          []string{"1.2.3.0/24"},
+			wantRejected: rejectShortRow,
+		},
+		{
+			name:         "invalid CIDR",
+			row:          []string{"not-a-network", "1"},
+			wantRejected: rejectInvalidCIDR,
+		},
+		{
+			name:         "invalid ASN",
+			row:          []string{"1.2.3.0/24", "not-an-asn"},
+			wantRejected: rejectInvalidASN,
+		},
+		{
+			name:         "ASN out of range",
+			row:          []string{"1.2.3.0/24", "4294967296"},
+			wantRejected: rejectInvalidASN,
+		},
+		{
+			name:         "-require-canonical rejects host bits",
+			args:         []string{"-require-canonical"},
+			row:          []string{"1.2.3.4/16", "64500"},
+			wantRejected: rejectNonCanonical,
+		},
+		{
+			name:         "-require-canonical rejects upper-case IPv6",
+			args:         []string{"-require-canonical"},
+			row:          []string{"2A01:4F8::/32", "24940"},
+			wantRejected: rejectNonCanonical,
+		},
+		{
+			name:       "-require-canonical accepts canonical CIDRs",
+			args:       []string{"-require-canonical"},
+			row:        []string{"2a01:4f8::/32", "24940"},
+			wantPrefix: "2a01:4f8::/32",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(24940)},
+		},
+		{
+			name:       "ASN 0 is stored without an ASN",
+			row:        []string{"23.128.0.0/10", "0", ""},
+			wantPrefix: "23.128.0.0/10",
+			wantRecord: mmdbtype.Map{},
+		},
+		{
+			name:       "-store-zero-asn",
+			args:       []string{"-store-zero-asn"},
+			row:        []string{"23.128.0.0/10", "0"},
+			wantPrefix: "23.128.0.0/10",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(0)},
+		},
+		{
+			name:         "-skip-zero-asn",
+			args:         []string{"-skip-zero-asn"},
+			row:          []string{"23.128.0.0/10", "0"},
+			wantRejected: rejectZeroASN,
+		},
+		{
+			name:       "-org-hash",
+			args:       []string{"-org-hash"},
+			row:        []string{"1.2.3.0/24", "64500", "Example"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":            mmdbtype.Uint32(64500),
+				"autonomous_system_organization_hash": mmdbtype.String(hashOrg("Example")),
+			},
+		},
+		{
+			name:       "-max-org-len",
+			args:       []string{"-max-org-len", "4"},
+			row:        []string{"1.2.3.0/24", "64500", "Exämple"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":       mmdbtype.Uint32(64500),
+				"autonomous_system_organization": mmdbtype.String("Exäm"),
+			},
+		},
+		{
+			name:       "-max-org-len with -org-ellipsis",
+			args:       []string{"-max-org-len", "4", "-org-ellipsis"},
+			row:        []string{"1.2.3.0/24", "64500", "Example"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":       mmdbtype.Uint32(64500),
+				"autonomous_system_organization": mmdbtype.String("Exa…"),
+			},
+		},
+		{
+			name:         "-only-ipv4",
+			args:         []string{"-only-ipv4"},
+			row:          []string{"2a01:4f8::/32", "24940"},
+			wantRejected: rejectOtherFamily,
+		},
+		{
+			name:         "-exclude-asn",
+			args:         []string{"-exclude-asn", "64500"},
+			row:          []string{"1.2.3.0/24", "64500"},
+			wantRejected: rejectFiltered,
+		},
+		{
+			name:         "-include",
+			args:         []string{"-include", "1.2.0.0/16"},
+			row:          []string{"5.5.5.0/24", "64500"},
+			wantRejected: rejectFiltered,
+		},
+		{
+			name:         "-max-prefix-len drops",
+			args:         []string{"-max-prefix-len", "v4=24"},
+			row:          []string{"1.2.3.128/25", "64500"},
+			wantRejected: rejectTooSpecific,
+		},
+		{
+			name:       "-max-prefix-len truncates",
+			args:       []string{"-max-prefix-len", "v4=24", "-max-prefix-action", "truncate"},
+			row:        []string{"1.2.3.128/25", "64500"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(64500)},
+		},
+		{
+			name:       "JSON column",
+			args:       []string{"-column-type", "4=json"},
+			header:     []string{"network", "asn", "org", "extra"},
+			row:        []string{"1.2.3.0/24", "64500", "Example", `{"country":"NL","autonomous_system_number":1}`},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":       mmdbtype.Uint32(64500),
+				"autonomous_system_organization": mmdbtype.String("Example"),
+				"country":                        mmdbtype.String("NL"),
+			},
+		},
+		{
+			name:       "rdns column",
+			header:     []string{"network", "asn", rdnsColumn},
+			row:        []string{"1.2.3.0/24", "64500", "example.net"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number": mmdbtype.Uint32(64500),
+				"reverse_dns":              mmdbtype.String("example.net"),
+			},
+		},
+		{
+			name:       "invalid rdns is ignored",
+			header:     []string{"network", "asn", rdnsColumn},
+			row:        []string{"1.2.3.0/24", "64500", "not a domain"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(64500)},
+		},
+		{
+			name:       "rpki column",
+			header:     []string{"network", "asn", rpkiColumn},
+			row:        []string{"1.2.3.0/24", "64500", "VALID"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number": mmdbtype.Uint32(64500),
+				"rpki_status":              mmdbtype.String("valid"),
+			},
+		},
+		{
+			name:       "invalid rpki is ignored",
+			header:     []string{"network", "asn", rpkiColumn},
+			row:        []string{"1.2.3.0/24", "64500", "maybe"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(64500)},
+		},
+		{
+			name:       "hits column",
+			header:     []string{"network", "asn", hitsColumn},
+			row:        []string{"1.2.3.0/24", "64500", "120"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number": mmdbtype.Uint32(64500),
+				"route_visibility":         mmdbtype.Uint32(120),
+			},
+		},
+		{
+			name:       "invalid hits is ignored",
+			header:     []string{"network", "asn", hitsColumn},
+			row:        []string{"1.2.3.0/24", "64500", "-1"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(64500)},
+		},
+		{
+			name:       "visibility column",
+			header:     []string{"network", "asn", visibilityColumn},
+			row:        []string{"1.2.3.0/24", "64500", "4"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number": mmdbtype.Uint32(64500),
+				"visibility":               mmdbtype.Uint32(4),
+			},
+		},
+		{
+			name:       "invalid visibility is ignored",
+			header:     []string{"network", "asn", visibilityColumn},
+			row:        []string{"1.2.3.0/24", "64500", "many"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(64500)},
+		},
+		{
+			name:       "path_length column",
+			header:     []string{"network", "asn", pathLengthColumn},
+			row:        []string{"1.2.3.0/24", "64500", "3"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number": mmdbtype.Uint32(64500),
+				"path_length":              mmdbtype.Uint32(3),
+			},
+		},
+		{
+			name:       "invalid path_length is ignored",
+			header:     []string{"network", "asn", pathLengthColumn},
+			row:        []string{"1.2.3.0/24", "64500", "x"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(64500)},
+		},
+		{
+			name:       "-idn to-unicode",
+			args:       []string{"-idn", idnToUnicode},
+			header:     []string{"network", "asn", rdnsColumn},
+			row:        []string{"1.2.3.0/24", "64500", "xn--bcher-kva.example"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number": mmdbtype.Uint32(64500),
+				"reverse_dns":              mmdbtype.String("bücher.example"),
+			},
+		},
+		{
+			name:       "-label-bogon-asns",
+			args:       []string{"-label-bogon-asns"},
+			row:        []string{"1.2.3.0/24", "64512", "Whoever"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":       mmdbtype.Uint32(64512),
+				"autonomous_system_organization": mmdbtype.String(mustBogonLabel(t, 64512)),
+			},
+		},
+		{
+			name:       "expires",
+			header:     []string{"network", "asn", expiresColumn},
+			row:        []string{"1.2.3.0/24", "64500", "2030-01-01T00:00:00Z"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number": mmdbtype.Uint32(64500),
+				"expires":                  mmdbtype.Uint64(1893456000),
+			},
+		},
+		{
+			name:         "-drop-expired",
+			args:         []string{"-drop-expired"},
+			header:       []string{"network", "asn", expiresColumn},
+			row:          []string{"1.2.3.0/24", "64500", "2001-01-01T00:00:00Z"},
+			wantRejected: rejectExpired,
+		},
+		{
+			name:       "control characters are stripped",
+			row:        []string{"1.2.3.0/24", "64500", "Exam\x01ple"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":       mmdbtype.Uint32(64500),
+				"autonomous_system_organization": mmdbtype.String("Example"),
+			},
+		},
+		{
+			name:         "-on-control-char reject",
+			args:         []string{"-on-control-char", controlCharReject},
+			row:          []string{"1.2.3.0/24", "64500", "Exam\x01ple"},
+			wantRejected: rejectControlChars,
+		},
+		{
+			name:       "invalid UTF-8 is replaced",
+			row:        []string{"1.2.3.0/24", "64500", "Exam\xffple"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":       mmdbtype.Uint32(64500),
+				"autonomous_system_organization": mmdbtype.String("Exam\uFFFDple"),
+			},
+		},
+		{
+			name:       "-set",
+			args:       []string{"-set", "org_upper=upper($org)"},
+			row:        []string{"1.2.3.0/24", "64500", "Example"},
+			wantPrefix: "1.2.3.0/24",
+			wantRecord: mmdbtype.Map{
+				"autonomous_system_number":       mmdbtype.Uint32(64500),
+				"autonomous_system_organization": mmdbtype.String("Example"),
+				"org_upper":                      mmdbtype.String("EXAMPLE"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.args...)
+			header := tt.header
+			if header == nil {
+				header = threeColumns
+			}
+			b, err := newRowBuilder(cfg, header, nil, nil, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := make([]int, len(tt.row))
+			row, err := b.build(inputRow{fields: tt.row, lines: lines}, b.newStats())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if row.rejected != tt.wantRejected {
+				t.Fatalf("got rejection %q, want %q", row.rejected, tt.wantRejected)
+			}
+			if tt.wantRejected != "" {
+				return
+			}
+			if row.prefix.String() != tt.wantPrefix {
+				t.Errorf("got prefix %s, want %s", row.prefix, tt.wantPrefix)
+			}
+			if !row.record.Equal(tt.wantRecord) {
+				t.Errorf("got record %v, want %v", row.record, tt.wantRecord)
+			}
+		})
+	}
+}
+
+// mustBogonLabel returns the label -label-bogon-asns gives asn.
+func mustBogonLabel(t *testing.T, asn uint32) string {
+	t.Helper()
+	label, ok := bogonLabel(asn)
+	if !ok {
+		t.Fatalf("AS%d is not a bogon", asn)
+	}
+	return label
+}
+
+// The rpki_status values stored are counted by status, from the rpki
+// column or, taking precedence over it, the rpki stage of the pipeline.
+func TestRowBuildRPKIStatus(t *testing.T) {
+	vrps := vrpSet{netip.MustParsePrefix("1.2.0.0/16"): {{asn: 64500, maxLength: 24}}}
+	tests := []struct {
+		name        string
+		pipeline    *enrichPipeline
+		rows        [][]string
+		wantStatus  map[string]int
+		wantInvalid int
+	}{
+		{
+			name: "rpki column",
+			rows: [][]string{
+				{"1.2.3.0/24", "64500", "VALID"},
+				{"1.2.4.0/24", "64500", "invalid"},
+				{"1.2.5.0/24", "64500", "notfound"},
+				{"1.2.6.0/24", "64500", "valid"},
+				{"1.2.7.0/24", "64500", "maybe"},
+				{"1.2.8.0/24", "64500", ""},
+			},
+			wantStatus:  map[string]int{"valid": 2, "invalid": 1, "notfound": 1},
+			wantInvalid: 1,
+		},
+		{
+			name:     "rpki stage",
+			pipeline: &enrichPipeline{rows: []enrichStage{{name: "rpki", row: vrps}}},
+			rows: [][]string{
+				{"1.2.3.0/24", "64500", "invalid"},
+				{"1.2.4.0/24", "64501", "valid"},
+				{"1.2.5.128/25", "64500", ""},
+				{"5.5.5.0/24", "64500", "maybe"},
+			},
+			wantStatus: map[string]int{"valid": 1, "invalid": 2, "unknown": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newRowBuilder(testConfig(t), []string{"network", "asn", rpkiColumn}, nil, nil, nil, tt.pipeline, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats := b.newStats()
+			for _, row := range tt.rows {
+				if _, err := b.build(inputRow{fields: row, lines: make([]int, len(row))}, stats); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(stats.rpkiStatus, tt.wantStatus) {
+				t.Errorf("got rpki_status counts %v, want %v", stats.rpkiStatus, tt.wantStatus)
+			}
+			if stats.invalidRPKI != tt.wantInvalid {
+				t.Errorf("got %d invalid rpki values, want %d", stats.invalidRPKI, tt.wantInvalid)
+			}
+		})
+	}
+}
+
+// A file mixing rows with and without an org column stores every row with
+// its own fields: a two-column row does not take the org of a neighbour.
+func TestRowBuildMixedFormats(t *testing.T) {
+	const input = "network,asn,org\n" +
+		"1.1.1.0/24,13335,Cloudflare\n" +
+		"8.8.8.0/24,15169\n" +
+		"9.9.9.0/24,19281,Quad9\n" +
+		"2a01:4f8::/32,24940\n" +
+		"2606:4700::/32,13335,\n"
+	db, stats := buildTestDB(t, testConfig(t), input)
+	if stats.rows != 5 {
+		t.Errorf("got %d rows, want 5", stats.rows)
+	}
+	tests := []struct {
+		ip   string
+		want map[string]any
+	}{
+		{"1.1.1.1", map[string]any{"autonomous_system_number": uint64(13335), "autonomous_system_organization": "Cloudflare"}},
+		{"8.8.8.8", map[string]any{"autonomous_system_number": uint64(15169)}},
+		{"9.9.9.9", map[string]any{"autonomous_system_number": uint64(19281), "autonomous_system_organization": "Quad9"}},
+		{"2a01:4f8::1", map[string]any{"autonomous_system_number": uint64(24940)}},
+		{"2606:4700::1", map[string]any{"autonomous_system_number": uint64(13335)}},
+	}
+	for _, tt := range tests {
+		if _, got := lookupTest(t, db, tt.ip); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// TestGoldenCorpus builds testdata/bgp-tools.csv and checks every lookup
+// of testdata/bgp-tools.expected.json.
+func TestGoldenCorpus(t *testing.T) {
+	source, err := os.ReadFile("testdata/bgp-tools.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/bgp-tools.expected.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var expected fixtureExpectations
+	if err := dec.Decode(&expected); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := buildTestDB(t, testConfig(t), string(source))
+	for _, want := range expected.Lookups {
+		t.Run(want.IP, func(t *testing.T) {
+			network, record, err := lookupRecord(db, net.ParseIP(want.IP))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got any
+			if record != nil {
+				got = mmdbToJSON(record)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want.Record)
+			if network.String() != want.Network || !bytes.Equal(gotJSON, wantJSON) {
+				t.Errorf("got %s %s, want %s %s", network, gotJSON, want.Network, wantJSON)
+			}
+		})
+	}
+}
+
+// FuzzRowBuild feeds single CSV lines after a network,asn,org header to the
+// row builder. Rows it accepts must have a masked prefix, a 32-bit ASN and
+// clean strings.
+func FuzzRowBuild(f *testing.F) {
+	fh, err := os.Open("testdata/bgp-tools.csv")
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		f.Add(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		f.Fatal(err)
+	}
+
+	cfg := testConfig(f)
+	cfg.format = formatCSV
+	header := []string{"network", "asn", "org"}
+	builder, err := newRowBuilder(cfg, header, nil, nil, nil, nil, nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		r, _, err := newRowReader(cfg, strings.NewReader(strings.Join(header, ",")+"\n"+line))
+		if err != nil {
+			return
+		}
+		fields, err := r.Read()
+		if err != nil {
+			return
+		}
+		row, err := builder.build(readInputRow(r, fields), builder.newStats())
+		if err != nil {
+			t.Fatalf("build(%q): %v", line, err)
+		}
+		if row.rejected != "" {
+			return
+		}
+
+		if !row.prefix.IsValid() || row.prefix != row.prefix.Masked() {
+			t.Errorf("build(%q): prefix %s is not masked", line, row.prefix)
+		}
+		if row.asn > math.MaxUint32 {
+			t.Errorf("build(%q): ASN %d does not fit 32 bits", line, row.asn)
+		}
+		if asn, ok := row.record["autonomous_system_number"]; ok && asn != mmdbtype.Uint32(row.asn) {
+			t.Errorf("build(%q): stored ASN %v, parsed %d", line, asn, row.asn)
+		}
+		for key, value := range row.record {
+			s, ok := value.(mmdbtype.String)
+			if !ok {
+				continue
+			}
+			if !utf8.ValidString(string(s)) || strings.ContainsFunc(string(s), unicode.IsControl) {
+				t.Errorf("build(%q): %s is %q", line, key, s)
+			}
+		}
+	})
+}
+
+// BenchmarkParseNetwork compares the parsing of the networks of a row
+// with net.ParseCIDR, as the build did before, and with net/netip, which
+// only allocates the net.IPNet of networks inserted into the tree.
+func BenchmarkParseNetwork(b *testing.B) {
+	networks := []string{"1.1.1.0/24", "11.32.0.0/16", "2a01:4f8::/32", "2a0e:b107:1::/48"}
+	b.Run("net.ParseCIDR", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for _, network := range networks {
+				if _, _, err := net.ParseCIDR(network); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("netip.ParsePrefix", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for _, network := range networks {
+				if _, err := netip.ParsePrefix(network); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("netip.ParsePrefix+insert", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for _, network := range networks {
+				prefix, err := netip.ParsePrefix(network)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = prefixNetwork(prefix.Masked())
+			}
+		}
+	})
+}
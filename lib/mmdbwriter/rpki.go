@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// vrp is a validated ROA payload: asn may originate prefix and its
+// more-specifics up to maxLength.
+type vrp struct {
+	asn       uint32
+	maxLength int
+}
+
+// vrpSet indexes VRPs by their prefix so the VRPs covering a route can be
+// found with one map lookup per prefix length.
+type vrpSet map[netip.Prefix][]vrp
+
+// vrpASN accepts both the numeric ASNs of rpki-client and the "AS13335"
+// strings of the RIPE validator export.
+type vrpASN uint32
+
+func (a *vrpASN) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid asn %s", data)
+	}
+	*a = vrpASN(asn)
+	return nil
+}
+
+// vrpExport is the shape shared by rpki-client JSON output and the RIPE
+// validated-objects export.
+type vrpExport struct {
+	ROAs []struct {
+		ASN       vrpASN `json:"asn"`
+		Prefix    string `json:"prefix"`
+		MaxLength int    `json:"maxLength"`
+	} `json:"roas"`
+}
+
+// loadVRPs reads a VRP export from a file or, for an http(s) URL, from a
+// download using the -fetch settings.
+func loadVRPs(ctx context.Context, source, userAgent string, retries int) (vrpSet, int, error) {
+	path := source
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		dir, err := os.MkdirTemp("", "mmdbwriter-rpki-")
+		if err != nil {
+			return nil, 0, err
+		}
+		defer os.RemoveAll(dir)
+		path = filepath.Join(dir, "vrps.json")
+		if _, err := fetchFile(ctx, source, path, userAgent, retries); err != nil {
+			return nil, 0, fmt.Errorf("failed to fetch VRPs from %s: %w", source, err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read VRPs: %w", err)
+	}
+	var export vrpExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse VRPs in %s: %w", source, err)
+	}
+
+	vrps := vrpSet{}
+	for _, roa := range export.ROAs {
+		prefix, err := netip.ParsePrefix(roa.Prefix)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid VRP prefix %q in %s", roa.Prefix, source)
+		}
+		prefix = prefix.Masked()
+		maxLength := roa.MaxLength
+		if maxLength == 0 {
+			maxLength = prefix.Bits()
+		}
+		if maxLength < prefix.Bits() || maxLength > prefix.Addr().BitLen() {
+			return nil, 0, fmt.Errorf("invalid maxLength %d for VRP %s in %s", roa.MaxLength, prefix, source)
+		}
+		vrps[prefix] = append(vrps[prefix], vrp{asn: uint32(roa.ASN), maxLength: maxLength})
+	}
+	return vrps, len(export.ROAs), nil
+}
+
+// validate returns the RFC 6811 origin validation state of a route: valid
+// when a covering VRP matches the origin and length, invalid when VRPs
+// cover it but none match, and unknown when no VRP covers it. AS 0 VRPs
+// cover but never match.
+func (s vrpSet) validate(route netip.Prefix, origin uint32) string {
+	covered := false
+	route = route.Masked()
+	for bits := route.Bits(); bits >= 0; bits-- {
+		covering, _ := route.Addr().Prefix(bits)
+		for _, v := range s[covering] {
+			covered = true
+			if v.asn != 0 && v.asn == origin && route.Bits() <= v.maxLength {
+				return "valid"
+			}
+		}
+	}
+	if covered {
+		return "invalid"
+	}
+	return "unknown"
+}
+
+// enrich sets rpki_status, replacing any rpki column. An AS_SET validates
+// as origin 0, which no VRP matches (RFC 6811).
+func (s vrpSet) enrich(prefix netip.Prefix, record *mmdbbuild.Record, stats *buildStats) {
+	status := s.validate(prefix, record.ASN)
+	record.RPKIStatus = status
+	stats.rpkiStatus[status]++
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadWhoisOrgs reads the aut-num objects of an RPSL (WHOIS) export and
+// returns the organization name of each ASN: the first descr line, or the
+// as-name when there is no descr.
+func loadWhoisOrgs(path string) (map[uint32]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WHOIS file: %w", err)
+	}
+	defer fh.Close()
+
+	orgs := map[uint32]string{}
+
+	var (
+		asn       uint32
+		inAutNum  bool
+		asName    string
+		descr     string
+		lineCount int
+	)
+	flush := func() {
+		if inAutNum {
+			switch {
+			case descr != "":
+				orgs[asn] = descr
+			case asName != "":
+				orgs[asn] = asName
+			}
+		}
+		inAutNum, asName, descr = false, "", ""
+	}
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineCount++
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			// A blank line ends the object.
+			flush()
+			continue
+		case line[0] == '%' || line[0] == '#':
+			continue
+		case line[0] == ' ' || line[0] == '\t' || line[0] == '+':
+			// Continuation of the previous attribute; only the first
+			// line of a descr is used, so there is nothing to add.
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		// Drop end-of-line comments.
+		if i := strings.Index(value, "#"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+
+		switch {
+		case key == "aut-num":
+			flush()
+			n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32)
+			if err != nil {
+				logger.Warn("skipping invalid aut-num", "file", path, "line", lineCount, "aut_num", value)
+				continue
+			}
+			asn, inAutNum = uint32(n), true
+		case key == "as-name" && asName == "":
+			asName = value
+		case key == "descr" && descr == "":
+			descr = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read WHOIS file: %w", err)
+	}
+	flush()
+
+	return orgs, nil
+}
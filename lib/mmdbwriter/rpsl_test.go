@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testRPSL = `% RIPE-style export
+aut-num:        AS64500
+as-name:        EXAMPLE-AS
+descr:          Example Networks B.V.  # the operator
+descr:          second descr line
+                continued
+source:         TEST
+
+aut-num:        AS64501
+as-name:        NAMEONLY-AS
+source:         TEST
+
+aut-num:        not-an-asn
+descr:          Broken
+
+route:          192.0.2.0/24
+descr:          Not an aut-num
+origin:         AS64502
+
+aut-num:        as64503
+descr:          Lower Case Prefix
+`
+
+func TestLoadWhoisOrgs(t *testing.T) {
+	orgs, err := loadWhoisOrgs(writeTestFile(t, "aut-num.db", testRPSL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32]string{
+		64500: "Example Networks B.V.",
+		64501: "NAMEONLY-AS",
+		64503: "Lower Case Prefix",
+	}
+	if !reflect.DeepEqual(orgs, want) {
+		t.Errorf("got %v, want %v", orgs, want)
+	}
+}
+
+func TestWhoisOrgsOverride(t *testing.T) {
+	cfg := testConfig(t, "-whois-orgs", writeTestFile(t, "aut-num.db", testRPSL))
+	db, _ := buildTestDB(t, cfg, "network,asn,org\n1.2.3.0/24,64500,example bv\n5.6.7.0/24,64999,Unknown To WHOIS\n")
+	for ip, want := range map[string]string{"1.2.3.4": "Example Networks B.V.", "5.6.7.8": "Unknown To WHOIS"} {
+		if _, record := lookupTest(t, db, ip); record["autonomous_system_organization"] != want {
+			t.Errorf("%s: got %v, want org %q", ip, record, want)
+		}
+	}
+}
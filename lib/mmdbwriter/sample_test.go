@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSample(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("network,asn\n")
+	for i := range 200 {
+		fmt.Fprintf(&input, "1.%d.%d.0/24,%d\n", i/100+1, i%100, 64500+i)
+	}
+
+	sampled := func(seed string) int {
+		_, stats := buildTestDB(t, testConfig(t, "-sample", "0.5", "-seed", seed), input.String())
+		if stats.records+stats.unsampled != 200 {
+			t.Fatalf("seed %s: %d records and %d unsampled rows, want 200 together", seed, stats.records, stats.unsampled)
+		}
+		return stats.records
+	}
+	first := sampled("42")
+	if first == 0 || first == 200 {
+		t.Errorf("sampled %d of 200 rows at 0.5", first)
+	}
+	if again := sampled("42"); again != first {
+		t.Errorf("the same seed sampled %d and %d rows", first, again)
+	}
+}
+
+func TestResolveSeed(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	cfg := testConfig(t)
+	if err := resolveSeed(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.seed != 1700000000 {
+		t.Errorf("got seed %d, want SOURCE_DATE_EPOCH", cfg.seed)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if err := resolveSeed(testConfig(t)); err == nil {
+		t.Error("an invalid SOURCE_DATE_EPOCH was accepted")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// Output schemas accepted by -schema.
+const (
+	// schemaDefault stores every field the input and flags produce.
+	schemaDefault = "bgp-tools"
+	// schemaGeoLite2ASN stores only the fields of MaxMind's GeoLite2-ASN
+	// database, so that the output is a drop-in replacement for it.
+	schemaGeoLite2ASN = "geolite2-asn"
+	// schemaGeoIP2City nests the country of -rir-stats and the location
+	// of -geofeed in the country, city and related maps of MaxMind's
+	// GeoIP2-City database, next to the fields of GeoLite2-ASN, for
+	// readers that expect one combined database.
+	schemaGeoIP2City = "geoip2-city"
+)
+
+// geolite2ASNDatabaseType is the database_type GeoLite2-ASN readers such
+// as geoip2-golang check for.
+const geolite2ASNDatabaseType = "GeoLite2-ASN"
+
+// geoip2CityDatabaseType is the database_type of -schema geoip2-city,
+// which City readers check for.
+const geoip2CityDatabaseType = "GeoIP2-City"
+
+// geolite2ASNFields are the fields of a GeoLite2-ASN record. Both types
+// already match: autonomous_system_number is a uint32 and
+// autonomous_system_organization a string.
+var geolite2ASNFields = []mmdbtype.String{
+	"autonomous_system_number",
+	"autonomous_system_organization",
+}
+
+// validateSchema checks -schema and rejects flags whose only effect would
+// be fields the schema does not have.
+func validateSchema(cfg *config) error {
+	switch cfg.schema {
+	case schemaDefault:
+		return nil
+	case schemaGeoLite2ASN, schemaGeoIP2City:
+	default:
+		return fmt.Errorf("unknown -schema %q (want %s, %s or %s)", cfg.schema, schemaDefault, schemaGeoLite2ASN, schemaGeoIP2City)
+	}
+
+	switch {
+	case cfg.orgHash:
+		return fmt.Errorf("-org-hash cannot be used with -schema %s", cfg.schema)
+	case cfg.mergeStrategy == mergeIntoArray:
+		return fmt.Errorf("-merge-strategy %s cannot be used with -schema %s", mergeIntoArray, cfg.schema)
+	case cfg.aggregates.enabled():
+		return fmt.Errorf("-also-insert-aggregate cannot be used with -schema %s", cfg.schema)
+	case cfg.tagBogonNetworks:
+		return fmt.Errorf("-tag-bogon-networks cannot be used with -schema %s", cfg.schema)
+	case cfg.peeringDB != "":
+		return fmt.Errorf("-peeringdb cannot be used with -schema %s", cfg.schema)
+	case len(cfg.anycast) > 0:
+		return fmt.Errorf("-anycast cannot be used with -schema %s", cfg.schema)
+	case len(cfg.geofeeds) > 0 && cfg.schema == schemaGeoLite2ASN:
+		return fmt.Errorf("-geofeed cannot be used with -schema %s", cfg.schema)
+	case cfg.asRel != "":
+		return fmt.Errorf("-as-rel cannot be used with -schema %s", cfg.schema)
+	case cfg.tagUnannounced:
+		return fmt.Errorf("-tag-unannounced cannot be used with -schema %s", cfg.schema)
+	case cfg.firstSeen != "":
+		return fmt.Errorf("-first-seen cannot be used with -schema %s", cfg.schema)
+	}
+	// The other outputs read the flat fields of the default schema.
+	if cfg.schema == schemaGeoIP2City {
+		switch {
+		case cfg.outputFormat != outputFormatMMDB:
+			return fmt.Errorf("-output-format %s cannot be used with -schema %s", cfg.outputFormat, cfg.schema)
+		case cfg.splitBy != "":
+			return fmt.Errorf("-split-by cannot be used with -schema %s", cfg.schema)
+		}
+	}
+	return nil
+}
+
+// applySchema removes the fields of record that the output schema does not
+// have. Under geoip2-city the country of the row is kept for
+// applyCitySchema.
+func applySchema(schema string, record mmdbtype.Map) mmdbtype.Map {
+	if schema != schemaGeoLite2ASN && schema != schemaGeoIP2City {
+		return record
+	}
+	out := mmdbtype.Map{}
+	for _, key := range geolite2ASNFields {
+		if v, ok := record[key]; ok {
+			out[key] = v
+		}
+	}
+	if v, ok := record["country"]; ok && schema == schemaGeoIP2City {
+		out["country"] = v
+	}
+	return out
+}
+
+// applyCitySchema rewrites every record of the tree in the geoip2-city
+// layout once the geofeeds have added their fields. It runs over the whole
+// tree, as the fields come from the rows and the geofeeds alike.
+func applyCitySchema(writer *mmdbwriter.Tree, cfg *config) error {
+	root := netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	if treeOptions(cfg).IPVersion == 4 {
+		root = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	}
+	err := writer.InsertFunc(prefixNetwork(root), func(existing mmdbtype.DataType) (mmdbtype.DataType, error) {
+		record, ok := existing.(mmdbtype.Map)
+		if !ok {
+			return existing, nil
+		}
+		return cityRecord(record), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to apply -schema %s: %w", schemaGeoIP2City, err)
+	}
+	return nil
+}
+
+// cityRecord returns the geoip2-city form of a flat record: the ASN
+// fields, country and continent from the geofeed country, else the RIR
+// country, registered_country from the RIR, and the geofeed region and
+// city as subdivisions and city. Codes are stored without names, which
+// the GeoIP2 readers leave empty.
+func cityRecord(record mmdbtype.Map) mmdbtype.Map {
+	out := mmdbtype.Map{}
+	for _, key := range geolite2ASNFields {
+		if v, ok := record[key]; ok {
+			out[key] = v
+		}
+	}
+	registered, _ := record["country"].(mmdbtype.String)
+	country, _ := record["geo_country"].(mmdbtype.String)
+	if country == "" {
+		country = registered
+	}
+	if country != "" {
+		out["country"] = mmdbtype.Map{"iso_code": country}
+		if continent, ok := continents[string(country)]; ok {
+			out["continent"] = mmdbtype.Map{"code": mmdbtype.String(continent)}
+		}
+	}
+	if registered != "" {
+		out["registered_country"] = mmdbtype.Map{"iso_code": registered}
+	}
+	// Geofeed regions are ISO 3166-2 codes, e.g. US-CA; GeoIP2 stores the
+	// part after the country.
+	if region, _ := record["geo_region"].(mmdbtype.String); region != "" {
+		if _, code, ok := strings.Cut(string(region), "-"); ok && code != "" {
+			out["subdivisions"] = mmdbtype.Slice{mmdbtype.Map{"iso_code": mmdbtype.String(code)}}
+		}
+	}
+	if city, _ := record["geo_city"].(mmdbtype.String); city != "" {
+		out["city"] = mmdbtype.Map{"names": mmdbtype.Map{"en": city}}
+	}
+	return out
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// lookupResponse is the JSON body of GET /lookup/{ip}.
+type lookupResponse struct {
+	IP      string         `json:"ip"`
+	Network string         `json:"network"`
+	Record  map[string]any `json:"record"`
+	// Version is the published version a lookup as of a date used.
+	Version string `json:"version,omitempty"`
+}
+
+// lookupServer answers lookups against one database, which watchDatabase
+// may replace at any time. db is nil until a valid database is loaded.
+type lookupServer struct {
+	db atomic.Pointer[maxminddb.Reader]
+
+	lookups  atomic.Uint64
+	notFound atomic.Uint64
+	invalid  atomic.Uint64
+	failed   atomic.Uint64
+
+	reloads        atomic.Uint64
+	reloadFailures atomic.Uint64
+
+	exports atomic.Uint64
+
+	// history answers lookups with ?as_of=, nil without -history.
+	history       *history
+	historyLookup atomic.Uint64
+
+	// asns is the -asn-db behind /asn/{asn}, nil without one.
+	asns              atomic.Pointer[map[uint32]*asnDBEntry]
+	asnLookups        atomic.Uint64
+	asnNotFound       atomic.Uint64
+	asnReloads        atomic.Uint64
+	asnReloadFailures atomic.Uint64
+}
+
+// asnResponse is the JSON body of GET /asn/{asn}.
+type asnResponse struct {
+	ASN uint32 `json:"asn"`
+	*asnDBEntry
+}
+
+// errNoDatabase fails lookups while no valid database is loaded.
+var errNoDatabase = errors.New("no database loaded")
+
+// lookupAsOf looks ip up in the version of -history current at asOf.
+func (s *lookupServer) lookupAsOf(ip net.IP, asOf string) (*net.IPNet, mmdbtype.DataType, string, error) {
+	if s.history == nil {
+		return nil, nil, "", errNoHistory
+	}
+	a, err := parseAsOf(asOf)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	s.historyLookup.Add(1)
+	db, v, err := s.history.at(a)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	network, record, err := lookupRecord(db, ip)
+	return network, record, v.Path, err
+}
+
+// lookup looks ip up in the current database.
+func (s *lookupServer) lookup(ip net.IP) (*net.IPNet, mmdbtype.DataType, error) {
+	db := s.db.Load()
+	if db == nil {
+		return nil, nil, errNoDatabase
+	}
+	return lookupRecord(db, ip)
+}
+
+// runServe implements `serve [flags] <db.mmdb|source.csv>`: it serves
+// lookups from an existing database, or from one built in memory when the
+// argument is a CSV source.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "`address` to listen on")
+	grpcListen := fs.String("grpc-listen", "",
+		"also serve the gRPC LookupService of pkg/lookuppb/lookup.proto on this `address` (without TLS)")
+	dnsListen := fs.String("dns-listen", "",
+		"also answer Team Cymru style origin TXT queries over DNS on this UDP `address`")
+	dnsZone := fs.String("dns-zone", "asn.example",
+		"`zone` of the DNS queries: <reversed-ip>.origin.<zone> and <reversed-nibbles>.origin6.<zone>")
+	dnsTTL := fs.Duration("dns-ttl", time.Hour, "TTL of the DNS answers")
+	reloadInterval := fs.Duration("reload-interval", 5*time.Second,
+		"check the database for changes this often and reload it (0 reloads on SIGHUP only)")
+	historyDir := fs.String("history", "",
+		"publish `dir` whose versions answer GET /lookup/{ip}?as_of=YYYY-MM-DD")
+	asnDB := fs.String("asn-db", "",
+		"ASN database `file` written by asn-db, JSON or SQLite, answering GET /asn/{asn}; reloaded like the database")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [flags] <db.mmdb|source.csv>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("serve needs a database or CSV file")
+	}
+	if strings.Trim(*dnsZone, ".") == "" {
+		return fmt.Errorf("-dns-zone must not be empty")
+	}
+	if *dnsTTL < 0 || *dnsTTL > math.MaxInt32*time.Second {
+		return fmt.Errorf("-dns-ttl must be between 0 and %d seconds", math.MaxInt32)
+	}
+	if *reloadInterval < 0 {
+		return fmt.Errorf("-reload-interval must not be negative")
+	}
+
+	// A database that is not there yet, e.g. in a volume a build job has
+	// still to fill, is picked up by the watcher; until then the server
+	// runs but is not ready.
+	path := fs.Arg(0)
+	s := &lookupServer{}
+	if *historyDir != "" {
+		if _, err := readHistoryIndex(*historyDir); err != nil {
+			return err
+		}
+		s.history = &history{dir: *historyDir}
+	}
+	info, _ := os.Stat(path)
+	if db, err := loadDatabase(path); err != nil {
+		if *reloadInterval == 0 {
+			return err
+		}
+		log.Printf("Serving without a database until %s is valid: %v", path, err)
+		info = nil
+	} else {
+		s.db.Store(db)
+	}
+	go s.watchDatabase(path, *reloadInterval, info)
+
+	if *asnDB != "" {
+		// Unlike the database, the ASN database has to be there from the
+		// start.
+		info, err := os.Stat(*asnDB)
+		if err != nil {
+			return fmt.Errorf("failed to read ASN database: %w", err)
+		}
+		asns, err := readASNDatabase(*asnDB)
+		if err != nil {
+			return err
+		}
+		s.asns.Store(&asns)
+		log.Printf("Serving %d ASNs from %s", len(asns), *asnDB)
+		go s.watchASNDatabase(*asnDB, *reloadInterval, info)
+	}
+	mux := s.handler(*asnDB != "")
+
+	errc := make(chan error, 3)
+	if *grpcListen != "" {
+		log.Printf("Serving gRPC lookups from %s on %s", fs.Arg(0), *grpcListen)
+		go func() { errc <- serveGRPC(*grpcListen, s) }()
+	}
+	if *dnsListen != "" {
+		log.Printf("Serving DNS origin lookups from %s for %s on %s", fs.Arg(0), *dnsZone, *dnsListen)
+		go func() { errc <- serveDNS(*dnsListen, *dnsZone, *dnsTTL, s) }()
+	}
+	log.Printf("Serving lookups from %s on %s", fs.Arg(0), *listen)
+	go func() { errc <- http.ListenAndServe(*listen, mux) }()
+	return <-errc
+}
+
+// handler routes the HTTP API of s, with GET /asn/{asn} when it serves an
+// ASN database.
+func (s *lookupServer) handler(asns bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	if asns {
+		mux.HandleFunc("GET /asn/{asn}", s.handleASN)
+	}
+	mux.HandleFunc("GET /lookup/{ip}", s.handleLookup)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /export.arrow", s.handleExportArrow)
+	return mux
+}
+
+// openOrBuild reads path into memory as a database, or builds one in
+// memory from it when it is a CSV file. Unlike a memory-mapped file, the
+// reader needs no Close and can be dropped while lookups still use it.
+func openOrBuild(path string) (*maxminddb.Reader, error) {
+	if !strings.HasSuffix(path, ".csv") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MMDB file: %w", err)
+		}
+		db, err := maxminddb.FromBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open MMDB file: %w", err)
+		}
+		return db, nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CSV file: %w", err)
+	}
+	defer fh.Close()
+
+	b, err := mmdbbuild.New()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := b.AddCSV(fh)
+	if err != nil {
+		return nil, err
+	}
+	db, err := b.BuildReader()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Built database in memory: %d records, %d rows skipped", stats.Records, stats.Skipped)
+	return db, nil
+}
+
+func (s *lookupServer) handleLookup(w http.ResponseWriter, r *http.Request) {
+	s.lookups.Add(1)
+
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil {
+		s.invalid.Add(1)
+		http.Error(w, "invalid IP address", http.StatusBadRequest)
+		return
+	}
+
+	var network *net.IPNet
+	var record mmdbtype.DataType
+	var version string
+	var err error
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		network, record, version, err = s.lookupAsOf(ip, asOf)
+	} else {
+		network, record, err = s.lookup(ip)
+	}
+	if err != nil {
+		s.failed.Add(1)
+		status := http.StatusInternalServerError
+		switch {
+		case err == errNoDatabase:
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, errNoVersion):
+			status = http.StatusNotFound
+		case errors.Is(err, errBadAsOf), err == errNoHistory:
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	resp := lookupResponse{IP: ip.String(), Network: network.String(), Version: version}
+	status := http.StatusOK
+	if record == nil {
+		s.notFound.Add(1)
+		status = http.StatusNotFound
+	} else if m, ok := mmdbToJSON(record).(map[string]any); ok {
+		resp.Record = m
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleASN answers the entry of an AS number, given as 13335 or AS13335.
+func (s *lookupServer) handleASN(w http.ResponseWriter, r *http.Request) {
+	s.asnLookups.Add(1)
+	asn, err := mmdbbuild.ParseASN(r.PathValue("asn"))
+	if err != nil {
+		http.Error(w, "invalid AS number", http.StatusBadRequest)
+		return
+	}
+	entry := (*s.asns.Load())[asn]
+	if entry == nil {
+		s.asnNotFound.Add(1)
+		http.Error(w, "AS number not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(asnResponse{ASN: asn, asnDBEntry: entry})
+}
+
+// handleExportArrow streams every network of the current database as an
+// Arrow IPC stream, for analytics tools to ingest without reading the MMDB
+// themselves. An export started before a reload finishes on the database
+// it started with.
+func (s *lookupServer) handleExportArrow(w http.ResponseWriter, r *http.Request) {
+	s.exports.Add(1)
+	db := s.db.Load()
+	if db == nil {
+		http.Error(w, errNoDatabase.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", arrowContentType)
+	bw := bufio.NewWriterSize(w, 1<<20)
+	n, err := exportArrowStream(db, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		// The status is sent, so the client only sees a truncated stream.
+		log.Printf("Arrow export failed after %d networks: %v", n, err)
+	}
+}
+
+func (s *lookupServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether a valid database is loaded, unlike
+// /healthz, which only tells the process is up.
+func (s *lookupServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.db.Load() == nil {
+		http.Error(w, errNoDatabase.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// handleMetrics writes the counters in the Prometheus text format.
+func (s *lookupServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	var ready, buildEpoch, nodes uint64
+	if db := s.db.Load(); db != nil {
+		ready, buildEpoch, nodes = 1, uint64(db.Metadata.BuildEpoch), uint64(db.Metadata.NodeCount)
+	}
+	metrics := []struct {
+		name, help, typ string
+		value           uint64
+	}{
+		{"mmdbwriter_lookups_total", "Lookup requests received.", "counter", s.lookups.Load()},
+		{"mmdbwriter_lookups_not_found_total", "Lookups of addresses without data.", "counter", s.notFound.Load()},
+		{"mmdbwriter_lookups_invalid_total", "Lookups of invalid IP addresses.", "counter", s.invalid.Load()},
+		{"mmdbwriter_lookups_failed_total", "Lookups that failed to read the database.", "counter", s.failed.Load()},
+		{"mmdbwriter_database_ready", "Whether a valid database is loaded.", "gauge", ready},
+		{"mmdbwriter_database_build_epoch_seconds", "Build time of the served database.", "gauge", buildEpoch},
+		{"mmdbwriter_database_nodes", "Search tree nodes of the served database.", "gauge", nodes},
+		{"mmdbwriter_database_reloads_total", "Databases reloaded after a change.", "counter", s.reloads.Load()},
+		{"mmdbwriter_database_reload_failures_total", "Reloads that failed and kept the previous database.", "counter", s.reloadFailures.Load()},
+		{"mmdbwriter_exports_total", "Arrow exports of the whole database requested.", "counter", s.exports.Load()},
+		{"mmdbwriter_history_lookups_total", "Lookups as of a date in a -history version.", "counter", s.historyLookup.Load()},
+	}
+	if asns := s.asns.Load(); asns != nil {
+		metrics = append(metrics, []struct {
+			name, help, typ string
+			value           uint64
+		}{
+			{"mmdbwriter_asn_lookups_total", "ASN lookup requests received.", "counter", s.asnLookups.Load()},
+			{"mmdbwriter_asn_lookups_not_found_total", "Lookups of AS numbers without an entry.", "counter", s.asnNotFound.Load()},
+			{"mmdbwriter_asn_database_asns", "AS numbers in the served ASN database.", "gauge", uint64(len(*asns))},
+			{"mmdbwriter_asn_database_reloads_total", "ASN databases reloaded after a change.", "counter", s.asnReloads.Load()},
+			{"mmdbwriter_asn_database_reload_failures_total", "ASN database reloads that failed and kept the previous one.", "counter", s.asnReloadFailures.Load()},
+		}...)
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
+
+// runHealthcheck implements `healthcheck [flags]`: it fails unless the
+// server answers /readyz, for the HEALTHCHECK of a container image that
+// has no curl or wget.
+func runHealthcheck(args []string) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	url := fs.String("url", "http://localhost:8080/readyz", "readiness `url` of the server")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for the answer")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s healthcheck [flags]\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("healthcheck takes no arguments")
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(*url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", *url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serveTestASNs is an asns.csv in the layout of https://bgp.tools/asns.csv.
+const serveTestASNs = `asn,name,class,cc
+AS13335,"Cloudflare, Inc.",Content,US
+AS15169,Google LLC,Content,US
+AS6939,Hurricane Electric LLC,Transit,US
+`
+
+// newServeTestServer serves the golden corpus and an ASN database built
+// from it with the handler of serve.
+func newServeTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	source, err := os.ReadFile("testdata/bgp-tools.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := buildTestMMDB(t, testConfig(t), string(source))
+
+	asnDB := filepath.Join(t.TempDir(), "asns.json")
+	asns := writeTestFile(t, "asns.csv", serveTestASNs)
+	if err := runASNDB([]string{"-asn-names", asns, asnDB, "testdata/bgp-tools.csv"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readASNDatabase(asnDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &lookupServer{}
+	s.db.Store(openTestDB(t, data))
+	s.asns.Store(&entries)
+	srv := httptest.NewServer(s.handler(true))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// getTest fetches path from srv and checks its status.
+func getTest(t *testing.T, srv *httptest.Server, path string, want int) []byte {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != want {
+		t.Errorf("GET %s: got status %d, want %d: %s", path, resp.StatusCode, want, body)
+	}
+	return body
+}
+
+func TestServeProbes(t *testing.T) {
+	srv := newServeTestServer(t)
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		getTest(t, srv, path, http.StatusOK)
+	}
+
+	// Without a database the process is up but not ready.
+	empty := httptest.NewServer((&lookupServer{}).handler(false))
+	defer empty.Close()
+	getTest(t, empty, "/healthz", http.StatusOK)
+	getTest(t, empty, "/readyz", http.StatusServiceUnavailable)
+}
+
+func TestServeGoldenCorpus(t *testing.T) {
+	srv := newServeTestServer(t)
+	data, err := os.ReadFile("testdata/bgp-tools.expected.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected fixtureExpectations
+	if err := json.Unmarshal(data, &expected); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range expected.Lookups {
+		status := http.StatusOK
+		if want.Record == nil {
+			status = http.StatusNotFound
+		}
+		body := getTest(t, srv, "/lookup/"+want.IP, status)
+		var got fixtureLookup
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("GET /lookup/%s: %v", want.IP, err)
+		}
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		if !bytes.Equal(gotJSON, wantJSON) {
+			t.Errorf("GET /lookup/%s: got %s, want %s", want.IP, gotJSON, wantJSON)
+		}
+	}
+}
+
+func TestServeASN(t *testing.T) {
+	srv := newServeTestServer(t)
+	tests := []struct {
+		path   string
+		status int
+		name   string
+	}{
+		{"/asn/13335", http.StatusOK, "Cloudflare, Inc."},
+		{"/asn/6939", http.StatusOK, "Hurricane Electric LLC"},
+		{"/asn/64511", http.StatusNotFound, ""},
+		{"/asn/not-a-number", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			body := getTest(t, srv, tt.path, tt.status)
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got struct {
+				Name         string `json:"name"`
+				IPv4Prefixes int    `json:"ipv4_prefixes"`
+				IPv6Prefixes int    `json:"ipv6_prefixes"`
+			}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.name || got.IPv4Prefixes+got.IPv6Prefixes == 0 {
+				t.Errorf("unexpected answer %s", body)
+			}
+		})
+	}
+}
+
+func TestServeExportArrow(t *testing.T) {
+	srv := newServeTestServer(t)
+	body := getTest(t, srv, "/export.arrow", http.StatusOK)
+	if !bytes.HasPrefix(body, []byte{0xff, 0xff, 0xff, 0xff}) || !bytes.HasSuffix(body, []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}) {
+		t.Error("not an Arrow stream")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// shardIndex is the JSON index written next to the shards. Each shard
+// covers one CIDR prefix; together the prefixes are disjoint and sorted.
+type shardIndex struct {
+	Shards []shardEntry `json:"shards"`
+}
+
+type shardEntry struct {
+	File     string `json:"file"`
+	Prefix   string `json:"prefix"`
+	First    string `json:"first"`
+	Last     string `json:"last"`
+	Networks int    `json:"networks"`
+	Size     int    `json:"size"`
+}
+
+// shardWriter splits a database into shards of at most maxSize bytes by
+// recursively halving the address space until each half fits.
+type shardWriter struct {
+	db       *maxminddb.Reader
+	opts     mmdbwriter.Options
+	maxSize  int
+	base     string
+	metadata map[string]string
+	index    shardIndex
+}
+
+// writeShards writes the built database as shards named after outputFile
+// (asn.mmdb becomes asn.shard-000.mmdb, ...) plus an asn.shards.json index.
+// Each shard carries the custom metadata keys of the build and is built
+// with opts.
+func writeShards(ctx context.Context, built *maxminddb.Reader, opts mmdbwriter.Options, outputFile string, maxSize int, metadata map[string]string) error {
+	if dir := filepath.Dir(outputFile); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
+	sw := &shardWriter{
+		db:       built,
+		opts:     opts,
+		maxSize:  maxSize,
+		base:     strings.TrimSuffix(outputFile, filepath.Ext(outputFile)),
+		metadata: metadata,
+	}
+
+	root := "::/0"
+	if built.Metadata.IPVersion == 4 {
+		root = "0.0.0.0/0"
+	}
+	_, network, _ := net.ParseCIDR(root)
+	if err := sw.shard(ctx, network); err != nil {
+		return err
+	}
+
+	indexFile := sw.base + ".shards.json"
+	data, err := json.MarshalIndent(sw.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := writeOutput(ctx, indexFile, bytes.NewReader(data), func() int64 { return int64(len(data)) }); err != nil {
+		return fmt.Errorf("failed to write shard index: %w", err)
+	}
+
+	for _, s := range sw.index.Shards {
+		logger.Debug("shard written", "file", s.File, "prefix", s.Prefix, "networks", s.Networks, "bytes", s.Size)
+	}
+	logger.Info("shards written", "shards", len(sw.index.Shards), "index", indexFile)
+	return nil
+}
+
+func (sw *shardWriter) shard(ctx context.Context, prefix *net.IPNet) error {
+	data, networks, err := sw.build(prefix)
+	if err != nil {
+		return err
+	}
+	if networks == 0 {
+		return nil
+	}
+
+	if len(data) > sw.maxSize {
+		ones, bits := prefix.Mask.Size()
+		if ones == bits {
+			return fmt.Errorf("network %s alone exceeds the shard size limit", prefix)
+		}
+		lower, upper := splitPrefix(prefix)
+		if err := sw.shard(ctx, lower); err != nil {
+			return err
+		}
+		return sw.shard(ctx, upper)
+	}
+
+	file := fmt.Sprintf("%s.shard-%03d.mmdb", sw.base, len(sw.index.Shards))
+	if err := writeOutput(ctx, file, bytes.NewReader(data), func() int64 { return int64(len(data)) }); err != nil {
+		return fmt.Errorf("failed to write shard: %w", err)
+	}
+
+	first, last := networkRange(prefix)
+	sw.index.Shards = append(sw.index.Shards, shardEntry{
+		File:     filepath.Base(file),
+		Prefix:   prefix.String(),
+		First:    first.String(),
+		Last:     last.String(),
+		Networks: networks,
+		Size:     len(data),
+	})
+	return nil
+}
+
+// build serializes the networks within prefix into a database of their own.
+func (sw *shardWriter) build(prefix *net.IPNet) ([]byte, int, error) {
+	writer, networks, err := copyDatabase(sw.db, prefix, sw.opts)
+	if err != nil || networks == 0 {
+		return nil, networks, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := (extraMetadata{db: writer, extra: sw.metadata}).WriteTo(&buf); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), networks, nil
+}
+
+// splitPrefix returns the two halves of prefix.
+func splitPrefix(prefix *net.IPNet) (*net.IPNet, *net.IPNet) {
+	ones, bits := prefix.Mask.Size()
+	mask := net.CIDRMask(ones+1, bits)
+
+	lower := &net.IPNet{IP: prefix.IP.Mask(mask), Mask: mask}
+
+	upperIP := make(net.IP, len(lower.IP))
+	copy(upperIP, lower.IP)
+	upperIP[ones/8] |= 0x80 >> (ones % 8)
+	upper := &net.IPNet{IP: upperIP, Mask: mask}
+
+	return lower, upper
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+func TestWriteShards(t *testing.T) {
+	source, err := os.ReadFile("testdata/bgp-tools.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t)
+	built, _ := buildTestDB(t, cfg, string(source))
+	dir := t.TempDir()
+
+	const maxSize = 3000
+	metadata := map[string]string{"license": "test"}
+	if err := writeShards(context.Background(), built, treeOptions(cfg), filepath.Join(dir, "asn.mmdb"), maxSize, metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "asn.shards.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index shardIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Shards) < 2 {
+		t.Fatalf("got %d shards, want the database split", len(index.Shards))
+	}
+
+	var lastPrefix *net.IPNet
+	for _, entry := range index.Shards {
+		if entry.Size > maxSize || entry.Networks == 0 {
+			t.Errorf("%s: %d networks in %d bytes", entry.File, entry.Networks, entry.Size)
+		}
+		_, prefix, err := net.ParseCIDR(entry.Prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastPrefix != nil {
+			if _, last := networkRange(lastPrefix); bytes.Compare(last, prefix.IP.To16()) >= 0 {
+				t.Errorf("%s overlaps or precedes %s", prefix, lastPrefix)
+			}
+		}
+		lastPrefix = prefix
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md, err := readMetadataMap(data); err != nil || md["license"] != "test" {
+			t.Errorf("%s: got metadata %v (%v), want the custom keys of the build", entry.File, md, err)
+		}
+		shard := openTestDB(t, data)
+		// Every network of the shard resolves as in the whole database.
+		networks := 0
+		err = walkDatabase(shard, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+			networks++
+			ip := network.IP
+			// Networks of the IPv4 subtree are walked as IPv4.
+			if ip4 := ip.To4(); ip4 != nil && len(prefix.IP) == net.IPv6len {
+				ip = append(make(net.IP, 12), ip4...)
+			}
+			if !prefix.Contains(ip) {
+				t.Errorf("%s: %s lies outside %s", entry.File, network, prefix)
+			}
+			_, want, err := lookupRecord(built, network.IP)
+			if err != nil {
+				return err
+			}
+			if !recordsEqual(record, want) {
+				t.Errorf("%s: %s is %v, want %v", entry.File, network, record, want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if networks != entry.Networks {
+			t.Errorf("%s: %d networks, index says %d", entry.File, networks, entry.Networks)
+		}
+	}
+}
+
+func TestSplitPrefix(t *testing.T) {
+	tests := []struct{ prefix, lower, upper string }{
+		{"0.0.0.0/0", "0.0.0.0/1", "128.0.0.0/1"},
+		{"10.0.0.0/8", "10.0.0.0/9", "10.128.0.0/9"},
+		{"192.0.2.0/31", "192.0.2.0/32", "192.0.2.1/32"},
+		{"2001:db8::/32", "2001:db8::/33", "2001:db8:8000::/33"},
+	}
+	for _, tt := range tests {
+		_, prefix, _ := net.ParseCIDR(tt.prefix)
+		lower, upper := splitPrefix(prefix)
+		if lower.String() != tt.lower || upper.String() != tt.upper {
+			t.Errorf("splitPrefix(%s) = %s, %s, want %s, %s", tt.prefix, lower, upper, tt.lower, tt.upper)
+		}
+	}
+}
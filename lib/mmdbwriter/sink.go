@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// outputSink is an output format. It receives the normalized records of a
+// database, each network with its record in network order, and writes
+// them to one file, which only replaces the previous one once close
+// succeeds. A new format is an implementation and a case of
+// openOutputSink; the ingestion does not know about them. The MMDB sink
+// also writes the output of a build: given the tree of the build, it is
+// closed without adding networks and writes that tree as it is.
+type outputSink interface {
+	add(network *net.IPNet, record mmdbtype.Map) error
+	close() error
+	// abort discards the output after a failure.
+	abort()
+}
+
+// sinkTarget is what an output sink writes: the file, the metadata of the
+// database its networks come from with the extra metadata of the build,
+// and for the MMDB sink the options of the tree, or the tree of a build
+// and its serialization when the build made one.
+type sinkTarget struct {
+	path     string
+	metadata maxminddb.Metadata
+	extra    map[string]string
+	opts     mmdbwriter.Options
+
+	tree       *mmdbwriter.Tree
+	serialized []byte
+	// ctx cancels the write of the MMDB sink; nil never does.
+	ctx context.Context
+}
+
+// openOutputSink opens the sink of an -output-format.
+func openOutputSink(format string, t sinkTarget) (outputSink, error) {
+	switch format {
+	case outputFormatMMDB:
+		return newMMDBSink(t)
+	case outputFormatSQLite:
+		return newSQLiteSink(t)
+	case outputFormatParquet:
+		return newParquetSink(t)
+	case outputFormatJSONL:
+		return newJSONLSink(t)
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// writeSink writes every network of db within the given network (all of
+// them when within is nil) to sink and closes it, returning the number of
+// networks written. The sink is aborted when anything fails, or ctx is
+// cancelled.
+func writeSink(ctx context.Context, sink outputSink, db *maxminddb.Reader, within *net.IPNet) (int, error) {
+	written := 0
+	err := walkDatabase(db, within, func(network *net.IPNet, record mmdbtype.DataType) error {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		m, _ := record.(mmdbtype.Map)
+		if err := sink.add(network, m); err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+	if err == nil {
+		err = sink.close()
+	}
+	if err != nil {
+		sink.abort()
+		return 0, err
+	}
+	return written, nil
+}
+
+// mmdbSink inserts the networks into a new tree, or takes the tree of a
+// build, and writes it with writeOutput.
+type mmdbSink struct {
+	ctx        context.Context
+	path       string
+	tree       *mmdbwriter.Tree
+	output     io.WriterTo
+	serialized []byte
+}
+
+func newMMDBSink(t sinkTarget) (outputSink, error) {
+	s := &mmdbSink{ctx: t.ctx, path: t.path, tree: t.tree, serialized: t.serialized}
+	if s.ctx == nil {
+		s.ctx = context.Background()
+	}
+	if s.tree == nil {
+		tree, err := mmdbwriter.New(t.opts)
+		if err != nil {
+			return nil, err
+		}
+		s.tree = tree
+	}
+	s.output = s.tree
+	if len(t.extra) > 0 {
+		s.output = extraMetadata{db: s.tree, extra: t.extra}
+	}
+	return s, nil
+}
+
+func (s *mmdbSink) add(network *net.IPNet, record mmdbtype.Map) error {
+	if err := s.tree.Insert(network, record); err != nil {
+		return fmt.Errorf("failed to insert record for %s: %w", network, err)
+	}
+	return nil
+}
+
+// close writes the serialization the build made, else the tree.
+func (s *mmdbSink) close() error {
+	output := s.output
+	size := func() int64 {
+		// Serializing again is exact and only happens after a failure.
+		n, _ := s.output.WriteTo(io.Discard)
+		return n
+	}
+	if s.serialized != nil {
+		output = bytes.NewReader(s.serialized)
+		size = func() int64 { return int64(len(s.serialized)) }
+	}
+	return writeOutput(s.ctx, s.path, output, size)
+}
+
+// abort has nothing to discard: writeOutput leaves no partial file.
+func (s *mmdbSink) abort() {}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// recordSizes are the search tree record sizes supported by the MMDB format.
+var recordSizes = []int{24, 28, 32}
+
+// printSizeReport re-serializes the built database at every record size and
+// prints a table of the output size and write time of each to w. Sizes that
+// cannot address all nodes and data of the tree are reported as not viable.
+// The table is the output -size-report asks for, so -quiet does not hide
+// it. The sizes are serialized concurrently on up to workers goroutines.
+func printSizeReport(w io.Writer, built *maxminddb.Reader, workers int) error {
+	type sizeResult struct {
+		bytes   int64
+		elapsed time.Duration
+		err     error
+	}
+	results := make([]sizeResult, len(recordSizes))
+
+	jobs := make([]outputJob, len(recordSizes))
+	for i, size := range recordSizes {
+		jobs[i] = outputJob{
+			name: fmt.Sprintf("record size %d", size),
+			run: func() error {
+				opts := treeOptionsFrom(built.Metadata)
+				opts.RecordSize = size
+				tree, _, err := copyDatabase(built, nil, opts)
+				if err != nil {
+					return err
+				}
+
+				// A size that cannot hold the tree is a result, not a
+				// failure of the report.
+				start := time.Now()
+				n, err := tree.WriteTo(io.Discard)
+				results[i] = sizeResult{bytes: n, elapsed: time.Since(start), err: err}
+				return nil
+			},
+		}
+	}
+	if err := runOutputJobs(jobs, workers); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "Record size comparison:")
+	fmt.Fprintf(w, "  %-11s  %14s  %12s\n", "Record size", "Output bytes", "Write time")
+	for i, size := range recordSizes {
+		r := results[i]
+		if r.err != nil {
+			fmt.Fprintf(w, "  %-11d  %14s  %12s  (%v)\n", size, "not viable", "-", r.err)
+			continue
+		}
+		fmt.Fprintf(w, "  %-11d  %14d  %12s\n", size, r.bytes, r.elapsed.Round(time.Microsecond))
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPrintSizeReport(t *testing.T) {
+	db, _ := buildTestDB(t, testConfig(t), "network,asn,org\n1.1.1.0/24,13335,Cloudflare\n2606:4700::/32,13335,Cloudflare\n8.8.8.0/24,15169,Google\n")
+	var buf bytes.Buffer
+	if err := printSizeReport(&buf, db, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2+len(recordSizes) {
+		t.Fatalf("got report %q, want a header and %d rows", buf.String(), len(recordSizes))
+	}
+	if lines[0] != "Record size comparison:" || strings.Fields(lines[1])[0] != "Record" {
+		t.Errorf("got header %q", lines[:2])
+	}
+	// Every size can hold this database, and larger records make a larger
+	// tree.
+	var last int
+	for i, size := range recordSizes {
+		fields := strings.Fields(lines[2+i])
+		if len(fields) != 3 || fields[0] != strconv.Itoa(size) {
+			t.Errorf("got row %q for record size %d", lines[2+i], size)
+			continue
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n <= last {
+			t.Errorf("record size %d: got %q bytes after %d", size, fields[1], last)
+		}
+		last = n
+	}
+}
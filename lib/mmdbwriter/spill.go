@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+	"slices"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// spillRunRows is the number of rows -external-sort sorts in memory before
+// writing them out as one run.
+const spillRunRows = 1 << 18
+
+// spillRow is a built row on its way through -external-sort. seq is its
+// position in the input, which decides between overlapping rows.
+type spillRow struct {
+	prefix netip.Prefix
+	seq    int
+	file   int
+	row    *builtRow
+}
+
+func compareSpillRows(a, b *spillRow) int {
+	if c := a.prefix.Addr().Compare(b.prefix.Addr()); c != 0 {
+		return c
+	}
+	if c := a.prefix.Bits() - b.prefix.Bits(); c != 0 {
+		return c
+	}
+	return a.seq - b.seq
+}
+
+// rowSpiller implements -external-sort: rows are written to sorted runs in
+// temporary files and merged back in prefix order, parents before their
+// more specific prefixes, which the tree inserts faster than input order.
+type rowSpiller struct {
+	dir   string
+	v6    bool
+	files []string
+	runs  []*os.File
+	batch []*spillRow
+	seq   int
+}
+
+func newRowSpiller(dir string, ipVersion int) *rowSpiller {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &rowSpiller{dir: dir, v6: ipVersion != 4}
+}
+
+func (s *rowSpiller) add(row *builtRow, file string) error {
+	if len(s.files) == 0 || s.files[len(s.files)-1] != file {
+		s.files = append(s.files, file)
+	}
+	s.batch = append(s.batch, &spillRow{
+		prefix: treePrefix(row.prefix, s.v6),
+		seq:    s.seq,
+		file:   len(s.files) - 1,
+		row:    row,
+	})
+	s.seq++
+	if len(s.batch) >= spillRunRows {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows to a new sorted run.
+func (s *rowSpiller) flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	slices.SortFunc(s.batch, compareSpillRows)
+	fh, err := os.CreateTemp(s.dir, "mmdbwriter-spill-*.run")
+	if err != nil {
+		return fmt.Errorf("failed to create spill file: %w", err)
+	}
+	s.runs = append(s.runs, fh)
+	w := bufio.NewWriterSize(fh, 1<<20)
+	var buf []byte
+	for _, r := range s.batch {
+		buf, err = appendSpillRow(buf[:0], r)
+		if err != nil {
+			return fmt.Errorf("failed to spill row for %s: %w", r.row.network, err)
+		}
+		if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(buf)))); err != nil {
+			return fmt.Errorf("failed to write spill file: %w", err)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return fmt.Errorf("failed to write spill file: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	// Clear the batch so the spilled rows can be collected.
+	clear(s.batch)
+	s.batch = s.batch[:0]
+	return nil
+}
+
+// merge calls store for the spilled rows in prefix order, leaving out rows
+// that a covering row later in the input replaced entirely, so the tree
+// ends up as if the rows were inserted in input order. It returns the
+// number of rows left out.
+func (s *rowSpiller) merge(store func(row *builtRow, file string) error) (int, error) {
+	if err := s.flush(); err != nil {
+		return 0, err
+	}
+	logger.Info("merging spilled rows", "rows", s.seq, "runs", len(s.runs), "dir", s.dir)
+
+	h := &spillHeap{}
+	readers := make([]*bufio.Reader, len(s.runs))
+	for i, fh := range s.runs {
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to read spill file: %w", err)
+		}
+		readers[i] = bufio.NewReaderSize(fh, 1<<20)
+		if err := h.push(readers[i], i, s.v6); err != nil {
+			return 0, err
+		}
+	}
+
+	// stack holds the covering prefixes of the current row with the
+	// highest input position among each one and its own covering rows.
+	type covering struct {
+		prefix netip.Prefix
+		maxSeq int
+	}
+	var stack []covering
+	overridden := 0
+	for h.Len() > 0 {
+		head := heap.Pop(h).(spillHead)
+		r := head.row
+		if err := h.push(readers[head.run], head.run, s.v6); err != nil {
+			return 0, err
+		}
+
+		for len(stack) > 0 && !stack[len(stack)-1].prefix.Contains(r.prefix.Addr()) {
+			stack = stack[:len(stack)-1]
+		}
+		maxSeq := -1
+		if len(stack) > 0 {
+			maxSeq = stack[len(stack)-1].maxSeq
+		}
+		if r.seq < maxSeq {
+			overridden++
+			continue
+		}
+		// A truncated row only fills gaps, so it does not replace the
+		// earlier rows it covers.
+		if !r.row.truncated {
+			maxSeq = r.seq
+		}
+		stack = append(stack, covering{prefix: r.prefix, maxSeq: maxSeq})
+		if err := store(r.row, s.files[r.file]); err != nil {
+			return 0, err
+		}
+	}
+	return overridden, nil
+}
+
+// close removes the spill files.
+func (s *rowSpiller) close() {
+	for _, fh := range s.runs {
+		fh.Close()
+		os.Remove(fh.Name())
+	}
+	s.runs = nil
+}
+
+// spillHead is the next row of a run in the merge.
+type spillHead struct {
+	row *spillRow
+	run int
+}
+
+type spillHeap []spillHead
+
+func (h spillHeap) Len() int           { return len(h) }
+func (h spillHeap) Less(i, j int) bool { return compareSpillRows(h[i].row, h[j].row) < 0 }
+func (h spillHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *spillHeap) Push(x any)        { *h = append(*h, x.(spillHead)) }
+func (h *spillHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// push reads the next row of a run into the heap, if there is one.
+func (h *spillHeap) push(r *bufio.Reader, run int, v6 bool) error {
+	size, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spill file: %w", err)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("failed to read spill file: %w", err)
+	}
+	row, err := decodeSpillRow(buf)
+	if err != nil {
+		return fmt.Errorf("corrupt spill file: %w", err)
+	}
+	row.prefix = treePrefix(row.row.prefix, v6)
+	heap.Push(h, spillHead{row: row, run: run})
+	return nil
+}
+
+// appendSpillRow encodes everything store needs of a row: the network,
+// ASN and record, and the source row for -rejects.
+func appendSpillRow(b []byte, r *spillRow) ([]byte, error) {
+	row := r.row
+	b = binary.AppendUvarint(b, uint64(r.seq))
+	b = binary.AppendUvarint(b, uint64(r.file))
+	b = appendSpillString(b, row.network)
+	b = appendSpillString(b, string(row.prefix.Addr().AsSlice()))
+	b = binary.AppendUvarint(b, uint64(row.prefix.Bits()))
+	b = binary.AppendUvarint(b, row.asn)
+	b, err := appendSpillValue(b, row.record)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.AppendUvarint(b, uint64(len(row.source.fields)))
+	for _, f := range row.source.fields {
+		b = appendSpillString(b, f)
+	}
+	b = binary.AppendUvarint(b, uint64(len(row.source.lines)))
+	for _, line := range row.source.lines {
+		b = binary.AppendUvarint(b, uint64(line))
+	}
+	truncated := uint64(0)
+	if row.truncated {
+		truncated = 1
+	}
+	return binary.AppendUvarint(b, truncated), nil
+}
+
+func decodeSpillRow(b []byte) (*spillRow, error) {
+	d := &spillDecoder{b: b}
+	r := &spillRow{seq: int(d.uvarint()), file: int(d.uvarint())}
+	row := &builtRow{network: d.string()}
+	addr, _ := netip.AddrFromSlice([]byte(d.string()))
+	row.prefix = netip.PrefixFrom(addr, int(d.uvarint()))
+	row.asn = d.uvarint()
+	record, _ := d.value().(mmdbtype.Map)
+	row.record = record
+	row.source.fields = make([]string, d.uvarint())
+	for i := range row.source.fields {
+		row.source.fields[i] = d.string()
+	}
+	row.source.lines = make([]int, d.uvarint())
+	for i := range row.source.lines {
+		row.source.lines[i] = int(d.uvarint())
+	}
+	row.truncated = d.uvarint() == 1
+	if d.err != nil {
+		return nil, d.err
+	}
+	r.row = row
+	return r, nil
+}
+
+// Type tags of the spilled record values.
+const (
+	spillBool byte = iota + 1
+	spillBytes
+	spillFloat32
+	spillFloat64
+	spillInt32
+	spillMap
+	spillSlice
+	spillString
+	spillUint16
+	spillUint32
+	spillUint64
+	spillUint128
+)
+
+func appendSpillString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendSpillValue(b []byte, v mmdbtype.DataType) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case mmdbtype.Bool:
+		b = append(b, spillBool)
+		if v {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case mmdbtype.Bytes:
+		return appendSpillString(append(b, spillBytes), string(v)), nil
+	case mmdbtype.Float32:
+		return binary.BigEndian.AppendUint32(append(b, spillFloat32), math.Float32bits(float32(v))), nil
+	case mmdbtype.Float64:
+		return binary.BigEndian.AppendUint64(append(b, spillFloat64), math.Float64bits(float64(v))), nil
+	case mmdbtype.Int32:
+		return binary.AppendVarint(append(b, spillInt32), int64(v)), nil
+	case mmdbtype.Map:
+		b = binary.AppendUvarint(append(b, spillMap), uint64(len(v)))
+		for key, value := range v {
+			b = appendSpillString(b, string(key))
+			if b, err = appendSpillValue(b, value); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case mmdbtype.Slice:
+		b = binary.AppendUvarint(append(b, spillSlice), uint64(len(v)))
+		for _, value := range v {
+			if b, err = appendSpillValue(b, value); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case mmdbtype.String:
+		return appendSpillString(append(b, spillString), string(v)), nil
+	case mmdbtype.Uint16:
+		return binary.AppendUvarint(append(b, spillUint16), uint64(v)), nil
+	case mmdbtype.Uint32:
+		return binary.AppendUvarint(append(b, spillUint32), uint64(v)), nil
+	case mmdbtype.Uint64:
+		return binary.AppendUvarint(append(b, spillUint64), uint64(v)), nil
+	case *mmdbtype.Uint128:
+		return appendSpillString(append(b, spillUint128), string((*big.Int)(v).Bytes())), nil
+	}
+	return nil, fmt.Errorf("cannot spill value of type %T", v)
+}
+
+// spillDecoder reads spilled values; the first error sticks.
+type spillDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *spillDecoder) fail() {
+	if d.err == nil {
+		d.err = errors.New("truncated row")
+	}
+	d.b = nil
+}
+
+func (d *spillDecoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *spillDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *spillDecoder) string() string {
+	n := d.uvarint()
+	if uint64(len(d.b)) < n {
+		d.fail()
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func (d *spillDecoder) fixed(n int) []byte {
+	if len(d.b) < n {
+		d.fail()
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *spillDecoder) value() mmdbtype.DataType {
+	switch tag := d.byte(); tag {
+	case spillBool:
+		return mmdbtype.Bool(d.byte() == 1)
+	case spillBytes:
+		return mmdbtype.Bytes(d.string())
+	case spillFloat32:
+		return mmdbtype.Float32(math.Float32frombits(binary.BigEndian.Uint32(d.fixed(4))))
+	case spillFloat64:
+		return mmdbtype.Float64(math.Float64frombits(binary.BigEndian.Uint64(d.fixed(8))))
+	case spillInt32:
+		v, n := binary.Varint(d.b)
+		if n <= 0 {
+			d.fail()
+			return nil
+		}
+		d.b = d.b[n:]
+		return mmdbtype.Int32(v)
+	case spillMap:
+		n := d.uvarint()
+		m := make(mmdbtype.Map, min(n, uint64(len(d.b))))
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			key := d.string()
+			m[mmdbtype.String(key)] = d.value()
+		}
+		return m
+	case spillSlice:
+		n := d.uvarint()
+		s := make(mmdbtype.Slice, 0, min(n, uint64(len(d.b))))
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			s = append(s, d.value())
+		}
+		return s
+	case spillString:
+		return mmdbtype.String(d.string())
+	case spillUint16:
+		return mmdbtype.Uint16(d.uvarint())
+	case spillUint32:
+		return mmdbtype.Uint32(d.uvarint())
+	case spillUint64:
+		return mmdbtype.Uint64(d.uvarint())
+	case spillUint128:
+		v := new(big.Int).SetBytes([]byte(d.string()))
+		return (*mmdbtype.Uint128)(v)
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unknown value type %d", tag)
+		}
+		return nil
+	}
+}
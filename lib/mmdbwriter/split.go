@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Partitions of -split-by.
+const (
+	splitRIR       = "rir"
+	splitContinent = "continent"
+)
+
+// splitUnknown is the part of the networks without a RIR or country.
+const splitUnknown = "unknown"
+
+// splitIndex is the JSON index written next to the parts of -split-by.
+type splitIndex struct {
+	SplitBy string      `json:"split_by"`
+	Parts   []splitPart `json:"parts"`
+}
+
+type splitPart struct {
+	File     string `json:"file"`
+	Part     string `json:"part"`
+	Networks int    `json:"networks"`
+	Size     int    `json:"size"`
+}
+
+// continents maps ISO 3166 alpha-2 codes to the continent codes of the
+// GeoIP databases. EU and AP are the pseudo-countries of RIR statistics for
+// space used across Europe and the Asia-Pacific region.
+var continents = func() map[string]string {
+	m := map[string]string{}
+	for continent, countries := range map[string]string{
+		"AF": "AO BF BI BJ BW CD CF CG CI CM CV DJ DZ EG EH ER ET GA GH GM GN GQ GW KE KM LR LS LY MA MG ML MR MU MW MZ NA NE NG RE RW SC SD SH SL SN SO SS ST SZ TD TG TN TZ UG YT ZA ZM ZW",
+		"AN": "AQ BV GS HM TF",
+		"AS": "AE AF AM AP AZ BD BH BN BT CC CN CX GE HK ID IL IN IO IQ IR JO JP KG KH KP KR KW KZ LA LB LK MM MN MO MV MY NP OM PH PK PS QA SA SG SY TH TJ TL TM TR TW UZ VN YE",
+		"EU": "AD AL AT AX BA BE BG BY CH CY CZ DE DK EE ES EU FI FO FR GB GG GI GR HR HU IE IM IS IT JE LI LT LU LV MC MD ME MK MT NL NO PL PT RO RS RU SE SI SJ SK SM UA VA XK",
+		"NA": "AG AI AW BB BL BM BQ BS BZ CA CR CU CW DM DO GD GL GP GT HN HT JM KN KY LC MF MQ MS MX NI PA PM PR SV SX TC TT US VC VG VI",
+		"OC": "AS AU CK FJ FM GU KI MH MP NC NF NR NU NZ PF PG PN PW SB TK TO TV UM VU WF WS",
+		"SA": "AR BO BR CL CO EC FK GF GY PE PY SR UY VE",
+	} {
+		for _, country := range strings.Fields(countries) {
+			m[country] = continent
+		}
+	}
+	return m
+}()
+
+func validateSplit(cfg *config) error {
+	switch cfg.splitBy {
+	case "":
+		return nil
+	case splitRIR:
+		if len(cfg.rirStats) == 0 {
+			return errors.New("-split-by rir requires -rir-stats")
+		}
+	case splitContinent:
+		if len(cfg.rirStats) == 0 && len(cfg.geofeeds) == 0 {
+			return errors.New("-split-by continent requires -rir-stats or -geofeed")
+		}
+	default:
+		return fmt.Errorf("invalid -split-by %q: must be %s or %s", cfg.splitBy, splitRIR, splitContinent)
+	}
+	switch {
+	case cfg.outputFile == stdioPath:
+		return errors.New("-split-by cannot be used when writing to stdout")
+	case cfg.shardMaxSize > 0:
+		return errors.New("-split-by cannot be combined with -shard-max-size")
+	case cfg.outputFormat != outputFormatMMDB:
+		return errors.New("-split-by requires -output-format mmdb")
+	}
+	return nil
+}
+
+// splitPartOf returns the part of a record: its rir, or the continent of
+// its geo_country, else its country, in lower case.
+func splitPartOf(splitBy string, record mmdbtype.DataType) string {
+	m, _ := record.(mmdbtype.Map)
+	var part string
+	if splitBy == splitRIR {
+		rir, _ := m["rir"].(mmdbtype.String)
+		part = string(rir)
+	} else {
+		country, _ := m["geo_country"].(mmdbtype.String)
+		if country == "" {
+			country, _ = m["country"].(mmdbtype.String)
+		}
+		part = continents[strings.ToUpper(string(country))]
+	}
+	if part == "" {
+		return splitUnknown
+	}
+	return strings.ToLower(part)
+}
+
+// writeSplit writes the networks of the built database partitioned by
+// splitBy, in addition to the full output: asn.mmdb gets asn.ripencc.mmdb,
+// asn.arin.mmdb, ... or asn.eu.mmdb, asn.na.mmdb, ... and an asn.split.json
+// index. Each part is built with opts, carries the custom metadata keys of
+// the build and is serialized on up to workers goroutines.
+func writeSplit(ctx context.Context, built *maxminddb.Reader, opts mmdbwriter.Options, splitBy, outputFile string, metadata map[string]string, workers int) error {
+	trees := map[string]*mmdbwriter.Tree{}
+	networks := map[string]int{}
+	err := walkDatabase(built, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+		part := splitPartOf(splitBy, record)
+		tree, ok := trees[part]
+		if !ok {
+			var err error
+			if tree, err = mmdbwriter.New(opts); err != nil {
+				return err
+			}
+			trees[part] = tree
+		}
+		if err := tree.Insert(network, record); err != nil {
+			return fmt.Errorf("failed to insert record for %s: %w", network, err)
+		}
+		networks[part]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	parts := make([]string, 0, len(trees))
+	for part := range trees {
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+
+	base := strings.TrimSuffix(outputFile, filepath.Ext(outputFile))
+	index := splitIndex{SplitBy: splitBy, Parts: make([]splitPart, len(parts))}
+	jobs := make([]outputJob, len(parts))
+	for i, part := range parts {
+		file := base + "." + part + ".mmdb"
+		index.Parts[i] = splitPart{File: filepath.Base(file), Part: part, Networks: networks[part]}
+		jobs[i] = outputJob{name: file, run: func() error {
+			var buf bytes.Buffer
+			if _, err := (extraMetadata{db: trees[part], extra: metadata}).WriteTo(&buf); err != nil {
+				return err
+			}
+			size := buf.Len()
+			index.Parts[i].Size = size
+			if err := writeOutput(ctx, file, &buf, func() int64 { return int64(size) }); err != nil {
+				return fmt.Errorf("failed to write split part: %w", err)
+			}
+			return nil
+		}}
+	}
+	if err := runOutputJobs(jobs, workers); err != nil {
+		return err
+	}
+
+	indexFile := base + ".split.json"
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := writeOutput(ctx, indexFile, bytes.NewReader(data), func() int64 { return int64(len(data)) }); err != nil {
+		return fmt.Errorf("failed to write split index: %w", err)
+	}
+
+	for _, p := range index.Parts {
+		logger.Info("split part written", "file", p.File, "part", p.Part, "networks", p.Networks, "bytes", p.Size)
+	}
+	logger.Info("split written", "split_by", splitBy, "parts", len(index.Parts), "index", indexFile)
+	return nil
+}
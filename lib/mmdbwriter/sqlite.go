@@ -0,0 +1,299 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSupported reports whether the SQLite driver is compiled in.
+const sqliteSupported = true
+
+const sqliteNetworksSchema = `
+CREATE TABLE networks (
+	prefix        TEXT NOT NULL,
+	network_start BLOB NOT NULL,
+	network_end   BLOB NOT NULL,
+	asn           INTEGER,
+	org           TEXT,
+	country       TEXT
+);
+`
+
+// sqliteNetworks writes networks and their records to the networks table
+// of a SQLite database, for -output-format sqlite and the -sqlite sidecar.
+// All rows are inserted through one prepared statement inside a single
+// transaction. The file is built next to its path and renamed over it, so
+// a failed build keeps the previous database.
+type sqliteNetworks struct {
+	path, tmp string
+	db        *sql.DB
+	tx        *sql.Tx
+	stmt      *sql.Stmt
+}
+
+func openSQLiteNetworks(path string) (*sqliteNetworks, error) {
+	outputDir := filepath.Dir(path)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	tmp := filepath.Join(outputDir, "."+filepath.Base(path)+".tmp")
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove old SQLite database: %w", err)
+	}
+
+	s := &sqliteNetworks{path: path, tmp: tmp}
+	var err error
+	if s.db, err = sql.Open("sqlite", tmp); err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	if _, err = s.db.Exec(sqliteNetworksSchema); err != nil {
+		err = fmt.Errorf("failed to create SQLite schema: %w", err)
+	} else if s.tx, err = s.db.Begin(); err == nil {
+		s.stmt, err = s.tx.Prepare(
+			"INSERT INTO networks (prefix, network_start, network_end, asn, org, country) VALUES (?, ?, ?, ?, ?, ?)")
+	}
+	if err != nil {
+		s.abort()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteNetworks) add(network *net.IPNet, record mmdbtype.Map) error {
+	var asn, org, country any
+	if v, ok := record["autonomous_system_number"].(mmdbtype.Uint32); ok {
+		asn = int64(v)
+	}
+	if v, ok := record["autonomous_system_organization"].(mmdbtype.String); ok {
+		org = string(v)
+	}
+	if v, ok := record["country"].(mmdbtype.String); ok {
+		country = string(v)
+	}
+	first, last := networkRange(network)
+	if _, err := s.stmt.Exec(network.String(), []byte(first), []byte(last), asn, org, country); err != nil {
+		return fmt.Errorf("failed to write SQLite row for %s: %w", network, err)
+	}
+	return nil
+}
+
+// finish commits the rows and builds the range index, leaving the
+// database next to its path. The index is created last as that is much
+// faster than maintaining it during the inserts.
+func (s *sqliteNetworks) finish() error {
+	s.stmt.Close()
+	if err := s.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit SQLite rows: %w", err)
+	}
+	if _, err := s.db.Exec("CREATE INDEX networks_range ON networks (network_start, network_end)"); err != nil {
+		return fmt.Errorf("failed to create SQLite index: %w", err)
+	}
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("failed to close SQLite database: %w", err)
+	}
+	return nil
+}
+
+// close finishes the database and renames it into place.
+func (s *sqliteNetworks) close() error {
+	if err := s.finish(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace SQLite database: %w", err)
+	}
+	return nil
+}
+
+// abort discards the database, leaving the one at the path as it was.
+func (s *sqliteNetworks) abort() {
+	if s.stmt != nil {
+		s.stmt.Close()
+	}
+	if s.tx != nil {
+		s.tx.Rollback()
+	}
+	s.db.Close()
+	os.Remove(s.tmp)
+}
+
+// sqliteSidecar mirrors every inserted prefix into a SQLite database so
+// that consumers without an MMDB reader can do range lookups in SQL. It
+// has the table of -output-format sqlite, but holds the input rows, so
+// overlapping prefixes all appear, and is only renamed into place by
+// acceptBuild.
+type sqliteSidecar struct {
+	*sqliteNetworks
+}
+
+func openSQLiteSidecar(path string) (*sqliteSidecar, error) {
+	s, err := openSQLiteNetworks(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteSidecar{s}, nil
+}
+
+// close finishes the database, which replaces the one at the path once the
+// build is accepted.
+func (s *sqliteSidecar) close() (pendingFile, error) {
+	if err := s.finish(); err != nil {
+		return pendingFile{}, err
+	}
+	return pendingFile{tmp: s.tmp, path: s.path}, nil
+}
+
+// newSQLiteSink writes the networks of a built database for -output-format
+// sqlite. Unlike the sidecar it holds the final tree, so networks never
+// overlap and a lookup matches at most one row.
+func newSQLiteSink(t sinkTarget) (outputSink, error) {
+	return openSQLiteNetworks(t.path)
+}
+
+const sqliteASNSchema = `
+CREATE TABLE asns (
+	asn           INTEGER PRIMARY KEY,
+	name          TEXT,
+	country       TEXT,
+	rir           TEXT,
+	ipv4_prefixes INTEGER NOT NULL,
+	ipv6_prefixes INTEGER NOT NULL
+);
+CREATE TABLE upstreams (
+	asn      INTEGER NOT NULL,
+	upstream INTEGER NOT NULL,
+	PRIMARY KEY (asn, upstream)
+);
+`
+
+// writeASNDatabaseSQLite writes the entries of asn-db to a SQLite database
+// at path, built next to it and renamed over it like -output-format sqlite.
+func writeASNDatabaseSQLite(entries []*asnDBEntry, path string) error {
+	outputDir := filepath.Dir(path)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	tmp := filepath.Join(outputDir, "."+filepath.Base(path)+".tmp")
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old SQLite database: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	db, err := sql.Open("sqlite", tmp)
+	if err != nil {
+		return fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(sqliteASNSchema); err != nil {
+		return fmt.Errorf("failed to create SQLite schema: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(
+		"INSERT INTO asns (asn, name, country, rir, ipv4_prefixes, ipv6_prefixes) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	upstreamStmt, err := tx.Prepare("INSERT INTO upstreams (asn, upstream) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer upstreamStmt.Close()
+
+	null := func(s string) any {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	for _, e := range entries {
+		if _, err := stmt.Exec(int64(e.ASN), null(e.Name), null(e.Country), null(e.RIR), e.IPv4Prefixes, e.IPv6Prefixes); err != nil {
+			return fmt.Errorf("failed to write SQLite row for AS%d: %w", e.ASN, err)
+		}
+		for _, upstream := range e.Upstreams {
+			if _, err := upstreamStmt.Exec(int64(e.ASN), int64(upstream)); err != nil {
+				return fmt.Errorf("failed to write SQLite upstream of AS%d: %w", e.ASN, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit SQLite rows: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("failed to close SQLite database: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace SQLite database: %w", err)
+	}
+	return nil
+}
+
+// readASNDatabaseSQLite reads the asns and upstreams tables written by
+// writeASNDatabaseSQLite. Databases from before the upstreams table are
+// read without upstreams.
+func readASNDatabaseSQLite(path string) (map[uint32]*asnDBEntry, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT asn, name, country, rir, ipv4_prefixes, ipv6_prefixes FROM asns")
+	if err != nil {
+		return nil, fmt.Errorf("invalid ASN database %s: %w", path, err)
+	}
+	defer rows.Close()
+	entries := map[uint32]*asnDBEntry{}
+	for rows.Next() {
+		var asn int64
+		var name, country, rir sql.NullString
+		e := &asnDBEntry{}
+		if err := rows.Scan(&asn, &name, &country, &rir, &e.IPv4Prefixes, &e.IPv6Prefixes); err != nil {
+			return nil, fmt.Errorf("invalid ASN database %s: %w", path, err)
+		}
+		e.ASN, e.Name, e.Country, e.RIR = uint32(asn), name.String, country.String, rir.String
+		entries[e.ASN] = e
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("invalid ASN database %s: %w", path, err)
+	}
+
+	var upstreamTable int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'upstreams'").Scan(&upstreamTable); err != nil {
+		return nil, fmt.Errorf("invalid ASN database %s: %w", path, err)
+	}
+	if upstreamTable == 0 {
+		return entries, nil
+	}
+	upstreams, err := db.Query("SELECT asn, upstream FROM upstreams ORDER BY asn, upstream")
+	if err != nil {
+		return nil, fmt.Errorf("invalid ASN database %s: %w", path, err)
+	}
+	defer upstreams.Close()
+	for upstreams.Next() {
+		var asn, upstream int64
+		if err := upstreams.Scan(&asn, &upstream); err != nil {
+			return nil, fmt.Errorf("invalid ASN database %s: %w", path, err)
+		}
+		if e := entries[uint32(asn)]; e != nil {
+			e.Upstreams = append(e.Upstreams, uint32(upstream))
+		}
+	}
+	if err := upstreams.Err(); err != nil {
+		return nil, fmt.Errorf("invalid ASN database %s: %w", path, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,38 @@
+//go:build !sqlite
+
+package main
+
+import (
+	"net"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// sqliteSupported reports whether the SQLite driver is compiled in.
+const sqliteSupported = false
+
+// sqliteSidecar is unavailable unless the binary is built with -tags sqlite,
+// which keeps the SQLite driver out of the default build.
+type sqliteSidecar struct{}
+
+func openSQLiteSidecar(string) (*sqliteSidecar, error) {
+	return nil, errNoSQLite
+}
+
+func (*sqliteSidecar) add(*net.IPNet, mmdbtype.Map) error { return nil }
+
+func (*sqliteSidecar) close() (pendingFile, error) { return pendingFile{}, nil }
+
+func (*sqliteSidecar) abort() {}
+
+func newSQLiteSink(sinkTarget) (outputSink, error) {
+	return nil, errNoSQLite
+}
+
+func writeASNDatabaseSQLite([]*asnDBEntry, string) error {
+	return errNoSQLite
+}
+
+func readASNDatabaseSQLite(string) (map[uint32]*asnDBEntry, error) {
+	return nil, errNoSQLite
+}
@@ -0,0 +1,116 @@
+//go:build sqlite
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// querySQLiteTest returns the prefix, asn and org of the most specific
+// row of the networks table of path containing ip, "" when none does.
+func querySQLiteTest(t *testing.T, path, ip string) (prefix string, asn sql.NullInt64, org sql.NullString) {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// IPv4 addresses are stored IPv4-mapped, which As16 returns.
+	addr := netip.MustParseAddr(ip).As16()
+	err = db.QueryRow(`SELECT prefix, asn, org FROM networks
+		WHERE ? BETWEEN network_start AND network_end
+		ORDER BY network_start DESC, network_end LIMIT 1`, addr[:]).Scan(&prefix, &asn, &org)
+	if err == sql.ErrNoRows {
+		return "", asn, org
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefix, asn, org
+}
+
+func TestSQLiteSidecar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.db")
+	cfg := testConfig(t, "-sqlite", path)
+	_, stats := buildTestDB(t, cfg, "network,asn,org\n1.1.0.0/16,13335,Cloudflare\n1.1.1.0/24,13335,\"Cloudflare, Inc.\"\n2606:4700::/32,13335,\n23.128.0.0/10,0,\n")
+	if err := acceptBuild(cfg, stats, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip, prefix string
+		asn        int64
+		org        string
+	}{
+		{"1.1.1.1", "1.1.1.0/24", 13335, "Cloudflare, Inc."},
+		{"1.1.2.1", "1.1.0.0/16", 13335, "Cloudflare"},
+		{"2606:4700::1111", "2606:4700::/32", 13335, ""},
+		{"23.128.0.1", "23.128.0.0/10", 0, ""},
+		{"9.9.9.9", "", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			prefix, asn, org := querySQLiteTest(t, path, tt.ip)
+			if prefix != tt.prefix || asn.Int64 != tt.asn || org.String != tt.org {
+				t.Errorf("got %q %v %v, want %q %d %q", prefix, asn, org, tt.prefix, tt.asn, tt.org)
+			}
+			// ASN 0 and missing organizations are NULL.
+			if prefix != "" && (asn.Valid != (tt.asn != 0) || org.Valid != (tt.org != "")) {
+				t.Errorf("got NULLs asn %v org %v", asn.Valid, org.Valid)
+			}
+		})
+	}
+}
+
+func TestSQLiteSidecarFailedBuild(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "asn.db")
+	cfg := testConfig(t, "-sqlite", path)
+	_, stats := buildTestDB(t, cfg, "network,asn,org\n1.1.1.0/24,13335,Cloudflare\n")
+	if err := acceptBuild(cfg, stats, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = testConfig(t, "-sqlite", path, "-strict")
+	cfg.csvFile = writeTestFile(t, "input.csv", "network,asn,org\n8.8.8.0/24,15169,Google\nnot-a-network,1,\n")
+	cfg.outputFile = filepath.Join(dir, "asn.mmdb")
+	if err := build(context.Background(), cfg, io.Discard); err == nil {
+		t.Fatal("build with an invalid row under -strict succeeded")
+	}
+	if prefix, _, _ := querySQLiteTest(t, path, "1.1.1.1"); prefix != "1.1.1.0/24" {
+		t.Errorf("previous sidecar lost, got %q", prefix)
+	}
+	if prefix, _, _ := querySQLiteTest(t, path, "8.8.8.8"); prefix != "" {
+		t.Errorf("failed build written to the sidecar: %q", prefix)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got files %v, want only asn.db", entries)
+	}
+}
+
+// The -output-format sqlite database has the table of the sidecar, with
+// the networks of the finished tree.
+func TestSQLiteOutput(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, "-output-format", outputFormatSQLite)
+	cfg.csvFile = writeTestFile(t, "input.csv", "network,asn,org\n1.1.0.0/16,13335,Cloudflare\n1.1.1.0/24,13335,\"Cloudflare, Inc.\"\n")
+	cfg.outputFile = filepath.Join(dir, "asn.db")
+	if err := build(context.Background(), cfg, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{"1.1.1.1": "1.1.1.0/24", "1.1.2.1": "1.1.2.0/23", "1.2.0.0": ""} {
+		if prefix, _, _ := querySQLiteTest(t, cfg.outputFile, ip); prefix != want {
+			t.Errorf("%s: got %q, want %q", ip, prefix, want)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Output formats of the stats command.
+const (
+	statsTable = "table"
+	statsJSON  = "json"
+	statsCSV   = "csv"
+)
+
+// statsUnknown is the country and RIR of origin ASNs the country data does
+// not cover.
+const statsUnknown = "unknown"
+
+// asnCountry is where an ASN is registered.
+type asnCountry struct {
+	country, rir string
+}
+
+// statsRow is the prefixes and address space of the networks whose origin
+// ASNs share a country or RIR. Address space is counted in /24s for IPv4
+// and /48s for IPv6, fractions included for longer prefixes.
+type statsRow struct {
+	Key          string  `json:"key"`
+	ASNs         int     `json:"asns"`
+	IPv4Prefixes int     `json:"ipv4_prefixes"`
+	IPv6Prefixes int     `json:"ipv6_prefixes"`
+	IPv4Slash24s float64 `json:"ipv4_slash24s"`
+	IPv6Slash48s float64 `json:"ipv6_slash48s"`
+
+	asns map[uint32]bool
+}
+
+func (r *statsRow) add(asn uint32, network *net.IPNet) {
+	if r.asns == nil {
+		r.asns = map[uint32]bool{}
+	}
+	r.asns[asn] = true
+	r.ASNs = len(r.asns)
+	ones, _ := network.Mask.Size()
+	if network.IP.To4() != nil {
+		r.IPv4Prefixes++
+		r.IPv4Slash24s += math.Exp2(float64(24 - ones))
+	} else {
+		r.IPv6Prefixes++
+		r.IPv6Slash48s += math.Exp2(float64(48 - ones))
+	}
+}
+
+// statsReport is what the stats command prints.
+type statsReport struct {
+	Countries []*statsRow `json:"countries"`
+	RIRs      []*statsRow `json:"rirs"`
+	Total     *statsRow   `json:"total"`
+}
+
+// runStats implements `stats [flags] <db.mmdb>`: it prints the prefixes and
+// address space of a built database per country and per RIR of their
+// origin ASNs, taken from -asn-db or the asn records of -rir-stats.
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	format := fs.String("format", statsTable, "output `format`: table, json or csv")
+	asnDB := fs.String("asn-db", "", "ASN database JSON `file` written by asn-db, giving the country and RIR of each ASN")
+	var rirStats rirStatsFiles
+	fs.Var(&rirStats, "rir-stats",
+		"RIR delegated-extended stats `file` whose asn records give the country and RIR of each ASN; repeat for each RIR")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s stats [flags] <db.mmdb>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("stats needs a database")
+	}
+	if *format != statsTable && *format != statsJSON && *format != statsCSV {
+		return fmt.Errorf("invalid -format %q: must be %s, %s or %s", *format, statsTable, statsJSON, statsCSV)
+	}
+	if *asnDB == "" && len(rirStats) == 0 {
+		return errors.New("stats needs -asn-db or -rir-stats for the countries of the ASNs")
+	}
+
+	countryOf, err := loadASNCountries(*asnDB, rirStats)
+	if err != nil {
+		return err
+	}
+	db, err := maxminddb.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open MMDB file: %w", err)
+	}
+	defer db.Close()
+
+	countries, rirs := map[string]*statsRow{}, map[string]*statsRow{}
+	row := func(rows map[string]*statsRow, key string) *statsRow {
+		if rows[key] == nil {
+			rows[key] = &statsRow{Key: key}
+		}
+		return rows[key]
+	}
+	total := &statsRow{Key: "total"}
+	withoutASN := 0
+	err = walkDatabase(db, nil, func(network *net.IPNet, record mmdbtype.DataType) error {
+		asn := recordASN(record)
+		if asn == nil {
+			withoutASN++
+			return nil
+		}
+		c := countryOf(*asn)
+		row(countries, c.country).add(*asn, network)
+		row(rirs, c.rir).add(*asn, network)
+		total.add(*asn, network)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if withoutASN > 0 {
+		logger.Info("skipped networks without an origin ASN", "networks", withoutASN)
+	}
+
+	report := statsReport{Countries: sortedStatsRows(countries), RIRs: sortedStatsRows(rirs), Total: total}
+	w := bufio.NewWriter(os.Stdout)
+	switch *format {
+	case statsJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	case statsCSV:
+		err = writeStatsCSV(w, report)
+	default:
+		writeStatsTable(w, "COUNTRY", report.Countries, total)
+		fmt.Fprintln(w)
+		writeStatsTable(w, "RIR", report.RIRs, total)
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// loadASNCountries returns the country and RIR of an ASN from the asn-db
+// JSON file, else from the RIR stats, else unknown.
+func loadASNCountries(asnDB string, rirStats []string) (func(uint32) asnCountry, error) {
+	entries := map[uint32]asnCountry{}
+	if asnDB != "" {
+		asns, err := readASNDatabase(asnDB)
+		if err != nil {
+			return nil, err
+		}
+		for asn, e := range asns {
+			if e.Country != "" || e.RIR != "" {
+				entries[asn] = asnCountry{e.Country, e.RIR}
+			}
+		}
+		logger.Info("loaded ASN database", "file", asnDB, "asns", len(entries))
+	}
+	var blocks rirASNBlocks
+	if len(rirStats) > 0 {
+		var err error
+		if blocks, err = loadRIRASNs(rirStats); err != nil {
+			return nil, err
+		}
+		logger.Info("loaded RIR ASN delegations", "count", len(blocks), "files", len(rirStats))
+	}
+	return func(asn uint32) asnCountry {
+		c, ok := entries[asn]
+		if !ok {
+			if block, found := blocks.lookup(asn); found {
+				c = asnCountry{block.country, block.rir}
+			}
+		}
+		c.country = cmp.Or(c.country, statsUnknown)
+		c.rir = cmp.Or(c.rir, statsUnknown)
+		return c
+	}, nil
+}
+
+// sortedStatsRows orders rows by IPv4 then IPv6 address space, largest
+// first, and then by key.
+func sortedStatsRows(rows map[string]*statsRow) []*statsRow {
+	sorted := make([]*statsRow, 0, len(rows))
+	for _, r := range rows {
+		sorted = append(sorted, r)
+	}
+	slices.SortFunc(sorted, func(a, b *statsRow) int {
+		if c := cmp.Compare(b.IPv4Slash24s, a.IPv4Slash24s); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.IPv6Slash48s, a.IPv6Slash48s); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return sorted
+}
+
+// formatSlashes writes an amount of address space without trailing zeros.
+func formatSlashes(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func writeStatsTable(w io.Writer, title string, rows []*statsRow, total *statsRow) {
+	header := []string{title, "ASNS", "IPV4_PREFIXES", "IPV6_PREFIXES", "IPV4_/24S", "IPV6_/48S"}
+	lines := [][]string{header}
+	for _, r := range append(rows, total) {
+		lines = append(lines, []string{r.Key, strconv.Itoa(r.ASNs), strconv.Itoa(r.IPv4Prefixes),
+			strconv.Itoa(r.IPv6Prefixes), formatSlashes(r.IPv4Slash24s), formatSlashes(r.IPv6Slash48s)})
+	}
+	widths := make([]int, len(header))
+	for _, line := range lines {
+		for i, v := range line {
+			widths[i] = max(widths[i], len(v))
+		}
+	}
+	for _, line := range lines {
+		fmt.Fprintf(w, "%-*s", widths[0], line[0])
+		for i := 1; i < len(line); i++ {
+			fmt.Fprintf(w, "  %*s", widths[i], line[i])
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// writeStatsCSV writes the rows of both groupings and the total, with the
+// grouping in the first column.
+func writeStatsCSV(w io.Writer, report statsReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"group", "key", "asns", "ipv4_prefixes", "ipv6_prefixes", "ipv4_slash24s", "ipv6_slash48s"})
+	write := func(group string, r *statsRow) {
+		cw.Write([]string{group, r.Key, strconv.Itoa(r.ASNs), strconv.Itoa(r.IPv4Prefixes),
+			strconv.Itoa(r.IPv6Prefixes), formatSlashes(r.IPv4Slash24s), formatSlashes(r.IPv6Slash48s)})
+	}
+	for _, r := range report.Countries {
+		write("country", r)
+	}
+	for _, r := range report.RIRs {
+		write("rir", r)
+	}
+	write("total", report.Total)
+	cw.Flush()
+	return cw.Error()
+}
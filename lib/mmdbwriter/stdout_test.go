@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestBuildToStdout(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.csvFile = writeTestFile(t, "input.csv", "network,asn,org\n1.1.1.0/24,13335,Cloudflare\n")
+	cfg.outputFile = stdioPath
+
+	var stdout bytes.Buffer
+	if err := build(context.Background(), cfg, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, stdout.Bytes())
+	if _, record := lookupTest(t, db, "1.1.1.1"); record["autonomous_system_number"] != uint64(13335) {
+		t.Errorf("got %v from the streamed database", record)
+	}
+}
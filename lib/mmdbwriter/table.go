@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// tableReader reads the bgp.tools table.txt dump: one "prefix ASN" pair per
+// line, separated by whitespace, without a header.
+type tableReader struct {
+	scanner *bufio.Scanner
+	line    int
+	offsets []int
+}
+
+func newTableReader(r io.Reader) *tableReader {
+	return &tableReader{scanner: bufio.NewScanner(r)}
+}
+
+func (tr *tableReader) header() []string {
+	return []string{"network", "asn"}
+}
+
+func (tr *tableReader) Read() ([]string, error) {
+	for tr.scanner.Scan() {
+		tr.line++
+		line := tr.scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		tr.offsets = tr.offsets[:0]
+		rest := line
+		for _, field := range fields {
+			i := strings.Index(rest, field)
+			tr.offsets = append(tr.offsets, len(line)-len(rest)+i)
+			rest = rest[i+len(field):]
+		}
+		return fields, nil
+	}
+	if err := tr.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (tr *tableReader) FieldPos(field int) (line, column int) {
+	column = 1
+	if field >= 0 && field < len(tr.offsets) {
+		column = tr.offsets[field] + 1
+	}
+	return tr.line, column
+}
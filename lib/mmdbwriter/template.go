@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"gopkg.in/yaml.v3"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// Field types of a -record-template field.
+const (
+	templateUint32 = "uint32"
+	templateString = "string"
+	templateBool   = "bool"
+	templateArray  = "array"
+)
+
+// recordTemplate is a -record-template file: which columns hold the
+// network and ASN, and how other columns map to record fields. Columns are
+// header names or 1-based column numbers.
+type recordTemplate struct {
+	Network string          `yaml:"network"`
+	ASN     string          `yaml:"asn"`
+	Fields  []templateField `yaml:"fields"`
+}
+
+// templateField maps one column to a record field. Arrays split the value
+// on separator (default ",") into items of the items type (default string).
+type templateField struct {
+	Column    string `yaml:"column"`
+	Field     string `yaml:"field"`
+	Type      string `yaml:"type"`
+	Items     string `yaml:"items"`
+	Separator string `yaml:"separator"`
+}
+
+// loadRecordTemplate reads and checks a -record-template file. Unknown
+// keys are errors, so a misspelled setting is not silently ignored.
+func loadRecordTemplate(path string) (*recordTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record template: %w", err)
+	}
+	var t recordTemplate
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&t); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse record template %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i := range t.Fields {
+		f := &t.Fields[i]
+		switch {
+		case f.Column == "":
+			return nil, fmt.Errorf("record template %s: field %d has no column", path, i+1)
+		case f.Field == "":
+			return nil, fmt.Errorf("record template %s: column %q has no field", path, f.Column)
+		case f.Field == "autonomous_system_number":
+			return nil, fmt.Errorf("record template %s: autonomous_system_number comes from the asn column", path)
+		case seen[f.Field]:
+			return nil, fmt.Errorf("record template %s: field %q is mapped twice", path, f.Field)
+		}
+		seen[f.Field] = true
+
+		if f.Type == "" {
+			f.Type = templateString
+		}
+		switch f.Type {
+		case templateUint32, templateString, templateBool:
+			if f.Items != "" || f.Separator != "" {
+				return nil, fmt.Errorf("record template %s: items and separator only apply to arrays (field %q)", path, f.Field)
+			}
+		case templateArray:
+			if f.Items == "" {
+				f.Items = templateString
+			}
+			if f.Items != templateUint32 && f.Items != templateString && f.Items != templateBool {
+				return nil, fmt.Errorf("record template %s: unknown items type %q of field %q (want uint32, string or bool)", path, f.Items, f.Field)
+			}
+			if f.Separator == "" {
+				f.Separator = ","
+			}
+		default:
+			return nil, fmt.Errorf("record template %s: unknown type %q of field %q (want uint32, string, bool or array)", path, f.Type, f.Field)
+		}
+		if f.Field == "autonomous_system_organization" && f.Type != templateString {
+			return nil, fmt.Errorf("record template %s: autonomous_system_organization must be a string", path)
+		}
+	}
+	return &t, nil
+}
+
+// templateColumn is a template field resolved against the header of an
+// input.
+type templateColumn struct {
+	index int
+	templateField
+}
+
+// templateIndex returns the position of a template column in header: a
+// 1-based number or a header name.
+func templateIndex(header []string, column string) (int, error) {
+	if n, err := strconv.Atoi(column); err == nil {
+		if n < 1 {
+			return 0, fmt.Errorf("invalid column number %d", n)
+		}
+		return n - 1, nil
+	}
+	if i := mmdbbuild.HeaderIndex(header, column); i >= 0 {
+		return i, nil
+	}
+	return 0, fmt.Errorf("the input has no column %q", column)
+}
+
+// templateValue converts a column value to the type of f.
+func templateValue(f templateField, value string) (mmdbtype.DataType, error) {
+	if f.Type != templateArray {
+		return templateScalar(f.Type, value)
+	}
+	items := mmdbtype.Slice{}
+	for _, item := range strings.Split(value, f.Separator) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		v, err := templateScalar(f.Items, item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func templateScalar(typ, value string) (mmdbtype.DataType, error) {
+	switch typ {
+	case templateUint32:
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uint32 %q", value)
+		}
+		return mmdbtype.Uint32(n), nil
+	case templateBool:
+		switch strings.ToLower(value) {
+		case "true", "yes", "1":
+			return mmdbtype.Bool(true), nil
+		case "false", "no", "0":
+			return mmdbtype.Bool(false), nil
+		}
+		return nil, fmt.Errorf("invalid bool %q", value)
+	}
+	return mmdbtype.String(value), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// Delta actions accepted by the update command.
+var (
+	deltaAdd      = []string{"add", "a", "+"}
+	deltaWithdraw = []string{"withdraw", "w", "-"}
+)
+
+// runUpdate implements `update base.mmdb delta.csv out.mmdb`: it loads an
+// existing database and applies a delta of added and withdrawn prefixes to
+// it, so frequent rebuilds do not need to reprocess the full table.
+func runUpdate(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: %s update <base.mmdb> <delta.csv> <out.mmdb>", os.Args[0])
+	}
+	baseFile, deltaFile, outFile := args[0], args[1], args[2]
+
+	logger.Info("loading base database", "file", baseFile)
+	b, err := mmdbbuild.Load(baseFile)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.Open(deltaFile)
+	if err != nil {
+		return fmt.Errorf("failed to open delta file: %w", err)
+	}
+	defer fh.Close()
+
+	logger.Info("applying delta", "file", deltaFile)
+	added, withdrawn, skipped, err := applyDelta(b, fh)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("writing output", "file", outFile)
+	size := func() int64 {
+		n, _ := b.WriteTo(io.Discard)
+		return n
+	}
+	if err := writeOutput(context.Background(), outFile, b, size); err != nil {
+		return err
+	}
+	logger.Info("output written", "file", outFile)
+	logger.Info("update summary", "added", added, "withdrawn", withdrawn, "skipped", skipped)
+	return nil
+}
+
+// applyDelta applies a delta CSV with a header row and action, network,
+// asn and optional org columns, in order. Rows that cannot be applied are
+// reported and skipped.
+func applyDelta(b *mmdbbuild.Builder, r io.Reader) (added, withdrawn, skipped int, err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	if _, err := cr.Read(); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to read delta header: %w", err)
+	}
+
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return added, withdrawn, skipped, nil
+		}
+		if err != nil {
+			return added, withdrawn, skipped, fmt.Errorf("failed to read delta row: %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+
+		if len(row) < 2 {
+			logger.Warn("skipping delta row with wrong field count", "line", line, "fields", len(row))
+			skipped++
+			continue
+		}
+		action := strings.ToLower(strings.TrimSpace(row[0]))
+		prefix, perr := netip.ParsePrefix(strings.TrimSpace(row[1]))
+		if perr != nil {
+			logger.Warn("skipping invalid network", "line", line, "network", row[1])
+			skipped++
+			continue
+		}
+
+		switch {
+		case slices.Contains(deltaAdd, action):
+			if len(row) < 3 {
+				logger.Warn("skipping addition without an ASN", "line", line)
+				skipped++
+				continue
+			}
+			asn, aerr := strconv.ParseUint(strings.TrimSpace(row[2]), 10, 32)
+			if aerr != nil {
+				logger.Warn("skipping invalid ASN", "line", line, "asn", row[2])
+				skipped++
+				continue
+			}
+			record := mmdbbuild.Record{ASN: uint32(asn)}
+			if len(row) >= 4 {
+				record.Organization = strings.TrimSpace(row[3])
+			}
+			err = b.AddPrefix(prefix, record)
+			if err == nil {
+				added++
+			}
+		case slices.Contains(deltaWithdraw, action):
+			err = b.RemovePrefix(prefix)
+			if err == nil {
+				withdrawn++
+			}
+		default:
+			logger.Warn("skipping unknown action", "line", line, "action", row[0])
+			skipped++
+			continue
+		}
+
+		if errors.Is(err, mmdbbuild.ErrUnsupportedNetwork) {
+			logger.Warn("skipping unsupported network", "line", line, "network", prefix)
+			skipped++
+			continue
+		}
+		if err != nil {
+			return added, withdrawn, skipped, err
+		}
+	}
+}
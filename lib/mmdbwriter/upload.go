@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// uploadTarget is a parsed -upload URL.
+type uploadTarget struct {
+	scheme string // "s3" or "gs"
+	bucket string
+	key    string
+}
+
+func (t uploadTarget) String() string {
+	return t.scheme + "://" + t.bucket + "/" + t.key
+}
+
+// parseUploadURL parses s3://bucket/key or gs://bucket/key. A key ending
+// in a slash is a prefix the output file name is appended to.
+func parseUploadURL(rawURL, outputFile string) (uploadTarget, error) {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok || (scheme != "s3" && scheme != "gs") {
+		return uploadTarget{}, fmt.Errorf("-upload %q must be an s3:// or gs:// URL", rawURL)
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return uploadTarget{}, fmt.Errorf("-upload %q has no bucket", rawURL)
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += filepath.Base(outputFile)
+	}
+	return uploadTarget{scheme: scheme, bucket: bucket, key: key}, nil
+}
+
+// validateUpload checks -upload against the other output options: a
+// single file has to be written for it to be uploaded.
+func validateUpload(cfg *config) error {
+	if cfg.upload == "" {
+		return nil
+	}
+	switch {
+	case cfg.outputFile == stdioPath:
+		return errors.New("-upload cannot be used when writing to stdout")
+	case cfg.shardMaxSize > 0:
+		return errors.New("-upload cannot be used with -shard-max-size")
+	}
+	_, err := parseUploadURL(cfg.upload, cfg.outputFile)
+	return err
+}
+
+// uploadChecksums are the digests of the uploaded file. The MD5 and, on
+// S3, the SHA-256 are checked by the store, which rejects a body that
+// does not match; the SHA-256 is also kept as object metadata.
+type uploadChecksums struct {
+	size   int64
+	md5    []byte
+	sha256 []byte
+}
+
+func fileChecksums(path string) (uploadChecksums, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return uploadChecksums{}, err
+	}
+	defer fh.Close()
+
+	m, s := md5.New(), sha256.New()
+	n, err := io.Copy(io.MultiWriter(m, s), fh)
+	if err != nil {
+		return uploadChecksums{}, err
+	}
+	return uploadChecksums{size: n, md5: m.Sum(nil), sha256: s.Sum(nil)}, nil
+}
+
+// uploadOutput uploads the finished output file to -upload, if given,
+// followed by its checksum and signature sidecars under the same key plus
+// their suffix. Each object is written with a single PUT, so it only
+// becomes visible once the whole file has arrived and its checksum matched:
+// an interrupted or corrupted upload leaves the previous object in place.
+func uploadOutput(ctx context.Context, cfg *config) error {
+	if cfg.upload == "" {
+		return nil
+	}
+	target, err := parseUploadURL(cfg.upload, cfg.outputFile)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Minute}
+	if err := uploadFile(ctx, client, cfg, cfg.outputFile, target); err != nil {
+		return err
+	}
+	for _, sidecar := range outputSidecars(cfg) {
+		sidecarTarget := target
+		sidecarTarget.key += strings.TrimPrefix(sidecar, cfg.outputFile)
+		if err := uploadFile(ctx, client, cfg, sidecar, sidecarTarget); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFile uploads one file, retrying transient failures like fetchFile.
+func uploadFile(ctx context.Context, client *http.Client, cfg *config, path string, target uploadTarget) error {
+	sums, err := fileChecksums(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s for upload: %w", path, err)
+	}
+
+	logger.Info("uploading", "file", path, "url", target.String(), "bytes", sums.size)
+	delay := fetchRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := uploadOnce(ctx, client, path, target, sums, cfg.userAgent)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("failed to upload %s to %s: %w", path, target, context.Cause(ctx))
+		}
+		var retryable errRetryable
+		if !errors.As(err, &retryable) || attempt >= cfg.fetchRetries {
+			return fmt.Errorf("failed to upload %s to %s: %w", path, target, err)
+		}
+		logger.Warn("upload failed, retrying", "url", target.String(), "attempt", attempt+1,
+			"attempts", cfg.fetchRetries+1, "error", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to upload %s to %s: %w", path, target, context.Cause(ctx))
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	logger.Info("uploaded", "url", target.String(), "sha256", hex.EncodeToString(sums.sha256))
+	return nil
+}
+
+// uploadOnce makes a single PUT that streams the file from disk.
+func uploadOnce(ctx context.Context, client *http.Client, path string, target uploadTarget, sums uploadChecksums, userAgent string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for upload: %w", path, err)
+	}
+	defer fh.Close()
+
+	var req *http.Request
+	if target.scheme == "s3" {
+		req, err = newS3Request(target, fh, sums, time.Now())
+	} else {
+		req, err = newGCSRequest(client, target, fh, sums)
+	}
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errRetryable{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err = fmt.Errorf("HTTP %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return errRetryable{err}
+	}
+	return err
+}
+
+// newS3Request builds a PUT signed with AWS Signature Version 4 from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and optional AWS_SESSION_TOKEN
+// environment variables. AWS_REGION (or AWS_DEFAULT_REGION) selects the
+// endpoint, and AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL point it at an
+// S3-compatible store with path-style URLs.
+func newS3Request(target uploadTarget, body io.Reader, sums uploadChecksums, now time.Time) (*http.Request, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("S3 upload needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	objectPath := "/" + s3EscapePath(target.key)
+	endpoint := "https://" + target.bucket + ".s3." + region + ".amazonaws.com"
+	if custom := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); custom != "" {
+		endpoint = strings.TrimSuffix(custom, "/")
+		objectPath = "/" + s3EscapePath(target.bucket) + objectPath
+	}
+	req, err := http.NewRequest(http.MethodPut, endpoint+objectPath, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = sums.size
+
+	payloadHash := hex.EncodeToString(sums.sha256)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	headers := map[string]string{
+		"content-md5":           base64.StdEncoding.EncodeToString(sums.md5),
+		"content-type":          "application/octet-stream",
+		"host":                  req.URL.Host,
+		"x-amz-checksum-sha256": base64.StdEncoding.EncodeToString(sums.sha256),
+		"x-amz-content-sha256":  payloadHash,
+		"x-amz-date":            amzDate,
+		"x-amz-meta-sha256":     payloadHash,
+	}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		headers["x-amz-security-token"] = token
+	}
+
+	signV4(req, objectPath, headers, payloadHash, region, "s3", accessKey, secretKey)
+	return req, nil
+}
+
+// signV4 signs req, whose escaped path is path and which has no query
+// string, with AWS Signature Version 4 for service in region. headers are
+// the lowercase headers to sign, including host and x-amz-date; they are
+// set on req, and so is the Authorization header.
+func signV4(req *http.Request, path string, headers map[string]string, payloadHash, region, service, accessKey, secretKey string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+		if name != "host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, "", canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	amzDate := headers["x-amz-date"]
+	day := amzDate[:8]
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath percent-encodes an object key the way Signature Version 4
+// expects: everything but unreserved characters and the slashes.
+func s3EscapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// gcsMetadataTokenURL hands out access tokens for the service account of
+// a Compute Engine, GKE or Cloud Run instance.
+const gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// newGCSRequest builds a PUT for the XML API of Cloud Storage. The access
+// token is GOOGLE_OAUTH_ACCESS_TOKEN (e.g. from `gcloud auth
+// print-access-token`), else the one of the instance service account.
+// STORAGE_EMULATOR_HOST points it at an emulator, which needs no token.
+func newGCSRequest(client *http.Client, target uploadTarget, body io.Reader, sums uploadChecksums) (*http.Request, error) {
+	endpoint := "https://storage.googleapis.com"
+	emulator := os.Getenv("STORAGE_EMULATOR_HOST")
+	if emulator != "" {
+		endpoint = strings.TrimSuffix(emulator, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" && emulator == "" {
+		var err error
+		if token, err = gcsMetadataToken(client); err != nil {
+			return nil, fmt.Errorf("GCS upload needs GOOGLE_OAUTH_ACCESS_TOKEN or an instance service account: %w", err)
+		}
+	}
+
+	objectURL := endpoint + "/" + s3EscapePath(target.bucket) + "/" + s3EscapePath(target.key)
+	req, err := http.NewRequest(http.MethodPut, objectURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = sums.size
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	md5sum := base64.StdEncoding.EncodeToString(sums.md5)
+	req.Header.Set("Content-MD5", md5sum)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("x-goog-hash", "md5="+md5sum)
+	req.Header.Set("x-goog-meta-sha256", hex.EncodeToString(sums.sha256))
+	return req, nil
+}
+
+func gcsMetadataToken(client *http.Client) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, gcsMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server: HTTP %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("metadata server: %w", err)
+	}
+	return token.AccessToken, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// validateProblem is one rule a row of a validate-input drop breaks.
+// Errors fail the check; warnings only fail it with -strict.
+type validateProblem struct {
+	line    int
+	warning bool
+	message string
+}
+
+// runValidateInput implements `validate-input [flags] <input>`: it checks
+// a CSV or JSONL drop meant for OpenDB against the rules of the schema and
+// prints every problem with its line, then PASS or FAIL. Unlike a build,
+// which skips bad rows with a warning, it reports all of them, so that a
+// publisher can fix the drop before contributing it.
+//
+// Errors are JSONL lines that are not JSON, rows with too few columns,
+// invalid CIDRs, ASNs that are not 32-bit numbers, AS_SETs or AS_TRANS,
+// fields that are not UTF-8 and rows repeating an earlier one exactly.
+// Warnings are CIDRs that are not canonical, bogon ASNs and organizations
+// with control characters.
+func runValidateInput(args []string) error {
+	fs := flag.NewFlagSet("validate-input", flag.ExitOnError)
+	cfg := &config{}
+	fs.StringVar(&cfg.format, "format", "",
+		"input format: csv or jsonl (default from the file extension, else csv)")
+	fs.Var(&cfg.columns, "columns",
+		"1-based positions of the network, ASN and org columns, e.g. `network=1,asn=3,org=5` (default detected from the header)")
+	strict := fs.Bool("strict", false, "fail on warnings too")
+	limit := fs.Int("limit", 100, "print at most `n` problems (0 prints all); all are counted")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s validate-input [flags] <input.csv|input.jsonl>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("validate-input needs an input file")
+	}
+	path := fs.Arg(0)
+	if cfg.format == "" {
+		cfg.format = formatFromExtension(path)
+	}
+	if cfg.format == "" {
+		cfg.format = formatCSV
+	}
+	if cfg.format != formatCSV && cfg.format != formatJSONL {
+		return fmt.Errorf("validate-input supports -format %s and %s, not %q", formatCSV, formatJSONL, cfg.format)
+	}
+	if *limit < 0 {
+		return errors.New("-limit must not be negative")
+	}
+
+	fh := os.Stdin
+	if path != stdioPath {
+		var err error
+		fh, err = os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open input file: %w", err)
+		}
+		defer fh.Close()
+	}
+	dr, err := decompressInput(fh)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer dr.Close()
+
+	var errorCount, warningCount int
+	rows, err := validateRows(cfg, dr, func(p validateProblem) {
+		kind := "error"
+		if p.warning {
+			kind = "warning"
+			warningCount++
+		} else {
+			errorCount++
+		}
+		if *limit == 0 || errorCount+warningCount <= *limit {
+			fmt.Printf("%s:%d: %s: %s\n", path, p.line, kind, p.message)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if printed := errorCount + warningCount; *limit > 0 && printed > *limit {
+		fmt.Printf("... %d more problems not printed (-limit %d)\n", printed-*limit, *limit)
+	}
+
+	failed := errorCount > 0 || (*strict && warningCount > 0)
+	result := "PASS"
+	if failed {
+		result = "FAIL"
+	}
+	fmt.Printf("%s: %d rows, %d errors, %d warnings\n", result, rows, errorCount, warningCount)
+	if failed {
+		return fmt.Errorf("validation of %s failed", path)
+	}
+	return nil
+}
+
+// validateRows checks the rows of r and passes each problem to report. It
+// returns the number of data rows read.
+func validateRows(cfg *config, r io.Reader, report func(validateProblem)) (int, error) {
+	rr, header, err := newRowReader(cfg, r)
+	if err != nil {
+		return 0, err
+	}
+	networkIndex, asnIndex, orgIndex, _ := inputColumns(cfg.columns, header)
+	problem := func(line int, warning bool, format string, args ...any) {
+		report(validateProblem{line: line, warning: warning, message: fmt.Sprintf(format, args...)})
+	}
+	if jr, ok := rr.(*jsonlReader); ok {
+		jr.onInvalid = func(line int, err error) { problem(line, false, "invalid JSON: %v", err) }
+	}
+
+	// seen maps each row, its fields trimmed and its network made
+	// canonical, to its first line.
+	seen := map[string]int{}
+	rows := 0
+	for {
+		fields, err := rr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return rows, fmt.Errorf("failed to read input row: %w", err)
+		}
+		rows++
+		line, _ := rr.FieldPos(0)
+
+		bad := false
+		for i, field := range fields {
+			if !utf8.ValidString(field) {
+				problem(line, false, "column %d is not valid UTF-8: %q", i+1, field)
+				bad = true
+			}
+		}
+		if len(fields) <= max(networkIndex, asnIndex) {
+			problem(line, false, "row has %d columns, the network and ASN need %d", len(fields), max(networkIndex, asnIndex)+1)
+			continue
+		}
+
+		network := strings.TrimSpace(fields[networkIndex])
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			problem(line, false, "invalid CIDR %q: %v", network, err)
+			bad = true
+		} else if prefix = prefix.Masked(); network != prefix.String() {
+			problem(line, true, "CIDR %q is not canonical, write %s", network, prefix)
+		}
+
+		asnStr := strings.TrimSpace(fields[asnIndex])
+		asn, asSet, err := parseOrigin(asnStr)
+		switch {
+		case err != nil:
+			problem(line, false, "invalid ASN %q: %v", asnStr, err)
+			bad = true
+		case asSet == nil:
+			if label, ok := bogonLabel(uint32(asn)); ok {
+				problem(line, true, "ASN %d is a bogon ASN (%s)", asn, label)
+			}
+		}
+
+		org := columnValue(fields, orgIndex)
+		if controlChars.bad(org) {
+			problem(line, true, "organization %q has control characters", org)
+		}
+		if bad {
+			continue
+		}
+
+		key := make([]string, len(fields))
+		for i := range fields {
+			key[i] = columnValue(fields, i)
+		}
+		key[networkIndex] = prefix.String()
+		row := strings.Join(key, "\x00")
+		if first, ok := seen[row]; ok {
+			problem(line, false, "duplicate of line %d", first)
+			continue
+		}
+		seen[row] = line
+	}
+	return rows, nil
+}
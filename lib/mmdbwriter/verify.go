@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+
+	"mmdbwriter/pkg/mmdbbuild"
+)
+
+// verifyRow is a source row whose ASN is checked against the database.
+type verifyRow struct {
+	prefix netip.Prefix
+	line   int
+}
+
+// runVerify implements `verify [flags] db.mmdb [source.csv]`: it looks up
+// the first address of a sample of the source networks in the database and
+// checks that each resolves to the ASN the source gives it, accounting for
+// more specific source networks that cover the same address. With -expect
+// it also checks the lookups of a golden file.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	cfg := &config{}
+	fs.StringVar(&cfg.format, "format", "",
+		"source format: csv, table or jsonl (default from the file extension, else csv)")
+	fs.Float64Var(&cfg.sample, "sample", 1, "fraction of source networks to check, in (0, 1]")
+	fs.Int64Var(&cfg.seed, "seed", 1, "seed of the sample")
+	fs.Var(&cfg.columns, "columns",
+		"1-based positions of the network and ASN columns of the source, e.g. `network=1,asn=3` (default detected from the header)")
+	expectFile := fs.String("expect", "",
+		"golden `file` of lookups (the gen-fixture .expected.json format) the database must return exactly")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [flags] <db.mmdb> [source.csv]\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 && (fs.NArg() != 1 || *expectFile == "") {
+		fs.Usage()
+		return errors.New("verify needs a database and a source file, or -expect")
+	}
+	dbFile, sourceFile := fs.Arg(0), fs.Arg(1)
+	if cfg.sample <= 0 || cfg.sample > 1 {
+		return errors.New("-sample must be in (0, 1]")
+	}
+	if cfg.format == "" && sourceFile != "" {
+		cfg.format = formatFromExtension(sourceFile)
+	}
+	if cfg.format == "" {
+		cfg.format = formatCSV
+	}
+	if cfg.format == formatFixed {
+		return errors.New("verify does not support -format fixed")
+	}
+
+	db, err := maxminddb.Open(dbFile)
+	if err != nil {
+		return fmt.Errorf("failed to open MMDB file: %w", err)
+	}
+	defer db.Close()
+
+	if *expectFile != "" {
+		if err := verifyExpectations(db, *expectFile); err != nil {
+			return err
+		}
+	}
+	if sourceFile == "" {
+		return nil
+	}
+
+	// Every source network is indexed, so the expected ASN of an address is
+	// that of the most specific network containing it, with later rows
+	// winning like they do in the build.
+	expected, sample, err := readVerifySource(cfg, sourceFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Verifying %d of %d source networks against %s\n", len(sample), len(expected), dbFile)
+
+	// Reserved and aliased space is skipped by default builds, e.g. the
+	// first address of ::/0, so it is only checked where the database
+	// holds it, as with -include-reserved-networks.
+	policy := mmdbbuild.NewNetworkPolicy(mmdbwriter.Options{IPVersion: int(db.Metadata.IPVersion)})
+
+	var mismatches, missing, skipped int
+	for _, row := range sample {
+		addr := row.prefix.Addr()
+		want, ok := expectedASN(expected, addr)
+		if !ok {
+			continue
+		}
+
+		_, record, err := lookupRecord(db, addr.AsSlice())
+		if err != nil {
+			return fmt.Errorf("failed to look up %s: %w", addr, err)
+		}
+		if record == nil && policy.Check(netip.PrefixFrom(addr, addr.BitLen())) != nil {
+			skipped++
+			continue
+		}
+
+		// ASN 0 is stored without an ASN field by default.
+		var got uint32
+		if m, ok := record.(mmdbtype.Map); ok {
+			if asn, ok := m["autonomous_system_number"].(mmdbtype.Uint32); ok {
+				got = uint32(asn)
+			}
+		}
+
+		switch {
+		case record == nil:
+			missing++
+			if missing+mismatches <= maxReportedDiscrepancies {
+				fmt.Printf("❌ %s (line %d): no record, want ASN %d\n", row.prefix, row.line, want)
+			}
+		case got != want:
+			mismatches++
+			if missing+mismatches <= maxReportedDiscrepancies {
+				fmt.Printf("❌ %s (line %d): got ASN %d, want %d\n", row.prefix, row.line, got, want)
+			}
+		}
+	}
+
+	fmt.Printf("Verified %d networks: %d mismatched, %d missing, %d skipped in reserved or aliased space\n",
+		len(sample)-skipped, mismatches, missing, skipped)
+	if mismatches+missing > 0 {
+		return fmt.Errorf("verification failed for %d networks", mismatches+missing)
+	}
+	return nil
+}
+
+// readVerifySource reads the networks and ASNs of the source file and
+// draws the sample of networks to check. A network listed more than once
+// is sampled once, as the row that wins in the build.
+func readVerifySource(cfg *config, path string) (map[netip.Prefix]uint32, []verifyRow, error) {
+	fh := os.Stdin
+	if path != stdioPath {
+		var err error
+		fh, err = os.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open source file: %w", err)
+		}
+		defer fh.Close()
+	}
+
+	dr, err := decompressInput(fh)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer dr.Close()
+	r, header, err := newRowReader(cfg, dr)
+	if err != nil {
+		return nil, nil, err
+	}
+	networkIndex, asnIndex, _, _ := inputColumns(cfg.columns, header)
+
+	var sampler *rand.Rand
+	if cfg.sample < 1 {
+		sampler = rand.New(rand.NewPCG(uint64(cfg.seed), 0))
+	}
+
+	expected := map[netip.Prefix]uint32{}
+	var sample []verifyRow
+	sampled := map[netip.Prefix]int{}
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read source row: %w", err)
+		}
+		if len(row) <= max(networkIndex, asnIndex) {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(row[networkIndex]))
+		if err != nil {
+			continue
+		}
+		// AS_SET origins are built without an ASN, like ASN 0.
+		asn, _, err := parseOrigin(strings.TrimSpace(row[asnIndex]))
+		if err != nil {
+			continue
+		}
+
+		prefix = prefix.Masked()
+		line, _ := r.FieldPos(networkIndex)
+		if i, ok := sampled[prefix]; ok {
+			sample[i].line = line
+		} else if _, ok := expected[prefix]; !ok && (sampler == nil || sampler.Float64() < cfg.sample) {
+			sampled[prefix] = len(sample)
+			sample = append(sample, verifyRow{prefix: prefix, line: line})
+		}
+		expected[prefix] = uint32(asn)
+	}
+	return expected, sample, nil
+}
+
+// expectedASN returns the ASN of the most specific source network
+// containing addr.
+func expectedASN(expected map[netip.Prefix]uint32, addr netip.Addr) (uint32, bool) {
+	for bits := addr.BitLen(); bits >= 0; bits-- {
+		prefix, _ := addr.Prefix(bits)
+		if asn, ok := expected[prefix]; ok {
+			return asn, true
+		}
+	}
+	return 0, false
+}
+
+// verifyExpectations looks up every address of a golden file in db and
+// checks that it returns the expected network and exactly the expected
+// record, or no record where the file has null.
+func verifyExpectations(db *maxminddb.Reader, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read expectations: %w", err)
+	}
+	// Numbers are compared as written, so large uint64 values survive.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var expected fixtureExpectations
+	if err := dec.Decode(&expected); err != nil {
+		return fmt.Errorf("failed to parse expectations %s: %w", path, err)
+	}
+
+	fmt.Printf("Checking %d expected lookups from %s\n", len(expected.Lookups), path)
+	failed := 0
+	for _, want := range expected.Lookups {
+		ip := net.ParseIP(want.IP)
+		if ip == nil {
+			return fmt.Errorf("expectations %s: invalid ip %q", path, want.IP)
+		}
+		network, record, err := lookupRecord(db, ip)
+		if err != nil {
+			return fmt.Errorf("failed to look up %s: %w", want.IP, err)
+		}
+		var got any
+		if record != nil {
+			got = mmdbToJSON(record)
+		}
+		gotJSON, err := json.Marshal(got)
+		if err != nil {
+			return err
+		}
+		wantJSON, err := json.Marshal(want.Record)
+		if err != nil {
+			return err
+		}
+		if network.String() == want.Network && bytes.Equal(gotJSON, wantJSON) {
+			continue
+		}
+		failed++
+		if failed <= maxReportedDiscrepancies {
+			fmt.Printf("❌ %s: got %s %s, want %s %s\n", want.IP, network, gotJSON, want.Network, wantJSON)
+		}
+	}
+
+	fmt.Printf("Checked %d expected lookups: %d failed\n", len(expected.Lookups), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d expected lookups failed", failed)
+	}
+	return nil
+}
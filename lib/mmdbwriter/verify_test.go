@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestVerifyGoldenCorpus(t *testing.T) {
+	source, err := os.ReadFile("testdata/bgp-tools.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := buildTestMMDB(t, testConfig(t), string(source))
+	dbFile := writeTestFile(t, "bgp-tools.mmdb", string(data))
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"source", []string{dbFile, "testdata/bgp-tools.csv"}},
+		{"sample", []string{"-sample", "0.5", dbFile, "testdata/bgp-tools.csv"}},
+		{"expect", []string{"-expect", "testdata/bgp-tools.expected.json", dbFile}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := runVerify(tt.args); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestReadVerifySourceDeduplicates(t *testing.T) {
+	path := writeTestFile(t, "source.csv",
+		"network,asn\n45.3.0.0/16,65550\n45.3.0.0/16,65551\n45.3.3.0/24,65552\n")
+	expected, sample, err := readVerifySource(&config{format: formatCSV, sample: 1}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sample) != len(expected) {
+		t.Fatalf("sampled %d networks of %d", len(sample), len(expected))
+	}
+	if sample[0].line != 3 {
+		t.Errorf("got line %d for the repeated network, want 3 of the row that wins", sample[0].line)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mmdbwriter/pkg/bgptools"
+)
+
+// whoisEnrichBatch is the number of ASNs asked for in one bulk mode
+// session.
+const whoisEnrichBatch = 1000
+
+// whoisCacheTTL is how long -whois-enrich uses a cached answer before
+// asking again. Names and registrations change rarely.
+const whoisCacheTTL = 7 * 24 * time.Hour
+
+// whoisASN is what -whois-enrich learned about an ASN. An ASN the server
+// did not answer for is cached with an empty name, so that it is not asked
+// for on every build.
+type whoisASN struct {
+	Name       string    `json:"name,omitempty"`
+	CC         string    `json:"cc,omitempty"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// defaultWhoisCache is the -whois-cache of the user, or none when the
+// system has no cache directory.
+func defaultWhoisCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mmdbwriter", "whois-asns.json")
+}
+
+// whoisEnrich resolves the name and country of the ASNs of the inputs that
+// asnNames does not name, from the cache and otherwise in batches over
+// bgp.tools bulk WHOIS, and returns them with the number of ASNs that were
+// asked for.
+func whoisEnrich(ctx context.Context, cfg *config, asnNames map[uint32]string, template *recordTemplate) (map[uint32]whoisASN, int, error) {
+	asns, err := inputASNs(cfg, template)
+	if err != nil {
+		return nil, 0, err
+	}
+	asns = slices.DeleteFunc(asns, func(asn uint32) bool {
+		_, ok := asnNames[asn]
+		return ok
+	})
+
+	cache := map[uint32]whoisASN{}
+	if cfg.whoisCache != "" {
+		if data, err := os.ReadFile(cfg.whoisCache); err == nil {
+			if err := json.Unmarshal(data, &cache); err != nil {
+				logger.Warn("ignoring invalid WHOIS cache", "file", cfg.whoisCache, "error", err)
+				cache = map[uint32]whoisASN{}
+			}
+		}
+	}
+
+	var missing []uint32
+	for _, asn := range asns {
+		if e, ok := cache[asn]; !ok || time.Since(e.ResolvedAt) > whoisCacheTTL {
+			missing = append(missing, asn)
+		}
+	}
+	logger.Info("enriching ASNs over WHOIS", "unnamed", len(asns), "cached", len(asns)-len(missing),
+		"to_query", len(missing))
+
+	if len(missing) > 0 {
+		client, err := bgptools.New(bgptools.Options{UserAgent: cfg.userAgent, WhoisAddr: cfg.whoisServer})
+		if err != nil {
+			return nil, 0, err
+		}
+		now := time.Now().UTC()
+		for batch := range slices.Chunk(missing, whoisEnrichBatch) {
+			queries := make([]string, len(batch))
+			for i, asn := range batch {
+				queries[i] = "AS" + strconv.FormatUint(uint64(asn), 10)
+				cache[asn] = whoisASN{ResolvedAt: now}
+			}
+			results, err := client.Whois(ctx, queries)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to enrich ASNs over WHOIS: %w", err)
+			}
+			for _, r := range results {
+				if _, asked := cache[r.ASN]; asked && !r.Prefix.IsValid() {
+					cache[r.ASN] = whoisASN{Name: r.Name, CC: r.CC, ResolvedAt: now}
+				}
+			}
+		}
+		if cfg.whoisCache != "" {
+			if err := writeWhoisCache(cfg.whoisCache, cache); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	enriched := make(map[uint32]whoisASN, len(asns))
+	for _, asn := range asns {
+		if e := cache[asn]; e.Name != "" || e.CC != "" {
+			enriched[asn] = e
+		}
+	}
+	return enriched, len(missing), nil
+}
+
+// inputASNs returns the origin ASNs of the inputs of a build in ascending
+// order, reading them ahead of it. AS_SET members are not included, as
+// their rows take no organization from the ASN.
+func inputASNs(cfg *config, template *recordTemplate) ([]uint32, error) {
+	seen := map[uint32]bool{}
+	for _, in := range buildInputs(cfg) {
+		err := func() error {
+			fh, err := os.Open(in.file)
+			if err != nil {
+				return fmt.Errorf("failed to open CSV file: %w", err)
+			}
+			defer fh.Close()
+			inCfg := *cfg
+			inCfg.format = in.format
+			dr, err := decompressInput(fh)
+			if err != nil {
+				return fmt.Errorf("%s: %w", in.file, err)
+			}
+			defer dr.Close()
+			r, header, err := newRowReader(&inCfg, dr)
+			if err != nil {
+				return err
+			}
+			b, err := newRowBuilder(cfg, header, nil, nil, nil, nil, template)
+			if err != nil {
+				return fmt.Errorf("%s: %w", in.file, err)
+			}
+			for {
+				row, err := r.Read()
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", in.file, err)
+				}
+				// Invalid rows are reported by the build.
+				asn, set, err := parseOrigin(strings.TrimSpace(columnValue(row, b.asnIndex)))
+				if err == nil && set == nil && asn != 0 {
+					seen[uint32(asn)] = true
+				}
+			}
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	asns := make([]uint32, 0, len(seen))
+	for asn := range seen {
+		asns = append(asns, asn)
+	}
+	slices.Sort(asns)
+	return asns, nil
+}
+
+// writeWhoisCache replaces the -whois-cache file with cache.
+func writeWhoisCache(path string, cache map[uint32]whoisASN) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create WHOIS cache directory: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write WHOIS cache: %w", err)
+	}
+	return nil
+}
@@ -2,18 +2,17 @@
 
 GO_COMPILER="go"
 MMDBWRITER_DIR="lib/mmdbwriter"
-SOURCE_FILE="main.go"
 OUTPUT_BINARY="mmdbwriter.bin"
 
 SCRIPT_DIR="$(dirname "$0")"
 PROJECT_ROOT="$(cd "$SCRIPT_DIR/../" && pwd)"
 
 echo "[+] Project root: $PROJECT_ROOT"
-echo "[+] Compiling $MMDBWRITER_DIR/$SOURCE_FILE..."
+echo "[+] Compiling $MMDBWRITER_DIR..."
 
 cd "$PROJECT_ROOT/$MMDBWRITER_DIR"
 
-$GO_COMPILER build -o "$OUTPUT_BINARY" "$SOURCE_FILE"
+$GO_COMPILER build -o "$OUTPUT_BINARY" .
 
 if [ $? -ne 0 ]; then
     echo "[!] Compilation failed."